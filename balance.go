@@ -0,0 +1,223 @@
+// Copyright 2018 Christos Katsakioris
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lfchring
+
+import (
+	"container/heap"
+	"math"
+)
+
+// NodeShare is the share of the keyspace that a distinct node is the primary
+// owner of, as a fraction of the whole keyspace.
+type NodeShare struct {
+	Node  Node
+	Share float64
+}
+
+// TopKByLoad returns the k distinct nodes with the largest shares of the
+// keyspace (as primary owners) in the current state of the ring, sorted by
+// decreasing share (and by node, among equal shares). If the ring consists of
+// less than k distinct nodes, all of them are returned. It returns nil if k is
+// not positive, or if the ring has been configured with a custom name
+// comparator (see ErrUnknownPositions).
+//
+// Rather than sorting the shares of all nodes, it maintains a heap of the k
+// largest ones while walking the ring.
+//
+// Complexity: O( V*N + N*log(k) )
+func (r *HashRing) TopKByLoad(k int) []NodeShare {
+	if k < 1 {
+		return nil
+	}
+	shares := r.state.Load().(*hashRingState).nodeShares()
+	if shares == nil {
+		return nil
+	}
+	h := make(nodeShareHeap, 0, k+1)
+	for node, share := range shares {
+		heap.Push(&h, NodeShare{Node: node, Share: share})
+		if h.Len() > k {
+			heap.Pop(&h)
+		}
+	}
+	ret := make([]NodeShare, h.Len())
+	for i := len(ret) - 1; i >= 0; i-- {
+		ret[i] = heap.Pop(&h).(NodeShare)
+	}
+	return ret
+}
+
+// LoadDistribution returns, for each distinct node of the ring, the fraction of
+// the keyspace that it is the primary owner of, as measured by the lengths of
+// the arcs between consecutive virtual nodes in the current state of the ring.
+// The fractions of all nodes sum up to 1 (give or take rounding errors). It
+// returns an empty map for an empty ring, and nil if the ring has been
+// configured with a custom name comparator (see ErrUnknownPositions).
+//
+// Complexity: O( V*N )
+func (r *HashRing) LoadDistribution() map[Node]float64 {
+	return r.state.Load().(*hashRingState).nodeShares()
+}
+
+// LoadStats summarizes a load distribution (e.g. as returned by
+// LoadDistribution), so that its balance may be asserted on.
+type LoadStats struct {
+	Min, Max, Mean, StdDev float64
+}
+
+// LoadStatsOf computes the minimum, maximum, mean and (population) standard
+// deviation of the shares of the given load distribution. It returns the zero
+// LoadStats for an empty distribution.
+func LoadStatsOf(dist map[Node]float64) LoadStats {
+	if len(dist) == 0 {
+		return LoadStats{}
+	}
+	ret := LoadStats{Min: math.Inf(1), Max: math.Inf(-1)}
+	for _, share := range dist {
+		ret.Min = math.Min(ret.Min, share)
+		ret.Max = math.Max(ret.Max, share)
+		ret.Mean += share
+	}
+	ret.Mean /= float64(len(dist))
+	for _, share := range dist {
+		ret.StdDev += (share - ret.Mean) * (share - ret.Mean)
+	}
+	ret.StdDev = math.Sqrt(ret.StdDev / float64(len(dist)))
+	return ret
+}
+
+// nodeShares returns the share of the keyspace that each distinct node of the
+// state is the primary owner of, or nil if the keys of the state have no known
+// positions.
+//
+// Complexity: O( V*N )
+func (s *hashRingState) nodeShares() map[Node]float64 {
+	if !s.hasPositions() {
+		return nil
+	}
+	ret := make(map[Node]float64, s.size())
+	if len(s.virtualNodes) == 0 {
+		return ret
+	}
+	for i, f := range s.arcFractions() {
+		ret[s.primaryOwner(i)] += f
+	}
+	return ret
+}
+
+// nodeShareHeap is a min-heap of NodeShares, i.e. the smallest share (or the
+// greatest node, among equal shares) is at its root.
+type nodeShareHeap []NodeShare
+
+func (h nodeShareHeap) Len() int { return len(h) }
+
+func (h nodeShareHeap) Less(i, j int) bool {
+	if h[i].Share != h[j].Share {
+		return h[i].Share < h[j].Share
+	}
+	return h[i].Node > h[j].Node
+}
+
+func (h nodeShareHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *nodeShareHeap) Push(x interface{}) { *h = append(*h, x.(NodeShare)) }
+
+func (h *nodeShareHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// BalanceScore returns a measure of how evenly the keyspace is distributed
+// among the distinct nodes of the ring (as primary owners), i.e. the ratio of
+// the mean share of the keyspace per node to the largest one. It lies in (0, 1]
+// for a non-empty ring, with 1 meaning that all nodes own equal shares. It
+// returns 0 for an empty ring, or if the ring has been configured with a custom
+// name comparator (see ErrUnknownPositions).
+//
+// Complexity: O( V*N )
+func (r *HashRing) BalanceScore() float64 {
+	return r.state.Load().(*hashRingState).balanceScore()
+}
+
+// BalanceDeltaForInsert computes the change in BalanceScore (i.e. the score
+// after minus the score before) that inserting the given distinct nodes to the
+// ring would cause, without actually inserting them. A positive delta means
+// that the insertion would make the distribution of the keyspace more even.
+//
+// It returns a non-nil error if the nodes cannot be inserted to the ring, for
+// the same reasons that Insert would fail, or ErrUnknownPositions if the ring
+// has been configured with a custom name comparator.
+//
+// Complexity: O( (V*N)*log(V*N) )
+func (r *HashRing) BalanceDeltaForInsert(nodes ...Node) (float64, error) {
+	oldState := r.state.Load().(*hashRingState)
+	if !oldState.hasPositions() {
+		return 0, ErrUnknownPositions
+	}
+	newState := oldState.derive()
+	if _, err := newState.insert(nodes...); err != nil {
+		return 0, err
+	}
+	return newState.balanceScore() - oldState.balanceScore(), nil
+}
+
+// balanceScore returns the ratio of the mean share of the keyspace per distinct
+// node of the state to the largest one, or 0 if the state is empty.
+func (s *hashRingState) balanceScore() float64 {
+	shares := s.nodeShares()
+	if len(shares) == 0 {
+		return 0
+	}
+	var max float64
+	for _, share := range shares {
+		if share > max {
+			max = share
+		}
+	}
+	// The shares of all nodes sum up to 1.
+	return 1 / float64(len(shares)) / max
+}
+
+// ReadPrimaryDistribution returns, for each distinct node, the fraction of the
+// given sample keys for which it is the first node returned by NodesForKey (if
+// rotated is false) or by NodesForKeyRotated (if rotated is true), i.e. the
+// node that would serve reads of the keys. Comparing the two distributions
+// reveals how much rotating the replica owners evens out the load of reads.
+// Nodes that are returned first for none of the keys are omitted. It returns an
+// empty map if there are no sample keys or the ring is empty.
+//
+// Complexity: O( K*log(V*N) )
+func (r *HashRing) ReadPrimaryDistribution(sampleKeys [][]byte, rotated bool) map[Node]float64 {
+	state := r.state.Load().(*hashRingState)
+	ret := make(map[Node]float64)
+	if len(sampleKeys) == 0 || len(state.virtualNodes) == 0 {
+		return ret
+	}
+	for _, key := range sampleKeys {
+		owners := state.readNodesForKey(key)
+		if rotated {
+			owners = rotateOwners(owners, key)
+		}
+		if len(owners) > 0 {
+			ret[owners[0]]++
+		}
+	}
+	for node := range ret {
+		ret[node] /= float64(len(sampleKeys))
+	}
+	return ret
+}
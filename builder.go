@@ -0,0 +1,82 @@
+// Copyright 2018 Christos Katsakioris
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lfchring
+
+// RingBuilder accumulates the distinct nodes of a new HashRing, so that it can
+// be constructed in one pass: all virtual nodes are sorted once and their
+// replica owners are computed once, no matter how many nodes are added.
+// Inserting thousands of nodes one by one, on the other hand, re-sorts the
+// whole ring for each one of them.
+//
+// A RingBuilder is not safe for concurrent use.
+type RingBuilder struct {
+	hashFunc          func([]byte) []byte
+	replicationFactor int
+	virtualNodeCount  int
+	opts              []Option
+
+	nodes   []Node
+	weights []int
+}
+
+// NewRingBuilder returns a new, empty RingBuilder for a HashRing of the given
+// parameters, configured by the given Options. The parameters are validated
+// by Build.
+func NewRingBuilder(hashFunc func([]byte) []byte, replicationFactor, virtualNodeCount int, opts ...Option) *RingBuilder {
+	return &RingBuilder{
+		hashFunc:          hashFunc,
+		replicationFactor: replicationFactor,
+		virtualNodeCount:  virtualNodeCount,
+		opts:              opts,
+	}
+}
+
+// Add adds the given distinct nodes to the builder, each one of them with the
+// ring's default number of virtual nodes, and returns the builder.
+func (b *RingBuilder) Add(nodes ...Node) *RingBuilder {
+	return b.AddWeighted(1, nodes...)
+}
+
+// AddWeighted adds the given distinct nodes to the builder, each one of them
+// with weight*virtualNodeCount virtual nodes (see InsertWeighted), and returns
+// the builder. An invalid weight is reported by Build.
+func (b *RingBuilder) AddWeighted(weight int, nodes ...Node) *RingBuilder {
+	for _, node := range nodes {
+		b.nodes = append(b.nodes, node)
+		b.weights = append(b.weights, weight)
+	}
+	return b
+}
+
+// Len returns the number of nodes added to the builder so far.
+func (b *RingBuilder) Len() int {
+	return len(b.nodes)
+}
+
+// Build constructs and returns the new HashRing, which contains all nodes that
+// have been added to the builder. The ring is equivalent to one that results
+// from inserting the same nodes (with the same weights) one by one, except for
+// its generation. A non-nil error value is returned if the parameters of the
+// ring are invalid, or if any of the nodes cannot be inserted, e.g. because it
+// has been added more than once (see BatchError).
+//
+// The builder may still be used after Build returns; the nodes added to it are
+// not affected by modifications of the returned ring.
+func (b *RingBuilder) Build() (*HashRing, error) {
+	return newHashRing(b.hashFunc, b.replicationFactor, b.virtualNodeCount, b.opts, func(s *hashRingState) error {
+		_, err := s.insertBatch(b.nodes, b.weights)
+		return err
+	})
+}
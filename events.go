@@ -0,0 +1,167 @@
+// Copyright 2018 Christos Katsakioris
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lfchring
+
+import "sort"
+
+// subscriptionBuffer is the capacity of the channels returned by Subscribe.
+const subscriptionBuffer = 16
+
+// RingEvent describes a change in the membership or the replication factor of
+// a ring, as delivered to its subscribers (see Subscribe).
+type RingEvent struct {
+	// Generation is the generation of the ring's state after the change.
+	Generation uint64
+
+	// Added and Removed are the distinct nodes (sorted) that have been
+	// inserted to and removed from the ring, respectively.
+	Added   []Node
+	Removed []Node
+
+	// OldReplicationFactor and NewReplicationFactor are the replication
+	// factors of the ring before and after the change, respectively.
+	OldReplicationFactor int
+	NewReplicationFactor int
+}
+
+// subscription is a subscriber of a ring, as created by Subscribe.
+type subscription struct {
+	events chan RingEvent
+}
+
+// Subscribe returns a channel that receives a RingEvent for every change in
+// the membership (e.g. through Insert or Remove) or the replication factor
+// (through SetReplicationFactor) of the ring from now on, along with a function
+// that cancels the subscription and closes the channel; it is safe to call it
+// more than once. Modifications that change neither (e.g. SetDraining) do not
+// produce any events.
+//
+// Events are delivered without ever blocking the writers of the ring, through
+// a buffered channel. If a subscriber falls behind so that its channel fills
+// up, all events pending in it are coalesced, along with the new one, into a
+// single event that describes their net effect (e.g. a node that has been
+// inserted and then removed again appears in neither Added nor Removed), hence
+// no change is ever lost, although subscribers may observe fewer events than
+// the modifications of the ring. No goroutines are involved.
+func (r *HashRing) Subscribe() (<-chan RingEvent, func()) {
+	sub := &subscription{events: make(chan RingEvent, subscriptionBuffer)}
+	r.subscribersMu.Lock()
+	if r.subscribers == nil {
+		r.subscribers = make(map[*subscription]struct{})
+	}
+	r.subscribers[sub] = struct{}{}
+	r.subscribersMu.Unlock()
+
+	unsubscribe := func() {
+		r.subscribersMu.Lock()
+		defer r.subscribersMu.Unlock()
+		if _, ok := r.subscribers[sub]; ok {
+			delete(r.subscribers, sub)
+			close(sub.events)
+		}
+	}
+	return sub.events, unsubscribe
+}
+
+// notify delivers the RingEvent that describes the transition of the ring from
+// oldState to newState (if any) to all of ring's subscribers.
+func (r *HashRing) notify(oldState, newState *hashRingState) {
+	r.subscribersMu.Lock()
+	defer r.subscribersMu.Unlock()
+	if len(r.subscribers) == 0 || oldState == nil {
+		return
+	}
+	ev := RingEvent{
+		Generation:           newState.generation,
+		Added:                make([]Node, 0),
+		Removed:              make([]Node, 0),
+		OldReplicationFactor: int(oldState.replicationFactor),
+		NewReplicationFactor: int(newState.replicationFactor),
+	}
+	for _, node := range newState.nodes() {
+		if !oldState.hasNode(node) {
+			ev.Added = append(ev.Added, node)
+		}
+	}
+	for _, node := range oldState.nodes() {
+		if !newState.hasNode(node) {
+			ev.Removed = append(ev.Removed, node)
+		}
+	}
+	if len(ev.Added) == 0 && len(ev.Removed) == 0 && ev.OldReplicationFactor == ev.NewReplicationFactor {
+		return
+	}
+	for sub := range r.subscribers {
+		sub.deliver(ev)
+	}
+}
+
+// deliver sends the given event to the subscriber without blocking, coalescing
+// it with all pending events if the subscriber's channel is full.
+func (sub *subscription) deliver(ev RingEvent) {
+	select {
+	case sub.events <- ev:
+		return
+	default:
+	}
+	pending := make([]RingEvent, 0, cap(sub.events)+1)
+drain:
+	for {
+		select {
+		case p := <-sub.events:
+			pending = append(pending, p)
+		default:
+			break drain
+		}
+	}
+	// Only the writers send to the channel, and they are serialized by
+	// ring's subscribersMu, so there is certainly room for one event now.
+	sub.events <- coalesceEvents(append(pending, ev))
+}
+
+// coalesceEvents returns a single RingEvent that describes the net effect of
+// the given (consecutive) events.
+func coalesceEvents(events []RingEvent) RingEvent {
+	last := events[len(events)-1]
+	ret := RingEvent{
+		Generation:           last.Generation,
+		Added:                make([]Node, 0),
+		Removed:              make([]Node, 0),
+		OldReplicationFactor: events[0].OldReplicationFactor,
+		NewReplicationFactor: last.NewReplicationFactor,
+	}
+	// Insertions and removals of each node alternate, hence their net
+	// effect is in {-1, 0, +1}.
+	delta := make(map[Node]int)
+	for _, ev := range events {
+		for _, node := range ev.Added {
+			delta[node]++
+		}
+		for _, node := range ev.Removed {
+			delta[node]--
+		}
+	}
+	for node, d := range delta {
+		switch {
+		case d > 0:
+			ret.Added = append(ret.Added, node)
+		case d < 0:
+			ret.Removed = append(ret.Removed, node)
+		}
+	}
+	sort.Slice(ret.Added, func(i, j int) bool { return ret.Added[i] < ret.Added[j] })
+	sort.Slice(ret.Removed, func(i, j int) bool { return ret.Removed[i] < ret.Removed[j] })
+	return ret
+}
@@ -0,0 +1,153 @@
+//go:build go1.18
+// +build go1.18
+
+// Copyright 2018 Christos Katsakioris
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lfchring
+
+import "fmt"
+
+// HashRingG is a consistent hashing ring of distinct nodes of an arbitrary
+// comparable type N (e.g. a struct of a host, a port and a region), rather than
+// of Nodes. Each distinct node is placed on the ring through the bytes that a
+// user-supplied function derives from it, which must be distinct for distinct
+// nodes, and the same for equal ones.
+//
+// It is a thin wrapper around a HashRing, and shares its properties: lookups
+// are lock-free, and the values of the nodes are swapped atomically along with
+// the membership of the ring, hence readers never observe a node that they
+// cannot map back to its value.
+//
+// Since it is generic, HashRingG is only available when building with Go 1.18
+// or later; the rest of the package does not require it.
+type HashRingG[N comparable] struct {
+	ring      *HashRing
+	nodeBytes func(N) []byte
+}
+
+// NewHashRingG returns a new HashRingG, configured with the given hash
+// function, function to derive the bytes of each distinct node, replication
+// factor and number of virtual nodes per distinct node, and populated with the
+// given distinct nodes; see NewHashRing.
+func NewHashRingG[N comparable](hashFunc func([]byte) []byte, nodeBytes func(N) []byte, replicationFactor, virtualNodeCount int, nodes ...N) (*HashRingG[N], error) {
+	r, err := NewHashRingGWithOptions(hashFunc, nodeBytes, replicationFactor, virtualNodeCount)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) > 0 {
+		if _, err = r.Insert(nodes...); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// NewHashRingGWithOptions is like NewHashRingG, but it returns an empty ring,
+// configured with the given Options; see NewHashRingWithOptions.
+func NewHashRingGWithOptions[N comparable](hashFunc func([]byte) []byte, nodeBytes func(N) []byte, replicationFactor, virtualNodeCount int, opts ...Option) (*HashRingG[N], error) {
+	if nodeBytes == nil {
+		return nil, fmt.Errorf("nodeBytes cannot be nil")
+	}
+	ring, err := NewHashRingWithOptions(hashFunc, replicationFactor, virtualNodeCount, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &HashRingG[N]{ring: ring, nodeBytes: nodeBytes}, nil
+}
+
+// ringNodes returns the Nodes that the given distinct nodes are placed on the
+// ring as.
+func (r *HashRingG[N]) ringNodes(nodes []N) []Node {
+	ret := make([]Node, len(nodes))
+	for i, node := range nodes {
+		ret[i] = Node(r.nodeBytes(node))
+	}
+	return ret
+}
+
+// valuesOf returns the values of the given Nodes in the given state.
+func valuesOf[N comparable](state *hashRingState, nodes []Node) []N {
+	ret := make([]N, len(nodes))
+	for i, node := range nodes {
+		ret[i], _ = state.values[node].(N)
+	}
+	return ret
+}
+
+// Insert inserts the given distinct nodes to the ring; see HashRing.Insert.
+func (r *HashRingG[N]) Insert(nodes ...N) ([]*VirtualNode, error) {
+	ringNodes := r.ringNodes(nodes)
+	defer r.ring.lockWriters()()
+	oldState := r.ring.state.Load().(*hashRingState)
+	newState := oldState.derive()
+	newVnodes, err := newState.insert(ringNodes...)
+	if err != nil {
+		return nil, err
+	}
+	for i, node := range ringNodes {
+		newState.values[node] = nodes[i]
+	}
+	if err := r.ring.commit(newState); err != nil {
+		return nil, err
+	}
+	return newVnodes, nil
+}
+
+// Remove removes the given distinct nodes from the ring; see HashRing.Remove.
+func (r *HashRingG[N]) Remove(nodes ...N) ([]*VirtualNode, error) {
+	return r.ring.Remove(r.ringNodes(nodes)...)
+}
+
+// NodesForKey returns the distinct nodes that are currently responsible for
+// holding the given key, the primary owner first; see HashRing.NodesForKey.
+//
+// Complexity: O( log(V*N) )
+func (r *HashRingG[N]) NodesForKey(key []byte) []N {
+	state := r.ring.state.Load().(*hashRingState)
+	return valuesOf[N](state, state.readNodesForKey(key))
+}
+
+// OwnerForKey returns the primary owner of the given key, or a non-nil error
+// if the ring is empty; see HashRing.OwnerForKey.
+//
+// Complexity: O( log(V*N) )
+func (r *HashRingG[N]) OwnerForKey(key []byte) (N, error) {
+	var zero N
+	state := r.ring.state.Load().(*hashRingState)
+	if len(state.virtualNodes) == 0 {
+		return zero, fmt.Errorf("empty ring")
+	}
+	return valuesOf[N](state, state.readNodesForKey(key)[:1])[0], nil
+}
+
+// Nodes returns the distinct nodes of the ring, sorted by the bytes that they
+// are placed on the ring as.
+//
+// Complexity: O( V*N )
+func (r *HashRingG[N]) Nodes() []N {
+	state := r.ring.state.Load().(*hashRingState)
+	return valuesOf[N](state, state.nodes())
+}
+
+// Size returns the number of distinct nodes in the ring.
+func (r *HashRingG[N]) Size() int {
+	return r.ring.Size()
+}
+
+// Generation returns the generation of the current state of the ring; see
+// HashRing.Generation.
+func (r *HashRingG[N]) Generation() uint64 {
+	return r.ring.Generation()
+}
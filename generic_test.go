@@ -0,0 +1,95 @@
+//go:build go1.18
+// +build go1.18
+
+// Copyright 2018 Christos Katsakioris
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lfchring
+
+import (
+	"fmt"
+	"testing"
+)
+
+type testEndpoint struct {
+	host   string
+	port   int
+	region string
+}
+
+func TestHashRingG(t *testing.T) {
+	endpointBytes := func(e testEndpoint) []byte {
+		return []byte(fmt.Sprintf("%s:%d/%s", e.host, e.port, e.region))
+	}
+	endpoints := []testEndpoint{
+		{"10.0.0.1", 8080, "eu"},
+		{"10.0.0.1", 8081, "eu"},
+		{"10.0.0.2", 8080, "us"},
+	}
+	r, err := NewHashRingG(hashFunc, endpointBytes, 2, 8, endpoints...)
+	if err != nil {
+		t.Errorf("NewHashRingG(): %v\n", err)
+		t.FailNow()
+	}
+	plain, _ := NewHashRing(hashFunc, 2, 8)
+	for _, e := range endpoints {
+		if _, err = plain.Insert(Node(endpointBytes(e))); err != nil {
+			t.Errorf("Insert(): %v\n", err)
+		}
+	}
+	if r.Size() != 3 || len(r.Nodes()) != 3 {
+		t.Errorf("Size() = %d, len(Nodes()) = %d; expected 3\n", r.Size(), len(r.Nodes()))
+	}
+	for i := 0; i < 100; i++ {
+		key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+		owners, expected := r.NodesForKey(key), plain.NodesForKey(key)
+		if len(owners) != len(expected) {
+			t.Errorf("NodesForKey() = %v; expected %v\n", owners, expected)
+			continue
+		}
+		for j := range owners {
+			if Node(endpointBytes(owners[j])) != expected[j] {
+				t.Errorf("NodesForKey() = %v; expected %v\n", owners, expected)
+			}
+		}
+		if owner, err := r.OwnerForKey(key); err != nil || owner != owners[0] {
+			t.Errorf("OwnerForKey() = %v, %v; expected %v\n", owner, err, owners[0])
+		}
+	}
+
+	if _, err = r.Insert(endpoints[0]); err == nil {
+		t.Errorf("Insert() of an existing node succeeded\n")
+	}
+	gen := r.Generation()
+	if _, err = r.Remove(endpoints[0]); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+	}
+	if r.Generation() != gen+1 {
+		t.Errorf("Generation() = %d; expected %d\n", r.Generation(), gen+1)
+	}
+	for _, e := range r.Nodes() {
+		if e == endpoints[0] {
+			t.Errorf("Nodes() = %v still contains the removed node\n", r.Nodes())
+		}
+	}
+	if _, err = r.Remove(endpoints[1], endpoints[2]); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+	}
+	if _, err = r.OwnerForKey([]byte("key")); err == nil {
+		t.Errorf("OwnerForKey() on an empty ring succeeded\n")
+	}
+	if _, err = NewHashRingG[testEndpoint](hashFunc, nil, 2, 8); err == nil {
+		t.Errorf("NewHashRingG() succeeded with a nil nodeBytes\n")
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Christos Katsakioris
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lfchring
+
+import "fmt"
+
+// stateHistory holds the last states of a ring, oldest first. It is immutable
+// once stored in ring's history.
+type stateHistory struct {
+	states []*hashRingState
+}
+
+// record appends the given state to ring's history (if maintained), evicting
+// the oldest retained state if the history is full. The history is replaced as
+// a whole (copy-on-write), so that it can be read without locking.
+func (r *HashRing) record(newState *hashRingState) {
+	if r.historyDepth == 0 {
+		return
+	}
+	for {
+		oldHistory, _ := r.history.Load().(*stateHistory)
+		if oldHistory == nil {
+			r.history.Store(&stateHistory{states: []*hashRingState{newState}})
+			return
+		}
+		start := 0
+		if len(oldHistory.states) >= r.historyDepth {
+			start = len(oldHistory.states) - r.historyDepth + 1
+		}
+		newHistory := &stateHistory{states: make([]*hashRingState, 0, r.historyDepth)}
+		newHistory.states = append(newHistory.states, oldHistory.states[start:]...)
+		newHistory.states = append(newHistory.states, newState)
+		if r.history.CompareAndSwap(oldHistory, newHistory) {
+			return
+		}
+	}
+}
+
+// NodesForKeyAtGeneration is like NodesForKey, but it looks up the replica
+// owners of the given key in the state of the ring at the given generation,
+// which may be either the current one or one of the states retained in ring's
+// history (see WithHistory). It returns a non-nil error if the state at the
+// given generation is not retained (anymore). Like NodesForKey, it returns the
+// fallback node (if any) alone if the ring was empty at the given generation,
+// and it replaces any nodes that were excluded from reads at that generation
+// (see SetReadExcluded).
+//
+// Complexity: O( H + log(V*N) )
+func (r *HashRing) NodesForKeyAtGeneration(key []byte, gen uint64) ([]Node, error) {
+	if state := r.state.Load().(*hashRingState); state.generation == gen {
+		return state.readNodesForKey(key), nil
+	}
+	if history, _ := r.history.Load().(*stateHistory); history != nil {
+		for i := len(history.states) - 1; i >= 0; i-- {
+			if history.states[i].generation == gen {
+				return history.states[i].readNodesForKey(key), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("generation %d is not retained", gen)
+}
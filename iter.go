@@ -19,6 +19,12 @@ package lfchring
 type VirtualNodesIterator struct {
 	ring *hashRingState
 	curr int
+
+	// offset is the index of the virtual node that the iteration starts
+	// from, wrapping around the end of the ring back to it; i.e. the
+	// curr-th virtual node of the iteration is at index
+	// (curr+offset) % len(ring.virtualNodes).
+	offset int
 }
 
 // HasNext returns true if there is at least one more virtual node in the ring
@@ -36,7 +42,20 @@ func (iter *VirtualNodesIterator) HasNext() bool {
 // before calling Next to avoid panicking.
 func (iter *VirtualNodesIterator) Next() *VirtualNode {
 	iter.curr++
-	return iter.ring.virtualNodes[iter.curr-1]
+	return iter.ring.virtualNodes[(iter.curr-1+iter.offset)%len(iter.ring.virtualNodes)]
+}
+
+// Reset moves the iterator back to the virtual node that the iteration started
+// from, so that the same state of the ring may be iterated over again, without
+// allocating a new iterator.
+func (iter *VirtualNodesIterator) Reset() {
+	iter.curr = 0
+}
+
+// Len returns the total number of virtual nodes of the iteration, i.e. the
+// number of virtual nodes in the state of the ring that is iterated over.
+func (iter *VirtualNodesIterator) Len() int {
+	return len(iter.ring.virtualNodes)
 }
 
 // VirtualNodesReverseIterator is an iterator for efficiently iterating through
@@ -44,6 +63,11 @@ func (iter *VirtualNodesIterator) Next() *VirtualNode {
 type VirtualNodesReverseIterator struct {
 	ring *hashRingState
 	curr int
+
+	// offset shifts the iteration along the ring, wrapping around its
+	// beginning, like in VirtualNodesIterator; i.e. the virtual node
+	// returned for curr is at index (curr+offset) % len(ring.virtualNodes).
+	offset int
 }
 
 // HasNext returns true if there is at least one more virtual node in the ring
@@ -61,5 +85,49 @@ func (iter *VirtualNodesReverseIterator) HasNext() bool {
 // HasNext before calling Next to avoid panicking.
 func (iter *VirtualNodesReverseIterator) Next() *VirtualNode {
 	iter.curr--
-	return iter.ring.virtualNodes[iter.curr+1]
+	return iter.ring.virtualNodes[(iter.curr+1+iter.offset)%len(iter.ring.virtualNodes)]
+}
+
+// Reset moves the iterator back to the virtual node that the (reverse)
+// iteration started from, so that the same state of the ring may be iterated
+// over again, without allocating a new iterator.
+func (iter *VirtualNodesReverseIterator) Reset() {
+	iter.curr = len(iter.ring.virtualNodes) - 1
+}
+
+// Len returns the total number of virtual nodes of the (reverse) iteration,
+// i.e. the number of virtual nodes in the state of the ring that is iterated
+// over.
+func (iter *VirtualNodesReverseIterator) Len() int {
+	return len(iter.ring.virtualNodes)
+}
+
+// ReplicaOwnersIterator is an iterator for efficiently iterating through all
+// virtual nodes in the ring in (alphanumerical) order, along with their replica
+// owners.
+//
+// For rings that do without maintaining replica owners, the owners of each
+// virtual node are computed on demand, as the iteration goes on.
+type ReplicaOwnersIterator struct {
+	ring *hashRingState
+	curr int
+}
+
+// HasNext returns true if there is at least one more virtual node in the ring
+// to iterate over, and false if there is none.
+//
+// The user of ReplicaOwnersIterator should always check the result of HasNext
+// before calling Next to avoid panicking.
+func (iter *ReplicaOwnersIterator) HasNext() bool {
+	return iter.curr < len(iter.ring.virtualNodes)
+}
+
+// Next returns the next virtual node of the iteration, along with its replica
+// owners.
+//
+// The user of ReplicaOwnersIterator should always check the result of HasNext
+// before calling Next to avoid panicking.
+func (iter *ReplicaOwnersIterator) Next() (*VirtualNode, []Node) {
+	iter.curr++
+	return iter.ring.virtualNodes[iter.curr-1], iter.ring.owners(iter.curr - 1)
 }
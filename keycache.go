@@ -0,0 +1,114 @@
+// Copyright 2018 Christos Katsakioris
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lfchring
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+)
+
+// keyCacheShards is the number of independently locked shards of a keyCache,
+// so that concurrent readers rarely contend for the same lock.
+const keyCacheShards = 16
+
+// maxCachedKeyLen is the maximum length of the keys whose hashes are cached by
+// a keyCache; longer keys are always hashed anew, so that the cache never pins
+// large buffers in memory, and since looking them up would cost about as much
+// as hashing them anyway.
+const maxCachedKeyLen = 1024
+
+// keyCacheEntry is an entry of the LRU cache of a keyCacheShard.
+type keyCacheEntry struct {
+	key    string
+	hashed []byte
+}
+
+// keyCacheShard is a shard of a keyCache, i.e. a bounded LRU cache of hashed
+// keys, protected by its own mutex.
+type keyCacheShard struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front: most recently used
+}
+
+// keyCache caches the hashes of the most recently hashed keys, as configured
+// through WithKeyCache, in a number of shards, each one of which is a bounded
+// LRU cache. It is safe for concurrent use.
+type keyCache struct {
+	size          int
+	shardCapacity int
+	shards        [keyCacheShards]keyCacheShard
+}
+
+// newKeyCache returns a new keyCache, which caches (roughly) at most size
+// hashed keys.
+func newKeyCache(size int) *keyCache {
+	kc := &keyCache{size: size, shardCapacity: (size + keyCacheShards - 1) / keyCacheShards}
+	kc.clear()
+	return kc
+}
+
+// shard returns the shard of the cache that the given key belongs to.
+func (kc *keyCache) shard(key []byte) *keyCacheShard {
+	h := fnv.New32a()
+	h.Write(key)
+	return &kc.shards[h.Sum32()%keyCacheShards]
+}
+
+// hash returns the hash of the given key, either from the cache or by
+// computing it through the given function (uncached, if the key is longer than
+// maxCachedKeyLen). The returned slice must not be modified.
+func (kc *keyCache) hash(key []byte, hashKey func([]byte) []byte) []byte {
+	if len(key) > maxCachedKeyLen {
+		return hashKey(key)
+	}
+	shard := kc.shard(key)
+	shard.mu.Lock()
+	if elem, exists := shard.entries[string(key)]; exists {
+		shard.lru.MoveToFront(elem)
+		shard.mu.Unlock()
+		return elem.Value.(*keyCacheEntry).hashed
+	}
+	shard.mu.Unlock()
+
+	// Compute the hash without holding the lock, since hashing is the
+	// expensive part; concurrent misses for the same key are harmless.
+	hashed := hashKey(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if _, exists := shard.entries[string(key)]; !exists {
+		entry := &keyCacheEntry{key: string(key), hashed: hashed}
+		shard.entries[entry.key] = shard.lru.PushFront(entry)
+		if shard.lru.Len() > kc.shardCapacity {
+			oldest := shard.lru.Back()
+			shard.lru.Remove(oldest)
+			delete(shard.entries, oldest.Value.(*keyCacheEntry).key)
+		}
+	}
+	return hashed
+}
+
+// clear evicts all hashed keys from the cache.
+func (kc *keyCache) clear() {
+	for i := range kc.shards {
+		shard := &kc.shards[i]
+		shard.mu.Lock()
+		shard.entries = make(map[string]*list.Element)
+		shard.lru = list.New()
+		shard.mu.Unlock()
+	}
+}
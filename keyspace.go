@@ -0,0 +1,254 @@
+// Copyright 2018 Christos Katsakioris
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lfchring
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// The keyspace of the ring consists of all byte slices of the same length as
+// the output of ring's hash function (i.e. its "width"). Each key corresponds
+// to a position on the ring, which is the big-endian unsigned integer that its
+// bytes represent.
+//
+// A virtual node owns the arc of the keyspace that lies (clockwise) between
+// its predecessor's name (exclusive) and its own name (inclusive).
+
+// keyspaceMinSlack is the minimum ratio of the size of the keyspace to the
+// number of virtual nodes in the ring.
+const keyspaceMinSlack = 2
+
+// keyspaceSize returns the number of distinct keys in a keyspace of keys that
+// are width bytes long, i.e. 2^(8*width).
+func keyspaceSize(width int) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(8*width))
+}
+
+// keyPosition returns the position of the given key in a keyspace of the given
+// width. Keys shorter than width are padded with trailing zero bytes, whereas
+// longer keys are truncated, so that the byte-wise ordering of keys is
+// preserved.
+func keyPosition(key []byte, width int) *big.Int {
+	padded := make([]byte, width)
+	copy(padded, key)
+	return new(big.Int).SetBytes(padded)
+}
+
+// positionKey returns the key (of the given width) found at the given position
+// of the keyspace.
+func positionKey(pos *big.Int, width int) []byte {
+	return pos.FillBytes(make([]byte, width))
+}
+
+// distance returns the clockwise distance from key `from` to key `to`, in a
+// keyspace of the given width.
+func distance(from, to []byte, width int) *big.Int {
+	d := new(big.Int).Sub(keyPosition(to, width), keyPosition(from, width))
+	if d.Sign() < 0 {
+		d.Add(d, keyspaceSize(width))
+	}
+	return d
+}
+
+// arcLength returns the number of keys in the arc (lo, hi] of a keyspace of
+// the given width. If lo and hi are equal, the arc is considered to span the
+// whole keyspace.
+func arcLength(lo, hi []byte, width int) *big.Int {
+	d := distance(lo, hi, width)
+	if d.Sign() == 0 {
+		return keyspaceSize(width)
+	}
+	return d
+}
+
+// fraction returns the given number of keys as a fraction of a keyspace of
+// the given width.
+func fraction(keys *big.Int, width int) float64 {
+	f, _ := new(big.Float).Quo(new(big.Float).SetInt(keys), new(big.Float).SetInt(keyspaceSize(width))).Float64()
+	return f
+}
+
+// keyWidth returns the width of the keys of the state, i.e. the length of the
+// names of its virtual nodes. Under a custom comparator, the names may be of
+// any length (and the first one is not necessarily the longest), hence the
+// length of the longest one is returned, in O( V*N ).
+func (s *hashRingState) keyWidth() int {
+	if len(s.virtualNodes) == 0 {
+		return len(s.hash(nil))
+	}
+	if s.compare == nil {
+		return len(s.virtualNodes[0].Name())
+	}
+	width := 0
+	for _, vn := range s.virtualNodes {
+		if len(vn.Name()) > width {
+			width = len(vn.Name())
+		}
+	}
+	return width
+}
+
+// hasPositions returns true if the keys of the state have known positions on
+// the ring, i.e. unless the state orders them through a custom comparator.
+func (s *hashRingState) hasPositions() bool {
+	return s.compare == nil
+}
+
+// largestArc returns the distinct node that owns (as the primary owner) the
+// largest contiguous arc of the keyspace, along with the bounds (lo, hi] of
+// that arc. It returns a non-nil error if the ring is empty.
+//
+// Complexity: O( V*N )
+func (s *hashRingState) largestArc() (Node, []byte, []byte, error) {
+	if len(s.virtualNodes) == 0 {
+		return "", nil, nil, fmt.Errorf("empty ring")
+	}
+	if !s.hasPositions() {
+		return "", nil, nil, ErrUnknownPositions
+	}
+	last := len(s.virtualNodes) - 1
+	primaries := make([]Node, len(s.virtualNodes))
+	for i := range primaries {
+		primaries[i] = s.primaryOwner(i)
+	}
+
+	// Find the first virtual node (start) whose primary owner differs from
+	// its predecessor's, so that the walk below does not begin in the
+	// middle of an arc. If there is none, a single node owns everything.
+	start := 0
+	for start < len(primaries) && primaries[start] == primaries[(start+last)%len(primaries)] {
+		start++
+	}
+	if start == len(primaries) {
+		return primaries[0], s.virtualNodes[last].Name(), s.virtualNodes[last].Name(), nil
+	}
+
+	var (
+		width   = s.keyWidth()
+		maxLen  = new(big.Int)
+		owner   Node
+		lo, hi  []byte
+		currLo  = s.virtualNodes[(start+last)%len(s.virtualNodes)].Name()
+		currLen = new(big.Int)
+	)
+	for n := 0; n < len(s.virtualNodes); n++ {
+		i := (start + n) % len(s.virtualNodes)
+		currLen.Add(currLen, s.arcLengthAt(i, width))
+
+		// The arc ends here if the next virtual node has a different
+		// primary owner.
+		if primaries[(i+1)%len(primaries)] != primaries[i] {
+			if currLen.Cmp(maxLen) > 0 {
+				maxLen.Set(currLen)
+				owner, lo, hi = primaries[i], currLo, s.virtualNodes[i].Name()
+			}
+			currLo, currLen = s.virtualNodes[i].Name(), new(big.Int)
+		}
+	}
+	return owner, lo, hi, nil
+}
+
+// arcLengthAt returns the number of keys that the virtual node at index i of
+// state's slice of virtual nodes owns, in a keyspace of the given width. Of a
+// run of virtual nodes with colliding names, only the first one owns any keys
+// (i.e. those that follow the previous distinct name), since keys are always
+// assigned to it; the rest own none, rather than the whole keyspace that
+// arcLength would count for their empty arcs.
+func (s *hashRingState) arcLengthAt(i, width int) *big.Int {
+	prev := s.virtualNodes[(i+len(s.virtualNodes)-1)%len(s.virtualNodes)]
+	if i > 0 && s.compareNames(prev.Name(), s.virtualNodes[i].Name()) == 0 {
+		return new(big.Int)
+	}
+	return arcLength(prev.Name(), s.virtualNodes[i].Name(), width)
+}
+
+// arc returns the arc of the keyspace that the virtual node at index i of
+// state's slice of virtual nodes owns, i.e. the range between its predecessor's
+// name (exclusive) and its own name (inclusive).
+func (s *hashRingState) arc(i int) KeyRange {
+	prev := i - 1
+	if prev < 0 {
+		prev = len(s.virtualNodes) - 1
+	}
+	return KeyRange{Lo: s.virtualNodes[prev].Name(), Hi: s.virtualNodes[i].Name(), compare: s.compare}
+}
+
+// distanceToNode returns the clockwise distance from the given key to the
+// nearest virtual node of the given distinct node, or a non-nil error if the
+// node is not in the ring.
+//
+// Complexity: O( V*N )
+func (s *hashRingState) distanceToNode(key []byte, target Node) (*big.Int, error) {
+	if !s.hasNode(target) {
+		return nil, fmt.Errorf("node %q is not in the ring", target)
+	}
+	if !s.hasPositions() {
+		return nil, ErrUnknownPositions
+	}
+	width := s.keyWidth()
+	var min *big.Int
+	for _, vn := range s.virtualNodes {
+		if vn.node != target {
+			continue
+		}
+		if d := distance(key, vn.Name(), width); min == nil || d.Cmp(min) < 0 {
+			min = d
+		}
+	}
+	return min, nil
+}
+
+// splitPoint returns the key that lies in the middle of the arc (lo, hi].
+func splitPoint(lo, hi []byte) []byte {
+	width := len(hi)
+	if len(lo) > width {
+		width = len(lo)
+	}
+	mid := arcLength(lo, hi, width)
+	mid.Rsh(mid, 1)
+	mid.Add(mid, keyPosition(lo, width))
+	mid.Mod(mid, keyspaceSize(width))
+	return positionKey(mid, width)
+}
+
+// arcFractions returns the length of the arc of each virtual node in the state
+// (i.e. the gap between it and its predecessor), as a fraction of the whole
+// keyspace. The returned slice is aligned to state's slice of virtual nodes.
+//
+// Complexity: O( V*N )
+func (s *hashRingState) arcFractions() []float64 {
+	width := s.keyWidth()
+	ret := make([]float64, len(s.virtualNodes))
+	for i := range s.virtualNodes {
+		ret[i] = fraction(s.arcLengthAt(i, width), width)
+	}
+	return ret
+}
+
+// arcLengthHistogram bins the lengths of the arcs of all virtual nodes in the
+// state (as fractions of the keyspace) into the given number of equal-width
+// buckets, and returns the number of arcs in each bucket.
+func (s *hashRingState) arcLengthHistogram(buckets int) []int {
+	ret := make([]int, buckets)
+	for _, f := range s.arcFractions() {
+		b := int(f * float64(buckets))
+		if b >= buckets {
+			b = buckets - 1
+		}
+		ret[b]++
+	}
+	return ret
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Christos Katsakioris
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lfchring
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lazyNamesCapacity is the maximum number of names of virtual nodes that are
+// cached by the rings configured through WithLazyNames.
+const lazyNamesCapacity = 1 << 16
+
+// lazyNameKey identifies a virtual node, whose name is to be computed.
+type lazyNameKey struct {
+	node Node
+	vnid uint16
+}
+
+// lazyNameEntry is an entry of the LRU cache of lazyNames.
+type lazyNameEntry struct {
+	key  lazyNameKey
+	name []byte
+}
+
+// lazyNames computes the names of virtual nodes on demand, using the hash
+// function of the ring, and caches the most recently used ones of them in a
+// bounded LRU cache. It is safe for concurrent use.
+type lazyNames struct {
+	hash     func([]byte) []byte
+	key      func(Node, uint16) []byte
+	capacity int
+
+	mu      sync.Mutex
+	entries map[lazyNameKey]*list.Element
+	lru     *list.List // front: most recently used
+}
+
+// newLazyNames returns a new lazyNames, which uses the given hash function (and
+// function to derive the bytes to hash) and caches at most capacity names.
+func newLazyNames(hashFunc func([]byte) []byte, key func(Node, uint16) []byte, capacity int) *lazyNames {
+	return &lazyNames{
+		hash:     hashFunc,
+		key:      key,
+		capacity: capacity,
+		entries:  make(map[lazyNameKey]*list.Element, capacity),
+		lru:      list.New(),
+	}
+}
+
+// name returns the name of the virtual node with the given vnid of the given
+// distinct node, either from the cache or by computing it.
+func (ln *lazyNames) name(node Node, vnid uint16) []byte {
+	key := lazyNameKey{node: node, vnid: vnid}
+	ln.mu.Lock()
+	if elem, exists := ln.entries[key]; exists {
+		ln.lru.MoveToFront(elem)
+		ln.mu.Unlock()
+		return elem.Value.(*lazyNameEntry).name
+	}
+	ln.mu.Unlock()
+
+	// Compute the name without holding the lock, since hashing is the
+	// expensive part; concurrent misses for the same key are harmless.
+	name := ln.hash(ln.key(node, vnid))
+
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if _, exists := ln.entries[key]; !exists {
+		ln.entries[key] = ln.lru.PushFront(&lazyNameEntry{key: key, name: name})
+		if ln.lru.Len() > ln.capacity {
+			oldest := ln.lru.Back()
+			ln.lru.Remove(oldest)
+			delete(ln.entries, oldest.Value.(*lazyNameEntry).key)
+		}
+	}
+	return name
+}
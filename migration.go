@@ -0,0 +1,541 @@
+// Copyright 2018 Christos Katsakioris
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lfchring
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+)
+
+// KeyRange represents a contiguous range (i.e. an arc) of the keyspace, which
+// consists of all keys that are greater than Lo and less than or equal to Hi,
+// wrapping around the end of the keyspace if Lo is not less than Hi. If Lo and
+// Hi are equal, the KeyRange spans the whole keyspace.
+type KeyRange struct {
+	Lo, Hi []byte
+
+	// compare is the comparator of the ring that the KeyRange comes from,
+	// if it has been configured with one (see WithNameComparator).
+	compare func(a, b []byte) int
+}
+
+// Contains returns true if the given key falls in the KeyRange, or false
+// otherwise. The keys are ordered in the same way as in the ring that the
+// KeyRange comes from, if any, or through bytes.Compare otherwise.
+func (kr KeyRange) Contains(key []byte) bool {
+	if kr.compare != nil {
+		return kr.ContainsFunc(key, kr.compare)
+	}
+	return kr.ContainsFunc(key, bytes.Compare)
+}
+
+// ContainsFunc is like Contains, but it orders the keys through the given
+// comparator, e.g. the one of a ring that has been configured through
+// WithNameComparator.
+func (kr KeyRange) ContainsFunc(key []byte, compare func(a, b []byte) int) bool {
+	switch c := compare(kr.Lo, kr.Hi); {
+	case c < 0:
+		return compare(key, kr.Lo) > 0 && compare(key, kr.Hi) <= 0
+	case c > 0:
+		return compare(key, kr.Lo) > 0 || compare(key, kr.Hi) <= 0
+	default:
+		return true
+	}
+}
+
+// Migration describes a contiguous range of the keyspace whose replica owners
+// change between two states of the ring, along with its replica owners before
+// and after the change.
+//
+// Ranges whose replica owners only change in order (but not as a set) do not
+// need any data to be moved, hence they are not considered to be migrating.
+type Migration struct {
+	KeyRange
+	OldOwners []Node
+	NewOwners []Node
+}
+
+// ExpectedKeysMoved estimates the number of keys that the given migrations
+// (e.g. as returned by SimulateRemoveVirtualNode) would move, out of the given
+// total number of keys stored in the ring, by summing up the fractions of the
+// keyspace that the migrations span and multiplying them by totalKeys. The
+// estimate assumes that the keys are uniformly distributed across the keyspace,
+// which holds for keys that are positioned through a good hash function. The
+// migrations are assumed not to overlap with each other. It returns -1 if the
+// ring has been configured with a custom name comparator (see
+// ErrUnknownPositions).
+func (r *HashRing) ExpectedKeysMoved(migs []Migration, totalKeys int64) int64 {
+	state := r.state.Load().(*hashRingState)
+	if !state.hasPositions() {
+		return -1
+	}
+	width := state.keyWidth()
+	moved := new(big.Int)
+	for _, mig := range migs {
+		moved.Add(moved, arcLength(mig.Lo, mig.Hi, width))
+	}
+	// Round the estimate to the nearest integer.
+	moved.Mul(moved, big.NewInt(totalKeys))
+	moved.Add(moved, new(big.Int).Rsh(keyspaceSize(width), 1))
+	return moved.Div(moved, keyspaceSize(width)).Int64()
+}
+
+// SimulateRemoveVirtualNode computes the migrations that removing the virtual
+// node with the given vnid of the given distinct node would cause, without
+// actually removing it. It returns a non-nil error if there is no such virtual
+// node in the ring.
+//
+// Complexity: O( (V*N)*log(V*N) )
+func (r *HashRing) SimulateRemoveVirtualNode(node Node, vnid uint16) ([]Migration, error) {
+	oldState := r.state.Load().(*hashRingState)
+	newState := oldState.derive()
+	i, err := newState.removeVirtualNode(node, vnid)
+	if err != nil {
+		return nil, err
+	}
+	newState.removeVirtualNodeAt(i)
+	newState.fixReplicaOwners()
+	return migrations(oldState, newState), nil
+}
+
+// PreviewInsert computes the migrations that inserting the given distinct nodes
+// would cause (see InsertWithMigration), without actually inserting them; the
+// ring is left untouched. It returns a non-nil error if the insertion would
+// fail, e.g. if any of the nodes are already in the ring.
+//
+// Complexity: O( (V*N)*log(V*N) )
+func (r *HashRing) PreviewInsert(nodes ...Node) ([]Migration, error) {
+	oldState := r.state.Load().(*hashRingState)
+	newState := oldState.derive()
+	if _, err := newState.insert(nodes...); err != nil {
+		return nil, err
+	}
+	return migrations(oldState, newState), nil
+}
+
+// PreviewRemove is like PreviewInsert, but for the removal of the given
+// distinct nodes (see RemoveWithMigration).
+//
+// Complexity: O( (V*N)*log(V*N) )
+func (r *HashRing) PreviewRemove(nodes ...Node) ([]Migration, error) {
+	oldState := r.state.Load().(*hashRingState)
+	newState := oldState.derive()
+	if _, err := newState.remove(nodes...); err != nil {
+		return nil, err
+	}
+	return migrations(oldState, newState), nil
+}
+
+// ReduceWeight sheds load from the given distinct node, without removing it
+// from the ring, by removing its dropVnodes virtual nodes with the highest
+// vnids, and returns the migrations that this causes.
+//
+// It returns a non-nil error, leaving the ring untouched, if the node is not in
+// the ring, if dropVnodes is not positive, or if it would remove all virtual
+// nodes of the node (Remove should be used for that instead).
+//
+// Complexity: O( dropVnodes*(V*N) + (V*N)*log(V*N) )
+func (r *HashRing) ReduceWeight(node Node, dropVnodes int) ([]Migration, error) {
+	defer r.lockWriters()()
+	oldState := r.state.Load().(*hashRingState)
+	if !oldState.hasNode(node) {
+		return nil, fmt.Errorf("node %q is not in the ring", node)
+	}
+	if vnodeCount := oldState.numVirtualNodes(node); dropVnodes < 1 || dropVnodes >= vnodeCount {
+		return nil, fmt.Errorf("dropVnodes value %d not in (0, %d)", dropVnodes, vnodeCount)
+	}
+	newState := oldState.derive()
+	for ; dropVnodes > 0; dropVnodes-- {
+		// The highest vnid of the node is never among the individually
+		// removed ones.
+		i, err := newState.removeVirtualNode(node, uint16(newState.vnodeCounts[node]-1))
+		if err != nil {
+			return nil, err
+		}
+		newState.removeVirtualNodeAt(i)
+	}
+	newState.fixReplicaOwners()
+	if err := r.commit(newState); err != nil {
+		return nil, err
+	}
+	return migrations(oldState, newState), nil
+}
+
+// InsertWithMigration is like Insert, but it also returns the migrations that
+// the insertion causes, i.e. the contiguous ranges of the keyspace whose
+// replica owners (as a set) change, along with their replica owners before and
+// after it, so that the movement of their data may be scheduled. Ranges whose
+// replica owners only change in order are not reported, and a range that wraps
+// around the end of the keyspace is reported as a single migration.
+//
+// Complexity: O( (V*N)*log(V*N) )
+func (r *HashRing) InsertWithMigration(nodes ...Node) ([]*VirtualNode, []Migration, error) {
+	defer r.lockWriters()()
+	oldState := r.state.Load().(*hashRingState)
+	newState := oldState.derive()
+	newVnodes, err := newState.insert(nodes...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := r.commit(newState); err != nil {
+		return nil, nil, err
+	}
+	return newVnodes, migrations(oldState, newState), nil
+}
+
+// RemoveWithMigration is like Remove, but it also returns the migrations that
+// the removal causes, like InsertWithMigration.
+//
+// Complexity: O( (V*N)*log(V*N) )
+func (r *HashRing) RemoveWithMigration(nodes ...Node) ([]*VirtualNode, []Migration, error) {
+	defer r.lockWriters()()
+	oldState := r.state.Load().(*hashRingState)
+	newState := oldState.derive()
+	removedVnodes, err := newState.remove(nodes...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := r.commit(newState); err != nil {
+		return nil, nil, err
+	}
+	return removedVnodes, migrations(oldState, newState), nil
+}
+
+// DiffAgainstSnapshot loads a ring saved through Save or SaveCompressed from
+// the given io.Reader, and returns the migrations from the saved ring to the
+// current state of the ring, e.g. for a standby to find out what has changed
+// while it was down.
+//
+// The saved ring is decoded directly into a single state, which is never
+// published as a HashRing, and which omits replica owners (see
+// WithoutReplicaOwnerMap) to avoid materializing them only to diff them once.
+// Since they cannot be saved, the ring's own rack constraint, tie-break hash
+// function, naming scheme and comparator of virtual nodes (if any) are assumed
+// for the saved ring as well. It returns a non-nil error if the saved ring
+// cannot be loaded, or if it was saved with a hash function known to differ
+// from the ring's (see CheckHashCompatible).
+//
+// Complexity: O( (V*N)*log(V*N) )
+func (r *HashRing) DiffAgainstSnapshot(rd io.Reader) ([]Migration, error) {
+	newState := r.state.Load().(*hashRingState)
+	opts := []Option{WithoutReplicaOwnerMap()}
+	if newState.rackOf != nil {
+		opts = append(opts, WithRackConstraint(newState.rackOf, newState.minRacks))
+	}
+	if newState.tieBreakHash != nil {
+		opts = append(opts, WithTieBreakHash(newState.tieBreakHash))
+	}
+	if newState.customNaming {
+		opts = append(opts, WithVirtualNodeNaming(newState.virtualNodeKey))
+	}
+	if newState.compare != nil {
+		opts = append(opts, WithNameComparator(newState.compare))
+	}
+	saved, err := loadRing(r.hash, rd, opts)
+	if err != nil {
+		return nil, err
+	}
+	oldState := saved.state.Load().(*hashRingState)
+	if err = oldState.checkHashCompatible(newState); err != nil {
+		return nil, err
+	}
+	return migrations(oldState, newState), nil
+}
+
+// MovedKeys returns the subset of the given keys (in their given order) whose
+// primary owner (i.e. NodesForKey(key)[0]) differs between the current states
+// of rings `from` and `to`. Instead of looking up each key independently in
+// each ring, the keys are sorted once and matched against each ring in a
+// single walk. It returns a non-nil error if either ring is empty, or if their
+// hash functions are known to differ (see CheckHashCompatible).
+//
+// Complexity: O( K*log(K) + V*N )
+func MovedKeys(from, to *HashRing, keys [][]byte) ([][]byte, error) {
+	fromState, toState := from.state.Load().(*hashRingState), to.state.Load().(*hashRingState)
+	if len(fromState.virtualNodes) == 0 || len(toState.virtualNodes) == 0 {
+		return nil, fmt.Errorf("empty ring")
+	}
+	if err := fromState.checkHashCompatible(toState); err != nil {
+		return nil, err
+	}
+	// Each ring orders the keys through its own comparator.
+	fromPrimaries := fromState.primariesOf(keys, fromState.sortedKeyOrder(keys))
+	toPrimaries := toState.primariesOf(keys, toState.sortedKeyOrder(keys))
+	ret := make([][]byte, 0)
+	for i := range keys {
+		if fromPrimaries[i] != toPrimaries[i] {
+			ret = append(ret, keys[i])
+		}
+	}
+	return ret, nil
+}
+
+// migrations computes the migrations between two states of the ring, i.e. all
+// maximal contiguous ranges of the keyspace whose replica owners (as a set)
+// differ between the two states.
+//
+// Complexity: O( (V*N)*log(V*N) )
+func migrations(oldState, newState *hashRingState) []Migration {
+	// Gather the names of all virtual nodes of both states, since these
+	// are the only positions where the replica owners may change.
+	bounds := make([][]byte, 0, len(oldState.virtualNodes)+len(newState.virtualNodes))
+	for _, vn := range oldState.virtualNodes {
+		bounds = append(bounds, vn.Name())
+	}
+	for _, vn := range newState.virtualNodes {
+		bounds = append(bounds, vn.Name())
+	}
+	sort.Slice(bounds, func(i, j int) bool { return newState.compareNames(bounds[i], bounds[j]) < 0 })
+	uniq := bounds[:0]
+	for i := range bounds {
+		if i == 0 || newState.compareNames(bounds[i], bounds[i-1]) != 0 {
+			uniq = append(uniq, bounds[i])
+		}
+	}
+	bounds = uniq
+
+	// All keys in each arc (bounds[i-1], bounds[i]] share the same owners
+	// in each one of the states; compare them arc by arc, merging any
+	// consecutive arcs that migrate identically.
+	ret := make([]Migration, 0)
+	for i := range bounds {
+		oldOwners, newOwners := oldState.nodesForKey(bounds[i]), newState.nodesForKey(bounds[i])
+		if sameNodeSet(oldOwners, newOwners) {
+			continue
+		}
+		lo := bounds[(i+len(bounds)-1)%len(bounds)]
+		if n := len(ret); n > 0 && bytes.Equal(ret[n-1].Hi, lo) &&
+			sameNodes(ret[n-1].OldOwners, oldOwners) && sameNodes(ret[n-1].NewOwners, newOwners) {
+			ret[n-1].Hi = bounds[i]
+			continue
+		}
+		ret = append(ret, Migration{
+			KeyRange:  KeyRange{Lo: lo, Hi: bounds[i], compare: newState.compare},
+			OldOwners: oldOwners,
+			NewOwners: newOwners,
+		})
+	}
+	// Merge the last migration with the first one, if they are contiguous
+	// through the end of the keyspace.
+	if n := len(ret); n > 1 && bytes.Equal(ret[n-1].Hi, ret[0].Lo) &&
+		sameNodes(ret[n-1].OldOwners, ret[0].OldOwners) && sameNodes(ret[n-1].NewOwners, ret[0].NewOwners) {
+		ret[n-1].Hi = ret[0].Hi
+		ret = ret[1:]
+	}
+	return ret
+}
+
+// RingDiff describes the differences between two rings, as returned by Diff.
+type RingDiff struct {
+	// AddedNodes and RemovedNodes are the distinct nodes (sorted) that are
+	// members of the other ring only, and of the ring only, respectively.
+	AddedNodes   []Node
+	RemovedNodes []Node
+
+	// ChangedVirtualNodes are the virtual nodes that are present in both
+	// rings (by name), but whose replica owners (as a set) differ, in the
+	// order in which they appear on the rings.
+	ChangedVirtualNodes []VirtualNodeChange
+
+	// OldReplicationFactor and NewReplicationFactor are the replication
+	// factors of the ring and of the other ring, respectively; similarly,
+	// OldVirtualNodeCount and NewVirtualNodeCount are their (default)
+	// numbers of virtual nodes per distinct node.
+	OldReplicationFactor, NewReplicationFactor int
+	OldVirtualNodeCount, NewVirtualNodeCount   int
+
+	// OldHashName and NewHashName are the names of the hash functions of
+	// the ring and of the other ring, respectively (see WithHashName), if
+	// known.
+	OldHashName, NewHashName string
+}
+
+// VirtualNodeChange describes a virtual node whose replica owners differ
+// between two rings.
+type VirtualNodeChange struct {
+	Name      []byte
+	OldOwners []Node
+	NewOwners []Node
+}
+
+// Structural returns true if the two rings differ in their replication factors,
+// in their numbers of virtual nodes per distinct node, or in their hash
+// functions (as far as their names are known; see CheckHashCompatible), or
+// false otherwise.
+func (d RingDiff) Structural() bool {
+	return d.OldReplicationFactor != d.NewReplicationFactor || d.OldVirtualNodeCount != d.NewVirtualNodeCount ||
+		d.OldHashName != "" && d.NewHashName != "" && d.OldHashName != d.NewHashName
+}
+
+// Empty returns true if the two rings do not differ at all, or false otherwise.
+func (d RingDiff) Empty() bool {
+	return !d.Structural() && len(d.AddedNodes) == 0 && len(d.RemovedNodes) == 0 && len(d.ChangedVirtualNodes) == 0
+}
+
+// Diff compares the current states of the ring and of the other ring, and
+// returns their differences, i.e. the distinct nodes added to and removed from
+// the ring to get to the other ring, the virtual nodes of both rings whose
+// replica owners differ, and whether the rings differ structurally (e.g. in
+// their replication factors). Virtual nodes are matched by their names, hence
+// they are not compared at all if the two rings are known to use different hash
+// functions (see CheckHashCompatible), which is reported as a structural
+// difference.
+//
+// Complexity: O( (V*N)*R )
+func (r *HashRing) Diff(other *HashRing) RingDiff {
+	oldState, newState := r.state.Load().(*hashRingState), other.state.Load().(*hashRingState)
+	ret := RingDiff{
+		AddedNodes:           make([]Node, 0),
+		RemovedNodes:         make([]Node, 0),
+		ChangedVirtualNodes:  make([]VirtualNodeChange, 0),
+		OldReplicationFactor: int(oldState.replicationFactor),
+		NewReplicationFactor: int(newState.replicationFactor),
+		OldVirtualNodeCount:  int(oldState.virtualNodeCount),
+		NewVirtualNodeCount:  int(newState.virtualNodeCount),
+		OldHashName:          oldState.hashName,
+		NewHashName:          newState.hashName,
+	}
+	for _, node := range newState.nodes() {
+		if !oldState.hasNode(node) {
+			ret.AddedNodes = append(ret.AddedNodes, node)
+		}
+	}
+	for _, node := range oldState.nodes() {
+		if !newState.hasNode(node) {
+			ret.RemovedNodes = append(ret.RemovedNodes, node)
+		}
+	}
+
+	// The names of the virtual nodes of rings with different hash
+	// functions are unrelated.
+	if oldState.checkHashCompatible(newState) != nil {
+		return ret
+	}
+	// Both slices of virtual nodes are sorted by name; merge them.
+	for i, j := 0, 0; i < len(oldState.virtualNodes) && j < len(newState.virtualNodes); {
+		switch oldState.compareNames(oldState.virtualNodes[i].Name(), newState.virtualNodes[j].Name()) {
+		case -1:
+			i++
+		case 1:
+			j++
+		default:
+			if oldOwners, newOwners := oldState.owners(i), newState.owners(j); !sameNodeSet(oldOwners, newOwners) {
+				ret.ChangedVirtualNodes = append(ret.ChangedVirtualNodes, VirtualNodeChange{
+					Name:      oldState.virtualNodes[i].Name(),
+					OldOwners: oldOwners,
+					NewOwners: newOwners,
+				})
+			}
+			i++
+			j++
+		}
+	}
+	return ret
+}
+
+// Transition describes a change of the set of replica owners while walking the
+// ring clockwise: at Position (the name of a virtual node), the arc of the
+// virtual node begins to be owned by the Entering nodes, and stops being owned
+// by the Leaving nodes, compared to the arc of the previous virtual node.
+type Transition struct {
+	Position []byte
+	Entering []Node
+	Leaving  []Node
+}
+
+// OwnershipTransitions returns all positions around the ring, in order, where
+// the set of replica owners changes, along with the nodes that enter and leave
+// it there. Replaying the transitions from the owners of any arc reconstructs
+// the owners (as sets) of all arcs of the ring. Virtual nodes whose owners only
+// differ in order from those of their predecessor are not transitions.
+//
+// Complexity: O( V*N )
+func (r *HashRing) OwnershipTransitions() []Transition {
+	return r.state.Load().(*hashRingState).ownershipTransitions()
+}
+
+// ownershipTransitions implements OwnershipTransitions, in a single walk over
+// state's virtual nodes, comparing the owners of consecutive ones.
+func (s *hashRingState) ownershipTransitions() []Transition {
+	ret := make([]Transition, 0)
+	for i := range s.virtualNodes {
+		prev, curr := s.owners((i+len(s.virtualNodes)-1)%len(s.virtualNodes)), s.owners(i)
+		if sameNodeSet(prev, curr) {
+			continue
+		}
+		ret = append(ret, Transition{
+			Position: s.virtualNodes[i].Name(),
+			Entering: nodesMinus(curr, prev),
+			Leaving:  nodesMinus(prev, curr),
+		})
+	}
+	return ret
+}
+
+// sameNodes returns true if the two slices of Nodes are equal, or false
+// otherwise.
+func sameNodes(a, b []Node) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameNodeSet returns true if the two slices of distinct Nodes consist of the
+// same Nodes, regardless of their order, or false otherwise.
+func sameNodeSet(a, b []Node) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, x := range a {
+		found := false
+		for _, y := range b {
+			if x == y {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// nodesMinus returns the Nodes of a that are not in b, in their order in a.
+func nodesMinus(a, b []Node) []Node {
+	ret := make([]Node, 0)
+	for _, x := range a {
+		found := false
+		for _, y := range b {
+			if x == y {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ret = append(ret, x)
+		}
+	}
+	return ret
+}
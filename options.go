@@ -0,0 +1,246 @@
+// Copyright 2018 Christos Katsakioris
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lfchring
+
+import "hash"
+
+// Option configures an optional feature of a HashRing during its
+// initialization through NewHashRingWithOptions.
+type Option func(*options)
+
+// options gathers the optional configuration of a HashRing, as set by the
+// Options passed to NewHashRingWithOptions.
+type options struct {
+	withoutReplicaOwners bool
+	hashName             string
+	internNodes          bool
+	rackOf               func(Node) string
+	minRacks             int
+	lazyNames            bool
+	historyDepth         int
+	tieBreakHash         func([]byte) []byte
+	initialGeneration    uint64
+	hasInitialGeneration bool
+	duplicateOwners      bool
+	synchronizedWriters  bool
+	streamingHash        func() hash.Hash
+	keyCacheSize         int
+	virtualNodeKey       func(Node, uint16) []byte
+	compare              func(a, b []byte) int
+}
+
+// WithoutReplicaOwnerMap configures the ring not to maintain the replica
+// owners of its virtual nodes at all, but to compute the replica owners of each
+// key on demand instead, by walking the ring clockwise.
+//
+// This trades some CPU time on each lookup for a large memory saving, which is
+// mostly worth it for rings of hundreds of thousands of virtual nodes, where
+// the replica owners dominate the memory footprint of the ring.
+func WithoutReplicaOwnerMap() Option {
+	return func(o *options) {
+		o.withoutReplicaOwners = true
+	}
+}
+
+// WithHashName attaches an identifier (e.g. "sha256") to the hash function of
+// the ring. Since Go functions are not comparable, this is the only way for
+// operations that involve multiple rings to verify that the rings use the same
+// hash function; such operations fail if the names of the rings' hash functions
+// differ. An empty name (the default) means that the hash function is
+// unidentified, and is never checked.
+func WithHashName(name string) Option {
+	return func(o *options) {
+		o.hashName = name
+	}
+}
+
+// WithInternedNodes configures the ring to intern the identifiers of its
+// distinct nodes, i.e. to keep one compact canonical copy of each one of them,
+// which all virtual nodes and replica owners of the node refer to.
+//
+// Although copies of a Node share their underlying bytes anyway, the Nodes
+// passed to the ring may be backed by much larger buffers (e.g. if they have
+// been sliced out of a request's body), or equal Nodes may be backed by
+// separate allocations (e.g. if they have been decoded more than once), both
+// of which would pin more memory than needed for as long as they are in the
+// ring. This is mostly worth it for rings with long node identifiers.
+func WithInternedNodes() Option {
+	return func(o *options) {
+		o.internNodes = true
+	}
+}
+
+// WithRackConstraint configures the ring to place the replicas of each key on
+// distinct nodes that span at least minRacks distinct racks, as reported by
+// rackOf for each node. To do so, the clockwise walk that finds the replica
+// owners of each virtual node skips any nodes that would leave too few of the
+// replicas for the rest of the required racks to be covered; the skipped nodes
+// are only used to fill in the replicas if the ring runs out of racks.
+//
+// rackOf must be deterministic, and must not be nil; minRacks must be positive
+// and not greater than the replication factor of the ring. Whether the
+// constraint holds for all keys of the ring may be verified through Validate.
+func WithRackConstraint(rackOf func(Node) string, minRacks int) Option {
+	return func(o *options) {
+		o.rackOf = rackOf
+		o.minRacks = minRacks
+	}
+}
+
+// WithLazyNames configures the ring not to store the names of its virtual
+// nodes (i.e. the outputs of the hash function), but to compute them on demand
+// from their distinct nodes and vnids instead, whenever they are compared
+// during sorting and searching. The most recently used names are cached in a
+// bounded LRU cache, shared among all states of the ring.
+//
+// This trades (a lot of) CPU time on each lookup and modification for memory,
+// and it is mostly worth it for enormous rings that are infrequently searched.
+// Note also that the cache is guarded by a mutex, hence the lookups of such a
+// ring are not lock-free.
+func WithLazyNames() Option {
+	return func(o *options) {
+		o.lazyNames = true
+	}
+}
+
+// WithHistory configures the ring to retain its last depth states (including
+// the current one), so that lookups may be performed against recent past
+// generations of the ring through NodesForKeyAtGeneration, e.g. to reconcile
+// delayed operations that were issued against an older topology. Retaining
+// states comes at the cost of the memory that they occupy. A depth of 0 (the
+// default) retains no history; a negative depth is invalid.
+func WithHistory(depth int) Option {
+	return func(o *options) {
+		o.historyDepth = depth
+	}
+}
+
+// WithTieBreakHash configures the ring to order any virtual nodes whose names
+// collide (and, hence, which of them the keys at that position are assigned
+// to) by the digests of the given hash function, which should be independent
+// of ring's hash function. By default, colliding virtual nodes are ordered by
+// their distinct nodes and vnids, which systematically favors lexicographically
+// smaller nodes; this only matters for rings where collisions are not
+// negligible, e.g. because of hash functions with short outputs.
+func WithTieBreakHash(hashFunc func([]byte) []byte) Option {
+	return func(o *options) {
+		o.tieBreakHash = hashFunc
+	}
+}
+
+// WithInitialGeneration configures the ring to start off at the given
+// generation, rather than at 0, so that subsequent modifications continue from
+// there. It is meant for rings that are restored from persisted state (e.g. by
+// Load), so that their generation remains monotonic across process restarts,
+// which any caching built on Generation relies on. Hence, LoadWithOptions
+// refuses an initial generation that is less than the persisted one. Once the
+// generation reaches math.MaxUint64, modifications of the ring fail with
+// ErrGenerationOverflow, rather than wrap it around to 0.
+func WithInitialGeneration(gen uint64) Option {
+	return func(o *options) {
+		o.initialGeneration = gen
+		o.hasInitialGeneration = true
+	}
+}
+
+// WithAllowDuplicateOwners configures whether the replica owners of each key
+// may include the same distinct node more than once. By default (or if allow
+// is false), the replica owners of a key are the distinct nodes of the virtual
+// nodes found while walking the ring clockwise from the key, each one included
+// only the first time that it is encountered, until replicationFactor distinct
+// nodes have been found (or the ring has been walked entirely). If allow is
+// true, they are instead the distinct nodes of the first replicationFactor
+// virtual nodes clockwise from the key (or of all virtual nodes, if there are
+// fewer), one per virtual node, regardless of whether some of them belong to
+// the same distinct node. This is only meant for unusual use cases, since it
+// means that keys may be replicated on fewer distinct nodes than the
+// replication factor. It cannot be combined with WithRackConstraint or with
+// join weights (see SetJoinWeight).
+func WithAllowDuplicateOwners(allow bool) Option {
+	return func(o *options) {
+		o.duplicateOwners = allow
+	}
+}
+
+// WithSynchronizedWriters configures the ring to serialize all of its
+// modifications (e.g. Insert and Remove) through an internal mutex, so that it
+// may be safely modified by multiple concurrent writers, which would otherwise
+// clobber each other's modifications. Lookups remain lock-free (and
+// allocation-free), since they never lock the mutex.
+//
+// Without it, a ring only supports a single writer at a time, and any
+// concurrent writers must be serialized externally.
+func WithSynchronizedWriters() Option {
+	return func(o *options) {
+		o.synchronizedWriters = true
+	}
+}
+
+// WithStreamingHash configures the ring with a factory of hash.Hash instances
+// that compute the same digests as the ring's hash function, so that objects
+// can be hashed while they are being read (see NodesForObjectStreaming, as well
+// as NodesForObject and NodesForObjectContext), instead of being read into
+// memory in their entirety first. The ring's hash function is still used for
+// everything else, e.g. for keys that are in memory already.
+func WithStreamingHash(newHash func() hash.Hash) Option {
+	return func(o *options) {
+		o.streamingHash = newHash
+	}
+}
+
+// WithKeyCache configures the ring to cache the hashes of the (at most) size
+// most recently hashed keys by NodesForKeyFunc and HashKey, so that hot keys
+// are not hashed over and over again. Keys longer than 1 KiB are never cached,
+// and neither are objects (see NodesForObject), so that the cache never pins
+// large buffers in memory. The cache is sharded, so that concurrent readers
+// rarely contend for the same lock. A size of 0 (the default) disables the
+// cache; see also ClearKeyCache.
+func WithKeyCache(size int) Option {
+	return func(o *options) {
+		o.keyCacheSize = size
+	}
+}
+
+// WithVirtualNodeNaming configures the ring to derive the bytes that are hashed
+// into the name of each virtual node (i.e. its position on the ring) through
+// the given function of its distinct node and vnid, rather than as
+// "<node>-<vnid>" (the default), e.g. to reproduce the placement of another
+// implementation of consistent hashing that names its virtual nodes as
+// "<node>#<vnid>". The function must return distinct bytes for distinct
+// virtual nodes, and the same bytes for the same virtual node, every time.
+func WithVirtualNodeNaming(virtualNodeKey func(node Node, vnid uint16) []byte) Option {
+	return func(o *options) {
+		o.virtualNodeKey = virtualNodeKey
+	}
+}
+
+// WithNameComparator configures the ring to order the names of its virtual
+// nodes (i.e. their positions on the ring), as well as the keys that are looked
+// up in it, through the given comparator, rather than bytes.Compare (the
+// default), e.g. to interoperate with a system that orders its ring positions
+// as unsigned big-endian integers of a fixed width. The comparator must return
+// a negative number, zero or a positive number if a is less than, equal to or
+// greater than b, respectively, and it must define a total order. Comparators
+// that are found inconsistent when the ring is initialized are rejected.
+//
+// Since the comparator only orders the keys, their positions on the ring are
+// unknown; hence, the methods that measure the keyspace (e.g. LoadDistribution
+// or LargestArc) report ErrUnknownPositions instead. The KeyRanges that such a
+// ring returns order keys through the comparator (see KeyRange.Contains).
+func WithNameComparator(compare func(a, b []byte) int) Option {
+	return func(o *options) {
+		o.compare = compare
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Christos Katsakioris
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lfchring
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// RingPatch is a compact description of the changes in the membership of a
+// ring between two of its states, meant to be propagated (e.g. through gossip)
+// to other replicas of the ring, instead of the whole set of its nodes.
+type RingPatch struct {
+	// Added and Removed are the distinct nodes (sorted) that have been
+	// inserted to and removed from the ring, respectively.
+	Added   []Node
+	Removed []Node
+
+	// Generation is the generation of the ring's state that the patch
+	// leads to.
+	Generation uint64
+
+	// From and To are the fingerprints of the membership of the ring
+	// before and after the patch, respectively.
+	From [sha256.Size]byte
+	To   [sha256.Size]byte
+}
+
+// DiffPatch returns the RingPatch that brings a ring from the current state of
+// ring `from` to the current state of ring `to`.
+//
+// Changes in the number of virtual nodes of distinct nodes that are members of
+// both rings (e.g. through ReduceWeight) cannot be expressed in a RingPatch;
+// applying such a patch fails, since the resulting membership does not match
+// the one of `to`.
+//
+// Complexity: O( V*N )
+func DiffPatch(from, to *HashRing) RingPatch {
+	fromState := from.state.Load().(*hashRingState)
+	toState := to.state.Load().(*hashRingState)
+	p := RingPatch{
+		Added:      make([]Node, 0),
+		Removed:    make([]Node, 0),
+		Generation: toState.generation,
+		From:       fromState.fingerprint(),
+		To:         toState.fingerprint(),
+	}
+	for _, node := range toState.nodes() {
+		if !fromState.hasNode(node) {
+			p.Added = append(p.Added, node)
+		}
+	}
+	for _, node := range fromState.nodes() {
+		if !toState.hasNode(node) {
+			p.Removed = append(p.Removed, node)
+		}
+	}
+	return p
+}
+
+// ApplyPatch applies the given RingPatch to the ring, bringing it from the
+// state that the patch was computed from, to the state that it leads to. The
+// generation of the ring becomes the one of the patch, unless the ring is
+// already past it, in which case it is incremented as usual.
+//
+// It returns a non-nil error, leaving the ring untouched, if the membership of
+// the ring does not match the one that the patch was computed from, or if the
+// membership that results from the patch does not match the expected one.
+//
+// Complexity: O( (V*N)*log(V*N) )
+func (r *HashRing) ApplyPatch(p RingPatch) error {
+	defer r.lockWriters()()
+	oldState := r.state.Load().(*hashRingState)
+	if oldState.fingerprint() != p.From {
+		return fmt.Errorf("ring does not match the state that the patch was computed from")
+	}
+	newState := oldState.derive()
+	if len(p.Removed) > 0 {
+		if _, err := newState.remove(p.Removed...); err != nil {
+			return err
+		}
+	}
+	if len(p.Added) > 0 {
+		if _, err := newState.insert(p.Added...); err != nil {
+			return err
+		}
+	}
+	if newState.fingerprint() != p.To {
+		return fmt.Errorf("patched ring does not match the state that the patch leads to")
+	}
+	if p.Generation > newState.generation {
+		newState.generation = p.Generation
+	}
+	return r.commit(newState)
+}
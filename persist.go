@@ -0,0 +1,377 @@
+// Copyright 2018 Christos Katsakioris
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lfchring
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// The persistence format of the ring consists of a fixed header, followed by
+// the parameters of the ring and by its distinct nodes, one after the other:
+//
+//	magic             4 bytes, "LFCH"
+//	version           1 byte
+//	flags             1 byte, see the flag* constants below
+//	replicationFactor uvarint
+//	virtualNodeCount  uvarint
+//	hashName          uvarint length, followed by the bytes of the name
+//	generation        uvarint (since version 2)
+//	number of nodes   uvarint
+//	for each node:
+//	    node          uvarint length, followed by the bytes of the node
+//	    vnode count   uvarint
+//	    draining      1 byte, 0 or 1
+//	    removed vnids uvarint count, followed by each vnid as a uvarint,
+//	                  sorted (since version 3)
+//
+// The virtual nodes themselves are not persisted, since they can be derived
+// from the distinct nodes (i.e. the vnids in [0, vnode count), minus any vnids
+// of virtual nodes that have been removed individually through
+// RemoveVirtualNodesByName), as long as the same hash function is used. The
+// generation of the ring is persisted, so that it remains monotonic across
+// process restarts; rings saved in version 1 of the format (which lacks it)
+// start over from generation 0 once they are loaded.
+//
+// Since version 4, the flags also record whether the ring names its virtual
+// nodes (see WithVirtualNodeNaming) or orders their names (see
+// WithNameComparator) in a custom way, since these cannot be persisted either,
+// so that such a ring is never silently loaded with the default ones.
+//
+// The whole stream may optionally be gzip-compressed, in which case Load
+// detects it and decompresses it transparently.
+const (
+	persistMagic   = "LFCH"
+	persistVersion = 4
+
+	flagWithoutReplicaOwners = 1 << 0
+	flagInternedNodes        = 1 << 1
+	flagLazyNames            = 1 << 2
+	flagDuplicateOwners      = 1 << 3
+	flagCustomNaming         = 1 << 4
+	flagCustomComparator     = 1 << 5
+
+	// maxPersistedNodeLen is the maximum length of a persisted node, which
+	// guards Load against allocating huge buffers for corrupted input.
+	maxPersistedNodeLen = 1 << 20
+)
+
+// gzipMagic is the header that all gzip streams start with.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Save writes the current state of the ring to the given io.Writer, in a
+// compact binary format from which it may be restored through Load. The
+// distinct nodes of the ring are streamed one by one, rather than being
+// gathered in a single buffer first.
+//
+// Since Go functions cannot be persisted, the hash function of the ring is not
+// saved; only its name (see WithHashName) is. It is the responsibility of the
+// caller to provide Load with the same hash function. For the same reason, any
+// rack constraint (see WithRackConstraint), tie-break hash function (see
+// WithTieBreakHash), naming scheme of virtual nodes (see
+// WithVirtualNodeNaming), comparator of their names (see WithNameComparator)
+// or hash functions registered for prefixes (see RegisterHashForPrefix) of the
+// ring are not saved either; only the use of a custom naming scheme or
+// comparator is recorded, so that LoadWithOptions may insist on them.
+func (r *HashRing) Save(w io.Writer) error {
+	return r.state.Load().(*hashRingState).save(w)
+}
+
+// SaveCompressed is like Save, but it gzip-compresses the written stream.
+func (r *HashRing) SaveCompressed(w io.Writer) error {
+	zw := gzip.NewWriter(w)
+	if err := r.state.Load().(*hashRingState).save(zw); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Load reads a ring from the given io.Reader, as written by either Save or
+// SaveCompressed, and returns it, using the given hash function. It returns a
+// non-nil error if the stream cannot be read or is not a valid saved ring, or
+// if the ring was saved with a custom naming scheme or comparator of virtual
+// nodes, which only LoadWithOptions can restore.
+//
+// The loaded ring resumes from the generation that it was saved at (see
+// WithInitialGeneration).
+func Load(hashFunc func([]byte) []byte, r io.Reader) (*HashRing, error) {
+	return loadRing(hashFunc, r, nil)
+}
+
+// LoadWithOptions is like Load, but it additionally configures the loaded ring
+// through the given Options, e.g. to restore the settings that are not saved
+// (see Save). A ring saved with a custom naming scheme (see
+// WithVirtualNodeNaming) or comparator (see WithNameComparator) of virtual
+// nodes must be given one again, and vice versa, or a non-nil error is
+// returned; it is the responsibility of the caller to provide the same ones.
+// Similarly, an initial generation (see WithInitialGeneration) may only move
+// the loaded ring's generation forward from the saved one.
+func LoadWithOptions(hashFunc func([]byte) []byte, r io.Reader, opts ...Option) (*HashRing, error) {
+	return loadRing(hashFunc, r, opts)
+}
+
+// loadRing implements Load, additionally configuring the loaded ring through
+// the given Options (on top of those implied by the saved ring's flags).
+func loadRing(hashFunc func([]byte) []byte, r io.Reader, opts []Option) (*HashRing, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress saved ring: %v", err)
+		}
+		defer zr.Close()
+		ring, err := load(hashFunc, bufio.NewReader(zr), opts)
+		if err != nil {
+			return nil, err
+		}
+		// Read through the end of the compressed stream, so that its
+		// checksum is verified.
+		if _, err = io.Copy(ioutil.Discard, zr); err != nil {
+			return nil, fmt.Errorf("failed to decompress saved ring: %v", err)
+		}
+		return ring, nil
+	}
+	return load(hashFunc, br, opts)
+}
+
+// save writes the state to the given io.Writer, in the persistence format.
+func (s *hashRingState) save(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	var flags byte
+	if s.withoutReplicaOwners {
+		flags |= flagWithoutReplicaOwners
+	}
+	if s.interned != nil {
+		flags |= flagInternedNodes
+	}
+	if s.lazyNames != nil {
+		flags |= flagLazyNames
+	}
+	if s.duplicateOwners {
+		flags |= flagDuplicateOwners
+	}
+	if s.customNaming {
+		flags |= flagCustomNaming
+	}
+	if s.compare != nil {
+		flags |= flagCustomComparator
+	}
+	bw.WriteString(persistMagic)
+	bw.WriteByte(persistVersion)
+	bw.WriteByte(flags)
+	writeUvarint(bw, uint64(s.replicationFactor))
+	writeUvarint(bw, uint64(s.virtualNodeCount))
+	writeUvarint(bw, uint64(len(s.hashName)))
+	bw.WriteString(s.hashName)
+	writeUvarint(bw, s.generation)
+
+	nodes := s.nodes()
+	writeUvarint(bw, uint64(len(nodes)))
+	for _, node := range nodes {
+		writeUvarint(bw, uint64(len(node)))
+		bw.WriteString(string(node))
+		writeUvarint(bw, uint64(s.vnodeCounts[node]))
+		if _, isDraining := s.draining[node]; isDraining {
+			bw.WriteByte(1)
+		} else {
+			bw.WriteByte(0)
+		}
+		removedVNIDs := s.sortedRemovedVNIDs(node)
+		writeUvarint(bw, uint64(len(removedVNIDs)))
+		for _, vnid := range removedVNIDs {
+			writeUvarint(bw, uint64(vnid))
+		}
+	}
+	// Any error that occurred while writing is sticky; Flush reports it.
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to save ring: %v", err)
+	}
+	return nil
+}
+
+// writeUvarint writes x to the given bufio.Writer as a uvarint.
+func writeUvarint(bw *bufio.Writer, x uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	bw.Write(buf[:binary.PutUvarint(buf[:], x)])
+}
+
+// load reads a ring in the persistence format from the given bufio.Reader, and
+// configures it through the given extra Options.
+func load(hashFunc func([]byte) []byte, br *bufio.Reader, extraOpts []Option) (*HashRing, error) {
+	header := make([]byte, len(persistMagic)+2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("failed to read saved ring header: %v", err)
+	}
+	if string(header[:len(persistMagic)]) != persistMagic {
+		return nil, fmt.Errorf("not a saved ring")
+	}
+	version := header[len(persistMagic)]
+	if version < 1 || version > persistVersion {
+		return nil, fmt.Errorf("unsupported saved ring version %d", version)
+	}
+	flags := header[len(persistMagic)+1]
+
+	replicationFactor, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replicationFactor: %v", err)
+	}
+	virtualNodeCount, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read virtualNodeCount: %v", err)
+	}
+	hashName, err := readString(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hashName: %v", err)
+	}
+	var generation uint64
+	if version >= 2 {
+		if generation, err = binary.ReadUvarint(br); err != nil {
+			return nil, fmt.Errorf("failed to read generation: %v", err)
+		}
+	}
+	opts := []Option{WithHashName(hashName), WithInitialGeneration(generation)}
+	if flags&flagWithoutReplicaOwners != 0 {
+		opts = append(opts, WithoutReplicaOwnerMap())
+	}
+	if flags&flagInternedNodes != 0 {
+		opts = append(opts, WithInternedNodes())
+	}
+	if flags&flagLazyNames != 0 {
+		opts = append(opts, WithLazyNames())
+	}
+	if flags&flagDuplicateOwners != 0 {
+		opts = append(opts, WithAllowDuplicateOwners(true))
+	}
+	// The naming scheme and the comparator of the virtual nodes must be
+	// given if, and only if, custom ones were used by the saved ring.
+	extra := &options{}
+	for _, opt := range extraOpts {
+		opt(extra)
+	}
+	if (flags&flagCustomNaming != 0) != (extra.virtualNodeKey != nil) {
+		return nil, fmt.Errorf("saved ring and options disagree on the use of a custom naming scheme of virtual nodes")
+	}
+	if (flags&flagCustomComparator != 0) != (extra.compare != nil) {
+		return nil, fmt.Errorf("saved ring and options disagree on the use of a custom comparator of virtual nodes")
+	}
+	// The generation may only move forward from the persisted one.
+	if extra.hasInitialGeneration && extra.initialGeneration < generation {
+		return nil, fmt.Errorf("initial generation %d precedes the saved generation %d", extra.initialGeneration, generation)
+	}
+	opts = append(opts, extraOpts...)
+	if replicationFactor > (1<<16)-1 || virtualNodeCount > (1<<16)-1 {
+		return nil, fmt.Errorf("invalid saved ring parameters (%d, %d)", replicationFactor, virtualNodeCount)
+	}
+	ring, err := newHashRing(hashFunc, int(replicationFactor), int(virtualNodeCount), opts, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Insert all nodes to the (yet unpublished) state of the new ring, and
+	// sort its virtual nodes only once, in the end.
+	state := ring.state.Load().(*hashRingState)
+	removedVNIDs := make(map[Node][]uint16)
+	numNodes, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the number of nodes: %v", err)
+	}
+	for i := uint64(0); i < numNodes; i++ {
+		node, err := readString(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read node #%d: %v", i, err)
+		}
+		vnodeCount, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the vnode count of node %q: %v", node, err)
+		}
+		if vnodeCount < 1 || vnodeCount > (1<<16)-1 {
+			return nil, fmt.Errorf("invalid vnode count %d of node %q", vnodeCount, node)
+		}
+		draining, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the draining flag of node %q: %v", node, err)
+		}
+		if _, err := state.insertNode(Node(node), uint16(vnodeCount)); err != nil {
+			return nil, err
+		}
+		if draining != 0 {
+			state.draining[Node(node)] = struct{}{}
+		}
+		if version >= 3 {
+			vnids, err := readRemovedVNIDs(br, int(vnodeCount))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the removed vnids of node %q: %v", node, err)
+			}
+			if len(vnids) > 0 {
+				removedVNIDs[Node(node)] = vnids
+			}
+		}
+	}
+	state.sortVirtualNodes()
+	for node, vnids := range removedVNIDs {
+		if err := state.removeVNIDs(node, vnids); err != nil {
+			return nil, err
+		}
+	}
+	state.fixReplicaOwners()
+	return ring, nil
+}
+
+// readRemovedVNIDs reads the vnids of the virtual nodes of a distinct node with
+// the given vnode count that have been removed individually, checking that they
+// are sorted and that none of them is the highest vnid of the node.
+func readRemovedVNIDs(br *bufio.Reader, vnodeCount int) ([]uint16, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if n >= uint64(vnodeCount) {
+		return nil, fmt.Errorf("count %d too large", n)
+	}
+	ret := make([]uint16, n)
+	for i := range ret {
+		vnid, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		if vnid >= uint64(vnodeCount-1) || (i > 0 && vnid <= uint64(ret[i-1])) {
+			return nil, fmt.Errorf("invalid vnid %d", vnid)
+		}
+		ret[i] = uint16(vnid)
+	}
+	return ret, nil
+}
+
+// readString reads a uvarint length from the given bufio.Reader, followed by
+// that many bytes, and returns the latter as a string.
+func readString(br *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return "", err
+	}
+	if n > maxPersistedNodeLen {
+		return "", fmt.Errorf("length %d too large", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
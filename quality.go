@@ -0,0 +1,134 @@
+// Copyright 2018 Christos Katsakioris
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lfchring
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+)
+
+const (
+	// qualityBuckets is the number of equal-width buckets that the keyspace
+	// is split into by CheckHashQuality.
+	qualityBuckets = 256
+
+	// qualityMinExpected is the minimum expected number of samples per
+	// bucket, below which the chi-square test is not reliable.
+	qualityMinExpected = 5
+
+	// qualitySeed seeds the generator of the random inputs that are hashed
+	// by CheckHashQuality, so that its results are reproducible.
+	qualitySeed = 1
+
+	// qualityInputLen is the length of the random inputs that are hashed by
+	// CheckHashQuality.
+	qualityInputLen = 16
+
+	// qualityZ is the standard normal quantile for a significance level of
+	// 0.001, at which CheckHashQuality rejects uniformity.
+	qualityZ = 3.090232
+)
+
+// HashQualityReport holds the results of CheckHashQuality, i.e. metrics of how
+// uniformly a hash function distributes its outputs across the keyspace.
+type HashQualityReport struct {
+	// Samples is the number of random inputs that were hashed.
+	Samples int
+
+	// Buckets is the number of equal-width buckets of the keyspace that the
+	// outputs of the hash function were binned into.
+	Buckets int
+
+	// ChiSquare is Pearson's chi-square statistic of the bucket counts,
+	// against the uniform distribution.
+	ChiSquare float64
+
+	// ChiSquareCritical is the critical value of the chi-square statistic
+	// (for Buckets-1 degrees of freedom, at a significance level of 0.001),
+	// above which the distribution is considered not uniform.
+	ChiSquareCritical float64
+
+	// MaxBucketDeviation is the largest relative deviation of any bucket's
+	// count from the expected (uniform) count, e.g. 0.1 for 10%.
+	MaxBucketDeviation float64
+
+	// Uniform is true if ChiSquare does not exceed ChiSquareCritical.
+	Uniform bool
+}
+
+// CheckHashQuality hashes the given number of (pseudo-)random inputs with the
+// given hash function, bins the outputs into equal-width buckets across the
+// keyspace, and reports how uniform their distribution is. It may be used to
+// reject a poor hash function before constructing a ring with it, since the
+// ring's balance depends on it.
+//
+// The inputs are generated from a fixed seed, so that the results for the same
+// hash function and number of samples are reproducible. It returns a non-nil
+// error if hashFunc is nil or produces outputs of varying (or zero) length, or
+// if samples are too few for the chi-square test to be reliable.
+func CheckHashQuality(hashFunc func([]byte) []byte, samples int) (HashQualityReport, error) {
+	if hashFunc == nil {
+		return HashQualityReport{}, fmt.Errorf("hashFunc cannot be nil")
+	}
+	if samples < qualityBuckets*qualityMinExpected {
+		return HashQualityReport{}, fmt.Errorf("samples value %d less than %d", samples, qualityBuckets*qualityMinExpected)
+	}
+
+	rnd := rand.New(rand.NewSource(qualitySeed))
+	input := make([]byte, qualityInputLen)
+	counts := make([]int, qualityBuckets)
+	width := -1
+	bucket := new(big.Int)
+	for i := 0; i < samples; i++ {
+		rnd.Read(input)
+		output := hashFunc(input)
+		if width == -1 {
+			width = len(output)
+		}
+		if len(output) == 0 || len(output) != width {
+			return HashQualityReport{}, fmt.Errorf("hashFunc output of length %d; expected non-zero length %d", len(output), width)
+		}
+		// The bucket of the output is floor(position * buckets / keyspace).
+		bucket.Mul(keyPosition(output, width), big.NewInt(qualityBuckets))
+		bucket.Rsh(bucket, uint(8*width))
+		counts[bucket.Int64()]++
+	}
+
+	expected := float64(samples) / qualityBuckets
+	report := HashQualityReport{
+		Samples:           samples,
+		Buckets:           qualityBuckets,
+		ChiSquareCritical: chiSquareCritical(qualityBuckets - 1),
+	}
+	for _, count := range counts {
+		diff := float64(count) - expected
+		report.ChiSquare += diff * diff / expected
+		if dev := math.Abs(diff) / expected; dev > report.MaxBucketDeviation {
+			report.MaxBucketDeviation = dev
+		}
+	}
+	report.Uniform = report.ChiSquare <= report.ChiSquareCritical
+	return report, nil
+}
+
+// chiSquareCritical approximates the critical value of the chi-square
+// distribution with the given degrees of freedom, at the significance level
+// that corresponds to qualityZ, using the Wilson-Hilferty transformation.
+func chiSquareCritical(df int) float64 {
+	k := 2 / (9 * float64(df))
+	return float64(df) * math.Pow(1-k+qualityZ*math.Sqrt(k), 3)
+}
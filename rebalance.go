@@ -0,0 +1,293 @@
+// Copyright 2018 Christos Katsakioris
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lfchring
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrRebalanceCanceled is returned by RebalanceJob.Wait when the job has been
+// canceled before bringing the ring to its target.
+var ErrRebalanceCanceled = errors.New("rebalance canceled")
+
+// RebalanceJob brings a ring to the membership of a target ring in the
+// background, a batch of distinct nodes at a time, as started by
+// StartRebalance.
+type RebalanceJob struct {
+	ring    *HashRing
+	move    func(Migration) error
+	steps   []rebalanceStep
+	batches [][]rebalanceStep
+
+	// batchSize is the maximum number of distinct nodes per batch, and
+	// interval is the pause between consecutive batches (see
+	// WithRebalanceThrottle).
+	batchSize int
+	interval  time.Duration
+
+	// completed is the number of steps that have been completed, accessed
+	// atomically.
+	completed int64
+
+	cancel     chan struct{}
+	cancelOnce sync.Once
+	done       chan struct{}
+	err        error
+}
+
+// rebalanceStep is a single step of a RebalanceJob, i.e. the insertion of a
+// distinct node (with the given number of virtual nodes) or its removal.
+type rebalanceStep struct {
+	node       Node
+	inserting  bool
+	vnodeCount int
+
+	// removedVNIDs are the vnids of the virtual nodes of the node that
+	// have been removed individually in the target ring, if inserting.
+	removedVNIDs []uint16
+}
+
+// RebalanceOption configures a RebalanceJob, as started by StartRebalance.
+type RebalanceOption func(*RebalanceJob)
+
+// WithRebalanceThrottle configures the job to insert (or remove) up to
+// batchSize distinct nodes per batch, rather than one, and to pause for the
+// given interval between consecutive batches, so that the migrations are
+// spread over time. Non-positive values leave the defaults (i.e. one node per
+// batch, without pauses) in place.
+func WithRebalanceThrottle(batchSize int, interval time.Duration) RebalanceOption {
+	return func(job *RebalanceJob) {
+		if batchSize > 0 {
+			job.batchSize = batchSize
+		}
+		if interval > 0 {
+			job.interval = interval
+		}
+	}
+}
+
+// StartRebalance starts bringing the ring to the membership of the target ring
+// in the background, and returns the RebalanceJob that does so. The job works
+// in batches of distinct nodes (one each, unless configured otherwise through
+// WithRebalanceThrottle), inserting all nodes of the target ring that are
+// missing from the ring first (so that capacity is added before any is taken
+// away), and then removing the ones that are not in the target ring. For each
+// batch, it calls move for each one of the migrations that the batch causes,
+// and it only advances the live state of the ring once all of them have
+// returned successfully; the next batch starts only after that (and after the
+// configured pause, if any).
+//
+// The job stops at the first batch that fails, leaving the ring at the state
+// that the last successful batch led to: if move returns a non-nil error, or if
+// the ring is modified by another writer in the meantime (ErrStaleGeneration).
+// While a batch is in progress, the job holds the lock among the writers of the
+// ring, if any (see WithSynchronizedWriters), so that other writers wait for
+// it instead; otherwise, the generation of the ring is checked again before
+// each call to move, so that no data are moved for a stale batch. Either way,
+// move must not modify the ring itself. Only the membership of the target ring
+// (including the number of virtual nodes of each node) is pursued; the rest of
+// its configuration is not.
+//
+// It returns a non-nil error, without starting the job, if the hash functions
+// of the rings are known to differ, if their replication factors differ, or
+// if any distinct node is a member of both rings with different virtual nodes
+// (e.g. a different number of them).
+func (r *HashRing) StartRebalance(target *HashRing, move func(Migration) error, opts ...RebalanceOption) (*RebalanceJob, error) {
+	if move == nil {
+		return nil, fmt.Errorf("move cannot be nil")
+	}
+	state, targetState := r.state.Load().(*hashRingState), target.state.Load().(*hashRingState)
+	if err := state.checkHashCompatible(targetState); err != nil {
+		return nil, err
+	}
+	if state.replicationFactor != targetState.replicationFactor {
+		return nil, fmt.Errorf("replication factors %d and %d differ", state.replicationFactor, targetState.replicationFactor)
+	}
+	job := &RebalanceJob{
+		ring:      r,
+		move:      move,
+		steps:     make([]rebalanceStep, 0),
+		batchSize: 1,
+		cancel:    make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(job)
+	}
+	for _, node := range targetState.nodes() {
+		if !state.hasNode(node) {
+			job.steps = append(job.steps, rebalanceStep{
+				node:         node,
+				inserting:    true,
+				vnodeCount:   targetState.vnodeCounts[node],
+				removedVNIDs: targetState.sortedRemovedVNIDs(node),
+			})
+		} else if state.vnodeCounts[node] != targetState.vnodeCounts[node] ||
+			!sameVNIDs(state.sortedRemovedVNIDs(node), targetState.sortedRemovedVNIDs(node)) {
+			return nil, fmt.Errorf("node %q has different virtual nodes (%d) in the target ring (%d)",
+				node, state.numVirtualNodes(node), targetState.numVirtualNodes(node))
+		}
+	}
+	inserts := len(job.steps)
+	for _, node := range state.nodes() {
+		if !targetState.hasNode(node) {
+			job.steps = append(job.steps, rebalanceStep{node: node})
+		}
+	}
+	// Insertions and removals are never mixed in the same batch.
+	for _, steps := range [][]rebalanceStep{job.steps[:inserts], job.steps[inserts:]} {
+		for len(steps) > 0 {
+			n := job.batchSize
+			if n > len(steps) {
+				n = len(steps)
+			}
+			job.batches = append(job.batches, steps[:n])
+			steps = steps[n:]
+		}
+	}
+	go job.run(state.generation)
+	return job, nil
+}
+
+// run performs the batches of the job one by one, starting off from the given
+// generation of the ring.
+func (job *RebalanceJob) run(gen uint64) {
+	defer close(job.done)
+	for i, batch := range job.batches {
+		if i > 0 && job.interval > 0 {
+			select {
+			case <-job.cancel:
+				job.err = ErrRebalanceCanceled
+				return
+			case <-time.After(job.interval):
+			}
+		}
+		select {
+		case <-job.cancel:
+			job.err = ErrRebalanceCanceled
+			return
+		default:
+		}
+		newState, err := job.runBatch(batch, gen)
+		if err != nil {
+			job.err = err
+			return
+		}
+		gen = newState.generation
+		atomic.AddInt64(&job.completed, int64(len(batch)))
+	}
+}
+
+// runBatch performs the given batch of steps (either all insertions or all
+// removals) of the job, provided that the ring is at the given generation, and
+// returns the new state of the ring.
+func (job *RebalanceJob) runBatch(batch []rebalanceStep, gen uint64) (*hashRingState, error) {
+	defer job.ring.lockWriters()()
+	oldState := job.ring.state.Load().(*hashRingState)
+	if oldState.generation != gen {
+		return nil, ErrStaleGeneration
+	}
+	newState := oldState.derive()
+	if newState.generation == oldState.generation {
+		return nil, ErrGenerationOverflow
+	}
+	nodes := make([]Node, len(batch))
+	for i := range batch {
+		nodes[i] = batch[i].node
+	}
+	if batch[0].inserting {
+		total := len(newState.virtualNodes)
+		for _, step := range batch {
+			total += step.vnodeCount
+		}
+		if err := newState.checkCapacity(total); err != nil {
+			return nil, err
+		}
+		for _, step := range batch {
+			if _, err := newState.insertNode(step.node, uint16(step.vnodeCount)); err != nil {
+				return nil, err
+			}
+		}
+		newState.sortVirtualNodes()
+		for _, step := range batch {
+			if err := newState.removeVNIDs(step.node, step.removedVNIDs); err != nil {
+				return nil, err
+			}
+		}
+		newState.fixReplicaOwners()
+	} else if _, err := newState.remove(nodes...); err != nil {
+		return nil, err
+	}
+
+	for _, mig := range migrations(oldState, newState) {
+		// Do not move any data for a batch that has gone stale.
+		if job.ring.state.Load().(*hashRingState) != oldState {
+			return nil, ErrStaleGeneration
+		}
+		if err := job.move(mig); err != nil {
+			return nil, fmt.Errorf("failed to move %x-%x for nodes %q: %v", mig.Lo, mig.Hi, nodes, err)
+		}
+	}
+	// Atomically replace the current state with the new one, only if it
+	// has not been replaced by another writer in the meantime.
+	if !job.ring.state.CompareAndSwap(oldState, newState) {
+		return nil, ErrStaleGeneration
+	}
+	job.ring.record(newState)
+	job.ring.notify(oldState, newState)
+	return newState, nil
+}
+
+// Progress returns the fraction of the distinct nodes of the job that have been
+// inserted or removed so far (i.e. in completed batches), in [0, 1].
+func (job *RebalanceJob) Progress() float64 {
+	if len(job.steps) == 0 {
+		return 1
+	}
+	return float64(atomic.LoadInt64(&job.completed)) / float64(len(job.steps))
+}
+
+// Cancel makes the job stop before its next batch; any batch in progress is
+// completed first. It is safe to call it more than once, or after the job has
+// finished.
+func (job *RebalanceJob) Cancel() {
+	job.cancelOnce.Do(func() { close(job.cancel) })
+}
+
+// Wait blocks until the job has finished, and returns nil if the ring has been
+// brought to its target, ErrRebalanceCanceled if the job has been canceled
+// before that, or the error that made the job stop otherwise.
+func (job *RebalanceJob) Wait() error {
+	<-job.done
+	return job.err
+}
+
+// sameVNIDs returns true if the two slices of vnids are equal, or false
+// otherwise.
+func sameVNIDs(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
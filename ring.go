@@ -25,11 +25,23 @@
 package lfchring
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"math"
+	"math/big"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"text/tabwriter"
 )
 
 // Node represents a single distinct node in the ring.
@@ -40,17 +52,25 @@ type VirtualNode struct {
 	name []byte
 	node Node
 	vnid uint16
+
+	// lazy computes (and caches) the name of the virtual node on demand,
+	// for rings configured through WithLazyNames; otherwise, it is nil
+	// and the name is stored in the virtual node.
+	lazy *lazyNames
 }
 
 // String returns a representation of the VirtualNode in a print-friendly
 // format.
 func (vn *VirtualNode) String() string {
-	return fmt.Sprintf("%x (%q, %d)", vn.name, vn.node, vn.vnid)
+	return fmt.Sprintf("%x (%q, %d)", vn.Name(), vn.node, vn.vnid)
 }
 
 // Name returns the "name" of the virtual node as it appears on the ring (i.e.
 // as a key in the key space that the ring operates on).
 func (vn *VirtualNode) Name() []byte {
+	if vn.lazy != nil {
+		return vn.lazy.name(vn.node, vn.vnid)
+	}
 	return vn.name
 }
 
@@ -60,6 +80,39 @@ func (vn *VirtualNode) Node() Node {
 	return vn.node
 }
 
+// OwnerSet is a read-only set of the distinct nodes that own a key. It allows
+// for cheap membership testing, without exposing (and thus risking the
+// modification of) the ring's underlying slice of replica owners.
+type OwnerSet struct {
+	owners []Node
+}
+
+// Contains returns true if the given node is one of the owners in the set, or
+// false otherwise.
+//
+// Complexity: O( replicationFactor )
+func (os OwnerSet) Contains(node Node) bool {
+	for _, owner := range os.owners {
+		if owner == node {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of the owners in the set.
+func (os OwnerSet) Len() int {
+	return len(os.owners)
+}
+
+// Nodes returns a newly allocated slice of the owners in the set, in the same
+// order as they would be returned by NodesForKey.
+func (os OwnerSet) Nodes() []Node {
+	ret := make([]Node, len(os.owners))
+	copy(ret, os.owners)
+	return ret
+}
+
 // HashRing is a lock-free consistent hashing ring entity, designed for
 // frequent reads by multiple readers and infrequent updates by one single
 // writer. In addition, it features efficient support of virtual ring nodes per
@@ -70,126 +123,1325 @@ type HashRing struct {
 	// *hashRingState. Its use is what makes this implementation of the
 	// consistent hashing ring concurrent data structure lock-free. Note
 	// however that this only works for a single writer. For multiple
-	// writers, an additional mutex among them would be needed.
+	// writers, an additional mutex among them is needed (see
+	// WithSynchronizedWriters).
 	state atomic.Value
 
-	// hash is the hash function used for all supported consistent hashing
-	// ring functionality and operations.
-	hash func([]byte) []byte
+	// writers is the mutex among multiple writers of the ring, if it has
+	// been configured through WithSynchronizedWriters; otherwise, it is
+	// nil. Readers never lock it.
+	writers *sync.Mutex
+
+	// hash is the hash function used for all supported consistent hashing
+	// ring functionality and operations.
+	hash func([]byte) []byte
+
+	// history is an atomic.Value meant to hold values of type
+	// *stateHistory, i.e. the last historyDepth states of the ring
+	// (including the current one). It is only maintained if historyDepth
+	// is positive.
+	history      atomic.Value
+	historyDepth int
+
+	// subscribers are the subscribers of the ring (see Subscribe), which
+	// are notified of its modifications; subscribersMu protects them.
+	subscribers   map[*subscription]struct{}
+	subscribersMu sync.Mutex
+}
+
+// NewHashRing returns a new HashRing, properly initialized based on the given
+// parameters, or a non-nil error value if the parameters are invalid.
+//
+// An arbitrary number of nodes may optionally be inserted to the new ring
+// during the initialization through parameter `nodes` (hence, NewHashRing is a
+// variadic function).
+func NewHashRing(hashFunc func([]byte) []byte, replicationFactor, virtualNodeCount int, nodes ...Node) (*HashRing, error) {
+	if len(nodes) == 0 {
+		return newHashRing(hashFunc, replicationFactor, virtualNodeCount, nil, nil)
+	}
+	return newHashRing(hashFunc, replicationFactor, virtualNodeCount, nil, func(s *hashRingState) error {
+		_, err := s.insert(nodes...)
+		return err
+	})
+}
+
+// NewHashRingWithOptions returns a new, empty HashRing, properly initialized
+// based on the given parameters and configured by the given Options, or a
+// non-nil error value if the parameters are invalid.
+func NewHashRingWithOptions(hashFunc func([]byte) []byte, replicationFactor, virtualNodeCount int, opts ...Option) (*HashRing, error) {
+	return newHashRing(hashFunc, replicationFactor, virtualNodeCount, opts, nil)
+}
+
+// newHashRing implements both NewHashRing and NewHashRingWithOptions. If
+// populate is not nil, it is called to fill the initial state of the ring
+// before it is committed.
+func newHashRing(hashFunc func([]byte) []byte, replicationFactor, virtualNodeCount int, opts []Option, populate func(*hashRingState) error) (*HashRing, error) {
+	if hashFunc == nil {
+		return nil, fmt.Errorf("hashFunc cannot be nil")
+	}
+	if replicationFactor < 1 || replicationFactor > (1<<16)-1 {
+		return nil, fmt.Errorf("replicationFactor value %d not in (0, %d)", replicationFactor, 1<<16)
+	}
+	if virtualNodeCount < 1 || virtualNodeCount > (1<<16)-1 {
+		return nil, fmt.Errorf("virtualNodeCount value %d not in (0, %d)", virtualNodeCount, 1<<16)
+	}
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.minRacks != 0 || o.rackOf != nil {
+		if o.rackOf == nil {
+			return nil, fmt.Errorf("rackOf cannot be nil")
+		}
+		if o.minRacks < 1 || o.minRacks > replicationFactor {
+			return nil, fmt.Errorf("minRacks value %d not in (0, %d]", o.minRacks, replicationFactor)
+		}
+		if o.duplicateOwners {
+			return nil, fmt.Errorf("duplicate owners cannot be combined with a rack constraint")
+		}
+	}
+
+	newState := &hashRingState{
+		hash:                 hashFunc,
+		hashName:             o.hashName,
+		virtualNodeCount:     uint16(virtualNodeCount),
+		replicationFactor:    uint16(replicationFactor),
+		virtualNodes:         make([]*VirtualNode, 0),
+		withoutReplicaOwners: o.withoutReplicaOwners,
+		duplicateOwners:      o.duplicateOwners,
+		draining:             make(map[Node]struct{}),
+		vnodeCounts:          make(map[Node]int),
+		removedVNIDs:         make(map[Node]map[uint16]struct{}),
+		rackOf:               o.rackOf,
+		minRacks:             o.minRacks,
+		tieBreakHash:         o.tieBreakHash,
+		streamingHash:        o.streamingHash,
+		virtualNodeKey:       defaultVirtualNodeKey,
+		generation:           o.initialGeneration,
+	}
+	if o.streamingHash != nil {
+		// Make sure that both hash functions agree, at least on a probe.
+		probe := []byte("lfchring")
+		h := o.streamingHash()
+		h.Write(probe)
+		if !bytes.Equal(h.Sum(nil), hashFunc(probe)) {
+			return nil, fmt.Errorf("streaming hash function disagrees with the ring's hash function")
+		}
+	}
+	if o.virtualNodeKey != nil {
+		newState.virtualNodeKey = o.virtualNodeKey
+		newState.customNaming = true
+	}
+	if o.compare != nil {
+		if err := checkComparator(o.compare, hashFunc); err != nil {
+			return nil, err
+		}
+		newState.compare = o.compare
+	}
+	if o.lazyNames {
+		newState.lazyNames = newLazyNames(hashFunc, newState.virtualNodeKey, lazyNamesCapacity)
+	}
+	if o.internNodes {
+		newState.interned = make(map[Node]Node)
+	}
+	if err := newState.checkCapacity(virtualNodeCount); err != nil {
+		return nil, err
+	}
+	if populate != nil {
+		if err := populate(newState); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.historyDepth < 0 {
+		return nil, fmt.Errorf("history depth value %d is negative", o.historyDepth)
+	}
+	if o.keyCacheSize < 0 {
+		return nil, fmt.Errorf("key cache size value %d is negative", o.keyCacheSize)
+	} else if o.keyCacheSize > 0 {
+		newState.keyCache = newKeyCache(o.keyCacheSize)
+	}
+
+	ring := &HashRing{hash: hashFunc, historyDepth: o.historyDepth}
+	if o.synchronizedWriters {
+		ring.writers = &sync.Mutex{}
+	}
+	ring.commit(newState)
+
+	return ring, nil
+}
+
+// Clone allocates, initializes and returns a new ring, which is a deep copy of
+// the original.
+func (r *HashRing) Clone() *HashRing {
+	oldState := r.state.Load().(*hashRingState)
+	newState := oldState.derive()
+	newState.generation = oldState.generation
+	newState.fixReplicaOwners()
+	newRing := &HashRing{hash: newState.hash, historyDepth: r.historyDepth}
+	if r.writers != nil {
+		newRing.writers = &sync.Mutex{}
+	}
+	newRing.commit(newState)
+	return newRing
+}
+
+// unlockNothing is returned by lockWriters for rings whose writers are not
+// synchronized.
+func unlockNothing() {}
+
+// lockWriters locks the mutex among the writers of the ring, if the ring has
+// been configured through WithSynchronizedWriters, and returns the function
+// that unlocks it. It is meant to be called (and the returned function to be
+// deferred) by all methods that modify the ring, before they load its current
+// state.
+func (r *HashRing) lockWriters() func() {
+	if r.writers == nil {
+		return unlockNothing
+	}
+	r.writers.Lock()
+	return r.writers.Unlock
+}
+
+// commit makes the given state the current state of the ring, recording it in
+// ring's history (if maintained) and notifying ring's subscribers as well. It
+// returns ErrGenerationOverflow (and the ring is left untouched) if the given
+// state does not advance the generation of the current one; it never fails for
+// a new ring, which has no current state yet.
+func (r *HashRing) commit(newState *hashRingState) error {
+	oldState, _ := r.state.Load().(*hashRingState)
+	if oldState != nil && newState.generation <= oldState.generation {
+		return ErrGenerationOverflow
+	}
+	r.record(newState)
+	r.state.Store(newState) // <-- Atomically replace the current state
+	// with the new one. At this point all new readers start working with
+	// the new state. The old state will be garbage collected once the
+	// existing readers (if any) are done with it (and once it is evicted
+	// from ring's history).
+	r.notify(oldState, newState)
+	return nil
+}
+
+// Validate checks the consistency of the current state of the ring, i.e. that
+// its virtual nodes are sorted and accounted for, and that the replica owners
+// of each one of them are correct, and it returns a non-nil error describing
+// the first inconsistency found, if any.
+//
+// For rings configured through WithRackConstraint, it also verifies that the
+// replica owners of each virtual node span the required number of racks.
+//
+// Complexity: O( (V*N)*R )
+func (r *HashRing) Validate() error {
+	return r.state.Load().(*hashRingState).validate()
+}
+
+// Warnings returns human-readable descriptions of the conditions under which
+// the current state of the ring cannot satisfy its configuration, and which
+// are otherwise silent, e.g. a replication factor greater than the number of
+// distinct nodes, a ring where the removal of any node would leave too few of
+// them for the replication factor, arcs whose replica owners do not span the
+// racks required by WithRackConstraint, or arcs whose replica owners include
+// duplicates (see WithAllowDuplicateOwners). It returns nil if there are no
+// such conditions.
+//
+// Unlike Validate, which detects inconsistencies of the ring itself, the
+// warnings describe a ring that is consistent, yet less durable than its
+// configuration suggests.
+//
+// Complexity: O( (V*N)*R )
+func (r *HashRing) Warnings() []string {
+	return r.state.Load().(*hashRingState).warnings()
+}
+
+// RepairOwners rebuilds the replica owners of all virtual nodes of the ring
+// from scratch, by walking the ring, and returns the number of entries that
+// had to be added, removed or replaced, e.g. to heal a ring whose replica
+// owners have become inconsistent with its virtual nodes after a bad restore.
+// If none had to, the ring is left untouched. It complements Validate, which
+// only detects such inconsistencies.
+//
+// It returns a non-nil error, leaving the ring untouched, if the virtual nodes
+// of the ring themselves are inconsistent, since they cannot be repaired.
+//
+// Complexity: O( (V*N)*R )
+func (r *HashRing) RepairOwners() (int, error) {
+	defer r.lockWriters()()
+	oldState := r.state.Load().(*hashRingState)
+	if err := oldState.validateVirtualNodes(); err != nil {
+		return 0, err
+	}
+	if oldState.withoutReplicaOwners {
+		return 0, nil
+	}
+	newState := oldState.derive()
+	newState.fixReplicaOwners()
+
+	repaired := 0
+	for i := range newState.replicaOwners {
+		if i >= len(oldState.replicaOwners) || !sameNodes(oldState.replicaOwners[i], newState.replicaOwners[i]) {
+			repaired++
+		}
+	}
+	if len(oldState.replicaOwners) > len(newState.replicaOwners) {
+		repaired += len(oldState.replicaOwners) - len(newState.replicaOwners)
+	}
+	if repaired > 0 {
+		if err := r.commit(newState); err != nil {
+			return 0, err
+		}
+	}
+	return repaired, nil
+}
+
+// Size returns the number of *distinct* nodes in the ring, in its current
+// state.
+func (r *HashRing) Size() int {
+	return r.state.Load().(*hashRingState).size()
+}
+
+// Nodes returns a newly allocated slice of the distinct nodes of the ring, in
+// its current state, sorted in increasing order.
+//
+// Complexity: O( V*N )
+func (r *HashRing) Nodes() []Node {
+	return r.state.Load().(*hashRingState).nodes()
+}
+
+// OwnerIndicesForKey is like NodesForKey, but it returns the replica owners of
+// the given key as indices into the slice of distinct nodes that Nodes returns,
+// appending them to dst[:0] (which is grown if needed) rather than allocating a
+// new slice, e.g. for allocation-free lookups on a hot path, where the caller
+// maps the indices to nodes itself. The indices only refer to the slice that
+// Nodes returns for the same state of the ring; callers should fetch it anew
+// whenever the Generation of the ring changes. Any fallback node (see
+// SetFallback), which is not a member of the ring, is not included.
+//
+// Complexity: O( log(V*N) )
+func (r *HashRing) OwnerIndicesForKey(key []byte, dst []int) []int {
+	state := r.state.Load().(*hashRingState)
+	dst = dst[:0]
+	if len(state.virtualNodes) == 0 {
+		return dst
+	}
+	for _, owner := range state.readNodesForKey(key) {
+		dst = append(dst, state.indexOfNode(owner))
+	}
+	return dst
+}
+
+// NodeSet returns the distinct nodes of the ring, in its current state, as a
+// newly allocated set, which the caller may freely modify, e.g. to cheaply
+// compare the membership of two rings.
+//
+// Complexity: O( N )
+func (r *HashRing) NodeSet() map[Node]struct{} {
+	state := r.state.Load().(*hashRingState)
+	ret := make(map[Node]struct{}, state.size())
+	for node := range state.vnodeCounts {
+		ret[node] = struct{}{}
+	}
+	return ret
+}
+
+// NodeVNodeCounts returns a map from each distinct node of the ring to the
+// number of its virtual nodes, in the current state of the ring. The counts are
+// gathered from the virtual nodes themselves, so they also reflect any virtual
+// nodes that have been removed individually (e.g. through ReduceWeight).
+//
+// Complexity: O( V*N )
+func (r *HashRing) NodeVNodeCounts() map[Node]int {
+	state := r.state.Load().(*hashRingState)
+	ret := make(map[Node]int, state.size())
+	for _, vn := range state.virtualNodes {
+		ret[vn.node]++
+	}
+	return ret
+}
+
+// VirtualNodesForNode returns the virtual nodes of the given distinct node in
+// the current state of the ring, in the order in which they appear on the ring,
+// or an empty slice if the node is not a member of the ring.
+//
+// Rather than walking the whole ring, each one of the node's virtual nodes is
+// looked up by its name, much like when the node is removed.
+//
+// Complexity: O( vnodeCount*log(V*N) )
+func (r *HashRing) VirtualNodesForNode(node Node) []*VirtualNode {
+	return r.state.Load().(*hashRingState).virtualNodesOf(node)
+}
+
+// HashName returns the identifier of ring's hash function, as configured
+// through the WithHashName Option, or an empty string if it is unidentified.
+func (r *HashRing) HashName() string {
+	return r.state.Load().(*hashRingState).hashName
+}
+
+// CheckHashCompatible returns a non-nil error if the hash functions of the two
+// rings are known to differ, i.e. if both of them have been identified (through
+// the WithHashName Option) by different names. Rings with unidentified hash
+// functions are always considered compatible.
+func (r *HashRing) CheckHashCompatible(other *HashRing) error {
+	return r.state.Load().(*hashRingState).checkHashCompatible(other.state.Load().(*hashRingState))
+}
+
+// RoutingAgrees returns true if both rings currently return identical replica
+// owners (as NodesForKey does) for all of the given sample keys; otherwise, it
+// returns false along with the first sample key that they disagree on. Unlike
+// comparing the membership of the rings, this also catches rings that place
+// their virtual nodes differently, e.g. because of different hash functions.
+//
+// Complexity: O( K*log(V*N) )
+func RoutingAgrees(a, b *HashRing, sampleKeys [][]byte) (bool, []byte) {
+	aState, bState := a.state.Load().(*hashRingState), b.state.Load().(*hashRingState)
+	for _, key := range sampleKeys {
+		if !sameNodes(aState.nodesForKey(key), bState.nodesForKey(key)) {
+			return false, key
+		}
+	}
+	return true, nil
+}
+
+// Equal returns true if the current states of the two rings are equal, i.e. if
+// they have the same replication factor, default number of virtual nodes per
+// distinct node, distinct nodes, and virtual nodes (in the same order), with
+// identical replica owners; otherwise, it returns false. The hash functions of
+// the rings cannot be compared directly, hence they are only taken into
+// account through the positions of the virtual nodes; the generations of the
+// rings are not taken into account either.
+//
+// Complexity: O( V*N )
+func (r *HashRing) Equal(other *HashRing) bool {
+	return r.state.Load().(*hashRingState).equal(other.state.Load().(*hashRingState))
+}
+
+// Checksum returns a SHA-256 checksum of the current state of the ring, i.e. of
+// its replication factor, its default number of virtual nodes per distinct
+// node, and its virtual nodes (names, distinct nodes and vnids) in ring order
+// along with their replica owners, e.g. for replicas of the ring to detect
+// that their views have diverged. It is deterministic and independent of the
+// order in which nodes have been inserted, hence rings that are Equal have
+// equal checksums. Like Equal, it does not take the generation of the ring
+// into account.
+//
+// The checksum is computed once per state of the ring, on first use; further
+// calls return it without computing it again (or allocating), until the ring
+// is modified.
+//
+// Complexity: O( (V*N)*R ), or O( 1 ) once computed
+func (r *HashRing) Checksum() [sha256.Size]byte {
+	return r.state.Load().(*hashRingState).computeChecksum()
+}
+
+// Generation returns the generation of the current state of the ring, i.e. a
+// number that is incremented every time the ring is modified. A new ring starts
+// off at generation 0, unless configured otherwise through
+// WithInitialGeneration, and a clone of a ring starts off at the same
+// generation as the original. The generation never wraps around: once it has
+// reached math.MaxUint64, modifications fail with ErrGenerationOverflow.
+func (r *HashRing) Generation() uint64 {
+	return r.state.Load().(*hashRingState).generation
+}
+
+// String returns the slice of virtual nodes of the current state of the ring,
+// along with their replica owners, as a "print-friendly" string.
+func (r *HashRing) String() string {
+	state := r.state.Load().(*hashRingState)
+	ret := bytes.Buffer{}
+	for i, vn := range state.virtualNodes {
+		if _, err := ret.WriteString(fmt.Sprintf("%d.  %s  =>  %q\n", i, vn, state.owners(i))); err != nil {
+			return "Ring too large to be represented in a string."
+		}
+	}
+	return ret.String()
+}
+
+// ExplainKeys returns a print-friendly table which shows, for each one of the
+// given keys, the virtual node that it is assigned to and its replica owners,
+// in the current state of the ring. It is meant to help with diagnosing the
+// placement of specific keys.
+func (r *HashRing) ExplainKeys(keys [][]byte) string {
+	state := r.state.Load().(*hashRingState)
+	ret := bytes.Buffer{}
+	w := tabwriter.NewWriter(&ret, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tVIRTUAL NODE\tOWNERS")
+	for _, key := range keys {
+		if len(state.virtualNodes) == 0 {
+			fmt.Fprintf(w, "%x\t-\t[]\n", key)
+			continue
+		}
+		i := state.search(key)
+		fmt.Fprintf(w, "%x\t%s\t%q\n", key, state.virtualNodes[i], state.owners(i))
+	}
+	_ = w.Flush()
+	return ret.String()
+}
+
+// WriteCSV writes the arcs of the current state of the ring to the given
+// io.Writer in CSV format, for offline analysis by non-Go tooling. After a
+// header row, there is one row for each virtual node, with the following
+// columns: the start (exclusive) and the end (inclusive) of its arc in hex,
+// the length of the arc as a fraction of the keyspace, and the replica owners
+// of the arc in order, separated by semicolons. It returns ErrUnknownPositions
+// (and writes nothing) if the ring has been configured with a custom name
+// comparator, since the lengths of the arcs are then unknown.
+func (r *HashRing) WriteCSV(w io.Writer) error {
+	state := r.state.Load().(*hashRingState)
+	if !state.hasPositions() {
+		return ErrUnknownPositions
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"start", "end", "fraction", "owners"}); err != nil {
+		return err
+	}
+	if len(state.virtualNodes) > 0 {
+		fractions := state.arcFractions()
+		for i := range state.virtualNodes {
+			arc := state.arc(i)
+			owners := state.owners(i)
+			ownerStrs := make([]string, len(owners))
+			for j := range owners {
+				ownerStrs[j] = string(owners[j])
+			}
+			if err := cw.Write([]string{
+				hex.EncodeToString(arc.Lo),
+				hex.EncodeToString(arc.Hi),
+				strconv.FormatFloat(fractions[i], 'g', -1, 64),
+				strings.Join(ownerStrs, ";"),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteDOT writes the current state of the ring to the given io.Writer as a
+// Graphviz DOT graph, e.g. to be rendered via `circo -Tsvg`. There is a graph
+// node for each virtual node, labeled with its distinct node, its vnid, the
+// first bytes of its name and its replica owners, and an edge from each virtual
+// node to its successor on the ring. The virtual nodes of each distinct node
+// share a fill color. The whole graph describes a single state of the ring,
+// even if the ring is modified concurrently.
+func (r *HashRing) WriteDOT(w io.Writer) error {
+	state := r.state.Load().(*hashRingState)
+	bw := bufio.NewWriter(w)
+	bw.WriteString("digraph ring {\n")
+	fmt.Fprintf(bw, "\tlabel=\"generation %d, replication factor %d\";\n", state.generation, state.replicationFactor)
+	bw.WriteString("\tnode [shape=box, style=filled];\n")
+	size := state.size()
+	for i, vn := range state.virtualNodes {
+		owners := state.owners(i)
+		ownerStrs := make([]string, len(owners))
+		for j := range owners {
+			ownerStrs[j] = string(owners[j])
+		}
+		name := vn.Name()
+		if len(name) > 4 {
+			name = name[:4]
+		}
+		label := fmt.Sprintf("%s #%d\n%x\nowners: %s", vn.node, vn.vnid, name, strings.Join(ownerStrs, ", "))
+		hue := float64(state.indexOfNode(vn.node)) / float64(size)
+		fmt.Fprintf(bw, "\tv%d [label=%s, fillcolor=\"%.3f 0.4 1.0\"];\n", i, dotQuote(label), hue)
+	}
+	for i := range state.virtualNodes {
+		fmt.Fprintf(bw, "\tv%d -> v%d;\n", i, (i+1)%len(state.virtualNodes))
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// dotQuote returns the given label as a quoted DOT string, in which newlines
+// are turned into DOT line breaks.
+func dotQuote(label string) string {
+	label = strings.ReplaceAll(label, `\`, `\\`)
+	label = strings.ReplaceAll(label, `"`, `\"`)
+	label = strings.ReplaceAll(label, "\n", `\n`)
+	return `"` + label + `"`
+}
+
+// Insert is a variadic method to insert an arbitrary number of distinct nodes
+// (i.e. all their virtual nodes) to the ring.
+//
+// In the case that any already existing distinct nodes are attempted to be
+// re-inserted to the ring (or a node appears more than once in the batch),
+// Insert returns a *BatchError listing all of them, and the ring is left
+// untouched. Otherwise, the ring is modified as expected, and a slice of the
+// new virtual nodes (not sorted) is returned.
+func (r *HashRing) Insert(nodes ...Node) ([]*VirtualNode, error) {
+	defer r.lockWriters()()
+	oldState := r.state.Load().(*hashRingState)
+	newState := oldState.derive()
+	newVnodes, err := newState.insert(nodes...)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.commit(newState); err != nil {
+		return nil, err
+	}
+	return newVnodes, nil
+}
+
+// InsertWeighted is like Insert, but each one of the given distinct nodes is
+// inserted with weight*virtualNodeCount virtual nodes, rather than
+// virtualNodeCount, so that it owns (roughly) weight times the share of the
+// keyspace of a node inserted through Insert, e.g. for nodes with more
+// capacity than others. Insert is equivalent to InsertWeighted with a weight of
+// 1. Remove removes all virtual nodes of a node, regardless of its weight.
+//
+// It returns a non-nil error (and the ring is left untouched) if the weight is
+// not positive, if weight*virtualNodeCount exceeds the maximum number of
+// virtual nodes per node (i.e. 65535), or for the same reasons as Insert.
+func (r *HashRing) InsertWeighted(weight int, nodes ...Node) ([]*VirtualNode, error) {
+	defer r.lockWriters()()
+	oldState := r.state.Load().(*hashRingState)
+	newState := oldState.derive()
+	newVnodes, err := newState.insertWeighted(weight, nodes...)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.commit(newState); err != nil {
+		return nil, err
+	}
+	return newVnodes, nil
+}
+
+// ErrStaleGeneration is returned by conditional modifications of the ring,
+// when the ring is not at the generation that the modification was meant for.
+var ErrStaleGeneration = errors.New("stale ring generation")
+
+// ErrUnknownPositions is returned by the methods that measure the keyspace
+// (e.g. LargestArc), when the ring orders the names of its virtual nodes
+// through a custom comparator (see WithNameComparator), since the positions of
+// the keys on the ring (hence the lengths of its arcs) are then unknown.
+var ErrUnknownPositions = errors.New("positions of keys are unknown under a custom name comparator")
+
+// ErrGenerationOverflow is returned by the modifications of the ring once its
+// generation has reached math.MaxUint64, since it cannot be incremented any
+// further without wrapping around; the ring is left untouched.
+var ErrGenerationOverflow = errors.New("ring generation overflow")
+
+// BatchError is returned by the modifications of the ring that involve a batch
+// of distinct nodes (e.g. Insert and Remove), when one or more of the nodes in
+// the batch are invalid for the modification. It gathers one error for each
+// invalid node, sorted by node, so that all of them may be fixed at once.
+type BatchError struct {
+	Errs []error
+}
+
+// Error returns the messages of all errors in the BatchError, joined.
+func (e *BatchError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the errors in the BatchError, so that errors.Is and errors.As
+// (as of Go 1.20) may inspect each one of them.
+func (e *BatchError) Unwrap() []error {
+	return e.Errs
+}
+
+// InsertIfGeneration is like Insert, but the insertion takes place only if the
+// ring is (and remains, until the insertion is complete) at the given
+// generation; otherwise, ErrStaleGeneration is returned and the ring is left
+// untouched. This provides optimistic concurrency control to multiple
+// coordinators modifying the same ring.
+func (r *HashRing) InsertIfGeneration(gen uint64, nodes ...Node) ([]*VirtualNode, error) {
+	defer r.lockWriters()()
+	oldState := r.state.Load().(*hashRingState)
+	if oldState.generation != gen {
+		return nil, ErrStaleGeneration
+	}
+	newState := oldState.derive()
+	if newState.generation == oldState.generation {
+		return nil, ErrGenerationOverflow
+	}
+	newVnodes, err := newState.insert(nodes...)
+	if err != nil {
+		return nil, err
+	}
+	// Atomically replace the current state with the new one, only if it
+	// has not been replaced by another writer in the meantime.
+	if !r.state.CompareAndSwap(oldState, newState) {
+		return nil, ErrStaleGeneration
+	}
+	r.record(newState)
+	r.notify(oldState, newState)
+	return newVnodes, nil
+}
+
+// Remove is a variadic method to remove an arbitrary number of distinct nodes
+// (i.e. all their virtual nodes) from the ring.
+//
+// If any of the distinct nodes cannot be found in the ring (or a node appears
+// more than once in the batch), a *BatchError listing all of them is returned
+// and the ring is left untouched; otherwise the ring is modified as expected,
+// and a slice of the removed virtual nodes (not sorted) is returned.
+func (r *HashRing) Remove(nodes ...Node) ([]*VirtualNode, error) {
+	defer r.lockWriters()()
+	oldState := r.state.Load().(*hashRingState)
+	newState := oldState.derive()
+	removedVnodes, err := newState.remove(nodes...)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.commit(newState); err != nil {
+		return nil, err
+	}
+	return removedVnodes, nil
+}
+
+// Clear removes all distinct nodes (i.e. all their virtual nodes) from the
+// ring in a single modification, keeping its configuration (e.g. its hash
+// function, replication factor and number of virtual nodes per distinct node)
+// intact, and returns a slice of the removed virtual nodes (sorted). Readers
+// that are already working with the previous state of the ring finish with it
+// undisturbed; lookups that follow find the ring empty. It returns nil (and the
+// ring is left untouched) if the generation of the ring cannot be incremented
+// any further (see ErrGenerationOverflow).
+func (r *HashRing) Clear() []*VirtualNode {
+	defer r.lockWriters()()
+	oldState := r.state.Load().(*hashRingState)
+	newState := oldState.derive()
+	removedVnodes := newState.clear()
+	if err := r.commit(newState); err != nil {
+		return nil
+	}
+	return removedVnodes
+}
+
+// Update removes the given distinct nodes from the ring and inserts the other
+// given distinct nodes to it, in a single atomic modification, e.g. to replace
+// a node with another one, so that readers never observe the ring with only
+// one of the two. The removals are applied first, hence a node that appears in
+// both batches is removed and inserted again (from scratch).
+//
+// If any of the nodes to be removed cannot be found in the ring, or if any of
+// the nodes to be inserted are already in the ring (after the removals), a
+// *BatchError listing all of them is returned, and the ring is left untouched.
+// Otherwise, the ring is modified as expected, and the slices of the new and
+// the removed virtual nodes (not sorted) are returned, in this order.
+func (r *HashRing) Update(insert []Node, remove []Node) ([]*VirtualNode, []*VirtualNode, error) {
+	defer r.lockWriters()()
+	oldState := r.state.Load().(*hashRingState)
+	newState := oldState.derive()
+	removedVnodes := make([]*VirtualNode, 0)
+	if len(remove) > 0 {
+		vns, err := newState.remove(remove...)
+		if err != nil {
+			return nil, nil, err
+		}
+		removedVnodes = vns
+	}
+	newVnodes := make([]*VirtualNode, 0)
+	if len(insert) > 0 {
+		vns, err := newState.insert(insert...)
+		if err != nil {
+			return nil, nil, err
+		}
+		newVnodes = vns
+	}
+	if err := r.commit(newState); err != nil {
+		return nil, nil, err
+	}
+	return newVnodes, removedVnodes, nil
+}
+
+// RemoveVirtualNodesByName removes the virtual nodes with the given names from
+// the ring, rather than all virtual nodes of some distinct nodes, e.g. to drain
+// a node gradually, one virtual node at a time, and returns them (not sorted).
+// If the name of a virtual node collides with the names of others, all of them
+// are removed. Removing the last virtual node of a distinct node removes the
+// distinct node from the ring altogether.
+//
+// Only the replica owners of the virtual nodes that precede the removed ones
+// closely enough to reach them (i.e. of the keys whose owners change) are
+// recomputed, unless the ring has been configured through WithRackConstraint
+// or WithAllowDuplicateOwners, or any nodes have join weights (see
+// SetJoinWeight), in which case all of them are.
+//
+// If any of the names cannot be found in the ring (or a name appears more than
+// once in the batch), a *BatchError listing all of them is returned and the
+// ring is left untouched.
+//
+// Complexity: Worst case O( K*(V*N) + (V*N)*R ) but should be
+// O( K*(V*N + R*R) ) on average.
+func (r *HashRing) RemoveVirtualNodesByName(names ...[]byte) ([]*VirtualNode, error) {
+	defer r.lockWriters()()
+	oldState := r.state.Load().(*hashRingState)
+	newState := oldState.derive()
+	newState.inheritReplicaOwners(oldState)
+	removedVnodes, err := newState.removeVirtualNodesByName(names)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.commit(newState); err != nil {
+		return nil, err
+	}
+	return removedVnodes, nil
+}
+
+// SetReplicationFactor changes the replication factor of the ring, i.e. the
+// number of distinct nodes that own each key, and recomputes the replica owners
+// of all virtual nodes accordingly, e.g. to increase the replicas of the keys
+// during a capacity increase without rebuilding the ring. The placement of the
+// virtual nodes on the ring is not affected. As with any modification of the
+// ring, readers that have already loaded the current state keep seeing the old
+// replication factor until their lookups complete.
+//
+// It returns a non-nil error (and the ring is left untouched) if rf is out of
+// the bounds accepted by NewHashRing, if it exceeds the number of distinct
+// nodes currently in the ring, or if it is less than the number of racks
+// required by WithRackConstraint.
+func (r *HashRing) SetReplicationFactor(rf int) error {
+	defer r.lockWriters()()
+	oldState := r.state.Load().(*hashRingState)
+	newState := oldState.derive()
+	if err := newState.setReplicationFactor(rf); err != nil {
+		return err
+	}
+	newState.fixReplicaOwners()
+	return r.commit(newState)
+}
+
+// SetDraining marks (or unmarks, if draining is false) the given distinct node
+// as draining. A draining node stops being the primary owner of any keys when
+// looked up through NodesForKeyRespectingDrain, but remains a replica owner of
+// them, so that it keeps serving them until their data have been migrated
+// elsewhere. The placement of the keys on the ring is not affected.
+//
+// It returns a non-nil error (and the ring is left untouched) if the node is
+// not a member of the ring. Removing a node from the ring also clears its
+// draining mark.
+func (r *HashRing) SetDraining(node Node, draining bool) error {
+	defer r.lockWriters()()
+	oldState := r.state.Load().(*hashRingState)
+	newState := oldState.derive()
+	if err := newState.setDraining(node, draining); err != nil {
+		return err
+	}
+	newState.inheritReplicaOwners(oldState)
+	return r.commit(newState)
+}
+
+// SetJoinWeight sets the join weight of the given distinct node, i.e. a number
+// in [0, 1] that scales the share of the keys whose replica owners include the
+// node, e.g. to let a newly inserted node take on its load gradually, by
+// ramping its join weight up from 0 to 1 over some time, rather than all at
+// once. The placement of the virtual nodes on the ring is not affected.
+//
+// For each virtual node that the replica owners are looked up for, a joining
+// node is accepted as a replica owner with probability equal to its join
+// weight, decided deterministically for each virtual node (and, hence, for all
+// keys in its arc). Rejected nodes are skipped, walking the ring clockwise, and
+// are only used if there are not enough other distinct nodes. Thus, the
+// primary owner of a key is not necessarily the distinct node of the virtual
+// node that the key is assigned to, while any nodes are joining.
+//
+// A node with a join weight of 1 (the default) is a normal member of the ring.
+// Removing a node from the ring also clears its join weight. It returns a
+// non-nil error (and the ring is left untouched) if the node is not a member of
+// the ring, if w is not in [0, 1], or if the ring has been configured through
+// WithRackConstraint or WithAllowDuplicateOwners. Join weights are not saved
+// by Save.
+//
+// Complexity: O( (V*N)*R )
+func (r *HashRing) SetJoinWeight(node Node, w float64) error {
+	defer r.lockWriters()()
+	oldState := r.state.Load().(*hashRingState)
+	newState := oldState.derive()
+	if err := newState.setJoinWeight(node, w); err != nil {
+		return err
+	}
+	newState.fixReplicaOwners()
+	return r.commit(newState)
+}
+
+// NodesForKeyRespectingDrain is like NodesForKey, but any draining nodes are
+// demoted to the end of the returned slice (preserving their relative order),
+// so that none of them is the primary owner of the key unless all of its
+// owners are draining.
+//
+// Complexity: O( log(V*N) )
+func (r *HashRing) NodesForKeyRespectingDrain(key []byte) []Node {
+	return r.state.Load().(*hashRingState).nodesForKeyRespectingDrain(key)
+}
+
+// NodesForKeyWithCapacity is like NodesForKey, but it skips any nodes for
+// which the given predicate returns true (i.e. nodes that are full), walking
+// the ring clockwise until it finds as many other distinct nodes as the
+// replication factor, or until it has walked the whole ring. Therefore, fewer
+// nodes are returned if too many of them are full, and none if all of them are
+// full. While the ring is empty, it returns the fallback node (see SetFallback)
+// alone, unless it is full. The predicate is called at most once per distinct
+// node.
+//
+// Complexity: Worst case O(V*N) but should be O( log(V*N) ) on average.
+func (r *HashRing) NodesForKeyWithCapacity(key []byte, full func(Node) bool) []Node {
+	return r.state.Load().(*hashRingState).nodesForKeyWithCapacity(key, full)
+}
+
+// NodesForKeyBounded implements consistent hashing with bounded loads: it is
+// like NodesForKey, but it skips any distinct nodes whose current load (as
+// supplied by the caller through loads, where missing nodes count as 0) is at
+// or above capacity times the average load, i.e. capacity*(L+1)/N for a total
+// load of L (counting the key being placed) over the N distinct nodes of the
+// ring. It walks the ring clockwise until it finds as many other distinct
+// nodes as the replication factor. A capacity slightly above 1 (e.g. 1.25)
+// bounds the load of each node at that many times the average, while keeping
+// the placement of the keys mostly consistent.
+//
+// If too many nodes are saturated for the replication factor to be met, the
+// rest of the replicas are filled in with the saturated nodes, least loaded
+// first; among nodes of equal load, the one that comes first clockwise of the
+// key is preferred. Hence, if the whole ring is saturated, the least loaded
+// node is returned first. While the ring is empty, it returns the fallback node
+// (see SetFallback) alone, regardless of its load, or nil if there is none.
+//
+// Complexity: Worst case O( V*N + N*log(N) ) but should be O( log(V*N) ) on
+// average.
+func (r *HashRing) NodesForKeyBounded(key []byte, loads map[Node]int, capacity float64) []Node {
+	return r.state.Load().(*hashRingState).nodesForKeyBounded(key, loads, capacity)
+}
+
+// NodesForKeyExcluding is like NodesForKey, but it skips the given excluded
+// distinct nodes (e.g. nodes known to be down), walking the ring clockwise past
+// them until it finds as many other distinct nodes as the replication factor,
+// or until it has walked the whole ring. Therefore, fewer nodes are returned if
+// too few of them remain after the exclusion. While the ring is empty, it
+// returns the fallback node (see SetFallback) alone, unless it is excluded.
+//
+// Complexity: Worst case O(V*N) but should be O( log(V*N) ) on average.
+func (r *HashRing) NodesForKeyExcluding(key []byte, excluded ...Node) []Node {
+	return r.state.Load().(*hashRingState).nodesForKeyExcluding(key, excluded)
+}
+
+// NodesForKey returns a slice of Nodes (of length equal to the configured
+// replication factor) that are currently responsible for holding the given
+// key, i.e. the distinct nodes of the virtual nodes that follow the key
+// clockwise (starting with the one that the key is assigned to), each one
+// included once by default, or once per virtual node for rings configured
+// through WithAllowDuplicateOwners (see there for the details). While the ring
+// is empty, it returns the fallback node (see SetFallback) alone, if one has
+// been set, or nil otherwise. Any nodes that are excluded from reads (see
+// SetReadExcluded) are replaced by the next distinct nodes clockwise.
+//
+// The order of the returned nodes is guaranteed: the primary owner of the key,
+// i.e. the distinct node of the first virtual node whose name is greater than
+// or equal to the key (wrapping around), always comes first, followed by the
+// rest of the owners in the order in which their first virtual nodes are met
+// while walking the ring clockwise from there. Hence, the returned slice can be
+// used as is as a list of the primary owner and its ordered fallbacks (e.g.
+// for quorum writes). The only exceptions are nodes that are skipped by the
+// walk, which may be appended at the end: those of racks that are already
+// covered, for rings configured through WithRackConstraint, and those that
+// are still joining (see SetJoinWeight), which may also be skipped as the
+// primary owner.
+//
+// Complexity: O( log(V*N) )
+func (r *HashRing) NodesForKey(key []byte) []Node {
+	return r.state.Load().(*hashRingState).readNodesForKey(key)
+}
+
+// NodesForKeyRotated is like NodesForKey, but the returned replica owners are
+// rotated by a (deterministic) offset derived from the key, so that each one
+// of them is returned first for a roughly equal share of the keys. This is
+// meant for spreading the load of reads, which are typically served by the
+// first returned node, evenly among the replica owners of each arc.
+//
+// Complexity: O( log(V*N) )
+func (r *HashRing) NodesForKeyRotated(key []byte) []Node {
+	return rotateOwners(r.state.Load().(*hashRingState).readNodesForKey(key), key)
+}
+
+// VirtualNodesForKey is like NodesForKey, but it returns the virtual nodes that
+// the replica owners of the given key have been selected through, rather than
+// the distinct nodes themselves, i.e. for each one of the nodes that NodesForKey
+// returns (in the same order), its first virtual node clockwise from (and
+// including) the one that the key is assigned to. It returns nil if the ring
+// is empty.
+//
+// Complexity: Worst case O(V*N) but should be O( log(V*N) ) on average.
+func (r *HashRing) VirtualNodesForKey(key []byte) []*VirtualNode {
+	return r.state.Load().(*hashRingState).virtualNodesForKey(key)
+}
+
+// DistinctNodesForKey returns the first n distinct nodes that are found while
+// walking the ring clockwise, starting from the virtual node that the given key
+// is assigned to, regardless of the replication factor of the ring; n is capped
+// at the number of distinct nodes in the ring. Hence, for n equal to the
+// replication factor, it returns the same nodes as NodesForKey, unless the
+// replica owners are selected otherwise (e.g. see WithRackConstraint). It
+// returns nil if the ring is empty or if n is not positive.
+//
+// Complexity: Worst case O(V*N) but should be O( log(V*N) + n ) on average.
+func (r *HashRing) DistinctNodesForKey(key []byte, n int) []Node {
+	return r.state.Load().(*hashRingState).distinctNodesForKey(key, n)
+}
+
+// IsOwner returns true if the given distinct node is currently one of the
+// replica owners of the given key, as returned by NodesForKey, or false
+// otherwise.
+//
+// It does not allocate, unless the ring has been configured through
+// WithoutReplicaOwnerMap or some of its nodes are excluded from reads.
+//
+// Complexity: O( log(V*N) + R )
+func (r *HashRing) IsOwner(node Node, key []byte) bool {
+	_, isOwner := r.state.Load().(*hashRingState).ownerRank(node, key)
+	return isOwner
+}
+
+// OwnerRank returns the position of the given distinct node among the replica
+// owners of the given key, as returned by NodesForKey (i.e. 0 for the primary
+// owner), along with true, if the node is currently one of them; otherwise, it
+// returns -1 and false. Like IsOwner, it does not allocate in the common case.
+//
+// Complexity: O( log(V*N) + R )
+func (r *HashRing) OwnerRank(node Node, key []byte) (int, bool) {
+	return r.state.Load().(*hashRingState).ownerRank(node, key)
+}
+
+// OwnerForKey returns the distinct node that is currently the primary owner of
+// the given key, i.e. NodesForKey(key)[0]. While the ring is empty, it returns
+// the fallback node (see SetFallback), if one has been set, or a non-nil error
+// otherwise. It also returns a non-nil error if all nodes of the ring are
+// excluded from reads (see SetReadExcluded).
+//
+// Complexity: O( log(V*N) )
+func (r *HashRing) OwnerForKey(key []byte) (Node, error) {
+	state := r.state.Load().(*hashRingState)
+	if len(state.virtualNodes) == 0 && state.fallback == "" {
+		return "", fmt.Errorf("empty ring")
+	}
+	owners := state.readNodesForKey(key)
+	if len(owners) == 0 {
+		return "", fmt.Errorf("all nodes are excluded from reads")
+	}
+	return owners[0], nil
+}
+
+// SetReadExcluded excludes (or stops excluding) the given distinct node from
+// the replica owners of keys, as they are looked up for reading (i.e. through
+// NodesForKey, OwnerForKey, OwnerSetForKey, NodesForObject,
+// NodesForKeyCacheable, NodesForKeyAtGeneration, PlacementFor and
+// NodesForKeyRespectingDrain), e.g. while the node is restarting. Each
+// excluded node is replaced by the next distinct node clockwise that is not
+// already an owner, so fewer nodes are returned only if too many of them are
+// excluded.
+//
+// Unlike removing the node, this causes no migrations: the placement of the
+// keys on the ring, their replica owners as reported by the rest of the
+// methods (e.g. those about migrations) and the ring's membership are not
+// affected. Removing a node from the ring also clears its exclusion. It returns
+// a non-nil error (and the ring is left untouched) if the node is not a member
+// of the ring.
+func (r *HashRing) SetReadExcluded(node Node, excluded bool) error {
+	defer r.lockWriters()()
+	oldState := r.state.Load().(*hashRingState)
+	newState := oldState.derive()
+	if err := newState.setReadExcluded(node, excluded); err != nil {
+		return err
+	}
+	newState.inheritReplicaOwners(oldState)
+	return r.commit(newState)
+}
+
+// SetNodeStatus marks the given distinct node as up (i.e. reachable) or down,
+// for NodesForKeyHealthy to route around the nodes that are down. Nodes are up
+// when they are inserted, and removing a node from the ring also clears its
+// status. Like SetReadExcluded, this causes no migrations, and it does not
+// affect any other lookups either. It returns a non-nil error (and the ring is
+// left untouched) if the node is not a member of the ring.
+func (r *HashRing) SetNodeStatus(node Node, up bool) error {
+	defer r.lockWriters()()
+	oldState := r.state.Load().(*hashRingState)
+	newState := oldState.derive()
+	if err := newState.setNodeStatus(node, up); err != nil {
+		return err
+	}
+	newState.inheritReplicaOwners(oldState)
+	return r.commit(newState)
+}
+
+// NodesForKeyHealthy is like NodesForKey, but it also skips the nodes that are
+// down (see SetNodeStatus), replacing each one of them by the next distinct
+// node clockwise that is up and not already an owner, so that up to
+// replicationFactor live owners are returned; fewer are returned only if too
+// many nodes are down.
+//
+// Complexity: O( log(V*N) ), or O( V*N ) in the worst case while nodes are down
+func (r *HashRing) NodesForKeyHealthy(key []byte) []Node {
+	return r.state.Load().(*hashRingState).healthyNodesForKey(key)
 }
 
-// NewHashRing returns a new HashRing, properly initialized based on the given
-// parameters, or a non-nil error value if the parameters are invalid.
+// SetMeta attaches the given metadata (e.g. the datacenter and the rack of the
+// node) to the given distinct node, replacing any that it had before, or clears
+// them if meta is empty, so that they may be consulted during routing. The ring
+// keeps a copy of meta. The metadata of a node are kept for as long as it is a
+// member of the ring, regardless of other nodes being inserted or removed, and
+// they are cleared once it is removed. They are not saved by Save.
 //
-// An arbitrary number of nodes may optionally be inserted to the new ring
-// during the initialization through parameter `nodes` (hence, NewHashRing is a
-// variadic function).
-func NewHashRing(hashFunc func([]byte) []byte, replicationFactor, virtualNodeCount int, nodes ...Node) (*HashRing, error) {
-	if hashFunc == nil {
-		return nil, fmt.Errorf("hashFunc cannot be nil")
-	}
-	if replicationFactor < 1 || replicationFactor > (1<<8)-1 {
-		return nil, fmt.Errorf("replicationFactor value %d not in (0, %d)", replicationFactor, 1<<8)
+// It returns a non-nil error (and the ring is left untouched) if the node is
+// not a member of the ring.
+func (r *HashRing) SetMeta(node Node, meta map[string]string) error {
+	defer r.lockWriters()()
+	oldState := r.state.Load().(*hashRingState)
+	newState := oldState.derive()
+	if err := newState.setMeta(node, meta); err != nil {
+		return err
 	}
-	if virtualNodeCount < 1 || virtualNodeCount > (1<<16)-1 {
-		return nil, fmt.Errorf("virtualNodeCount value %d not in (0, %d)", virtualNodeCount, 1<<16)
+	newState.inheritReplicaOwners(oldState)
+	return r.commit(newState)
+}
+
+// Meta returns a copy of the metadata of the given distinct node in the current
+// state of the ring (see SetMeta), or nil if it has none or it is not a member
+// of the ring.
+func (r *HashRing) Meta(node Node) map[string]string {
+	meta, exists := r.state.Load().(*hashRingState).meta[node]
+	if !exists {
+		return nil
 	}
+	return copyMeta(meta)
+}
 
-	newState := &hashRingState{
-		hash:              hashFunc,
-		virtualNodeCount:  uint16(virtualNodeCount),
-		replicationFactor: uint8(replicationFactor),
-		virtualNodes:      make([]*VirtualNode, 0),
-		replicaOwners:     make(map[*VirtualNode][]Node),
+// SetFallback sets the node that keys are routed to (by NodesForKey,
+// OwnerForKey and the rest of the lookups) while the ring is empty, e.g. during
+// the bootstrap of a service, before any nodes have been inserted. The fallback
+// node is not a member of the ring (i.e. it has no virtual nodes), and it is
+// cleared as soon as any nodes are inserted; it does not take effect again if
+// the ring becomes empty later, unless it is set anew. An empty node unsets it.
+// SetFallback has no effect (and the Generation of the ring does not change) if
+// the ring is not empty, or if its generation cannot be incremented any further
+// (see ErrGenerationOverflow). The fallback node is not saved by Save.
+func (r *HashRing) SetFallback(node Node) {
+	defer r.lockWriters()()
+	state := r.state.Load().(*hashRingState)
+	if len(state.virtualNodes) > 0 || state.fallback == node {
+		return
 	}
-	if len(nodes) > 0 {
-		newState.insert(nodes...)
+	newState := state.derive()
+	newState.fallback = node
+	_ = r.commit(newState)
+}
+
+// NodesForKeyCacheable returns the replica owners of the given key, along with
+// the generation of the ring that they have been looked up in, and the arc of
+// the keyspace (i.e. the arc of the key's virtual node) over which the same
+// replica owners apply. Note that, like all KeyRanges, the arc excludes its
+// lower bound and includes its upper bound.
+//
+// Together, they allow clients to safely cache the replica owners of all keys
+// in the arc, for as long as the Generation of the ring remains gen. Like those
+// of NodesForKey, the owners exclude any nodes that are excluded from reads
+// (see SetReadExcluded). It returns nil owners and an empty arc if the ring is
+// empty.
+//
+// Complexity: O( log(V*N) )
+func (r *HashRing) NodesForKeyCacheable(key []byte) (owners []Node, gen uint64, arc KeyRange) {
+	state := r.state.Load().(*hashRingState)
+	if len(state.virtualNodes) == 0 {
+		return nil, state.generation, KeyRange{}
 	}
+	i := state.search(key)
+	return state.readOwners(i), state.generation, state.arc(i)
+}
 
-	ring := &HashRing{hash: hashFunc}
-	ring.state.Store(newState)
+// Placement describes where a key is placed in a specific state of the ring.
+type Placement struct {
+	// VirtualNode is the virtual node that the key is assigned to, i.e.
+	// the first one clockwise of (or at) the key's position.
+	VirtualNode *VirtualNode
 
-	return ring, nil
-}
+	// Arc is the arc of the keyspace that VirtualNode owns, which the key
+	// falls in.
+	Arc KeyRange
 
-// Clone allocates, initializes and returns a new ring, which is a deep copy of
-// the original.
-func (r *HashRing) Clone() *HashRing {
-	newState := r.state.Load().(*hashRingState).derive()
-	newState.fixReplicaOwners()
-	newRing := &HashRing{hash: newState.hash}
-	newRing.state.Store(newState)
-	return newRing
+	// Owners are the replica owners of the key, as returned by NodesForKey
+	// (i.e. excluding any nodes that are excluded from reads), and Primary
+	// is the first one of them.
+	Owners  []Node
+	Primary Node
 }
 
-// Size returns the number of *distinct* nodes in the ring, in its current
-// state.
-func (r *HashRing) Size() int {
-	return r.state.Load().(*hashRingState).size()
+// PlacementFor returns the Placement of the given key in the current state of
+// the ring, so that all of its parts are consistent with each other. It returns
+// a non-nil error if the ring is empty, or if all of its nodes are excluded
+// from reads (see SetReadExcluded).
+//
+// Complexity: O( log(V*N) )
+func (r *HashRing) PlacementFor(key []byte) (Placement, error) {
+	state := r.state.Load().(*hashRingState)
+	if len(state.virtualNodes) == 0 {
+		return Placement{}, fmt.Errorf("empty ring")
+	}
+	i := state.search(key)
+	owners := state.readOwners(i)
+	if len(owners) == 0 {
+		return Placement{}, fmt.Errorf("all nodes are excluded from reads")
+	}
+	return Placement{
+		VirtualNode: state.virtualNodes[i],
+		Arc:         state.arc(i),
+		Owners:      owners,
+		Primary:     owners[0],
+	}, nil
 }
 
-// String returns the slice of virtual nodes of the current state of the ring,
-// along with their replica owners, as a "print-friendly" string.
-func (r *HashRing) String() string {
-	state := r.state.Load().(*hashRingState)
-	ret := bytes.Buffer{}
-	for i, vn := range state.virtualNodes {
-		if _, err := ret.WriteString(fmt.Sprintf("%d.  %s  =>  %q\n", i, vn, state.replicaOwners[vn])); err != nil {
-			return "Ring too large to be represented in a string."
-		}
+// Rehash returns a new ring with the same configuration (e.g. replication
+// factor and number of virtual nodes per distinct node) and distinct nodes as
+// the current state of the ring, but with all virtual nodes placed on the ring
+// through the given hash function instead, e.g. to migrate away from a
+// deprecated hash function. The ring itself is left untouched.
+//
+// Since both the virtual nodes and the keys are placed on the new ring through
+// the new hash function, most keys end up on different replica owners: this is
+// a full data movement operation, whose extent may be estimated beforehand
+// through HashMigrationImpact. The new owners of each key have to be looked
+// up in the new ring (e.g. through HashKey and NodesForKey); no Diff or
+// Migration may describe the movement, since the positions of the keys change
+// too. The name of the hash function (see WithHashName) and the streaming hash
+// function (see WithStreamingHash) of the ring are not carried over to the new
+// ring, since they describe the old hash function. It returns a non-nil error
+// if the new hash function is nil.
+//
+// Complexity: O( (V*N)*log(V*N) )
+func (r *HashRing) Rehash(newHash func([]byte) []byte) (*HashRing, error) {
+	if newHash == nil {
+		return nil, fmt.Errorf("newHash cannot be nil")
 	}
-	return ret.String()
+	newState := r.state.Load().(*hashRingState).rehash(newHash)
+	newRing := &HashRing{hash: newHash, historyDepth: r.historyDepth}
+	if r.writers != nil {
+		newRing.writers = &sync.Mutex{}
+	}
+	newRing.commit(newState)
+	return newRing, nil
 }
 
-// Insert is a variadic method to insert an arbitrary number of distinct nodes
-// (i.e. all their virtual nodes) to the ring.
+// HashMigrationImpact estimates the churn that migrating the ring to the given
+// hash function would cause, as the fraction of the given sample keys whose
+// primary owner would change. Each sample key is hashed (as in NodesForObject)
+// by ring's current hash function and by the new one respectively, to locate it
+// in the current and in the rehashed ring. The ring itself is left untouched.
 //
-// In the case that an already existing distinct node is attempted to be
-// re-inserted to the ring, Insert returns a non-nil error value and the ring
-// is left untouched. Otherwise, the ring is modified as expected, and a slice
-// of the new virtual nodes (not sorted) is returned.
-func (r *HashRing) Insert(nodes ...Node) ([]*VirtualNode, error) {
+// It returns a non-nil error if the new hash function is nil, if no sample keys
+// are given, or if the ring is empty.
+//
+// Complexity: O( (V*N)*log(V*N) ) + O( K*(hash + log(V*N)) )
+func (r *HashRing) HashMigrationImpact(newHash func([]byte) []byte, sampleKeys [][]byte) (float64, error) {
+	if newHash == nil {
+		return 0, fmt.Errorf("newHash cannot be nil")
+	}
+	if len(sampleKeys) == 0 {
+		return 0, fmt.Errorf("no sample keys")
+	}
 	oldState := r.state.Load().(*hashRingState)
-	newState := oldState.derive()
-	newVnodes, err := newState.insert(nodes...)
-	if err != nil {
-		return nil, err
+	if len(oldState.virtualNodes) == 0 {
+		return 0, fmt.Errorf("empty ring")
 	}
-	r.state.Store(newState) // <-- Atomically replace the current state
-	// with the new one. At this point all new readers start working with
-	// the new state. The old state will be garbage collected once the
-	// existing readers (if any) are done with it.
-	return newVnodes, nil
+	newState := oldState.rehash(newHash)
+
+	moved := 0
+	for _, key := range sampleKeys {
+		if oldState.virtualNodeForKey(oldState.hash(key)).node != newState.virtualNodeForKey(newHash(key)).node {
+			moved++
+		}
+	}
+	return float64(moved) / float64(len(sampleKeys)), nil
 }
 
-// Remove is a variadic method to remove an arbitrary number of distinct nodes
-// (i.e. all their virtual nodes) from the ring.
+// PrimaryKeysFor returns the subset of the given keys (in their given order)
+// whose primary owner is currently the given distinct node, i.e. those for
+// which NodesForKey(key)[0] equals node. Instead of looking up each key
+// independently, the keys are sorted once and matched against the ring in a
+// single walk. It returns nil if the ring is empty.
 //
-// If any of the distinct nodes' virtual nodes cannot be found in the ring, a
-// non-nil error value is returned and the ring is left untouched; otherwise
-// the ring is modified as expected, and a slice of the removed virtual nodes
-// (not sorted) is returned.
-func (r *HashRing) Remove(nodes ...Node) ([]*VirtualNode, error) {
+// Complexity: O( K*log(K) + V*N )
+func (r *HashRing) PrimaryKeysFor(node Node, keys [][]byte) [][]byte {
+	return r.state.Load().(*hashRingState).primaryKeysFor(node, keys)
+}
+
+// CountKeysPerNode returns the number of the given keys that each distinct node
+// is currently the primary owner of, i.e. for how many of them it would be
+// returned first by NodesForKey, looking all of them up in the same state of
+// the ring. Distinct nodes that own none of the keys are not in the returned
+// map, which is empty if the ring is empty.
+//
+// Complexity: O( K*log(V*N) )
+func (r *HashRing) CountKeysPerNode(keys [][]byte) map[Node]int {
+	return r.state.Load().(*hashRingState).countKeysPerNode(keys, false)
+}
+
+// CountKeyReplicasPerNode is like CountKeysPerNode, but it counts all replica
+// owners of each key (as returned by NodesForKey), rather than its primary
+// owner only, i.e. the number of replicas of the given keys that each
+// distinct node would hold.
+//
+// Complexity: O( K*log(V*N) )
+func (r *HashRing) CountKeyReplicasPerNode(keys [][]byte) map[Node]int {
+	return r.state.Load().(*hashRingState).countKeysPerNode(keys, true)
+}
+
+// EstimateScaleImpact estimates the churn that adding n more distinct nodes to
+// the ring would cause, as the fraction of the keyspace whose primary owner
+// would change, without knowing the identities of the new nodes. To do so, it
+// simulates the insertion of n synthetic nodes, whose identities are derived
+// deterministically from their number, so that the estimate is reproducible.
+// The ring itself is left untouched.
+//
+// It returns 0 if n is not positive, 1 if the ring is empty, and NaN if the
+// ring has been configured with a custom name comparator (see
+// ErrUnknownPositions).
+//
+// Complexity: O( n*V*hash ) + O( (V*N)*log(V*N) )
+func (r *HashRing) EstimateScaleImpact(n int) float64 {
+	if n < 1 {
+		return 0
+	}
 	oldState := r.state.Load().(*hashRingState)
+	if len(oldState.virtualNodes) == 0 {
+		return 1
+	}
+	if !oldState.hasPositions() {
+		return math.NaN()
+	}
 	newState := oldState.derive()
-	removedVnodes, err := newState.remove(nodes...)
-	if err != nil {
-		return nil, err
+	synthetic := make(map[Node]struct{}, n)
+	for i := 0; len(synthetic) < n; i++ {
+		node := Node(fmt.Sprintf("lfchring-synthetic-node-%d", i))
+		if _, err := newState.insertNode(node, newState.virtualNodeCount); err != nil {
+			continue // the (unlikely) case of a real node with that name
+		}
+		synthetic[node] = struct{}{}
 	}
-	r.state.Store(newState) // <-- Atomically replace the current state
-	// with the new one. At this point all new readers start working with
-	// the new state. The old state will be garbage collected once the
-	// existing readers (if any) are done with it.
-	return removedVnodes, nil
+	// The replica owners of the new state are not needed; only the arcs of
+	// the synthetic nodes' virtual nodes, since they are exactly the ones
+	// whose primary owner changes.
+	newState.sortVirtualNodes()
+	width := newState.keyWidth()
+	moved := new(big.Int)
+	for i, vn := range newState.virtualNodes {
+		if _, isSynthetic := synthetic[vn.node]; isSynthetic {
+			moved.Add(moved, newState.arcLengthAt(i, width))
+		}
+	}
+	return fraction(moved, width)
 }
 
-// NodesForKey returns a slice of Nodes (of length equal to the configured
-// replication factor) that are currently responsible for holding the given
-// key.
+// OwnerSetForKey returns the set of Nodes that are currently responsible for
+// holding the given key. It is meant for efficiently checking whether a
+// specific node owns the key, since no allocation takes place (unless any nodes
+// are excluded from reads).
 //
 // Complexity: O( log(V*N) )
-func (r *HashRing) NodesForKey(key []byte) []Node {
-	return r.state.Load().(*hashRingState).nodesForKey(key)
+func (r *HashRing) OwnerSetForKey(key []byte) OwnerSet {
+	return OwnerSet{owners: r.state.Load().(*hashRingState).readNodesForKey(key)}
 }
 
 // NodesForObject returns a slice of Nodes (of length equal to the configured
@@ -198,17 +1450,184 @@ func (r *HashRing) NodesForKey(key []byte) []Node {
 // returns a non-nil error value in the case of a failure while reading from
 // the io.Reader.
 //
+// If the ring has been configured with a streaming hash function (see
+// WithStreamingHash), the object is hashed while it is read, rather than read
+// into memory in its entirety first (like NodesForObjectStreaming), unless it
+// starts with a prefix that a hash function has been registered for (see
+// RegisterHashForPrefix).
+//
 // Complexity: O( Read ) + O( hash ) + O( log(V*N) )
 func (r *HashRing) NodesForObject(reader io.Reader) ([]Node, error) {
-	objectBytes, err := ioutil.ReadAll(reader)
+	state := r.state.Load().(*hashRingState)
+	key, err := state.hashObject(reader)
 	if err != nil {
 		return nil, err
 	}
-	return r.NodesForKey(r.hash(objectBytes)), nil
+	return state.readNodesForKey(key), nil
+}
+
+// NodesForObjectContext is like NodesForObject, but it stops reading from the
+// io.Reader once the given context is done, returning the context's error.
+// Reading takes place in a separate goroutine, so that it returns promptly even
+// if a single Read blocks; that goroutine makes no further Read calls after the
+// context is done, and it exits as soon as the blocked Read returns (e.g. once
+// the caller closes the underlying connection or file). Like NodesForObject,
+// it hashes the object while reading it if the ring has been configured with a
+// streaming hash function (see WithStreamingHash), so that large objects are
+// not read into memory.
+//
+// Complexity: O( Read ) + O( hash ) + O( log(V*N) )
+func (r *HashRing) NodesForObjectContext(ctx context.Context, reader io.Reader) ([]Node, error) {
+	type result struct {
+		key []byte
+		err error
+	}
+	state := r.state.Load().(*hashRingState)
+	done := make(chan result, 1)
+	go func() {
+		key, err := state.hashObject(&contextReader{ctx: ctx, reader: reader})
+		done <- result{key, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-done:
+		if res.err != nil {
+			return nil, res.err
+		}
+		return state.readNodesForKey(res.key), nil
+	}
+}
+
+// contextReader is an io.Reader that stops reading from the underlying
+// io.Reader once its context is done, returning the context's error instead.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+// Read implements io.Reader.
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.reader.Read(p)
+}
+
+// NodesForObjectStreaming is like NodesForObject, but it hashes the object
+// while reading it from the io.Reader, using the streaming hash function of the
+// ring (see WithStreamingHash), so that the object is never read into memory in
+// its entirety. Hash functions registered for key prefixes (see
+// RegisterHashForPrefix) are not taken into account. It returns a non-nil
+// error if the ring has not been configured with a streaming hash function, or
+// in the case of a failure while reading from the io.Reader.
+//
+// Complexity: O( Read ) + O( hash ) + O( log(V*N) )
+func (r *HashRing) NodesForObjectStreaming(reader io.Reader) ([]Node, error) {
+	state := r.state.Load().(*hashRingState)
+	if state.streamingHash == nil {
+		return nil, fmt.Errorf("no streaming hash function configured")
+	}
+	h := state.streamingHash()
+	if _, err := io.Copy(h, reader); err != nil {
+		return nil, err
+	}
+	return state.readNodesForKey(h.Sum(nil)), nil
+}
+
+// NodesForKeyFunc is like NodesForObject, but for a raw (i.e. not yet hashed)
+// key that is in memory already: it applies extract to the key, and looks up
+// the replica owners of the (hashed) portion of the key that extract returns,
+// e.g. the tenant prefix of keys of the form "tenant:object", so that all keys
+// of the same tenant are placed on the same nodes. A nil extract uses the
+// whole key.
+//
+// Complexity: O( extract ) + O( hash ) + O( log(V*N) )
+func (r *HashRing) NodesForKeyFunc(key []byte, extract func([]byte) []byte) []Node {
+	if extract != nil {
+		key = extract(key)
+	}
+	state := r.state.Load().(*hashRingState)
+	return state.readNodesForKey(state.hashKey(key))
+}
+
+// sampleKeyMaxAttempts is the maximum number of random keys that
+// SampleKeyForNode generates before giving up.
+const sampleKeyMaxAttempts = 1 << 16
+
+// SampleKeyForNode returns a (pseudo-)random key, i.e. a position on the ring,
+// whose primary owner (as returned by OwnerForKey) is the given distinct node,
+// e.g. to write tests or to generate load that targets a specific node. Keys
+// are generated from the given seed, so that the same key is returned for the
+// same seed and state of the ring.
+//
+// It returns a non-nil error if the node is not in the ring, or if none of a
+// bounded number of generated keys lands on the node, e.g. because it owns a
+// negligible share of the keyspace, or because it is excluded from reads.
+func (r *HashRing) SampleKeyForNode(node Node, seed int64) ([]byte, error) {
+	state := r.state.Load().(*hashRingState)
+	if !state.hasNode(node) {
+		return nil, fmt.Errorf("node %q is not in the ring", node)
+	}
+	rnd := rand.New(rand.NewSource(seed))
+	for i := 0; i < sampleKeyMaxAttempts; i++ {
+		key := make([]byte, state.keyWidth())
+		rnd.Read(key)
+		if owners := state.readNodesForKey(key); len(owners) > 0 && owners[0] == node {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("no key found for node %q in %d attempts", node, sampleKeyMaxAttempts)
+}
+
+// HashKey hashes the given key into a position on the ring, which may then be
+// passed to NodesForKey and the rest of the methods that operate on positions.
+// The hash function of the longest registered prefix of the key is used (see
+// RegisterHashForPrefix), or ring's hash function if there is none.
+//
+// Complexity: O( P + hash )
+func (r *HashRing) HashKey(key []byte) []byte {
+	state := r.state.Load().(*hashRingState)
+	if state.keyCache == nil {
+		return state.hashKey(key)
+	}
+	// Cached hashes are shared, hence they are not to be modified.
+	return append([]byte(nil), state.hashKey(key)...)
+}
+
+// ClearKeyCache evicts all hashed keys from the cache of the ring (see
+// WithKeyCache), e.g. once the hash function that the ring has been configured
+// with starts hashing keys differently. It does nothing if the ring has not been
+// configured with a key cache.
+func (r *HashRing) ClearKeyCache() {
+	if kc := r.state.Load().(*hashRingState).keyCache; kc != nil {
+		kc.clear()
+	}
+}
+
+// RegisterHashForPrefix makes all keys that start with the given prefix be
+// hashed by the given hash function (instead of ring's hash function) when
+// placed on the ring through HashKey or NodesForObject, so that the placement
+// of, e.g., the keys of each tenant of a multi-tenant system is isolated from
+// the others, while the ring's membership is shared. If multiple registered
+// prefixes match a key, the longest one wins. Registering a prefix again
+// replaces its hash function.
+//
+// It returns a non-nil error (and the ring is left untouched) if hashFunc is
+// nil, or if its outputs are not as long as the outputs of ring's hash function.
+func (r *HashRing) RegisterHashForPrefix(prefix []byte, hashFunc func([]byte) []byte) error {
+	defer r.lockWriters()()
+	oldState := r.state.Load().(*hashRingState)
+	newState := oldState.derive()
+	if err := newState.setPrefixHash(prefix, hashFunc); err != nil {
+		return err
+	}
+	newState.inheritReplicaOwners(oldState)
+	return r.commit(newState)
 }
 
 // VirtualNodeForKey returns the virtual node in the ring that the given key
-// would be assigned to.
+// would be assigned to, or nil if the ring is empty.
 //
 // Complexity: O( log(V*N) )
 func (r *HashRing) VirtualNodeForKey(key []byte) *VirtualNode {
@@ -233,6 +1652,39 @@ func (r *HashRing) Successor(key []byte) (*VirtualNode, error) {
 	return r.state.Load().(*hashRingState).successor(key)
 }
 
+// Successors returns the n virtual nodes that succeed the one that the given
+// key would be assigned to, in clockwise order, i.e. the first one of them is
+// the one that Successor returns. The ring is walked at most once, hence n is
+// capped at the number of virtual nodes in the ring (in which case the last
+// one returned is the virtual node that the key is assigned to). It returns a
+// non-nil error if the ring is empty, or if n is negative.
+//
+// Complexity: O( log(V*N) + n )
+func (r *HashRing) Successors(key []byte, n int) ([]*VirtualNode, error) {
+	return r.state.Load().(*hashRingState).neighbors(key, n, 1)
+}
+
+// Predecessors is like Successors, but it returns the n virtual nodes that
+// precede the one that the given key would be assigned to, in
+// counter-clockwise order, i.e. the first one of them is the one that
+// Predecessor returns.
+//
+// Complexity: O( log(V*N) + n )
+func (r *HashRing) Predecessors(key []byte, n int) ([]*VirtualNode, error) {
+	return r.state.Load().(*hashRingState).neighbors(key, n, -1)
+}
+
+// ReplicaChain returns the ordered chain of virtual nodes that should receive
+// replicas of the data whose primary owner is the given virtual node, i.e. the
+// first virtual node of each of its next replicationFactor-1 replica owners,
+// walking the ring clockwise from the given virtual node. It returns a non-nil
+// error if the given virtual node is not in the ring.
+//
+// Complexity: Worst case O(V*N) but should be O( log(V*N) ) on average.
+func (r *HashRing) ReplicaChain(vn *VirtualNode) ([]*VirtualNode, error) {
+	return r.state.Load().(*hashRingState).replicaChain(vn.Name())
+}
+
 // PredecessorNode returns the virtual node which is the first predecessor to
 // the one that the given key would be assigned to, but also belongs to a
 // different distinct node than the latter. It returns a non-nil error if the
@@ -253,6 +1705,224 @@ func (r *HashRing) SuccessorNode(key []byte) (*VirtualNode, error) {
 	return r.state.Load().(*hashRingState).successorNode(key)
 }
 
+// NextVNodeOfNode returns the first virtual node of the given target distinct
+// node, walking the ring clockwise from (and including) the virtual node that
+// the given key would be assigned to, e.g. to direct a request for the key to
+// a specific one of its replica owners. The target need not be one of the
+// replica owners of the key. It returns a non-nil error if the target is not
+// in the ring.
+//
+// Complexity: Worst case O(V*N) but should be O( log(V*N) ) on average.
+func (r *HashRing) NextVNodeOfNode(key []byte, target Node) (*VirtualNode, error) {
+	return r.state.Load().(*hashRingState).nextVNodeOfNode(key, target)
+}
+
+// OwnerBoundaryForKey returns the name of the virtual node where the primary
+// ownership of the arcs of the keyspace transitions to the distinct node that
+// is the primary owner of the given key, i.e. the first virtual node of the
+// owner's contiguous run of virtual nodes that includes the key's virtual node,
+// walking the ring clockwise from the closest preceding virtual node of a
+// different distinct node (see PredecessorNode). It returns a non-nil error if
+// the ring either is empty or consists of a single distinct node.
+//
+// Complexity: Worst case O(V*N) but should be O( log(V*N) ) on average.
+func (r *HashRing) OwnerBoundaryForKey(key []byte) ([]byte, error) {
+	return r.state.Load().(*hashRingState).ownerBoundaryForKey(key)
+}
+
+// LargestArc returns the distinct node that owns (as the primary owner) the
+// largest contiguous arc of the keyspace, i.e. the largest run of consecutive
+// virtual nodes whose keys have the same primary owner (see SetJoinWeight),
+// along with the bounds of that arc: the keys that belong to it are greater
+// than lo and less than or equal to hi (wrapping around the end of the keyspace
+// if lo >= hi). It returns a non-nil error if the ring is empty, or
+// ErrUnknownPositions if the ring has been configured with a custom name
+// comparator.
+//
+// Along with SplitPointOf, it may be used to manually (or automatically)
+// rebalance the ring, by inserting a virtual node at the split point of the
+// largest arc.
+//
+// Complexity: O( V*N )
+func (r *HashRing) LargestArc() (owner Node, lo, hi []byte, err error) {
+	return r.state.Load().(*hashRingState).largestArc()
+}
+
+// ArcLengthHistogram returns the distribution of the lengths of the arcs of
+// the virtual nodes in the ring (i.e. the gaps between consecutive virtual
+// nodes), as a histogram of the given number of buckets. The length of each
+// arc is measured as a fraction of the keyspace, and the i-th bucket counts the
+// arcs whose length falls in [i/buckets, (i+1)/buckets).
+//
+// A heavily skewed histogram may reveal a poor hash function or a too low
+// virtual node count. It returns nil if buckets is less than 1, or if the ring
+// has been configured with a custom name comparator (see ErrUnknownPositions).
+//
+// Complexity: O( V*N )
+func (r *HashRing) ArcLengthHistogram(buckets int) []int {
+	state := r.state.Load().(*hashRingState)
+	if buckets < 1 || !state.hasPositions() {
+		return nil
+	}
+	return state.arcLengthHistogram(buckets)
+}
+
+// SplitPointOf returns the key that lies in the middle of the arc (lo, hi] of
+// the keyspace, taking into account the wrap-around at the end of the ring.
+func (r *HashRing) SplitPointOf(lo, hi []byte) []byte {
+	return splitPoint(lo, hi)
+}
+
+// DistanceToNode returns the clockwise distance in the keyspace from the given
+// key to the nearest virtual node of the given distinct node, i.e. the number
+// of positions that the key would have to be moved by to reach target's
+// territory. A zero distance means that the key falls on one of target's
+// virtual nodes. It returns a non-nil error if target is not in the ring, or
+// ErrUnknownPositions if the ring has been configured with a custom name
+// comparator.
+//
+// Complexity: O( V*N )
+func (r *HashRing) DistanceToNode(key []byte, target Node) (*big.Int, error) {
+	return r.state.Load().(*hashRingState).distanceToNode(key, target)
+}
+
+// IterArcsForNode walks the arcs of the current state of the ring in order,
+// calling fn for each arc that the given distinct node is a replica owner of,
+// along with the replica owners of the arc, until fn returns false. It returns
+// a non-nil error if the node is not in the ring.
+//
+// Complexity: O( V*N )
+func (r *HashRing) IterArcsForNode(node Node, fn func(arc KeyRange, owners []Node) bool) error {
+	state := r.state.Load().(*hashRingState)
+	if !state.hasNode(node) {
+		return fmt.Errorf("node %q is not in the ring", node)
+	}
+	for i := range state.virtualNodes {
+		owners := state.owners(i)
+		if (OwnerSet{owners: owners}).Contains(node) && !fn(state.arc(i), owners) {
+			break
+		}
+	}
+	return nil
+}
+
+// Arc is a contiguous range of the keyspace, along with its replica owners.
+type Arc struct {
+	KeyRange
+	Owners []Node
+}
+
+// CompactArcs returns the arcs of the current state of the ring in order, with
+// all consecutive arcs that share identical replica owners (in the same order)
+// merged into single ones, e.g. to build the smallest possible routing table
+// for the ring, since the boundaries between such arcs are redundant for
+// routing. If the replica owners of all arcs are identical, a single Arc that
+// spans the whole keyspace is returned. It returns nil if the ring is empty.
+//
+// Complexity: O( V*N )
+func (r *HashRing) CompactArcs() []Arc {
+	state := r.state.Load().(*hashRingState)
+	n := len(state.virtualNodes)
+	if n == 0 {
+		return nil
+	}
+	// Find the first arc whose owners differ from its predecessor's, so
+	// that the walk below does not begin in the middle of a merged arc.
+	start := -1
+	for i := 0; i < n; i++ {
+		if !sameNodes(state.owners(i), state.owners((i+n-1)%n)) {
+			start = i
+			break
+		}
+	}
+	if start == -1 {
+		last := state.virtualNodes[n-1].Name()
+		return []Arc{{KeyRange: KeyRange{Lo: last, Hi: last, compare: state.compare}, Owners: state.owners(0)}}
+	}
+
+	ret := make([]Arc, 0)
+	for k := 0; k < n; k++ {
+		i := (start + k) % n
+		owners := state.owners(i)
+		if m := len(ret); m > 0 && sameNodes(ret[m-1].Owners, owners) {
+			ret[m-1].Hi = state.virtualNodes[i].Name()
+			continue
+		}
+		ret = append(ret, Arc{KeyRange: state.arc(i), Owners: owners})
+	}
+	return ret
+}
+
+// WrapsAround returns true if the lookup of the given key wraps around the end
+// of the ring, i.e. if the key is greater than the names of all virtual nodes
+// in the current state of the ring, and is therefore assigned to the first one
+// of them (the one with the smallest name). A key that is equal to the name of
+// the last virtual node does not wrap around. It returns false if the ring is
+// empty.
+//
+// Complexity: O( 1 )
+func (r *HashRing) WrapsAround(key []byte) bool {
+	state := r.state.Load().(*hashRingState)
+	if len(state.virtualNodes) == 0 {
+		return false
+	}
+	return state.compareNames(key, state.virtualNodes[len(state.virtualNodes)-1].Name()) > 0
+}
+
+// VirtualNodesLen returns the number of virtual nodes in the current state of
+// the ring.
+func (r *HashRing) VirtualNodesLen() int {
+	return len(r.state.Load().(*hashRingState).virtualNodes)
+}
+
+// IndexForKey returns the index (in the sorted order of the virtual nodes in
+// the current state of the ring) of the virtual node that the given key is
+// assigned to, or a non-nil error if the ring is empty.
+//
+// Note that indices are only meaningful for as long as the ring is not
+// modified; see Generation.
+//
+// Complexity: O( log(V*N) )
+func (r *HashRing) IndexForKey(key []byte) (int, error) {
+	state := r.state.Load().(*hashRingState)
+	if len(state.virtualNodes) == 0 {
+		return -1, fmt.Errorf("empty ring")
+	}
+	return state.search(key), nil
+}
+
+// VirtualNodeAt returns the virtual node at the given index, in the sorted
+// order of the virtual nodes in the current state of the ring. The index wraps
+// around modulo the number of virtual nodes in both directions, hence
+// VirtualNodeAt(VirtualNodesLen()) returns the first virtual node, whereas
+// VirtualNodeAt(-1) returns the last one. It returns a non-nil error if the
+// ring is empty.
+//
+// Along with IndexForKey, it allows navigating the ring clockwise (i+1) or
+// counter-clockwise (i-1) by position rather than by key.
+//
+// Complexity: O( 1 )
+func (r *HashRing) VirtualNodeAt(i int) (*VirtualNode, error) {
+	state := r.state.Load().(*hashRingState)
+	n := len(state.virtualNodes)
+	if n == 0 {
+		return nil, fmt.Errorf("empty ring")
+	}
+	return state.virtualNodes[((i%n)+n)%n], nil
+}
+
+// VirtualNodesInRange returns the virtual nodes in the current state of the
+// ring whose names fall in [start, end), in ring order. If start is greater
+// than end, the range wraps around the end of the keyspace, i.e. it contains
+// the names that are greater than or equal to start, followed by those that are
+// less than end. If start and end are equal, the range is empty. An empty slice
+// is returned if no virtual node falls in the range.
+//
+// Complexity: O( log(V*N) + K ), where K is the number of virtual nodes returned
+func (r *HashRing) VirtualNodesInRange(start, end []byte) []*VirtualNode {
+	return r.state.Load().(*hashRingState).virtualNodesInRange(start, end)
+}
+
 // HasVirtualNode returns true if the given key corresponds to a virtual node
 // in the ring, or false otherwise.
 //
@@ -301,6 +1971,35 @@ func (r *HashRing) NewVirtualNodesIterator() *VirtualNodesIterator {
 	}
 }
 
+// NewVirtualNodesIteratorFrom returns a new VirtualNodesIterator for
+// efficiently iterating through ring's virtual nodes in (alphanumerical) order,
+// starting from the virtual node that the given key is assigned to (as
+// returned by VirtualNodeForKey), and wrapping around the end of the ring back
+// to the virtual node right before it, e.g. for range-scan style traversals.
+//
+// Complexity: O( log(V*N) )
+func (r *HashRing) NewVirtualNodesIteratorFrom(key []byte) *VirtualNodesIterator {
+	currState := r.state.Load().(*hashRingState)
+	iter := &VirtualNodesIterator{
+		ring: currState,
+		curr: 0,
+	}
+	if len(currState.virtualNodes) > 0 {
+		iter.offset = currState.search(key)
+	}
+	return iter
+}
+
+// NewReplicaOwnersIterator returns a new ReplicaOwnersIterator for efficiently
+// iterating through ring's virtual nodes in (alphanumerical) order, along with
+// the replica owners of each one of them.
+func (r *HashRing) NewReplicaOwnersIterator() *ReplicaOwnersIterator {
+	return &ReplicaOwnersIterator{
+		ring: r.state.Load().(*hashRingState),
+		curr: 0,
+	}
+}
+
 // NewVirtualNodesReverseIterator returns a new VirtualNodesReverseIterator for
 // efficiently iterating through ring's virtual nodes in reverse
 // (alphanumerical) order.
@@ -311,3 +2010,24 @@ func (r *HashRing) NewVirtualNodesReverseIterator() *VirtualNodesReverseIterator
 		curr: len(currState.virtualNodes) - 1,
 	}
 }
+
+// NewVirtualNodesReverseIteratorFrom returns a new VirtualNodesReverseIterator
+// for efficiently iterating through ring's virtual nodes in reverse
+// (alphanumerical) order, starting from the virtual node that the given key is
+// assigned to (as returned by VirtualNodeForKey), and wrapping around the
+// beginning of the ring back to the virtual node right after it.
+//
+// Complexity: O( log(V*N) )
+func (r *HashRing) NewVirtualNodesReverseIteratorFrom(key []byte) *VirtualNodesReverseIterator {
+	currState := r.state.Load().(*hashRingState)
+	iter := &VirtualNodesReverseIterator{
+		ring: currState,
+		curr: len(currState.virtualNodes) - 1,
+	}
+	if len(currState.virtualNodes) > 0 {
+		// The first virtual node of the iteration is the one at index
+		// (curr+offset) % len(virtualNodes), with curr at its maximum.
+		iter.offset = currState.search(key) + 1
+	}
+	return iter
+}
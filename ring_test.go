@@ -16,18 +16,25 @@ package lfchring
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"encoding/csv"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
+	"math"
 	"math/big"
 	"math/rand"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unsafe"
 	//"golang.org/x/crypto/blake2b"
 )
 
@@ -57,7 +64,7 @@ func checkVirtualNodes(t *testing.T, r *HashRing) {
 		} else {
 			numVNIDs[state.virtualNodes[i].Node()] = 1
 		}
-		if bytes.Compare(state.virtualNodes[i].Name(), state.virtualNodes[i+1].Name()) >= 0 {
+		if state.compareNames(state.virtualNodes[i].Name(), state.virtualNodes[i+1].Name()) >= 0 {
 			t.Errorf("%x == state.virtualNodes[%d] >= state.virtualNodes[%d] == %x\n",
 				state.virtualNodes[i], i, i+1, state.virtualNodes[i+1])
 		}
@@ -99,6 +106,11 @@ func TestNewRingBadValues(t *testing.T) {
 	} else {
 		t.Errorf("Expected error from NewHashRing()\n")
 	}
+	if _, err := NewHashRing(hashFunc, 1<<16, 1); err != nil {
+		t.Logf("NewHashRing(hashFunc, 1<<16, 1): %v\n", err)
+	} else {
+		t.Errorf("Expected error from NewHashRing()\n")
+	}
 }
 
 func TestNewEmptyRing(t *testing.T) {
@@ -1162,111 +1174,5594 @@ func TestHasVirtualNodeBigRing(t *testing.T)      { testHasVirtualNode(t, 2, 128
 func TestHasVirtualNodeHugeRing(t *testing.T)     { testHasVirtualNode(t, 2, 256, 512) }
 func TestHasVirtualNodeGiganticRing(t *testing.T) { testHasVirtualNode(t, 2, 512, 1024) }
 
-/*
- * BENCHMARKS
- *
- * To run only the benchmarks:
- *	$ go test -v -bench=. -benchtime=9s -benchmem -run=matchnothingregex
- */
+func TestOwnerSetForKey(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 3, 8, "node-0", "node-1", "node-2", "node-3", "node-4")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
 
-func benchmarkNewHashRing(b *testing.B, hash func([]byte) []byte, replicationFactor, numVnodes, numNodes int) {
+	for i := 0x00; i < 0x10; i++ {
+		key := hashFunc([]byte(strconv.Itoa(i)))
+		owners := r.NodesForKey(key)
+		set := r.OwnerSetForKey(key)
+		if set.Len() != len(owners) {
+			t.Errorf("OwnerSetForKey(%x).Len() == %d; expected %d\n", key, set.Len(), len(owners))
+		}
+		for j := 0; j < 5; j++ {
+			node := Node(fmt.Sprintf("node-%d", j))
+			expected := false
+			for _, owner := range owners {
+				if owner == node {
+					expected = true
+				}
+			}
+			if set.Contains(node) != expected {
+				t.Errorf("OwnerSetForKey(%x).Contains(%q) == %t; expected %t\n", key, node, !expected, expected)
+			}
+		}
+		// Modifying the returned nodes must not affect the ring.
+		setNodes := set.Nodes()
+		setNodes[0] = "garbage"
+		if r.NodesForKey(key)[0] == "garbage" {
+			t.Errorf("OwnerSet.Nodes() exposed the ring's internal slice\n")
+		}
+	}
+}
+
+func testWithoutReplicaOwnerMap(t *testing.T, replicationFactor, numVnodes, numNodes int) {
 	nodes := make([]Node, numNodes)
 	for i := 0; i < numNodes; i++ {
 		nodes[i] = Node(fmt.Sprintf("node-%d", i))
 	}
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		r, _ = NewHashRing(hash, replicationFactor, numVnodes, nodes...)
+	r1, err := NewHashRing(hashFunc, replicationFactor, numVnodes, nodes...)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
 	}
-}
+	r2, err := NewHashRingWithOptions(hashFunc, replicationFactor, numVnodes, WithoutReplicaOwnerMap())
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r2.Insert(nodes...); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if state := r2.state.Load().(*hashRingState); state.replicaOwners != nil {
+		t.Errorf("Ring without replica owner map has %d replica owner entries\n", len(state.replicaOwners))
+	}
+	checkVirtualNodes(t, r2)
 
-//func BenchmarkNewHashRing_4x256_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 4, 256) }
-//func BenchmarkNewHashRing_4x256_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 4, 256) }
-func BenchmarkNewHashRing_4x256(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 4, 256) }
+	iter1, iter2 := r1.NewReplicaOwnersIterator(), r2.NewReplicaOwnersIterator()
+	for iter1.HasNext() && iter2.HasNext() {
+		vn1, owners1 := iter1.Next()
+		vn2, owners2 := iter2.Next()
+		if !bytes.Equal(vn1.name, vn2.name) {
+			t.Errorf("%s != %s\n", vn1, vn2)
+			t.FailNow()
+		}
+		if fmt.Sprint(owners1) != fmt.Sprint(owners2) {
+			t.Errorf("Iterator owners of %s: %v != %v\n", vn1, owners1, owners2)
+		}
+		if nodes1, nodes2 := r1.NodesForKey(vn1.name), r2.NodesForKey(vn2.name); fmt.Sprint(nodes1) != fmt.Sprint(nodes2) {
+			t.Errorf("NodesForKey(%x): %v != %v\n", vn1.name, nodes1, nodes2)
+		}
+	}
+	if iter1.HasNext() || iter2.HasNext() {
+		t.Errorf("Iterators of equivalent rings yielded different numbers of virtual nodes\n")
+	}
+}
+func TestWithoutReplicaOwnerMapTinyRing(t *testing.T)   { testWithoutReplicaOwnerMap(t, 3, 4, 4) }
+func TestWithoutReplicaOwnerMapRfLtDnRing(t *testing.T) { testWithoutReplicaOwnerMap(t, 16, 128, 15) }
+func TestWithoutReplicaOwnerMapBigRing(t *testing.T)    { testWithoutReplicaOwnerMap(t, 3, 128, 128) }
 
-//func BenchmarkNewHashRing_4x512_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 4, 512) }
-//func BenchmarkNewHashRing_4x512_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 4, 512) }
-func BenchmarkNewHashRing_4x512(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 4, 512) }
+func TestLargestArc(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if _, _, _, err = r.LargestArc(); err == nil {
+		t.Errorf("LargestArc(): expected an error for an empty ring\n")
+	}
 
-//func BenchmarkNewHashRing_4x1024_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 4, 1024) }
-//func BenchmarkNewHashRing_4x1024_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 4, 1024) }
-func BenchmarkNewHashRing_4x1024(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 4, 1024) }
+	if _, err = r.Insert("node-0"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	owner, lo, hi, err := r.LargestArc()
+	if err != nil {
+		t.Errorf("LargestArc(): %v\n", err)
+		t.FailNow()
+	}
+	if owner != "node-0" || !bytes.Equal(lo, hi) {
+		t.Errorf("LargestArc() == (%q, %x, %x); expected the whole ring for node-0\n", owner, lo, hi)
+	}
 
-//func BenchmarkNewHashRing_8x128_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 8, 128) }
-//func BenchmarkNewHashRing_8x128_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 8, 128) }
-func BenchmarkNewHashRing_8x128(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 8, 128) }
+	if _, err = r.Insert("node-1", "node-2", "node-3"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	owner, lo, hi, err = r.LargestArc()
+	if err != nil {
+		t.Errorf("LargestArc(): %v\n", err)
+		t.FailNow()
+	}
+	// All virtual nodes in (lo, hi] must belong to the reported owner,
+	// whereas the one at lo and the one after hi must not.
+	if vn := r.VirtualNodeForKey(lo); vn.node == owner {
+		t.Errorf("LargestArc(): virtual node %s at lo belongs to owner %q\n", vn, owner)
+	}
+	largest := arcLength(lo, hi, len(hi))
+	for vn, _ := r.Successor(lo); ; vn, _ = r.Successor(vn.name) {
+		if vn.node != owner {
+			t.Errorf("LargestArc(): virtual node %s in arc does not belong to owner %q\n", vn, owner)
+		}
+		if bytes.Equal(vn.name, hi) {
+			break
+		}
+	}
+	if vn, _ := r.Successor(hi); vn.node == owner {
+		t.Errorf("LargestArc(): virtual node %s after hi belongs to owner %q\n", vn, owner)
+	}
 
-//func BenchmarkNewHashRing_8x256_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 8, 256) }
-//func BenchmarkNewHashRing_8x256_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 8, 256) }
-func BenchmarkNewHashRing_8x256(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 8, 256) }
+	// No single virtual node's arc may be larger than the largest arc.
+	vns := make([]*VirtualNode, 0)
+	for vn := range r.VirtualNodes(nil) {
+		vns = append(vns, vn)
+	}
+	for i := range vns {
+		prev := vns[(i+len(vns)-1)%len(vns)]
+		if l := arcLength(prev.name, vns[i].name, len(hi)); l.Cmp(largest) > 0 {
+			t.Errorf("Arc of %s is larger than the reported largest arc\n", vns[i])
+		}
+	}
+}
 
-//func BenchmarkNewHashRing_8x512_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 8, 512) }
-//func BenchmarkNewHashRing_8x512_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 8, 512) }
-func BenchmarkNewHashRing_8x512(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 8, 512) }
+func TestSplitPointOf(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	for _, tc := range []struct{ lo, hi, expected []byte }{
+		{[]byte{0x00, 0x00}, []byte{0x10, 0x00}, []byte{0x08, 0x00}},
+		{[]byte{0xf0, 0x00}, []byte{0x10, 0x00}, []byte{0x00, 0x00}},
+		{[]byte{0x00, 0x00}, []byte{0x00, 0x00}, []byte{0x80, 0x00}},
+		{[]byte{0x00, 0x01}, []byte{0x00, 0x04}, []byte{0x00, 0x02}},
+	} {
+		if split := r.SplitPointOf(tc.lo, tc.hi); !bytes.Equal(split, tc.expected) {
+			t.Errorf("SplitPointOf(%x, %x) == %x; expected %x\n", tc.lo, tc.hi, split, tc.expected)
+		}
+	}
+}
 
-//func BenchmarkNewHashRing_16x64_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 16, 64) }
-//func BenchmarkNewHashRing_16x64_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 16, 64) }
-func BenchmarkNewHashRing_16x64(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 16, 64) }
+func TestGeneration(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 4, "node-0")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	gen := r.Generation()
+	if _, err = r.Insert("node-1"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if r.Generation() != gen+1 {
+		t.Errorf("Generation() == %d after Insert(); expected %d\n", r.Generation(), gen+1)
+	}
+	if _, err = r.Insert("node-0"); err == nil {
+		t.Errorf("Insert(): expected an error for an existing node\n")
+	}
+	if r.Generation() != gen+1 {
+		t.Errorf("Generation() == %d after failed Insert(); expected %d\n", r.Generation(), gen+1)
+	}
+	if _, err = r.Remove("node-0"); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+		t.FailNow()
+	}
+	if r.Generation() != gen+2 {
+		t.Errorf("Generation() == %d after Remove(); expected %d\n", r.Generation(), gen+2)
+	}
+	if r2 := r.Clone(); r2.Generation() != r.Generation() {
+		t.Errorf("Clone().Generation() == %d; expected %d\n", r2.Generation(), r.Generation())
+	}
+}
 
-//func BenchmarkNewHashRing_16x128_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 16, 128) }
-//func BenchmarkNewHashRing_16x128_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 16, 128) }
-func BenchmarkNewHashRing_16x128(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 16, 128) }
+func TestWithReadState(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 4, "node-0", "node-1")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	key := hashFunc([]byte("key"))
+	r.WithReadState(func(rs ReadSnapshot) {
+		gen := rs.Generation()
+		owners := rs.NodesForKey(key)
+
+		// Modify the ring while still reading through the snapshot.
+		if _, err := r.Insert("node-2", "node-3", "node-4"); err != nil {
+			t.Errorf("Insert(): %v\n", err)
+			t.FailNow()
+		}
 
-//func BenchmarkNewHashRing_16x256_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 16, 256) }
-//func BenchmarkNewHashRing_16x256_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 16, 256) }
-func BenchmarkNewHashRing_16x256(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 16, 256) }
+		if rs.Generation() != gen {
+			t.Errorf("ReadSnapshot.Generation() changed from %d to %d\n", gen, rs.Generation())
+		}
+		if rs.Size() != 2 {
+			t.Errorf("ReadSnapshot.Size() == %d; expected 2\n", rs.Size())
+		}
+		if fmt.Sprint(rs.NodesForKey(key)) != fmt.Sprint(owners) {
+			t.Errorf("ReadSnapshot.NodesForKey() changed from %v to %v\n", owners, rs.NodesForKey(key))
+		}
+		if vn := rs.VirtualNodeForKey(key); vn.node != owners[0] {
+			t.Errorf("ReadSnapshot.VirtualNodeForKey() == %s; expected one of %q\n", vn, owners[0])
+		}
+		if !rs.OwnerSetForKey(key).Contains(owners[1]) {
+			t.Errorf("ReadSnapshot.OwnerSetForKey() does not contain %q\n", owners[1])
+		}
+	})
+	if r.Size() != 5 {
+		t.Errorf("Size() == %d; expected 5\n", r.Size())
+	}
+}
 
-//func BenchmarkNewHashRing_32x32_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 32, 32) }
-//func BenchmarkNewHashRing_32x32_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 32, 32) }
-func BenchmarkNewHashRing_32x32(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 32, 32) }
+func TestHashMigrationImpact(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 16)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	sampleKeys := make([][]byte, 1000)
+	for i := range sampleKeys {
+		sampleKeys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+	if _, err = r.HashMigrationImpact(sha256Hash, sampleKeys); err == nil {
+		t.Errorf("HashMigrationImpact(): expected an error for an empty ring\n")
+	}
+	if _, err = r.Insert("node-0", "node-1", "node-2", "node-3"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.HashMigrationImpact(nil, sampleKeys); err == nil {
+		t.Errorf("HashMigrationImpact(): expected an error for a nil hash function\n")
+	}
+	if _, err = r.HashMigrationImpact(sha256Hash, nil); err == nil {
+		t.Errorf("HashMigrationImpact(): expected an error for no sample keys\n")
+	}
 
-//func BenchmarkNewHashRing_32x64_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 32, 64) }
-//func BenchmarkNewHashRing_32x64_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 32, 64) }
-func BenchmarkNewHashRing_32x64(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 32, 64) }
+	// Migrating to the same hash function should move nothing.
+	impact, err := r.HashMigrationImpact(sha256Hash, sampleKeys)
+	if err != nil {
+		t.Errorf("HashMigrationImpact(): %v\n", err)
+		t.FailNow()
+	}
+	if impact != 0 {
+		t.Errorf("HashMigrationImpact(sha256) == %f; expected 0\n", impact)
+	}
 
-//func BenchmarkNewHashRing_32x128_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 32, 128) }
-//func BenchmarkNewHashRing_32x128_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 32, 128) }
-func BenchmarkNewHashRing_32x128(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 32, 128) }
+	// Migrating to a different hash function should move most keys.
+	gen := r.Generation()
+	otherHash := func(in []byte) []byte {
+		out := sha256.Sum256(append([]byte("salt"), in...))
+		return out[:]
+	}
+	impact, err = r.HashMigrationImpact(otherHash, sampleKeys)
+	if err != nil {
+		t.Errorf("HashMigrationImpact(): %v\n", err)
+		t.FailNow()
+	}
+	if impact < 0.5 || impact > 1 {
+		t.Errorf("HashMigrationImpact(otherHash) == %f; expected roughly 0.75\n", impact)
+	}
+	if r.Generation() != gen {
+		t.Errorf("HashMigrationImpact() modified the ring\n")
+	}
+}
 
-//func BenchmarkNewHashRing_32x256_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 32, 256) }
-//func BenchmarkNewHashRing_32x256_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 32, 256) }
-func BenchmarkNewHashRing_32x256(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 32, 256) }
+func TestHashName(t *testing.T) {
+	r1, err := NewHashRingWithOptions(hashFunc, 2, 4, WithHashName("sha256"))
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	if r1.HashName() != "sha256" {
+		t.Errorf("HashName() == %q; expected %q\n", r1.HashName(), "sha256")
+	}
+	if _, err = r1.Insert("node-0"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if r1.HashName() != "sha256" || r1.Clone().HashName() != "sha256" {
+		t.Errorf("Hash name was not preserved across Insert() and Clone()\n")
+	}
 
-//func BenchmarkNewHashRing_64x32_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 64, 32) }
-//func BenchmarkNewHashRing_64x32_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 64, 32) }
-func BenchmarkNewHashRing_64x32(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 64, 32) }
+	r2, _ := NewHashRingWithOptions(hashFunc, 2, 4, WithHashName("sha256"))
+	r3, _ := NewHashRingWithOptions(hashFunc, 2, 4, WithHashName("blake2b"))
+	r4, _ := NewHashRing(hashFunc, 2, 4)
+	if r4.HashName() != "" {
+		t.Errorf("HashName() == %q; expected an empty name by default\n", r4.HashName())
+	}
+	if err = r1.CheckHashCompatible(r2); err != nil {
+		t.Errorf("CheckHashCompatible(): %v\n", err)
+	}
+	if err = r1.CheckHashCompatible(r4); err != nil {
+		t.Errorf("CheckHashCompatible(): %v\n", err)
+	}
+	if err = r1.CheckHashCompatible(r3); err == nil {
+		t.Errorf("CheckHashCompatible(): expected an error for different hash names\n")
+	}
+}
 
-//func BenchmarkNewHashRing_64x64_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 64, 64) }
-//func BenchmarkNewHashRing_64x64_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 64, 64) }
-func BenchmarkNewHashRing_64x64(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 64, 64) }
+func TestArcLengthHistogram(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 64)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if hist := r.ArcLengthHistogram(0); hist != nil {
+		t.Errorf("ArcLengthHistogram(0) == %v; expected nil\n", hist)
+	}
+	if hist := r.ArcLengthHistogram(4); fmt.Sprint(hist) != "[0 0 0 0]" {
+		t.Errorf("ArcLengthHistogram(4) == %v for an empty ring; expected no arcs\n", hist)
+	}
 
-//func BenchmarkNewHashRing_64x128_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 64, 128) }
-//func BenchmarkNewHashRing_64x128_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 64, 128) }
-func BenchmarkNewHashRing_64x128(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 64, 128) }
+	if _, err = r.Insert("node-0"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	sum := 0.0
+	for _, f := range r.state.Load().(*hashRingState).arcFractions() {
+		sum += f
+	}
+	if sum < 0.999999 || sum > 1.000001 {
+		t.Errorf("Arcs sum up to %f of the keyspace; expected 1\n", sum)
+	}
 
-//func BenchmarkNewHashRing_64x256_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 64, 256) }
-//func BenchmarkNewHashRing_64x256_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 64, 256) }
-func BenchmarkNewHashRing_64x256(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 64, 256) }
+	if _, err = r.Insert("node-1", "node-2", "node-3"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	hist := r.ArcLengthHistogram(100)
+	total := 0
+	for _, count := range hist {
+		total += count
+	}
+	if total != 4*64 {
+		t.Errorf("ArcLengthHistogram() counted %d arcs; expected %d\n", total, 4*64)
+	}
+	// With 256 virtual nodes, no arc should be anywhere near half the
+	// keyspace.
+	for b := 50; b < 100; b++ {
+		if hist[b] != 0 {
+			t.Errorf("ArcLengthHistogram(100)[%d] == %d; expected 0\n", b, hist[b])
+		}
+	}
+}
 
-//func BenchmarkNewHashRing_128x16_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 128, 16) }
-//func BenchmarkNewHashRing_128x16_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 128, 16) }
-func BenchmarkNewHashRing_128x16(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 128, 16) }
+func TestDraining(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 3, 8, "node-0", "node-1", "node-2", "node-3")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if err = r.SetDraining("node-9", true); err == nil {
+		t.Errorf("SetDraining(): expected an error for a node not in the ring\n")
+	}
+	if err = r.SetDraining("node-0", true); err != nil {
+		t.Errorf("SetDraining(): %v\n", err)
+		t.FailNow()
+	}
+	r2 := r.Clone()
 
-//func BenchmarkNewHashRing_128x32_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 128, 32) }
-//func BenchmarkNewHashRing_128x32_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 128, 32) }
-func BenchmarkNewHashRing_128x32(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 128, 32) }
+	for vn := range r.VirtualNodes(nil) {
+		owners := r.NodesForKey(vn.name)
+		drained := r.NodesForKeyRespectingDrain(vn.name)
+		if len(owners) != len(drained) {
+			t.Errorf("NodesForKeyRespectingDrain(%x) == %v; expected a permutation of %v\n", vn.name, drained, owners)
+			continue
+		}
+		if drained[0] == "node-0" {
+			t.Errorf("NodesForKeyRespectingDrain(%x) == %v; draining node is primary\n", vn.name, drained)
+		}
+		if !r.OwnerSetForKey(vn.name).Contains("node-0") {
+			continue
+		}
+		if drained[len(drained)-1] != "node-0" {
+			t.Errorf("NodesForKeyRespectingDrain(%x) == %v; expected draining node last\n", vn.name, drained)
+		}
+		if fmt.Sprint(r2.NodesForKeyRespectingDrain(vn.name)) != fmt.Sprint(drained) {
+			t.Errorf("Draining mark was not preserved by Clone()\n")
+		}
+	}
 
-//func BenchmarkNewHashRing_128x64_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 128, 64) }
-//func BenchmarkNewHashRing_128x64_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 128, 64) }
-func BenchmarkNewHashRing_128x64(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 128, 64) }
+	if err = r.SetDraining("node-0", false); err != nil {
+		t.Errorf("SetDraining(): %v\n", err)
+		t.FailNow()
+	}
+	for vn := range r.VirtualNodes(nil) {
+		if fmt.Sprint(r.NodesForKey(vn.name)) != fmt.Sprint(r.NodesForKeyRespectingDrain(vn.name)) {
+			t.Errorf("NodesForKeyRespectingDrain(%x) differs from NodesForKey() without draining nodes\n", vn.name)
+		}
+	}
+}
 
-//func BenchmarkNewHashRing_128x128_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 128, 128) }
-//func BenchmarkNewHashRing_128x128_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 128, 128) }
-func BenchmarkNewHashRing_128x128(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 128, 128) }
+func testReplicaChain(t *testing.T, replicationFactor, numVnodes, numNodes int) {
+	nodes := make([]Node, numNodes)
+	for i := 0; i < numNodes; i++ {
+		nodes[i] = Node(fmt.Sprintf("node-%d", i))
+	}
+	r, err := NewHashRing(hashFunc, replicationFactor, numVnodes, nodes...)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.ReplicaChain(&VirtualNode{name: hashFunc([]byte("garbage"))}); err == nil {
+		t.Errorf("ReplicaChain(): expected an error for a virtual node not in the ring\n")
+	}
 
-//func BenchmarkNewHashRing_128x256_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 128, 256) }
-//func BenchmarkNewHashRing_128x256_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 128, 256) }
-func BenchmarkNewHashRing_128x256(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 128, 256) }
+	for vn := range r.VirtualNodes(nil) {
+		chain, err := r.ReplicaChain(vn)
+		if err != nil {
+			t.Errorf("ReplicaChain(%s): %v\n", vn, err)
+			t.FailNow()
+		}
+		owners := r.NodesForKey(vn.name)
+		if len(chain) != len(owners)-1 {
+			t.Errorf("ReplicaChain(%s) has length %d; expected %d\n", vn, len(chain), len(owners)-1)
+			t.FailNow()
+		}
+		// Each link of the chain must be the first virtual node of
+		// the corresponding owner, clockwise of the previous link.
+		prev := vn
+		for i, link := range chain {
+			if link.node != owners[i+1] {
+				t.Errorf("ReplicaChain(%s)[%d] == %s; expected a virtual node of %q\n", vn, i, link, owners[i+1])
+			}
+			for succ, _ := r.Successor(vn.name); succ != link; succ, _ = r.Successor(succ.name) {
+				if succ.node == link.node {
+					t.Errorf("ReplicaChain(%s)[%d] == %s; but %s comes first\n", vn, i, link, succ)
+				}
+			}
+			if distance(vn.name, link.name, len(vn.name)).Cmp(distance(vn.name, prev.name, len(vn.name))) <= 0 {
+				t.Errorf("ReplicaChain(%s) is not in clockwise order\n", vn)
+			}
+			prev = link
+		}
+	}
+}
+func TestReplicaChainTinyRing(t *testing.T)   { testReplicaChain(t, 3, 4, 4) }
+func TestReplicaChainRfLtDnRing(t *testing.T) { testReplicaChain(t, 16, 32, 15) }
+func TestReplicaChainMediumRing(t *testing.T) { testReplicaChain(t, 3, 64, 32) }
+
+// stringData returns the address of the bytes underlying the given string.
+func stringData(s string) uintptr {
+	return (*[2]uintptr)(unsafe.Pointer(&s))[0]
+}
+
+func TestInternedNodes(t *testing.T) {
+	r, err := NewHashRingWithOptions(hashFunc, 3, 8, WithInternedNodes())
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	// Slice the identifiers of the nodes out of a larger buffer.
+	buf := strings.Repeat("x", 1024)
+	nodes := []Node{Node(buf[:64]), Node(buf[:65]), Node(buf[:66])}
+	if _, err = r.Insert(nodes...); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	checkVirtualNodes(t, r)
+
+	state := r.state.Load().(*hashRingState)
+	for _, vn := range state.virtualNodes {
+		canonical, exists := state.interned[vn.node]
+		if !exists {
+			t.Errorf("Node of %s has not been interned\n", vn)
+			continue
+		}
+		if stringData(string(vn.node)) != stringData(string(canonical)) {
+			t.Errorf("Node of %s does not refer to its canonical copy\n", vn)
+		}
+		if stringData(string(vn.node)) == stringData(buf) {
+			t.Errorf("Node of %s still refers to the caller's buffer\n", vn)
+		}
+	}
+	for i, owners := range state.replicaOwners {
+		for _, owner := range owners {
+			if stringData(string(owner)) != stringData(string(state.interned[owner])) {
+				t.Errorf("Owner %q of virtual node #%d does not refer to its canonical copy\n", owner, i)
+			}
+		}
+	}
+
+	if _, err = r.Remove(nodes[0]); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+		t.FailNow()
+	}
+	if state = r.state.Load().(*hashRingState); len(state.interned) != 2 {
+		t.Errorf("%d nodes interned after Remove(); expected 2\n", len(state.interned))
+	}
+}
+
+// checkMigrations verifies that the given migrations between the two given
+// states of a ring are exactly the ranges whose replica owners changed, by
+// checking all keys at, and right after, the names of the virtual nodes of
+// both states.
+func checkMigrations(t *testing.T, oldState, newState *hashRingState, migs []Migration) {
+	t.Helper()
+	keys := make([][]byte, 0)
+	for _, s := range []*hashRingState{oldState, newState} {
+		for _, vn := range s.virtualNodes {
+			next := new(big.Int).SetBytes(vn.name)
+			next.Add(next, big.NewInt(1))
+			keys = append(keys, vn.name, positionKey(next.Mod(next, keyspaceSize(len(vn.name))), len(vn.name)))
+		}
+	}
+	for _, key := range keys {
+		oldOwners, newOwners := oldState.nodesForKey(key), newState.nodesForKey(key)
+		var mig *Migration
+		for i := range migs {
+			if migs[i].Contains(key) {
+				if mig != nil {
+					t.Errorf("Key %x is contained in more than one migrations\n", key)
+				}
+				mig = &migs[i]
+			}
+		}
+		switch {
+		case mig == nil && !sameNodeSet(oldOwners, newOwners):
+			t.Errorf("Owners of key %x changed from %v to %v, but no migration was reported\n", key, oldOwners, newOwners)
+		case mig != nil && sameNodeSet(oldOwners, newOwners):
+			t.Errorf("Owners of key %x did not change (%v), but a migration was reported\n", key, oldOwners)
+		case mig != nil && (!sameNodes(mig.OldOwners, oldOwners) || !sameNodes(mig.NewOwners, newOwners)):
+			t.Errorf("Owners of key %x changed from %v to %v, but migration reports %v to %v\n",
+				key, oldOwners, newOwners, mig.OldOwners, mig.NewOwners)
+		}
+	}
+}
+
+func TestSimulateRemoveVirtualNode(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 3, 8, "node-0", "node-1", "node-2", "node-3", "node-4")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.SimulateRemoveVirtualNode("node-9", 0); err == nil {
+		t.Errorf("SimulateRemoveVirtualNode(): expected an error for a node not in the ring\n")
+	}
+	if _, err = r.SimulateRemoveVirtualNode("node-0", 8); err == nil {
+		t.Errorf("SimulateRemoveVirtualNode(): expected an error for a vnid not in the ring\n")
+	}
+
+	gen := r.Generation()
+	oldState := r.state.Load().(*hashRingState)
+	numMigs := 0
+	for vnid := uint16(0); vnid < 8; vnid++ {
+		migs, err := r.SimulateRemoveVirtualNode("node-2", vnid)
+		if err != nil {
+			t.Errorf("SimulateRemoveVirtualNode(): %v\n", err)
+			t.FailNow()
+		}
+		numMigs += len(migs)
+		newState := oldState.derive()
+		i, _ := newState.removeVirtualNode("node-2", vnid)
+		newState.removeVirtualNodeAt(i)
+		newState.fixReplicaOwners()
+		checkMigrations(t, oldState, newState, migs)
+	}
+	if numMigs == 0 {
+		t.Errorf("SimulateRemoveVirtualNode() reported no migrations for any virtual node\n")
+	}
+	if r.Generation() != gen || r.Size() != 5 {
+		t.Errorf("SimulateRemoveVirtualNode() modified the ring\n")
+	}
+}
+
+func TestKeyRangeContains(t *testing.T) {
+	for _, tc := range []struct {
+		kr       KeyRange
+		key      []byte
+		expected bool
+	}{
+		{KeyRange{Lo: []byte{0x10}, Hi: []byte{0x20}}, []byte{0x10}, false},
+		{KeyRange{Lo: []byte{0x10}, Hi: []byte{0x20}}, []byte{0x15}, true},
+		{KeyRange{Lo: []byte{0x10}, Hi: []byte{0x20}}, []byte{0x20}, true},
+		{KeyRange{Lo: []byte{0x10}, Hi: []byte{0x20}}, []byte{0x21}, false},
+		{KeyRange{Lo: []byte{0xf0}, Hi: []byte{0x10}}, []byte{0xff}, true},
+		{KeyRange{Lo: []byte{0xf0}, Hi: []byte{0x10}}, []byte{0x05}, true},
+		{KeyRange{Lo: []byte{0xf0}, Hi: []byte{0x10}}, []byte{0x80}, false},
+		{KeyRange{Lo: []byte{0x10}, Hi: []byte{0x10}}, []byte{0x80}, true},
+	} {
+		if tc.kr.Contains(tc.key) != tc.expected {
+			t.Errorf("(%x, %x].Contains(%x) == %t; expected %t\n", tc.kr.Lo, tc.kr.Hi, tc.key, !tc.expected, tc.expected)
+		}
+	}
+}
+
+func TestExplainKeys(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 4)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	keys := [][]byte{hashFunc([]byte("key-0")), hashFunc([]byte("key-1"))}
+	if table := r.ExplainKeys(keys); strings.Count(table, "\n") != 3 {
+		t.Errorf("ExplainKeys() on an empty ring:\n%s\nexpected a header and 2 rows\n", table)
+	}
+
+	if _, err = r.Insert("node-0", "node-1", "node-2"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	table := r.ExplainKeys(keys)
+	t.Log("\n" + table)
+	lines := strings.Split(strings.TrimSuffix(table, "\n"), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "KEY") {
+		t.Errorf("ExplainKeys():\n%s\nexpected a header and 2 rows\n", table)
+		t.FailNow()
+	}
+	for i, key := range keys {
+		row := lines[i+1]
+		if !strings.HasPrefix(row, hex.EncodeToString(key)) {
+			t.Errorf("Row %q does not start with key %x\n", row, key)
+		}
+		if !strings.Contains(row, r.VirtualNodeForKey(key).String()) {
+			t.Errorf("Row %q does not contain virtual node %s\n", row, r.VirtualNodeForKey(key))
+		}
+		if !strings.HasSuffix(row, fmt.Sprintf("%q", r.NodesForKey(key))) {
+			t.Errorf("Row %q does not end with owners %q\n", row, r.NodesForKey(key))
+		}
+	}
+}
+
+func TestInsertIfGeneration(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 4, "node-0")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	gen := r.Generation()
+	if _, err = r.InsertIfGeneration(gen+1, "node-1"); err != ErrStaleGeneration {
+		t.Errorf("InsertIfGeneration(): returned %v; expected ErrStaleGeneration\n", err)
+	}
+	if _, err = r.InsertIfGeneration(gen, "node-0"); err == nil || err == ErrStaleGeneration {
+		t.Errorf("InsertIfGeneration(): returned %v; expected an error for an existing node\n", err)
+	}
+	if r.Size() != 1 || r.Generation() != gen {
+		t.Errorf("Failed InsertIfGeneration() modified the ring\n")
+	}
+	vns, err := r.InsertIfGeneration(gen, "node-1")
+	if err != nil {
+		t.Errorf("InsertIfGeneration(): %v\n", err)
+		t.FailNow()
+	}
+	if len(vns) != 4 || r.Size() != 2 || r.Generation() != gen+1 {
+		t.Errorf("InsertIfGeneration() did not insert the node as expected\n")
+	}
+	if _, err = r.InsertIfGeneration(gen, "node-2"); err != ErrStaleGeneration {
+		t.Errorf("InsertIfGeneration(): returned %v; expected ErrStaleGeneration\n", err)
+	}
+}
+
+func TestParallelInsertIfGeneration(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 4)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	// Each coordinator keeps retrying to insert its node, until it
+	// succeeds; no insertion may be lost.
+	concurrency := 8
+	done := make(chan struct{})
+	for i := 0; i < concurrency; i++ {
+		go func(node Node) {
+			defer func() { done <- struct{}{} }()
+			for {
+				if _, err := r.InsertIfGeneration(r.Generation(), node); err != ErrStaleGeneration {
+					if err != nil {
+						t.Errorf("InsertIfGeneration(): %v\n", err)
+					}
+					return
+				}
+				runtime.Gosched()
+			}
+		}(Node(fmt.Sprintf("node-%d", i)))
+	}
+	for i := 0; i < concurrency; i++ {
+		<-done
+	}
+	if r.Size() != concurrency {
+		t.Errorf("Size() == %d; expected %d\n", r.Size(), concurrency)
+	}
+	checkVirtualNodes(t, r)
+}
+
+func TestReduceWeight(t *testing.T) {
+	nodes := []Node{"node-0", "node-1", "node-2", "node-3"}
+	r, err := NewHashRing(hashFunc, 2, 8, nodes...)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	for _, dropVnodes := range []int{-1, 0, 8, 9} {
+		if _, err = r.ReduceWeight("node-0", dropVnodes); err == nil {
+			t.Errorf("ReduceWeight(node-0, %d): expected an error\n", dropVnodes)
+		}
+	}
+	if _, err = r.ReduceWeight("node-4", 1); err == nil {
+		t.Errorf("ReduceWeight(node-4, 1): expected an error\n")
+	}
+
+	oldRing := r.Clone()
+	migrations, err := r.ReduceWeight("node-0", 3)
+	if err != nil {
+		t.Errorf("ReduceWeight(): %v\n", err)
+		t.FailNow()
+	}
+	state := r.state.Load().(*hashRingState)
+	if r.Size() != len(nodes) || len(state.virtualNodes) != len(nodes)*8-3 {
+		t.Errorf("ReduceWeight() left %d nodes and %d vnodes\n", r.Size(), len(state.virtualNodes))
+	}
+	for vnid := uint16(0); vnid < 8; vnid++ {
+		has := r.HasVirtualNode(hashFunc([]byte(fmt.Sprintf("node-0-%d", vnid))))
+		if has != (vnid < 5) {
+			t.Errorf("HasVirtualNode(node-0, %d) == %t\n", vnid, has)
+		}
+	}
+	if len(migrations) == 0 {
+		t.Errorf("ReduceWeight() returned no migrations\n")
+	}
+	checkMigrations(t, oldRing.state.Load().(*hashRingState), state, migrations)
+
+	// The node should still be removable as a whole.
+	removed, err := r.Remove("node-0")
+	if err != nil {
+		t.Errorf("Remove(): %v\n", err)
+		t.FailNow()
+	}
+	if len(removed) != 5 || r.Size() != len(nodes)-1 {
+		t.Errorf("Remove() removed %d vnodes, leaving %d nodes\n", len(removed), r.Size())
+	}
+	checkVirtualNodes(t, r)
+}
+
+func TestDistanceToNode(t *testing.T) {
+	nodes := []Node{"node-0", "node-1", "node-2", "node-3"}
+	r, err := NewHashRing(hashFunc, 2, 16, nodes...)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.DistanceToNode(hashFunc([]byte("key")), "node-4"); err == nil {
+		t.Errorf("DistanceToNode(): expected an error for a node not in the ring\n")
+	}
+	width := len(hashFunc(nil))
+	for i := 0; i < 100; i++ {
+		key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+		primary := r.VirtualNodeForKey(key)
+		for _, node := range nodes {
+			d, err := r.DistanceToNode(key, node)
+			if err != nil {
+				t.Errorf("DistanceToNode(%x, %q): %v\n", key, node, err)
+				t.FailNow()
+			}
+			// Moving the key by the distance should land it on one of
+			// target's virtual nodes.
+			moved := positionKey(new(big.Int).Mod(new(big.Int).Add(keyPosition(key, width), d), keyspaceSize(width)), width)
+			if vn := r.VirtualNodeForKey(moved); vn.Node() != node || !bytes.Equal(vn.Name(), moved) {
+				t.Errorf("DistanceToNode(%x, %q) == %v lands on %s\n", key, node, d, vn)
+			}
+			if node == primary.Node() && d.Cmp(distance(key, primary.Name(), width)) != 0 {
+				t.Errorf("DistanceToNode(%x, %q) == %v; expected the distance to %s\n", key, node, d, primary)
+			}
+		}
+		d, err := r.DistanceToNode(primary.Name(), primary.Node())
+		if err != nil || d.Sign() != 0 {
+			t.Errorf("DistanceToNode(%s) == (%v, %v); expected zero\n", primary, d, err)
+		}
+	}
+}
+
+func testSaveLoad(t *testing.T, replicationFactor, virtualNodeCount, numNodes int, compressed bool) {
+	nodes := make([]Node, numNodes)
+	for i := 0; i < numNodes; i++ {
+		nodes[i] = Node(fmt.Sprintf("Node-%d", i))
+	}
+	r, err := NewHashRingWithOptions(hashFunc, replicationFactor, virtualNodeCount, WithHashName("sha256"), WithInternedNodes())
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.Insert(nodes...); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.ReduceWeight(nodes[0], virtualNodeCount/2); err != nil {
+		t.Errorf("ReduceWeight(): %v\n", err)
+		t.FailNow()
+	}
+	if err = r.SetDraining(nodes[1], true); err != nil {
+		t.Errorf("SetDraining(): %v\n", err)
+		t.FailNow()
+	}
+
+	buf := &bytes.Buffer{}
+	if compressed {
+		err = r.SaveCompressed(buf)
+	} else {
+		err = r.Save(buf)
+	}
+	if err != nil {
+		t.Errorf("Save(): %v\n", err)
+		t.FailNow()
+	}
+	saved := buf.Bytes()
+	loaded, err := Load(hashFunc, bytes.NewReader(saved))
+	if err != nil {
+		t.Errorf("Load(): %v\n", err)
+		t.FailNow()
+	}
+	if loaded.String() != r.String() {
+		t.Errorf("Loaded ring differs from the saved one\n")
+	}
+	if loaded.HashName() != "sha256" || loaded.Size() != r.Size() {
+		t.Errorf("Loaded ring has hash name %q and %d nodes\n", loaded.HashName(), loaded.Size())
+	}
+	if loaded.Generation() != r.Generation() {
+		t.Errorf("Loaded ring at generation %d; expected %d\n", loaded.Generation(), r.Generation())
+	}
+	key := hashFunc([]byte("key"))
+	if !sameNodes(loaded.NodesForKeyRespectingDrain(key), r.NodesForKeyRespectingDrain(key)) {
+		t.Errorf("Loaded ring does not respect the draining nodes\n")
+	}
+	if loaded.state.Load().(*hashRingState).interned == nil {
+		t.Errorf("Loaded ring does not intern its nodes\n")
+	}
+
+	// Any truncation of the saved ring should be detected.
+	for _, n := range []int{0, 3, len(saved) / 2, len(saved) - 1} {
+		if _, err = Load(hashFunc, bytes.NewReader(saved[:n])); err == nil {
+			t.Errorf("Load(): expected an error for a ring truncated at %d bytes\n", n)
+		}
+	}
+}
+
+func TestSaveLoadTinyRing(t *testing.T)         { testSaveLoad(t, 2, 4, 4, false) }
+func TestSaveLoadMedium(t *testing.T)           { testSaveLoad(t, 3, 32, 64, false) }
+func TestSaveLoadCompressedMedium(t *testing.T) { testSaveLoad(t, 3, 32, 64, true) }
+
+func TestLoadBadValues(t *testing.T) {
+	for _, saved := range []string{"", "LFCX\x01\x00", "LFCH\x04\x00", "LFCH\x01\x00\x00\x04\x00\x00"} {
+		if _, err := Load(hashFunc, strings.NewReader(saved)); err != nil {
+			t.Logf("Load(%q): %v\n", saved, err)
+		} else {
+			t.Errorf("Load(%q): expected an error\n", saved)
+		}
+	}
+	r, _ := NewHashRing(hashFunc, 2, 4, "node-0")
+	buf := &bytes.Buffer{}
+	if err := r.Save(buf); err != nil {
+		t.Errorf("Save(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err := Load(nil, buf); err == nil {
+		t.Errorf("Load(): expected an error for a nil hash function\n")
+	}
+}
+
+func TestInitialGeneration(t *testing.T) {
+	r, err := NewHashRingWithOptions(hashFunc, 2, 4, WithInitialGeneration(42))
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	if gen := r.Generation(); gen != 42 {
+		t.Errorf("Generation() == %d; expected 42\n", gen)
+	}
+	if _, err = r.Insert("node-0", "node-1"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if gen := r.Generation(); gen != 43 {
+		t.Errorf("Generation() == %d; expected 43\n", gen)
+	}
+
+	// A ring saved in version 1 of the format starts over from generation 0.
+	v1 := "LFCH\x01\x00\x02\x04\x00\x01\x06node-0\x04\x00"
+	loaded, err := Load(hashFunc, strings.NewReader(v1))
+	if err != nil {
+		t.Errorf("Load(): %v\n", err)
+		t.FailNow()
+	}
+	if loaded.Generation() != 0 || loaded.Size() != 1 {
+		t.Errorf("Loaded ring at generation %d with %d nodes; expected 0 and 1\n", loaded.Generation(), loaded.Size())
+	}
+
+	// A ring saved in version 2 of the format lacks removed vnids.
+	v2 := "LFCH\x02\x00\x02\x04\x00\x07\x01\x06node-0\x04\x00"
+	if loaded, err = Load(hashFunc, strings.NewReader(v2)); err != nil {
+		t.Errorf("Load(): %v\n", err)
+		t.FailNow()
+	}
+	if loaded.Generation() != 7 || loaded.VirtualNodesLen() != 4 {
+		t.Errorf("Loaded ring at generation %d with %d virtual nodes; expected 7 and 4\n", loaded.Generation(), loaded.VirtualNodesLen())
+	}
+
+	// The generation is monotonic across Save and Load: it may only move
+	// forward from the saved one.
+	buf := &bytes.Buffer{}
+	if err = r.Save(buf); err != nil {
+		t.Errorf("Save(): %v\n", err)
+		t.FailNow()
+	}
+	saved := buf.Bytes()
+	if loaded, err = Load(hashFunc, bytes.NewReader(saved)); err != nil || loaded.Generation() != 43 {
+		t.Errorf("Load(): %v; loaded ring at generation %d, expected 43\n", err, loaded.Generation())
+		t.FailNow()
+	}
+	if _, err = loaded.Insert("node-2"); err != nil || loaded.Generation() != 44 {
+		t.Errorf("Insert(): %v; ring at generation %d, expected 44\n", err, loaded.Generation())
+	}
+	if _, err = LoadWithOptions(hashFunc, bytes.NewReader(saved), WithInitialGeneration(0)); err == nil {
+		t.Errorf("LoadWithOptions(): expected an error for a generation that goes backwards\n")
+	}
+	if loaded, err = LoadWithOptions(hashFunc, bytes.NewReader(saved), WithInitialGeneration(100)); err != nil || loaded.Generation() != 100 {
+		t.Errorf("LoadWithOptions(): %v; loaded ring at generation %d, expected 100\n", err, loaded.Generation())
+	}
+
+	// The generation never wraps around.
+	if r, err = NewHashRingWithOptions(hashFunc, 2, 4, WithInitialGeneration(math.MaxUint64-1)); err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.Insert("node-0"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	if _, err = r.Insert("node-1"); err != ErrGenerationOverflow {
+		t.Errorf("Insert() == %v; expected ErrGenerationOverflow\n", err)
+	}
+	if _, err = r.InsertIfGeneration(math.MaxUint64, "node-1"); err != ErrGenerationOverflow {
+		t.Errorf("InsertIfGeneration() == %v; expected ErrGenerationOverflow\n", err)
+	}
+	if err = r.SetMeta("node-0", map[string]string{"dc": "a"}); err != ErrGenerationOverflow {
+		t.Errorf("SetMeta() == %v; expected ErrGenerationOverflow\n", err)
+	}
+	if removed := r.Clear(); removed != nil {
+		t.Errorf("Clear() removed %d virtual nodes; expected none\n", len(removed))
+	}
+	if r.Generation() != math.MaxUint64 || r.Size() != 1 || r.Meta("node-0") != nil {
+		t.Errorf("ring at generation %d with %d nodes; expected it untouched\n", r.Generation(), r.Size())
+	}
+}
+
+func TestBatchError(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 4, "node-0", "node-1", "node-2")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	gen := r.Generation()
+
+	_, err = r.Insert("node-3", "node-2", "node-4", "node-0", "node-4", "node-2")
+	batchErr, ok := err.(*BatchError)
+	if !ok {
+		t.Errorf("Insert(): returned %v; expected a *BatchError\n", err)
+		t.FailNow()
+	}
+	expected := []string{"node-0", "node-2", "node-4"}
+	if len(batchErr.Unwrap()) != len(expected) {
+		t.Errorf("Insert(): %v; expected %d errors\n", err, len(expected))
+		t.FailNow()
+	}
+	for i, e := range batchErr.Unwrap() {
+		if !strings.Contains(e.Error(), fmt.Sprintf("%q", expected[i])) {
+			t.Errorf("Insert(): error #%d is %q; expected one about %q\n", i, e, expected[i])
+		}
+	}
+
+	_, err = r.Remove("node-5", "node-1", "node-3")
+	if batchErr, ok = err.(*BatchError); !ok || len(batchErr.Errs) != 2 {
+		t.Errorf("Remove(): returned %v; expected a *BatchError of 2 errors\n", err)
+	}
+	if r.Size() != 3 || r.Generation() != gen {
+		t.Errorf("Failed Insert() or Remove() modified the ring\n")
+	}
+	checkVirtualNodes(t, r)
+}
+
+func TestNodesForKeyCacheable(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if owners, _, arc := r.NodesForKeyCacheable(hashFunc([]byte("key"))); owners != nil || arc.Lo != nil || arc.Hi != nil {
+		t.Errorf("NodesForKeyCacheable(): expected no owners for an empty ring\n")
+	}
+	if _, err = r.Insert("node-0", "node-1", "node-2"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	for i := 0; i < 100; i++ {
+		key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+		owners, gen, arc := r.NodesForKeyCacheable(key)
+		if gen != r.Generation() {
+			t.Errorf("NodesForKeyCacheable(%x): generation %d; expected %d\n", key, gen, r.Generation())
+		}
+		if !sameNodes(owners, r.NodesForKey(key)) {
+			t.Errorf("NodesForKeyCacheable(%x): owners %q; expected %q\n", key, owners, r.NodesForKey(key))
+		}
+		if !arc.Contains(key) {
+			t.Errorf("NodesForKeyCacheable(%x): arc (%x, %x] does not contain the key\n", key, arc.Lo, arc.Hi)
+		}
+		// The same owners should apply to the bounds of the arc, but
+		// not to the key right after it.
+		if !sameNodes(r.NodesForKey(arc.Hi), owners) {
+			t.Errorf("NodesForKeyCacheable(%x): owners differ at the end of the arc\n", key)
+		}
+		if vn := r.VirtualNodeForKey(arc.Lo); bytes.Equal(vn.Name(), arc.Hi) {
+			t.Errorf("NodesForKeyCacheable(%x): the start of the arc belongs to it\n", key)
+		}
+	}
+
+	// Nodes that are excluded from reads are replaced, like in NodesForKey.
+	if err = r.SetReadExcluded("node-1", true); err != nil {
+		t.Errorf("SetReadExcluded(): %v\n", err)
+		t.FailNow()
+	}
+	for i := 0; i < 100; i++ {
+		key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+		owners, _, _ := r.NodesForKeyCacheable(key)
+		if expected := r.NodesForKey(key); !sameNodes(owners, expected) || r.OwnerSetForKey(key).Contains("node-1") {
+			t.Errorf("NodesForKeyCacheable(%x): owners %q; expected %q\n", key, owners, expected)
+		}
+	}
+}
+
+func testOwnershipTransitions(t *testing.T, replicationFactor, virtualNodeCount, numNodes int) {
+	r, err := NewHashRing(hashFunc, replicationFactor, virtualNodeCount)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if transitions := r.OwnershipTransitions(); len(transitions) != 0 {
+		t.Errorf("OwnershipTransitions() == %v; expected none for an empty ring\n", transitions)
+	}
+	for i := 0; i < numNodes; i++ {
+		if _, err = r.Insert(Node(fmt.Sprintf("Node-%d", i))); err != nil {
+			t.Errorf("Insert(): %v\n", err)
+			t.FailNow()
+		}
+	}
+	transitions := r.OwnershipTransitions()
+
+	// Replay the transitions, starting from the owners of the last arc,
+	// and check that they reconstruct the owners of all arcs.
+	state := r.state.Load().(*hashRingState)
+	owners := make(map[Node]struct{})
+	for _, node := range state.owners(len(state.virtualNodes) - 1) {
+		owners[node] = struct{}{}
+	}
+	next := 0
+	for i, vn := range state.virtualNodes {
+		if next < len(transitions) && bytes.Equal(transitions[next].Position, vn.name) {
+			for _, node := range transitions[next].Leaving {
+				delete(owners, node)
+			}
+			for _, node := range transitions[next].Entering {
+				owners[node] = struct{}{}
+			}
+			next++
+		}
+		expected := state.owners(i)
+		if len(owners) != len(expected) {
+			t.Errorf("Replayed %d owners at %s; expected %q\n", len(owners), vn, expected)
+			t.FailNow()
+		}
+		for _, node := range expected {
+			if _, exists := owners[node]; !exists {
+				t.Errorf("Replayed owners at %s lack %q\n", vn, node)
+				t.FailNow()
+			}
+		}
+	}
+	if next != len(transitions) {
+		t.Errorf("Replayed %d out of %d transitions\n", next, len(transitions))
+	}
+}
+
+func TestOwnershipTransitionsTinyRing(t *testing.T)   { testOwnershipTransitions(t, 2, 4, 4) }
+func TestOwnershipTransitionsSingleNode(t *testing.T) { testOwnershipTransitions(t, 2, 4, 1) }
+func TestOwnershipTransitionsMedium(t *testing.T)     { testOwnershipTransitions(t, 3, 32, 16) }
+
+func TestCheckHashQuality(t *testing.T) {
+	report, err := CheckHashQuality(hashFunc, 100000)
+	if err != nil {
+		t.Errorf("CheckHashQuality(): %v\n", err)
+		t.FailNow()
+	}
+	t.Logf("CheckHashQuality(sha256): %+v\n", report)
+	if !report.Uniform || report.MaxBucketDeviation > 0.5 {
+		t.Errorf("CheckHashQuality(sha256): %+v; expected a uniform distribution\n", report)
+	}
+
+	// A hash function that only ever uses the lower half of each byte.
+	weak := func(b []byte) []byte {
+		h := sha256Hash(b)
+		for i := range h {
+			h[i] &= 0x0f
+		}
+		return h
+	}
+	if report, err = CheckHashQuality(weak, 100000); err != nil {
+		t.Errorf("CheckHashQuality(): %v\n", err)
+		t.FailNow()
+	}
+	t.Logf("CheckHashQuality(weak): %+v\n", report)
+	if report.Uniform || report.MaxBucketDeviation < 1 {
+		t.Errorf("CheckHashQuality(weak): %+v; expected a non-uniform distribution\n", report)
+	}
+
+	if _, err = CheckHashQuality(nil, 100000); err == nil {
+		t.Errorf("CheckHashQuality(nil): expected an error\n")
+	}
+	if _, err = CheckHashQuality(hashFunc, 100); err == nil {
+		t.Errorf("CheckHashQuality(100 samples): expected an error\n")
+	}
+	varying := func(b []byte) []byte { return b[:b[0]%4] }
+	if _, err = CheckHashQuality(varying, 100000); err == nil {
+		t.Errorf("CheckHashQuality(varying): expected an error\n")
+	}
+}
+
+func TestVirtualNodeAt(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 4)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.VirtualNodeAt(0); err == nil {
+		t.Errorf("VirtualNodeAt(0): expected an error for an empty ring\n")
+	}
+	if _, err = r.IndexForKey(hashFunc([]byte("key"))); err == nil {
+		t.Errorf("IndexForKey(): expected an error for an empty ring\n")
+	}
+	if _, err = r.Insert("node-0", "node-1", "node-2"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	n := r.VirtualNodesLen()
+	if n != 12 {
+		t.Errorf("VirtualNodesLen() == %d; expected 12\n", n)
+	}
+	iter := r.NewVirtualNodesIterator()
+	for i := 0; iter.HasNext(); i++ {
+		vn := iter.Next()
+		for _, j := range []int{i, i + n, i - n, i + 3*n} {
+			if at, err := r.VirtualNodeAt(j); err != nil || at != vn {
+				t.Errorf("VirtualNodeAt(%d) == (%s, %v); expected %s\n", j, at, err, vn)
+			}
+		}
+		if j, err := r.IndexForKey(vn.Name()); err != nil || j != i {
+			t.Errorf("IndexForKey(%x) == (%d, %v); expected %d\n", vn.Name(), j, err, i)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+		j, err := r.IndexForKey(key)
+		if err != nil {
+			t.Errorf("IndexForKey(): %v\n", err)
+			t.FailNow()
+		}
+		if vn, _ := r.VirtualNodeAt(j); vn != r.VirtualNodeForKey(key) {
+			t.Errorf("VirtualNodeAt(IndexForKey(%x)) == %s; expected %s\n", key, vn, r.VirtualNodeForKey(key))
+		}
+	}
+}
+
+func TestRackConstraint(t *testing.T) {
+	rackOf := func(node Node) string { return fmt.Sprintf("rack-%c", node[len(node)-1]) }
+	for _, bad := range []struct {
+		rackOf   func(Node) string
+		minRacks int
+	}{{nil, 2}, {rackOf, 0}, {rackOf, 4}} {
+		if _, err := NewHashRingWithOptions(hashFunc, 3, 8, WithRackConstraint(bad.rackOf, bad.minRacks)); err == nil {
+			t.Errorf("NewHashRingWithOptions(): expected an error for minRacks %d\n", bad.minRacks)
+		}
+	}
+
+	r, err := NewHashRingWithOptions(hashFunc, 3, 16, WithRackConstraint(rackOf, 3))
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	// With only two racks, the constraint cannot hold, although all keys
+	// should still be replicated to three distinct nodes.
+	if _, err = r.Insert("n0-a", "n1-a", "n2-b", "n3-b"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if err = r.Validate(); err != nil {
+		t.Logf("Validate(): %v\n", err)
+	} else {
+		t.Errorf("Validate(): expected an error for a ring of two racks\n")
+	}
+	if owners := r.NodesForKey(hashFunc([]byte("key"))); len(owners) != 3 {
+		t.Errorf("NodesForKey() == %q; expected 3 owners\n", owners)
+	}
+
+	if _, err = r.Insert("n4-c", "n5-a", "n6-b", "n7-c", "n8-c"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if err = r.Validate(); err != nil {
+		t.Errorf("Validate(): %v\n", err)
+	}
+	iter := r.NewReplicaOwnersIterator()
+	for iter.HasNext() {
+		vn, owners := iter.Next()
+		racks := make(map[string]struct{})
+		for _, owner := range owners {
+			racks[rackOf(owner)] = struct{}{}
+		}
+		if len(owners) != 3 || len(racks) != 3 || owners[0] != vn.Node() {
+			t.Errorf("Replica owners of %s: %q\n", vn, owners)
+		}
+	}
+	checkVirtualNodes(t, r)
+}
+
+func TestValidate(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 3, 16)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if err = r.Validate(); err != nil {
+		t.Errorf("Validate(): %v for an empty ring\n", err)
+	}
+	for i := 0; i < 8; i++ {
+		if _, err = r.Insert(Node(fmt.Sprintf("node-%d", i))); err != nil {
+			t.Errorf("Insert(): %v\n", err)
+			t.FailNow()
+		}
+		if err = r.Validate(); err != nil {
+			t.Errorf("Validate(): %v\n", err)
+		}
+	}
+
+	// Corrupt a private copy of the state, in various ways.
+	state := r.state.Load().(*hashRingState).derive()
+	state.fixReplicaOwners()
+	state.replicaOwners[3] = state.replicaOwners[4]
+	if err = state.validate(); err == nil {
+		t.Errorf("validate(): expected an error for stale replica owners\n")
+	}
+	state.fixReplicaOwners()
+	state.virtualNodes[3], state.virtualNodes[4] = state.virtualNodes[4], state.virtualNodes[3]
+	if err = state.validate(); err == nil {
+		t.Errorf("validate(): expected an error for unsorted virtual nodes\n")
+	}
+}
+
+func TestDiffPatch(t *testing.T) {
+	r1, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1", "node-2")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	r2 := r1.Clone()
+	if _, err = r2.Remove("node-1"); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r2.Insert("node-3", "node-4"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+
+	p := DiffPatch(r1, r2)
+	if !sameNodes(p.Added, []Node{"node-3", "node-4"}) || !sameNodes(p.Removed, []Node{"node-1"}) {
+		t.Errorf("DiffPatch(): added %q and removed %q\n", p.Added, p.Removed)
+	}
+	r3 := r1.Clone()
+	if err = r3.ApplyPatch(p); err != nil {
+		t.Errorf("ApplyPatch(): %v\n", err)
+		t.FailNow()
+	}
+	if r3.String() != r2.String() || r3.Generation() != r2.Generation() {
+		t.Errorf("Patched ring differs from the target one\n")
+	}
+	if err = r3.Validate(); err != nil {
+		t.Errorf("Validate(): %v\n", err)
+	}
+
+	// The patch should not be applicable twice.
+	gen := r3.Generation()
+	if err = r3.ApplyPatch(p); err == nil || r3.Generation() != gen {
+		t.Errorf("ApplyPatch(): expected an error for a ring that does not match\n")
+	}
+
+	// Weight changes cannot be expressed in patches.
+	r4 := r1.Clone()
+	if _, err = r4.ReduceWeight("node-0", 2); err != nil {
+		t.Errorf("ReduceWeight(): %v\n", err)
+		t.FailNow()
+	}
+	r5 := r1.Clone()
+	if err = r5.ApplyPatch(DiffPatch(r1, r4)); err == nil || r5.String() != r1.String() {
+		t.Errorf("ApplyPatch(): expected an error for a patch with weight changes\n")
+	}
+	if p = DiffPatch(r1, r1); len(p.Added) != 0 || len(p.Removed) != 0 || p.From != p.To {
+		t.Errorf("DiffPatch(r1, r1): %+v; expected an empty patch\n", p)
+	}
+}
+
+func TestEstimateScaleImpact(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 64)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if impact := r.EstimateScaleImpact(1); impact != 1 {
+		t.Errorf("EstimateScaleImpact(1) == %f; expected 1 for an empty ring\n", impact)
+	}
+	for i := 0; i < 8; i++ {
+		if _, err = r.Insert(Node(fmt.Sprintf("node-%d", i))); err != nil {
+			t.Errorf("Insert(): %v\n", err)
+			t.FailNow()
+		}
+	}
+	if impact := r.EstimateScaleImpact(0); impact != 0 {
+		t.Errorf("EstimateScaleImpact(0) == %f; expected 0\n", impact)
+	}
+	gen := r.Generation()
+	prev := 0.0
+	for _, n := range []int{1, 2, 8, 24} {
+		impact := r.EstimateScaleImpact(n)
+		t.Logf("EstimateScaleImpact(%d) == %f\n", n, impact)
+		// Adding n nodes to 8 should move about n/(n+8) of the keyspace.
+		if expected := float64(n) / float64(n+8); impact <= prev || math.Abs(impact-expected) > 0.1 {
+			t.Errorf("EstimateScaleImpact(%d) == %f; expected about %f\n", n, impact, expected)
+		}
+		if again := r.EstimateScaleImpact(n); again != impact {
+			t.Errorf("EstimateScaleImpact(%d) is not reproducible: %f != %f\n", n, again, impact)
+		}
+		prev = impact
+	}
+	if r.Generation() != gen || r.Size() != 8 {
+		t.Errorf("EstimateScaleImpact() modified the ring\n")
+	}
+}
+
+func TestPrimaryKeysFor(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 16)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	if primaryKeys := r.PrimaryKeysFor("node-0", keys); primaryKeys != nil {
+		t.Errorf("PrimaryKeysFor(): expected nil for an empty ring\n")
+	}
+	nodes := []Node{"node-0", "node-1", "node-2", "node-3"}
+	if _, err = r.Insert(nodes...); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	total := 0
+	for _, node := range nodes {
+		primaryKeys := r.PrimaryKeysFor(node, keys)
+		total += len(primaryKeys)
+		k := 0
+		for _, key := range keys {
+			if r.NodesForKey(key)[0] != node {
+				continue
+			}
+			if k >= len(primaryKeys) || !bytes.Equal(primaryKeys[k], key) {
+				t.Errorf("PrimaryKeysFor(%q): missing or out of order key %x\n", node, key)
+				t.FailNow()
+			}
+			k++
+		}
+		if k != len(primaryKeys) {
+			t.Errorf("PrimaryKeysFor(%q) returned %d keys; expected %d\n", node, len(primaryKeys), k)
+		}
+	}
+	if total != len(keys) {
+		t.Errorf("PrimaryKeysFor() returned %d keys in total; expected %d\n", total, len(keys))
+	}
+}
+
+func testLazyNames(t *testing.T, replicationFactor, virtualNodeCount, numNodes, capacity int) {
+	nodes := make([]Node, numNodes)
+	for i := 0; i < numNodes; i++ {
+		nodes[i] = Node(fmt.Sprintf("Node-%d", i))
+	}
+	eager, err := NewHashRing(hashFunc, replicationFactor, virtualNodeCount, nodes...)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	lazy, err := NewHashRingWithOptions(hashFunc, replicationFactor, virtualNodeCount, WithLazyNames())
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	lazy.state.Load().(*hashRingState).lazyNames = newLazyNames(hashFunc, defaultVirtualNodeKey, capacity)
+	if _, err = lazy.Insert(nodes...); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	for _, vn := range lazy.state.Load().(*hashRingState).virtualNodes {
+		if vn.name != nil {
+			t.Errorf("Virtual node %s stores its name\n", vn)
+			t.FailNow()
+		}
+	}
+	if lazy.String() != eager.String() {
+		t.Errorf("Lazily named ring differs from the eager one\n")
+	}
+	for i := 0; i < 100; i++ {
+		key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+		if !sameNodes(lazy.NodesForKey(key), eager.NodesForKey(key)) {
+			t.Errorf("NodesForKey(%x) == %q; expected %q\n", key, lazy.NodesForKey(key), eager.NodesForKey(key))
+		}
+	}
+	if _, err = lazy.Remove(nodes[0]); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+		t.FailNow()
+	}
+	if err = lazy.Validate(); err != nil {
+		t.Errorf("Validate(): %v\n", err)
+	}
+	if ln := lazy.state.Load().(*hashRingState).lazyNames; ln.lru.Len() > capacity || len(ln.entries) != ln.lru.Len() {
+		t.Errorf("Cache of %d (%d) names exceeds its capacity %d\n", ln.lru.Len(), len(ln.entries), capacity)
+	}
+	checkVirtualNodes(t, lazy)
+}
+
+func TestLazyNamesTinyRing(t *testing.T)   { testLazyNames(t, 2, 4, 4, lazyNamesCapacity) }
+func TestLazyNamesSmallCache(t *testing.T) { testLazyNames(t, 3, 16, 16, 8) }
+func TestLazyNamesMediumRing(t *testing.T) { testLazyNames(t, 3, 64, 64, 1024) }
+
+func TestRoutingAgrees(t *testing.T) {
+	nodes := []Node{"node-0", "node-1", "node-2", "node-3"}
+	a, _ := NewHashRing(hashFunc, 2, 16, nodes...)
+	b, _ := NewHashRing(hashFunc, 2, 16, nodes[3], nodes[1], nodes[0], nodes[2])
+	keys := make([][]byte, 200)
+	for i := range keys {
+		keys[i] = hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	if agree, key := RoutingAgrees(a, b, keys); !agree {
+		t.Errorf("RoutingAgrees(): disagreement on %x\n", key)
+	}
+
+	// Same membership, but slightly different hash function.
+	otherHash := func(b []byte) []byte { return sha256Hash(append([]byte{0}, b...)) }
+	c, _ := NewHashRing(otherHash, 2, 16, nodes...)
+	agree, key := RoutingAgrees(a, c, keys)
+	if agree || key == nil {
+		t.Errorf("RoutingAgrees(): expected a disagreement for different hash functions\n")
+	} else if sameNodes(a.NodesForKey(key), c.NodesForKey(key)) {
+		t.Errorf("RoutingAgrees(): rings agree on the reported key %x\n", key)
+	}
+
+	empty, _ := NewHashRing(hashFunc, 2, 16)
+	if agree, _ = RoutingAgrees(a, empty, keys); agree {
+		t.Errorf("RoutingAgrees(): expected a disagreement with an empty ring\n")
+	}
+	if agree, _ = RoutingAgrees(empty, empty.Clone(), keys); !agree {
+		t.Errorf("RoutingAgrees(): expected empty rings to agree\n")
+	}
+}
+
+func TestNodesForKeyAtGeneration(t *testing.T) {
+	if _, err := NewHashRingWithOptions(hashFunc, 2, 8, WithHistory(-1)); err == nil {
+		t.Errorf("NewHashRingWithOptions(): expected an error for a negative history depth\n")
+	}
+	r, err := NewHashRingWithOptions(hashFunc, 2, 8, WithHistory(3))
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	key := hashFunc([]byte("key"))
+	if owners, err := r.NodesForKeyAtGeneration(key, r.Generation()); err != nil || owners != nil {
+		t.Errorf("NodesForKeyAtGeneration() == (%q, %v); expected no owners\n", owners, err)
+	}
+	clones := make(map[uint64]*HashRing)
+	for i := 0; i < 6; i++ {
+		if _, err = r.Insert(Node(fmt.Sprintf("node-%d", i))); err != nil {
+			t.Errorf("Insert(): %v\n", err)
+			t.FailNow()
+		}
+		clones[r.Generation()] = r.Clone()
+	}
+	for gen, clone := range clones {
+		owners, err := r.NodesForKeyAtGeneration(key, gen)
+		if gen+3 <= r.Generation() {
+			if err == nil {
+				t.Errorf("NodesForKeyAtGeneration(%d): expected an error for an evicted generation\n", gen)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NodesForKeyAtGeneration(%d): %v\n", gen, err)
+		} else if !sameNodes(owners, clone.NodesForKey(key)) {
+			t.Errorf("NodesForKeyAtGeneration(%d) == %q; expected %q\n", gen, owners, clone.NodesForKey(key))
+		}
+	}
+	if _, err = r.NodesForKeyAtGeneration(key, r.Generation()+1); err == nil {
+		t.Errorf("NodesForKeyAtGeneration(): expected an error for a future generation\n")
+	}
+
+	// Without any history, only the current generation is available.
+	clone := clones[r.Generation()]
+	if _, err = clone.NodesForKeyAtGeneration(key, clone.Generation()); err != nil {
+		t.Errorf("NodesForKeyAtGeneration(): %v\n", err)
+	}
+	noHistory, _ := NewHashRing(hashFunc, 2, 8, "node-0")
+	if _, err = noHistory.Insert("node-1"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = noHistory.NodesForKeyAtGeneration(key, noHistory.Generation()-1); err == nil {
+		t.Errorf("NodesForKeyAtGeneration(): expected an error for a ring without history\n")
+	}
+
+	// Nodes that are excluded from reads are replaced at the generations
+	// at which they are excluded, like in NodesForKey.
+	gen, owners := r.Generation(), r.NodesForKey(key)
+	if err = r.SetReadExcluded(owners[0], true); err != nil {
+		t.Errorf("SetReadExcluded(): %v\n", err)
+		t.FailNow()
+	}
+	if current, err := r.NodesForKeyAtGeneration(key, r.Generation()); err != nil || !sameNodes(current, r.NodesForKey(key)) {
+		t.Errorf("NodesForKeyAtGeneration() == (%q, %v); expected %q\n", current, err, r.NodesForKey(key))
+	} else if r.OwnerSetForKey(key).Contains(owners[0]) {
+		t.Errorf("NodesForKeyAtGeneration() == %q; expected %q to be excluded\n", current, owners[0])
+	}
+	if previous, err := r.NodesForKeyAtGeneration(key, gen); err != nil || !sameNodes(previous, owners) {
+		t.Errorf("NodesForKeyAtGeneration(%d) == (%q, %v); expected %q\n", gen, previous, err, owners)
+	}
+}
+
+func TestTinyKeyspace(t *testing.T) {
+	// A hash function of 1-byte outputs has a keyspace of 256 positions.
+	tinyHash := func(b []byte) []byte { return sha256Hash(b)[:1] }
+	if _, err := NewHashRing(tinyHash, 2, 1000); err != nil {
+		t.Logf("NewHashRing(tinyHash, 2, 1000): %v\n", err)
+	} else {
+		t.Errorf("NewHashRing(tinyHash, 2, 1000): expected an error\n")
+	}
+	nodes := make([]Node, 10)
+	for i := range nodes {
+		nodes[i] = Node(fmt.Sprintf("node-%d", i))
+	}
+	if _, err := NewHashRing(tinyHash, 2, 16, nodes...); err != nil {
+		t.Logf("NewHashRing(tinyHash, 2, 16, 10 nodes): %v\n", err)
+	} else {
+		t.Errorf("NewHashRing(tinyHash, 2, 16, 10 nodes): expected an error\n")
+	}
+
+	// Collisions among the virtual nodes are (almost) certain, but the
+	// ring should still be consistent.
+	r, err := NewHashRing(tinyHash, 2, 16, nodes[:6]...)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.Insert(nodes[6:]...); err == nil {
+		t.Errorf("Insert(): expected an error for exceeding the keyspace\n")
+	}
+	if err = r.Validate(); err != nil {
+		t.Errorf("Validate(): %v\n", err)
+	}
+	// Virtual nodes whose names collide with their predecessors' own no
+	// keys, rather than the whole keyspace.
+	total := 0.0
+	for _, share := range r.LoadDistribution() {
+		total += share
+	}
+	if math.Abs(total-1) > 1e-9 {
+		t.Errorf("LoadDistribution() sums up to %v; expected 1\n", total)
+	}
+	if impact := r.EstimateScaleImpact(1); impact < 0 || impact > 1 {
+		t.Errorf("EstimateScaleImpact(1) = %v; expected a fraction\n", impact)
+	}
+	if _, err = r.Remove(nodes[1], nodes[4]); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+		t.FailNow()
+	}
+	if err = r.Validate(); err != nil {
+		t.Errorf("Validate(): %v\n", err)
+	}
+}
+
+func TestPlacementFor(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 3, 8)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.PlacementFor(hashFunc([]byte("key"))); err == nil {
+		t.Errorf("PlacementFor(): expected an error for an empty ring\n")
+	}
+	if _, err = r.Insert("node-0", "node-1", "node-2", "node-3"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	for i := 0; i < 100; i++ {
+		key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+		p, err := r.PlacementFor(key)
+		if err != nil {
+			t.Errorf("PlacementFor(%x): %v\n", key, err)
+			t.FailNow()
+		}
+		if p.VirtualNode != r.VirtualNodeForKey(key) || !bytes.Equal(p.Arc.Hi, p.VirtualNode.Name()) || !p.Arc.Contains(key) {
+			t.Errorf("PlacementFor(%x): virtual node %s, arc (%x, %x]\n", key, p.VirtualNode, p.Arc.Lo, p.Arc.Hi)
+		}
+		if !sameNodes(p.Owners, r.NodesForKey(key)) || p.Primary != p.Owners[0] || p.Primary != p.VirtualNode.Node() {
+			t.Errorf("PlacementFor(%x): owners %q, primary %q\n", key, p.Owners, p.Primary)
+		}
+	}
+
+	// Nodes that are excluded from reads are replaced, like in NodesForKey.
+	if err = r.SetReadExcluded("node-2", true); err != nil {
+		t.Errorf("SetReadExcluded(): %v\n", err)
+		t.FailNow()
+	}
+	for i := 0; i < 100; i++ {
+		key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+		p, err := r.PlacementFor(key)
+		if err != nil {
+			t.Errorf("PlacementFor(%x): %v\n", key, err)
+			t.FailNow()
+		}
+		if !sameNodes(p.Owners, r.NodesForKey(key)) || p.Primary != p.Owners[0] || p.Primary == "node-2" {
+			t.Errorf("PlacementFor(%x): owners %q, primary %q\n", key, p.Owners, p.Primary)
+		}
+		if p.VirtualNode != r.VirtualNodeForKey(key) {
+			t.Errorf("PlacementFor(%x): virtual node %s\n", key, p.VirtualNode)
+		}
+	}
+	for _, node := range []Node{"node-0", "node-1", "node-3"} {
+		if err = r.SetReadExcluded(node, true); err != nil {
+			t.Errorf("SetReadExcluded(): %v\n", err)
+			t.FailNow()
+		}
+	}
+	if _, err = r.PlacementFor(hashFunc([]byte("key"))); err == nil {
+		t.Errorf("PlacementFor(): expected an error when all nodes are excluded\n")
+	}
+}
+
+func TestRegisterHashForPrefix(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 16, "node-0", "node-1", "node-2", "node-3")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	tenantHash := func(b []byte) []byte { return sha256Hash(append([]byte("tenant-a"), b...)) }
+	innerHash := func(b []byte) []byte { return sha256Hash(append([]byte("inner"), b...)) }
+	if err = r.RegisterHashForPrefix([]byte("a/"), nil); err == nil {
+		t.Errorf("RegisterHashForPrefix(): expected an error for a nil hash function\n")
+	}
+	if err = r.RegisterHashForPrefix([]byte("a/"), func(b []byte) []byte { return sha256Hash(b)[:8] }); err == nil {
+		t.Errorf("RegisterHashForPrefix(): expected an error for a hash function of different width\n")
+	}
+	if err = r.RegisterHashForPrefix([]byte("a/"), hashFunc); err != nil {
+		t.Errorf("RegisterHashForPrefix(): %v\n", err)
+	}
+	// Registering the same prefix again should replace its hash function.
+	if err = r.RegisterHashForPrefix([]byte("a/"), tenantHash); err != nil {
+		t.Errorf("RegisterHashForPrefix(): %v\n", err)
+	}
+	if err = r.RegisterHashForPrefix([]byte("a/inner/"), innerHash); err != nil {
+		t.Errorf("RegisterHashForPrefix(): %v\n", err)
+	}
+
+	for key, hash := range map[string]func([]byte) []byte{
+		"b/key":       hashFunc,
+		"a":           hashFunc,
+		"a/key":       tenantHash,
+		"a/inner":     tenantHash,
+		"a/inner/key": innerHash,
+	} {
+		if !bytes.Equal(r.HashKey([]byte(key)), hash([]byte(key))) {
+			t.Errorf("HashKey(%q) used the wrong hash function\n", key)
+		}
+		owners, err := r.NodesForObject(strings.NewReader(key))
+		if err != nil {
+			t.Errorf("NodesForObject(%q): %v\n", key, err)
+		} else if !sameNodes(owners, r.NodesForKey(hash([]byte(key)))) {
+			t.Errorf("NodesForObject(%q) == %q; expected %q\n", key, owners, r.NodesForKey(hash([]byte(key))))
+		}
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	buf := &bytes.Buffer{}
+	if err = r.WriteCSV(buf); err != nil || buf.String() != "start,end,fraction,owners\n" {
+		t.Errorf("WriteCSV() == (%q, %v); expected only the header for an empty ring\n", buf.String(), err)
+	}
+	if _, err = r.Insert("node-0", "node,1", "node-2"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	buf.Reset()
+	if err = r.WriteCSV(buf); err != nil {
+		t.Errorf("WriteCSV(): %v\n", err)
+		t.FailNow()
+	}
+	records, err := csv.NewReader(buf).ReadAll()
+	if err != nil {
+		t.Errorf("Reading CSV: %v\n", err)
+		t.FailNow()
+	}
+	if len(records) != 1+r.VirtualNodesLen() {
+		t.Errorf("WriteCSV() wrote %d records; expected %d\n", len(records), 1+r.VirtualNodesLen())
+		t.FailNow()
+	}
+	total := 0.0
+	for i, record := range records[1:] {
+		vn, _ := r.VirtualNodeAt(i)
+		prev, _ := r.VirtualNodeAt(i - 1)
+		if record[0] != hex.EncodeToString(prev.Name()) || record[1] != hex.EncodeToString(vn.Name()) {
+			t.Errorf("Record %d: arc (%s, %s]; expected (%x, %x]\n", i, record[0], record[1], prev.Name(), vn.Name())
+		}
+		fraction, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			t.Errorf("Record %d: %v\n", i, err)
+		}
+		total += fraction
+		if owners := r.NodesForKey(vn.Name()); record[3] != fmt.Sprintf("%s;%s", owners[0], owners[1]) {
+			t.Errorf("Record %d: owners %q; expected %q\n", i, record[3], owners)
+		}
+	}
+	if math.Abs(total-1) > 1e-9 {
+		t.Errorf("Fractions of the arcs sum up to %f\n", total)
+	}
+}
+
+func TestTieBreakHash(t *testing.T) {
+	// With a hash function of 1-byte outputs, collisions abound.
+	tinyHash := func(b []byte) []byte { return sha256Hash(b)[:1] }
+	tieBreakHash := func(b []byte) []byte { return sha256Hash(append([]byte("tie-break"), b...)) }
+	nodes := []Node{"node-0", "node-1", "node-2", "node-3", "node-4"}
+	r, err := NewHashRingWithOptions(tinyHash, 2, 16, WithTieBreakHash(tieBreakHash))
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.Insert(nodes...); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if err = r.Validate(); err != nil {
+		t.Errorf("Validate(): %v\n", err)
+	}
+	collisions := 0
+	state := r.state.Load().(*hashRingState)
+	for i := 1; i < len(state.virtualNodes); i++ {
+		prev, vn := state.virtualNodes[i-1], state.virtualNodes[i]
+		if !bytes.Equal(prev.Name(), vn.Name()) {
+			continue
+		}
+		collisions++
+		prevTie := tieBreakHash([]byte(fmt.Sprintf("%s-%d", prev.node, prev.vnid)))
+		vnTie := tieBreakHash([]byte(fmt.Sprintf("%s-%d", vn.node, vn.vnid)))
+		if bytes.Compare(prevTie, vnTie) >= 0 {
+			t.Errorf("Colliding virtual nodes %s and %s are not ordered by the tie-break hash\n", prev, vn)
+		}
+		// Keys at the collision point go to the first one of them.
+		if first := r.VirtualNodeForKey(vn.Name()); bytes.Compare(first.Name(), vn.Name()) != 0 || first == vn {
+			t.Errorf("VirtualNodeForKey(%x) == %s\n", vn.Name(), first)
+		}
+	}
+	if collisions == 0 {
+		t.Errorf("Expected some collisions among %d virtual nodes in a keyspace of 256\n", len(state.virtualNodes))
+	}
+	if _, err = r.Remove(nodes[2]); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+	}
+	if err = r.Validate(); err != nil {
+		t.Errorf("Validate(): %v\n", err)
+	}
+}
+
+func TestIterArcsForNode(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1", "node-2", "node-3")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	fn := func(arc KeyRange, owners []Node) bool { return true }
+	if err = r.IterArcsForNode("node-4", fn); err == nil {
+		t.Errorf("IterArcsForNode(): expected an error for a node not in the ring\n")
+	}
+
+	expected := make([]KeyRange, 0)
+	iter := r.NewReplicaOwnersIterator()
+	for i := 0; iter.HasNext(); i++ {
+		vn, owners := iter.Next()
+		if (OwnerSet{owners: owners}).Contains("node-1") {
+			prev, _ := r.VirtualNodeAt(i - 1)
+			expected = append(expected, KeyRange{Lo: prev.Name(), Hi: vn.Name()})
+		}
+	}
+	arcs := make([]KeyRange, 0)
+	err = r.IterArcsForNode("node-1", func(arc KeyRange, owners []Node) bool {
+		if !(OwnerSet{owners: owners}).Contains("node-1") || !sameNodes(owners, r.NodesForKey(arc.Hi)) {
+			t.Errorf("IterArcsForNode(): arc (%x, %x] with owners %q\n", arc.Lo, arc.Hi, owners)
+		}
+		arcs = append(arcs, arc)
+		return true
+	})
+	if err != nil {
+		t.Errorf("IterArcsForNode(): %v\n", err)
+	}
+	if len(arcs) != len(expected) {
+		t.Errorf("IterArcsForNode() walked %d arcs; expected %d\n", len(arcs), len(expected))
+		t.FailNow()
+	}
+	for i := range arcs {
+		if !bytes.Equal(arcs[i].Lo, expected[i].Lo) || !bytes.Equal(arcs[i].Hi, expected[i].Hi) {
+			t.Errorf("IterArcsForNode(): arc #%d is (%x, %x]; expected (%x, %x]\n", i, arcs[i].Lo, arcs[i].Hi, expected[i].Lo, expected[i].Hi)
+		}
+	}
+
+	// Stop early.
+	calls := 0
+	_ = r.IterArcsForNode("node-1", func(arc KeyRange, owners []Node) bool {
+		calls++
+		return calls < 3
+	})
+	if calls != 3 {
+		t.Errorf("IterArcsForNode() called fn %d times; expected 3\n", calls)
+	}
+}
+
+func TestWrapsAround(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	maxKey := bytes.Repeat([]byte{0xff}, sha256.Size)
+	if r.WrapsAround(maxKey) {
+		t.Errorf("WrapsAround(): expected false for an empty ring\n")
+	}
+	if _, err = r.Insert("node-0", "node-1", "node-2"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	first, _ := r.VirtualNodeAt(0)
+	last, _ := r.VirtualNodeAt(-1)
+	justAfterLast := new(big.Int).Add(new(big.Int).SetBytes(last.Name()), big.NewInt(1)).FillBytes(make([]byte, sha256.Size))
+	for _, tc := range []struct {
+		key   []byte
+		wraps bool
+		vn    *VirtualNode
+	}{
+		{maxKey, true, first},
+		{justAfterLast, true, first},
+		{last.Name(), false, last},
+		{make([]byte, sha256.Size), false, first},
+		{first.Name(), false, first},
+	} {
+		if wraps := r.WrapsAround(tc.key); wraps != tc.wraps {
+			t.Errorf("WrapsAround(%x) == %t; expected %t\n", tc.key, wraps, tc.wraps)
+		}
+		if vn := r.VirtualNodeForKey(tc.key); vn != tc.vn {
+			t.Errorf("VirtualNodeForKey(%x) == %s; expected %s\n", tc.key, vn, tc.vn)
+		}
+	}
+}
+
+func TestTopKByLoad(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if top := r.TopKByLoad(3); len(top) != 0 {
+		t.Errorf("TopKByLoad(3) == %v; expected none for an empty ring\n", top)
+	}
+	nodes := []Node{"node-0", "node-1", "node-2", "node-3", "node-4"}
+	if _, err = r.Insert(nodes...); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if top := r.TopKByLoad(0); top != nil {
+		t.Errorf("TopKByLoad(0) == %v; expected nil\n", top)
+	}
+
+	// Compute the expected order by brute force.
+	shares := r.state.Load().(*hashRingState).nodeShares()
+	expected := make([]NodeShare, 0, len(shares))
+	for node, share := range shares {
+		expected = append(expected, NodeShare{node, share})
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		if expected[i].Share != expected[j].Share {
+			return expected[i].Share > expected[j].Share
+		}
+		return expected[i].Node < expected[j].Node
+	})
+	var total float64
+	for _, ns := range expected {
+		total += ns.Share
+	}
+	if math.Abs(total-1) > 1e-9 {
+		t.Errorf("shares sum up to %f; expected 1\n", total)
+	}
+
+	for k := 1; k <= len(nodes)+2; k++ {
+		top := r.TopKByLoad(k)
+		n := k
+		if n > len(nodes) {
+			n = len(nodes)
+		}
+		if len(top) != n {
+			t.Errorf("len(TopKByLoad(%d)) == %d; expected %d\n", k, len(top), n)
+			continue
+		}
+		for i := range top {
+			if top[i] != expected[i] {
+				t.Errorf("TopKByLoad(%d)[%d] == %v; expected %v\n", k, i, top[i], expected[i])
+			}
+		}
+	}
+}
+
+func TestBalanceDeltaForInsert(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if score := r.BalanceScore(); score != 0 {
+		t.Errorf("BalanceScore() == %f; expected 0 for an empty ring\n", score)
+	}
+	delta, err := r.BalanceDeltaForInsert("node-0")
+	if err != nil {
+		t.Errorf("BalanceDeltaForInsert(): %v\n", err)
+		t.FailNow()
+	}
+	if math.Abs(delta-1) > 1e-9 {
+		t.Errorf("BalanceDeltaForInsert() == %f; expected 1 for the first node\n", delta)
+	}
+	if _, err = r.Insert("node-0", "node-1", "node-2"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.BalanceDeltaForInsert("node-1"); err == nil {
+		t.Errorf("BalanceDeltaForInsert(): expected an error for a node already in the ring\n")
+	}
+
+	pre := r.BalanceScore()
+	if pre <= 0 || pre > 1 {
+		t.Errorf("BalanceScore() == %f; expected it in (0, 1]\n", pre)
+	}
+	delta, err = r.BalanceDeltaForInsert("node-3", "node-4")
+	if err != nil {
+		t.Errorf("BalanceDeltaForInsert(): %v\n", err)
+		t.FailNow()
+	}
+	// The ring must have been left untouched.
+	if r.Size() != 3 || r.BalanceScore() != pre {
+		t.Errorf("BalanceDeltaForInsert() modified the ring\n")
+	}
+	if _, err = r.Insert("node-3", "node-4"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if post := r.BalanceScore(); math.Abs(post-pre-delta) > 1e-9 {
+		t.Errorf("BalanceDeltaForInsert() == %f; expected %f\n", delta, post-pre)
+	}
+}
+
+func TestNodeVNodeCounts(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if counts := r.NodeVNodeCounts(); len(counts) != 0 {
+		t.Errorf("NodeVNodeCounts() == %v; expected an empty map\n", counts)
+	}
+	if _, err = r.Insert("node-0", "node-1", "node-2"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.ReduceWeight("node-1", 5); err != nil {
+		t.Errorf("ReduceWeight(): %v\n", err)
+		t.FailNow()
+	}
+	expected := map[Node]int{"node-0": 8, "node-1": 3, "node-2": 8}
+	counts := r.NodeVNodeCounts()
+	if len(counts) != len(expected) {
+		t.Errorf("NodeVNodeCounts() == %v; expected %v\n", counts, expected)
+	}
+	for node, count := range expected {
+		if counts[node] != count {
+			t.Errorf("NodeVNodeCounts()[%q] == %d; expected %d\n", node, counts[node], count)
+		}
+	}
+}
+
+func TestNodesForKeyWithCapacity(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 3, 8)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	never := func(Node) bool { return false }
+	if nodes := r.NodesForKeyWithCapacity([]byte("key"), never); len(nodes) != 0 {
+		t.Errorf("NodesForKeyWithCapacity() == %v; expected none for an empty ring\n", nodes)
+	}
+	if _, err = r.Insert("node-0", "node-1", "node-2", "node-3", "node-4"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	for i := 0; i < 100; i++ {
+		key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+		owners := r.NodesForKey(key)
+		if nodes := r.NodesForKeyWithCapacity(key, never); !sameNodes(nodes, owners) {
+			t.Errorf("NodesForKeyWithCapacity(%x) == %v; expected %v\n", key, nodes, owners)
+		}
+
+		// Mark the primary owner as full; the rest should shift by one.
+		calls := make(map[Node]int)
+		nodes := r.NodesForKeyWithCapacity(key, func(node Node) bool {
+			calls[node]++
+			return node == owners[0]
+		})
+		if len(nodes) != 3 || !sameNodes(nodes[:2], owners[1:]) || nodes[2] == owners[0] {
+			t.Errorf("NodesForKeyWithCapacity(%x) == %v; owners are %v\n", key, nodes, owners)
+		}
+		for node, n := range calls {
+			if n != 1 {
+				t.Errorf("full(%q) called %d times; expected once\n", node, n)
+			}
+		}
+
+		// With only two nodes that are not full, only those are returned.
+		nodes = r.NodesForKeyWithCapacity(key, func(node Node) bool {
+			return node != "node-1" && node != "node-3"
+		})
+		if len(nodes) != 2 {
+			t.Errorf("NodesForKeyWithCapacity(%x) == %v; expected node-1 and node-3\n", key, nodes)
+		}
+		if nodes = r.NodesForKeyWithCapacity(key, func(Node) bool { return true }); len(nodes) != 0 {
+			t.Errorf("NodesForKeyWithCapacity(%x) == %v; expected none\n", key, nodes)
+		}
+	}
+}
+
+func TestRepairOwners(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 3, 16, "node-0", "node-1", "node-2", "node-3")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	gen := r.Generation()
+	if repaired, err := r.RepairOwners(); err != nil || repaired != 0 {
+		t.Errorf("RepairOwners() == (%d, %v); expected nothing to repair\n", repaired, err)
+	}
+	if r.Generation() != gen {
+		t.Errorf("RepairOwners() modified a consistent ring\n")
+	}
+
+	// Corrupt the replica owners of a copy of the state, and publish it.
+	state := r.state.Load().(*hashRingState).derive()
+	state.fixReplicaOwners()
+	state.replicaOwners[3] = []Node{"node-9"}
+	state.replicaOwners = append(state.replicaOwners, state.replicaOwners[0], state.replicaOwners[1])
+	r.commit(state)
+	if err = r.Validate(); err == nil {
+		t.Errorf("Validate(): expected an error for the corrupted ring\n")
+	}
+	repaired, err := r.RepairOwners()
+	if err != nil {
+		t.Errorf("RepairOwners(): %v\n", err)
+		t.FailNow()
+	}
+	if repaired != 3 {
+		t.Errorf("RepairOwners() == %d; expected 3\n", repaired)
+	}
+	if err = r.Validate(); err != nil {
+		t.Errorf("Validate(): %v after RepairOwners()\n", err)
+	}
+
+	// Missing replica owners should be repaired as well.
+	state = r.state.Load().(*hashRingState).derive()
+	state.fixReplicaOwners()
+	state.replicaOwners = state.replicaOwners[:len(state.replicaOwners)-2]
+	r.commit(state)
+	if repaired, err = r.RepairOwners(); err != nil || repaired != 2 {
+		t.Errorf("RepairOwners() == (%d, %v); expected 2\n", repaired, err)
+	}
+
+	// Unsorted virtual nodes cannot be repaired.
+	state = r.state.Load().(*hashRingState).derive()
+	state.fixReplicaOwners()
+	state.virtualNodes[3], state.virtualNodes[4] = state.virtualNodes[4], state.virtualNodes[3]
+	r.commit(state)
+	gen = r.Generation()
+	if _, err = r.RepairOwners(); err == nil {
+		t.Errorf("RepairOwners(): expected an error for unsorted virtual nodes\n")
+	}
+	if r.Generation() != gen {
+		t.Errorf("RepairOwners() modified the ring despite failing\n")
+	}
+}
+
+func TestNextVNodeOfNode(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1", "node-2")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.NextVNodeOfNode([]byte("key"), "node-3"); err == nil {
+		t.Errorf("NextVNodeOfNode(): expected an error for a node not in the ring\n")
+	}
+	state := r.state.Load().(*hashRingState)
+	for i := 0; i < 100; i++ {
+		key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+		for _, target := range []Node{"node-0", "node-1", "node-2"} {
+			vn, err := r.NextVNodeOfNode(key, target)
+			if err != nil {
+				t.Errorf("NextVNodeOfNode(%x, %q): %v\n", key, target, err)
+				continue
+			}
+			if vn.Node() != target {
+				t.Errorf("NextVNodeOfNode(%x, %q) == %s\n", key, target, vn)
+			}
+			// No virtual node of the target may lie between the key's
+			// virtual node and the returned one.
+			for j := state.search(key); state.virtualNodes[j] != vn; j = (j + 1) % len(state.virtualNodes) {
+				if state.virtualNodes[j].Node() == target {
+					t.Errorf("NextVNodeOfNode(%x, %q) == %s skips %s\n", key, target, vn, state.virtualNodes[j])
+					break
+				}
+			}
+		}
+		primary := r.VirtualNodeForKey(key)
+		if vn, _ := r.NextVNodeOfNode(key, primary.Node()); vn != primary {
+			t.Errorf("NextVNodeOfNode(%x, %q) == %s; expected %s\n", key, primary.Node(), vn, primary)
+		}
+	}
+}
+
+func TestHighReplicationFactor(t *testing.T) {
+	nodes := make([]Node, 400)
+	for i := range nodes {
+		nodes[i] = Node(fmt.Sprintf("node-%d", i))
+	}
+	r, err := NewHashRing(hashFunc, 300, 2, nodes...)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if err = r.Validate(); err != nil {
+		t.Errorf("Validate(): %v\n", err)
+	}
+	owners := r.NodesForKey(hashFunc([]byte("key")))
+	distinct := make(map[Node]struct{}, len(owners))
+	for _, owner := range owners {
+		distinct[owner] = struct{}{}
+	}
+	if len(owners) != 300 || len(distinct) != 300 {
+		t.Errorf("NodesForKey() returned %d owners (%d distinct); expected 300\n", len(owners), len(distinct))
+	}
+
+	buf := &bytes.Buffer{}
+	if err = r.Save(buf); err != nil {
+		t.Errorf("Save(): %v\n", err)
+		t.FailNow()
+	}
+	loaded, err := Load(hashFunc, buf)
+	if err != nil {
+		t.Errorf("Load(): %v\n", err)
+		t.FailNow()
+	}
+	if loaded.String() != r.String() {
+		t.Errorf("Loaded ring differs from the saved one\n")
+	}
+}
+
+func TestDiffAgainstSnapshot(t *testing.T) {
+	r, err := NewHashRingWithOptions(hashFunc, 2, 8, WithHashName("sha256"))
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.Insert("node-0", "node-1", "node-2", "node-3"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	buf := &bytes.Buffer{}
+	if err = r.SaveCompressed(buf); err != nil {
+		t.Errorf("SaveCompressed(): %v\n", err)
+		t.FailNow()
+	}
+	saved := buf.Bytes()
+	if migs, err := r.DiffAgainstSnapshot(bytes.NewReader(saved)); err != nil || len(migs) != 0 {
+		t.Errorf("DiffAgainstSnapshot() == (%v, %v); expected no migrations\n", migs, err)
+	}
+
+	oldRing := r.Clone()
+	if _, err = r.Remove("node-1"); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.Insert("node-4"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	migs, err := r.DiffAgainstSnapshot(bytes.NewReader(saved))
+	if err != nil {
+		t.Errorf("DiffAgainstSnapshot(): %v\n", err)
+		t.FailNow()
+	}
+	if len(migs) == 0 {
+		t.Errorf("DiffAgainstSnapshot() returned no migrations\n")
+	}
+	checkMigrations(t, oldRing.state.Load().(*hashRingState), r.state.Load().(*hashRingState), migs)
+
+	if _, err = r.DiffAgainstSnapshot(bytes.NewReader(saved[:len(saved)/2])); err == nil {
+		t.Errorf("DiffAgainstSnapshot(): expected an error for a truncated snapshot\n")
+	}
+	other, _ := NewHashRingWithOptions(hashFunc, 2, 8, WithHashName("blake2b"))
+	if _, err = other.DiffAgainstSnapshot(bytes.NewReader(saved)); err == nil {
+		t.Errorf("DiffAgainstSnapshot(): expected an error for an incompatible hash function\n")
+	}
+}
+
+func TestMovedKeys(t *testing.T) {
+	from, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1", "node-2", "node-3")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	to := from.Clone()
+	if _, err = to.Remove("node-2"); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = to.Insert("node-4"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	keys := make([][]byte, 500)
+	for i := range keys {
+		keys[i] = hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	moved, err := MovedKeys(from, to, keys)
+	if err != nil {
+		t.Errorf("MovedKeys(): %v\n", err)
+		t.FailNow()
+	}
+	expected := make([][]byte, 0)
+	for _, key := range keys {
+		if from.NodesForKey(key)[0] != to.NodesForKey(key)[0] {
+			expected = append(expected, key)
+		}
+	}
+	if len(expected) == 0 {
+		t.Errorf("no keys moved; the test is not meaningful\n")
+	}
+	if len(moved) != len(expected) {
+		t.Errorf("MovedKeys() returned %d keys; expected %d\n", len(moved), len(expected))
+		t.FailNow()
+	}
+	for i := range moved {
+		if !bytes.Equal(moved[i], expected[i]) {
+			t.Errorf("MovedKeys()[%d] == %x; expected %x\n", i, moved[i], expected[i])
+		}
+	}
+	if moved, err = MovedKeys(from, from, keys); err != nil || len(moved) != 0 {
+		t.Errorf("MovedKeys(from, from) == (%d keys, %v); expected none\n", len(moved), err)
+	}
+
+	empty, _ := NewHashRing(hashFunc, 2, 8)
+	if _, err = MovedKeys(from, empty, keys); err == nil {
+		t.Errorf("MovedKeys(): expected an error for an empty ring\n")
+	}
+}
+
+func TestSetFallback(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	key := hashFunc([]byte("key"))
+	if _, err = r.OwnerForKey(key); err == nil {
+		t.Errorf("OwnerForKey(): expected an error for an empty ring\n")
+	}
+	r.SetFallback("fallback")
+	if nodes := r.NodesForKey(key); !sameNodes(nodes, []Node{"fallback"}) {
+		t.Errorf("NodesForKey() == %v; expected the fallback\n", nodes)
+	}
+	if owner, err := r.OwnerForKey(key); err != nil || owner != "fallback" {
+		t.Errorf("OwnerForKey() == (%q, %v); expected the fallback\n", owner, err)
+	}
+	if r.Size() != 0 {
+		t.Errorf("Size() == %d; the fallback should not be a member\n", r.Size())
+	}
+	if nodes := r.NodesForKeyExcluding(key); !sameNodes(nodes, []Node{"fallback"}) {
+		t.Errorf("NodesForKeyExcluding() == %v; expected the fallback\n", nodes)
+	}
+	if nodes := r.NodesForKeyExcluding(key, "fallback"); len(nodes) != 0 {
+		t.Errorf("NodesForKeyExcluding() == %v; expected no nodes\n", nodes)
+	}
+	if nodes := r.NodesForKeyBounded(key, map[Node]int{"fallback": 100}, 1.25); !sameNodes(nodes, []Node{"fallback"}) {
+		t.Errorf("NodesForKeyBounded() == %v; expected the fallback\n", nodes)
+	}
+
+	if _, err = r.Insert("node-0", "node-1"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	nodes := r.NodesForKey(key)
+	if len(nodes) != 2 || nodes[0] == "fallback" || nodes[1] == "fallback" {
+		t.Errorf("NodesForKey() == %v; expected the members of the ring\n", nodes)
+	}
+	if owner, err := r.OwnerForKey(key); err != nil || owner != nodes[0] {
+		t.Errorf("OwnerForKey() == (%q, %v); expected %q\n", owner, err, nodes[0])
+	}
+
+	// Setting the fallback of a non-empty ring has no effect.
+	gen := r.Generation()
+	r.SetFallback("other")
+	if r.Generation() != gen {
+		t.Errorf("Generation() == %d after SetFallback() on a non-empty ring; expected %d\n", r.Generation(), gen)
+	}
+
+	// The fallback has been cleared by the insertion.
+	if _, err = r.Remove("node-0", "node-1"); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.OwnerForKey(key); err == nil {
+		t.Errorf("OwnerForKey(): expected an error after the fallback was cleared\n")
+	}
+	r.SetFallback("fallback")
+	if owner, err := r.OwnerForKey(key); err != nil || owner != "fallback" {
+		t.Errorf("OwnerForKey() == (%q, %v); expected the fallback\n", owner, err)
+	}
+	r.SetFallback("")
+	if _, err = r.OwnerForKey(key); err == nil {
+		t.Errorf("OwnerForKey(): expected an error after unsetting the fallback\n")
+	}
+}
+
+func TestSetJoinWeight(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 64, "node-0", "node-1", "node-2", "node-3")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	for _, w := range []float64{-0.1, 1.1, math.NaN()} {
+		if err = r.SetJoinWeight("node-0", w); err == nil {
+			t.Errorf("SetJoinWeight(node-0, %v): expected an error\n", w)
+		}
+	}
+	if err = r.SetJoinWeight("node-4", 0.5); err == nil {
+		t.Errorf("SetJoinWeight(node-4, 0.5): expected an error for a node not in the ring\n")
+	}
+	before := r.Clone()
+
+	// Count the virtual nodes whose replica owners include node-3, as its
+	// join weight is ramped up.
+	countOwned := func() int {
+		state := r.state.Load().(*hashRingState)
+		n := 0
+		for i := range state.virtualNodes {
+			for _, owner := range state.owners(i) {
+				if owner == "node-3" {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	full := countOwned()
+	prev := -1
+	for _, w := range []float64{0, 0.25, 0.5, 0.75, 1} {
+		if err = r.SetJoinWeight("node-3", w); err != nil {
+			t.Errorf("SetJoinWeight(node-3, %v): %v\n", w, err)
+			t.FailNow()
+		}
+		if err = r.Validate(); err != nil {
+			t.Errorf("Validate(): %v at join weight %v\n", err, w)
+		}
+		owned := countOwned()
+		if owned < prev {
+			t.Errorf("node-3 owns %d virtual nodes at join weight %v; less than %d before\n", owned, w, prev)
+		}
+		prev = owned
+		if w == 0 && owned != 0 {
+			t.Errorf("node-3 owns %d virtual nodes at join weight 0\n", owned)
+		}
+	}
+	if prev != full {
+		t.Errorf("node-3 owns %d virtual nodes at join weight 1; expected %d\n", prev, full)
+	}
+	if before.String() != r.String() {
+		t.Errorf("ring differs from the original at join weight 1\n")
+	}
+
+	// The rest of the APIs agree with NodesForKey on the primary owners
+	// of the keys while node-3 is joining.
+	if err = r.SetJoinWeight("node-3", 0.5); err != nil {
+		t.Errorf("SetJoinWeight(node-3, 0.5): %v\n", err)
+		t.FailNow()
+	}
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	primaryKeys := r.PrimaryKeysFor("node-3", keys)
+	expectedPrimaryKeys := 0
+	for _, key := range keys {
+		owners := r.NodesForKey(key)
+		if owners[0] == "node-3" {
+			expectedPrimaryKeys++
+		}
+		if excl := r.NodesForKeyExcluding(key); !sameNodes(excl, owners) {
+			t.Errorf("NodesForKeyExcluding(%x) == %v; expected %v\n", key, excl, owners)
+		}
+	}
+	if len(primaryKeys) != expectedPrimaryKeys {
+		t.Errorf("PrimaryKeysFor(node-3) returned %d keys; expected %d\n", len(primaryKeys), expectedPrimaryKeys)
+	}
+	state := r.state.Load().(*hashRingState)
+	share := 0.0
+	for i, f := range state.arcFractions() {
+		if state.owners(i)[0] == "node-3" {
+			share += f
+		}
+	}
+	if dist := r.LoadDistribution(); math.Abs(dist["node-3"]-share) > 1e-9 {
+		t.Errorf("LoadDistribution()[node-3] == %v; expected %v\n", dist["node-3"], share)
+	}
+
+	// A single joining node is still used rather than returning no owners.
+	single, _ := NewHashRing(hashFunc, 2, 8, "node-0")
+	if err = single.SetJoinWeight("node-0", 0); err != nil {
+		t.Errorf("SetJoinWeight(): %v\n", err)
+		t.FailNow()
+	}
+	if owners := single.NodesForKey(hashFunc([]byte("key"))); !sameNodes(owners, []Node{"node-0"}) {
+		t.Errorf("NodesForKey() == %v; expected [node-0]\n", owners)
+	}
+}
+
+func TestExpectedKeysMoved(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 1, 16, "node-0", "node-1", "node-2", "node-3")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if moved := r.ExpectedKeysMoved(nil, 1000000); moved != 0 {
+		t.Errorf("ExpectedKeysMoved(nil) == %d; expected 0\n", moved)
+	}
+	whole := []Migration{{KeyRange: KeyRange{Lo: make([]byte, sha256.Size), Hi: make([]byte, sha256.Size)}}}
+	if moved := r.ExpectedKeysMoved(whole, 1000000); moved != 1000000 {
+		t.Errorf("ExpectedKeysMoved(whole keyspace) == %d; expected 1000000\n", moved)
+	}
+
+	// Removing a virtual node migrates exactly the keys of its arc.
+	state := r.state.Load().(*hashRingState)
+	vn := state.virtualNodes[5]
+	migs, err := r.SimulateRemoveVirtualNode(vn.Node(), vn.vnid)
+	if err != nil {
+		t.Errorf("SimulateRemoveVirtualNode(): %v\n", err)
+		t.FailNow()
+	}
+	const totalKeys = 1 << 40
+	expected := int64(math.Round(state.arcFractions()[5] * totalKeys))
+	if moved := r.ExpectedKeysMoved(migs, totalKeys); math.Abs(float64(moved-expected)) > 1 {
+		t.Errorf("ExpectedKeysMoved() == %d; expected %d\n", moved, expected)
+	}
+}
+
+func TestSetReadExcluded(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 3, 16, "node-0", "node-1", "node-2", "node-3", "node-4")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if err = r.SetReadExcluded("node-5", true); err == nil {
+		t.Errorf("SetReadExcluded(node-5): expected an error for a node not in the ring\n")
+	}
+	before := r.Clone()
+	if err = r.SetReadExcluded("node-2", true); err != nil {
+		t.Errorf("SetReadExcluded(): %v\n", err)
+		t.FailNow()
+	}
+	state := r.state.Load().(*hashRingState)
+	for i := 0; i < 200; i++ {
+		key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+		owners := state.nodesForKey(key)
+		if !sameNodes(owners, before.NodesForKey(key)) {
+			t.Errorf("placement of %x changed by SetReadExcluded()\n", key)
+		}
+		nodes := r.NodesForKey(key)
+		if len(nodes) != 3 || r.OwnerSetForKey(key).Contains("node-2") {
+			t.Errorf("NodesForKey(%x) == %v; expected 3 nodes other than node-2\n", key, nodes)
+			continue
+		}
+		// The remaining owners keep their order, followed by the
+		// replacement (if any).
+		expected := nodesMinus(owners, []Node{"node-2"})
+		if !sameNodes(nodes[:len(expected)], expected) {
+			t.Errorf("NodesForKey(%x) == %v; owners are %v\n", key, nodes, owners)
+		}
+		if owner, err := r.OwnerForKey(key); err != nil || owner != nodes[0] {
+			t.Errorf("OwnerForKey(%x) == (%q, %v); expected %q\n", key, owner, err, nodes[0])
+		}
+	}
+	if migs := migrations(before.state.Load().(*hashRingState), state); len(migs) != 0 {
+		t.Errorf("SetReadExcluded() caused %d migrations\n", len(migs))
+	}
+	if clone := r.Clone(); !sameNodes(clone.NodesForKey(hashFunc([]byte("key"))), r.NodesForKey(hashFunc([]byte("key")))) {
+		t.Errorf("Clone() does not preserve the exclusion\n")
+	}
+
+	if err = r.SetReadExcluded("node-2", false); err != nil {
+		t.Errorf("SetReadExcluded(): %v\n", err)
+		t.FailNow()
+	}
+	if r.String() != before.String() {
+		t.Errorf("ring differs from the original after lifting the exclusion\n")
+	}
+
+	for _, node := range []Node{"node-0", "node-1", "node-2", "node-3", "node-4"} {
+		if err = r.SetReadExcluded(node, true); err != nil {
+			t.Errorf("SetReadExcluded(): %v\n", err)
+			t.FailNow()
+		}
+	}
+	if _, err = r.OwnerForKey(hashFunc([]byte("key"))); err == nil {
+		t.Errorf("OwnerForKey(): expected an error when all nodes are excluded\n")
+	}
+}
+
+func TestMinReplicationAcrossRing(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 3, 16)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if n := r.MinReplicationAcrossRing(); n != 0 {
+		t.Errorf("MinReplicationAcrossRing() == %d; expected 0 for an empty ring\n", n)
+	}
+	if _, err = r.Insert("node-0", "node-1"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if n := r.MinReplicationAcrossRing(); n != 2 {
+		t.Errorf("MinReplicationAcrossRing() == %d; expected 2 for 2 nodes\n", n)
+	}
+	if _, err = r.Insert("node-2", "node-3", "node-4", "node-5"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if n := r.MinReplicationAcrossRing(); n != 3 {
+		t.Errorf("MinReplicationAcrossRing() == %d; expected 3\n", n)
+	}
+	if err = r.SetDraining("node-0", true); err != nil {
+		t.Errorf("SetDraining(): %v\n", err)
+		t.FailNow()
+	}
+	if err = r.SetReadExcluded("node-1", true); err != nil {
+		t.Errorf("SetReadExcluded(): %v\n", err)
+		t.FailNow()
+	}
+	if n := r.MinReplicationAcrossRing(); n != 3 {
+		t.Errorf("MinReplicationAcrossRing() == %d; expected 3 without skip rules\n", n)
+	}
+
+	// Compute the expected minimum by brute force.
+	state := r.state.Load().(*hashRingState)
+	full := func(node Node) bool { return node == "node-2" }
+	skipped := map[Node]bool{"node-0": true, "node-1": true, "node-2": true}
+	expected := 3
+	for i := range state.virtualNodes {
+		n := 0
+		for _, owner := range state.owners(i) {
+			if !skipped[owner] {
+				n++
+			}
+		}
+		if n < expected {
+			expected = n
+		}
+	}
+	if n := r.MinReplicationAcrossRing(SkipDraining(), SkipReadExcluded(), SkipFull(full)); n != expected {
+		t.Errorf("MinReplicationAcrossRing() == %d; expected %d\n", n, expected)
+	}
+	if n := r.MinReplicationAcrossRing(SkipDraining()); n != 2 {
+		t.Errorf("MinReplicationAcrossRing(SkipDraining()) == %d; expected 2\n", n)
+	}
+}
+
+func TestNodeSet(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1", "node-2")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	set := r.NodeSet()
+	if len(set) != 3 {
+		t.Errorf("NodeSet() == %v; expected 3 nodes\n", set)
+	}
+	for _, node := range []Node{"node-0", "node-1", "node-2"} {
+		if _, exists := set[node]; !exists {
+			t.Errorf("NodeSet() lacks %q\n", node)
+		}
+	}
+	// Modifying the set should not affect the ring.
+	delete(set, "node-0")
+	set["node-3"] = struct{}{}
+	if state := r.state.Load().(*hashRingState); r.Size() != 3 || !state.hasNode("node-0") || state.hasNode("node-3") {
+		t.Errorf("modifying the set returned by NodeSet() affected the ring\n")
+	}
+	if again := r.NodeSet(); len(again) != 3 {
+		t.Errorf("NodeSet() == %v; expected 3 nodes\n", again)
+	}
+}
+
+func TestOwnerBoundaryForKey(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	key := hashFunc([]byte("key"))
+	if _, err = r.OwnerBoundaryForKey(key); err == nil {
+		t.Errorf("OwnerBoundaryForKey(): expected an error for an empty ring\n")
+	}
+	if _, err = r.Insert("node-0"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.OwnerBoundaryForKey(key); err == nil {
+		t.Errorf("OwnerBoundaryForKey(): expected an error for a single-distinct-node ring\n")
+	}
+	if _, err = r.Insert("node-1", "node-2"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	for i := 0; i < 100; i++ {
+		key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+		boundary, err := r.OwnerBoundaryForKey(key)
+		if err != nil {
+			t.Errorf("OwnerBoundaryForKey(%x): %v\n", key, err)
+			continue
+		}
+		owner := r.VirtualNodeForKey(key).Node()
+		pred, err := r.PredecessorNode(key)
+		if err != nil {
+			t.Errorf("PredecessorNode(%x): %v\n", key, err)
+			continue
+		}
+		// The boundary is the successor of the predecessor node, and it
+		// belongs to the owner of the key.
+		succ, err := r.Successor(pred.Name())
+		if err != nil {
+			t.Errorf("Successor(%s): %v\n", pred, err)
+			continue
+		}
+		if !bytes.Equal(boundary, succ.Name()) || succ.Node() != owner {
+			t.Errorf("OwnerBoundaryForKey(%x) == %x; expected %s of %q\n", key, boundary, succ, owner)
+		}
+	}
+}
+
+func TestMaterialize(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 3, 16)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if nodes := r.Materialize().Route([]byte("key")); nodes != nil {
+		t.Errorf("Route() == %v; expected nil for an empty ring\n", nodes)
+	}
+	if _, err = r.Insert("node-0", "node-1", "node-2", "node-3", "node-4", "node-5"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if err = r.SetDraining("node-0", true); err != nil {
+		t.Errorf("SetDraining(): %v\n", err)
+		t.FailNow()
+	}
+	if err = r.SetReadExcluded("node-1", true); err != nil {
+		t.Errorf("SetReadExcluded(): %v\n", err)
+		t.FailNow()
+	}
+	calls := make(map[Node]int)
+	full := func(node Node) bool {
+		calls[node]++
+		return node == "node-2"
+	}
+	plain := r.Materialize()
+	router := r.Materialize(SkipDraining(), SkipReadExcluded(), SkipFull(full))
+	for node, n := range calls {
+		if n != 1 {
+			t.Errorf("full(%q) called %d times; expected once\n", node, n)
+		}
+	}
+	if router.Generation() != r.Generation() {
+		t.Errorf("Generation() == %d; expected %d\n", router.Generation(), r.Generation())
+	}
+	state := r.state.Load().(*hashRingState)
+	for i := 0; i < 200; i++ {
+		key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+		if nodes := plain.Route(key); !sameNodes(nodes, state.nodesForKey(key)) {
+			t.Errorf("Route(%x) == %v without skip rules; expected %v\n", key, nodes, state.nodesForKey(key))
+		}
+		nodes := router.Route(key)
+		if len(nodes) != 3 {
+			t.Errorf("Route(%x) == %v; expected 3 nodes\n", key, nodes)
+		}
+		for _, node := range nodes {
+			if node == "node-0" || node == "node-1" || node == "node-2" {
+				t.Errorf("Route(%x) == %v includes skipped %q\n", key, nodes, node)
+			}
+		}
+	}
+
+	// The router should not reflect subsequent changes to the ring.
+	key := hashFunc([]byte("key"))
+	routed := router.Route(key)
+	if _, err = r.Remove(routed[0]); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+		t.FailNow()
+	}
+	if nodes := router.Route(key); !sameNodes(nodes, routed) {
+		t.Errorf("Route() == %v after Remove(); expected %v\n", nodes, routed)
+	}
+}
+
+func TestOwnerIndicesForKey(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 3, 16)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if indices := r.OwnerIndicesForKey([]byte("key"), nil); len(indices) != 0 {
+		t.Errorf("OwnerIndicesForKey() == %v; expected none for an empty ring\n", indices)
+	}
+	if _, err = r.Insert("node-3", "node-1", "node-4", "node-0", "node-2"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	nodes := r.Nodes()
+	if !sameNodes(nodes, []Node{"node-0", "node-1", "node-2", "node-3", "node-4"}) {
+		t.Errorf("Nodes() == %v\n", nodes)
+	}
+	dst := make([]int, 0, 3)
+	for i := 0; i < 100; i++ {
+		key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+		dst = r.OwnerIndicesForKey(key, dst)
+		owners := r.NodesForKey(key)
+		if len(dst) != len(owners) {
+			t.Errorf("OwnerIndicesForKey(%x) == %v; expected %d indices\n", key, dst, len(owners))
+			continue
+		}
+		for j := range dst {
+			if nodes[dst[j]] != owners[j] {
+				t.Errorf("OwnerIndicesForKey(%x)[%d] maps to %q; expected %q\n", key, j, nodes[dst[j]], owners[j])
+			}
+		}
+	}
+	key := hashFunc([]byte("key"))
+	if allocs := testing.AllocsPerRun(100, func() { dst = r.OwnerIndicesForKey(key, dst) }); allocs != 0 {
+		t.Errorf("OwnerIndicesForKey() allocates %v times per call\n", allocs)
+	}
+}
+
+func TestReadPrimaryDistribution(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 3, 4)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	keys := make([][]byte, 3000)
+	for i := range keys {
+		keys[i] = hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	if dist := r.ReadPrimaryDistribution(keys, false); len(dist) != 0 {
+		t.Errorf("ReadPrimaryDistribution() == %v; expected an empty map for an empty ring\n", dist)
+	}
+	if _, err = r.Insert("node-0", "node-1", "node-2"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	for _, key := range keys[:100] {
+		rotated, owners := r.NodesForKeyRotated(key), r.NodesForKey(key)
+		if !sameNodeSet(rotated, owners) {
+			t.Errorf("NodesForKeyRotated(%x) == %v; not a rotation of %v\n", key, rotated, owners)
+		}
+	}
+
+	// With as many nodes as the replication factor, each node is the
+	// replica owner of all keys, so rotation should spread the reads
+	// (almost) evenly, unlike the plain ordering.
+	spread := func(dist map[Node]float64) float64 {
+		var min, max, sum float64 = 1, 0, 0
+		for _, node := range []Node{"node-0", "node-1", "node-2"} {
+			min, max = math.Min(min, dist[node]), math.Max(max, dist[node])
+			sum += dist[node]
+		}
+		if math.Abs(sum-1) > 1e-9 {
+			t.Errorf("distribution %v sums up to %f; expected 1\n", dist, sum)
+		}
+		return max - min
+	}
+	plain, rotated := spread(r.ReadPrimaryDistribution(keys, false)), spread(r.ReadPrimaryDistribution(keys, true))
+	if rotated > 0.05 || rotated >= plain {
+		t.Errorf("spread of rotated reads %f; plain %f\n", rotated, plain)
+	}
+}
+
+func TestCompactArcs(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 32)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if arcs := r.CompactArcs(); arcs != nil {
+		t.Errorf("CompactArcs() == %v; expected nil for an empty ring\n", arcs)
+	}
+	if _, err = r.Insert("node-0", "node-1"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.Insert("node-2", "node-3"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	arcs := r.CompactArcs()
+	if len(arcs) == 0 || len(arcs) >= r.VirtualNodesLen() {
+		t.Errorf("CompactArcs() returned %d arcs for %d virtual nodes\n", len(arcs), r.VirtualNodesLen())
+	}
+	for i := range arcs {
+		next := arcs[(i+1)%len(arcs)]
+		if !bytes.Equal(arcs[i].Hi, next.Lo) {
+			t.Errorf("arc %d ends at %x, but arc %d starts at %x\n", i, arcs[i].Hi, (i+1)%len(arcs), next.Lo)
+		}
+		if sameNodes(arcs[i].Owners, next.Owners) && len(arcs) > 1 {
+			t.Errorf("arcs %d and %d share owners %v\n", i, (i+1)%len(arcs), next.Owners)
+		}
+	}
+	// Every key should be routed identically through the compact arcs.
+	for i := 0; i < 500; i++ {
+		key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+		found := 0
+		for _, arc := range arcs {
+			if arc.Contains(key) {
+				found++
+				if !sameNodes(arc.Owners, r.NodesForKey(key)) {
+					t.Errorf("key %x in arc with owners %v; expected %v\n", key, arc.Owners, r.NodesForKey(key))
+				}
+			}
+		}
+		if found != 1 {
+			t.Errorf("key %x found in %d arcs; expected 1\n", key, found)
+		}
+	}
+
+	// A single distinct node owns the whole keyspace.
+	small, _ := NewHashRing(hashFunc, 1, 8, "node-0")
+	if arcs := small.CompactArcs(); len(arcs) != 1 || !bytes.Equal(arcs[0].Lo, arcs[0].Hi) {
+		t.Errorf("CompactArcs() == %v; expected a single arc spanning the keyspace\n", arcs)
+	}
+}
+
+func TestStartRebalance(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1", "node-2")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	target := r.Clone()
+	if _, err = target.Remove("node-1"); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = target.Insert("node-3", "node-4"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.StartRebalance(target, nil); err == nil {
+		t.Errorf("StartRebalance(): expected an error for a nil move\n")
+	}
+	other, _ := NewHashRing(hashFunc, 3, 8)
+	if _, err = r.StartRebalance(other, func(Migration) error { return nil }); err == nil {
+		t.Errorf("StartRebalance(): expected an error for a different replication factor\n")
+	}
+
+	// A failing move stops the job after the last successful batch.
+	batches, prevGen := 0, ^uint64(0)
+	job, err := r.Clone().StartRebalance(target, func(Migration) error {
+		return fmt.Errorf("disk full")
+	})
+	if err != nil {
+		t.Errorf("StartRebalance(): %v\n", err)
+		t.FailNow()
+	}
+	if err = job.Wait(); err == nil || job.Progress() != 0 {
+		t.Errorf("Wait() == %v at progress %f; expected an error at 0\n", err, job.Progress())
+	}
+
+	// A successful job brings the ring to the target, one batch at a time.
+	oldState := r.state.Load().(*hashRingState)
+	job, err = r.StartRebalance(target, func(mig Migration) error {
+		if gen := r.Generation(); gen != prevGen {
+			batches++
+			prevGen = gen
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("StartRebalance(): %v\n", err)
+		t.FailNow()
+	}
+	if err = job.Wait(); err != nil {
+		t.Errorf("Wait(): %v\n", err)
+	}
+	if job.Progress() != 1 {
+		t.Errorf("Progress() == %f; expected 1\n", job.Progress())
+	}
+	newState := r.state.Load().(*hashRingState)
+	if newState.fingerprint() != target.state.Load().(*hashRingState).fingerprint() {
+		t.Errorf("ring does not match the target after the rebalance\n")
+	}
+	if newState.generation != oldState.generation+3 || batches != 3 {
+		t.Errorf("rebalance took %d generations and %d batches; expected 3\n", newState.generation-oldState.generation, batches)
+	}
+	if err = r.Validate(); err != nil {
+		t.Errorf("Validate(): %v\n", err)
+	}
+
+	// Cancel the job while its first batch is in progress.
+	r2 := target.Clone()
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	job, err = r2.StartRebalance(ringWithMembershipOf(t, oldState), func(Migration) error {
+		select {
+		case entered <- struct{}{}:
+		default:
+		}
+		<-release
+		return nil
+	})
+	if err != nil {
+		t.Errorf("StartRebalance(): %v\n", err)
+		t.FailNow()
+	}
+	<-entered
+	job.Cancel()
+	close(release)
+	if err = job.Wait(); err != ErrRebalanceCanceled {
+		t.Errorf("Wait() == %v; expected ErrRebalanceCanceled\n", err)
+	}
+	job.Cancel()
+	if p := job.Progress(); p <= 0 || p >= 1 {
+		t.Errorf("Progress() == %f after canceling; expected it in (0, 1)\n", p)
+	}
+
+	// Another writer modifying the ring makes the job stop, without moving
+	// any more data.
+	r3 := ringWithMembershipOf(t, oldState)
+	moves := 0
+	job, err = r3.StartRebalance(target, func(Migration) error {
+		moves++
+		r3.SetMeta(r3.Nodes()[0], map[string]string{"dc": "a"})
+		return nil
+	})
+	if err != nil {
+		t.Errorf("StartRebalance(): %v\n", err)
+		t.FailNow()
+	}
+	if err = job.Wait(); err != ErrStaleGeneration {
+		t.Errorf("Wait() == %v; expected ErrStaleGeneration\n", err)
+	}
+	if moves != 1 {
+		t.Errorf("move was called %d times; expected once\n", moves)
+	}
+
+	// With synchronized writers, other writers wait for the batch instead.
+	r4, err := NewHashRingWithOptions(hashFunc, 2, 8, WithSynchronizedWriters())
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r4.Insert("node-0", "node-1", "node-2"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	writerDone := make(chan struct{})
+	var once sync.Once
+	job, err = r4.StartRebalance(target, func(Migration) error {
+		once.Do(func() {
+			go func() {
+				r4.SetMeta("node-0", map[string]string{"zone": "a"})
+				close(writerDone)
+			}()
+		})
+		return nil
+	})
+	if err != nil {
+		t.Errorf("StartRebalance(): %v\n", err)
+		t.FailNow()
+	}
+	<-writerDone
+	if err = job.Wait(); err != nil && err != ErrStaleGeneration {
+		t.Errorf("Wait(): %v\n", err)
+	}
+	if p := job.Progress(); p == 0 {
+		t.Errorf("Progress() == %f; expected the first batch to complete\n", p)
+	}
+
+	// Throttled batches of two nodes each: two insertions, then one
+	// removal.
+	r5 := ringWithMembershipOf(t, oldState)
+	gen := r5.Generation()
+	start := time.Now()
+	job, err = r5.StartRebalance(target, func(Migration) error { return nil }, WithRebalanceThrottle(2, 10*time.Millisecond))
+	if err != nil {
+		t.Errorf("StartRebalance(): %v\n", err)
+		t.FailNow()
+	}
+	if err = job.Wait(); err != nil {
+		t.Errorf("Wait(): %v\n", err)
+	}
+	if r5.Generation() != gen+2 {
+		t.Errorf("throttled rebalance took %d generations; expected 2\n", r5.Generation()-gen)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("throttled rebalance took %v; expected at least one pause\n", elapsed)
+	}
+	if !r5.Equal(target) {
+		t.Errorf("ring does not match the target after the throttled rebalance\n")
+	}
+}
+
+// ringWithMembershipOf returns a new ring with the same membership as the given state.
+func ringWithMembershipOf(t *testing.T, state *hashRingState) *HashRing {
+	r, err := NewHashRing(hashFunc, int(state.replicationFactor), int(state.virtualNodeCount), state.nodes()...)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	return r
+}
+
+func TestNodesForKeyFunc(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 16, "node-0", "node-1", "node-2", "node-3")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	tenant := func(key []byte) []byte {
+		if i := bytes.IndexByte(key, ':'); i >= 0 {
+			return key[:i]
+		}
+		return key
+	}
+	for _, tn := range []string{"acme", "globex", "initech"} {
+		expected := r.NodesForKey(r.HashKey([]byte(tn)))
+		for i := 0; i < 50; i++ {
+			key := []byte(fmt.Sprintf("%s:object-%d", tn, i))
+			if nodes := r.NodesForKeyFunc(key, tenant); !sameNodes(nodes, expected) {
+				t.Errorf("NodesForKeyFunc(%q) == %v; expected %v\n", key, nodes, expected)
+			}
+			if nodes := r.NodesForKeyFunc(key, nil); !sameNodes(nodes, r.NodesForKey(r.HashKey(key))) {
+				t.Errorf("NodesForKeyFunc(%q, nil) == %v; expected the owners of the whole key\n", key, nodes)
+			}
+		}
+	}
+}
+
+func TestSampleKeyForNode(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1", "node-2", "node-3")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.SampleKeyForNode("node-4", 1); err == nil {
+		t.Errorf("SampleKeyForNode(node-4): expected an error for a node not in the ring\n")
+	}
+	for _, node := range []Node{"node-0", "node-1", "node-2", "node-3"} {
+		for seed := int64(0); seed < 10; seed++ {
+			key, err := r.SampleKeyForNode(node, seed)
+			if err != nil {
+				t.Errorf("SampleKeyForNode(%q, %d): %v\n", node, seed, err)
+				continue
+			}
+			if owner, _ := r.OwnerForKey(key); owner != node {
+				t.Errorf("SampleKeyForNode(%q, %d) == %x, owned by %q\n", node, seed, key, owner)
+			}
+			if again, _ := r.SampleKeyForNode(node, seed); !bytes.Equal(again, key) {
+				t.Errorf("SampleKeyForNode(%q, %d) is not reproducible\n", node, seed)
+			}
+		}
+	}
+	if err = r.SetReadExcluded("node-0", true); err != nil {
+		t.Errorf("SetReadExcluded(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.SampleKeyForNode("node-0", 1); err == nil {
+		t.Errorf("SampleKeyForNode(node-0): expected an error for a node excluded from reads\n")
+	}
+}
+
+func TestAllowDuplicateOwners(t *testing.T) {
+	nodes := []Node{"node-0", "node-1", "node-2"}
+	dedup, err := NewHashRing(hashFunc, 3, 8, nodes...)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	dup, err := NewHashRingWithOptions(hashFunc, 3, 8, WithAllowDuplicateOwners(true))
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = dup.Insert(nodes...); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if err = dup.Validate(); err != nil {
+		t.Errorf("Validate(): %v\n", err)
+	}
+
+	state := dup.state.Load().(*hashRingState)
+	sawDuplicate := false
+	for i := 0; i < 256; i++ {
+		key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+		got := dedup.NodesForKey(key)
+		seen := make(map[Node]bool)
+		for _, node := range got {
+			if seen[node] {
+				t.Errorf("NodesForKey(%x) = %v: duplicate owners by default\n", key, got)
+			}
+			seen[node] = true
+		}
+
+		got = dup.NodesForKey(key)
+		if len(got) != 3 {
+			t.Errorf("NodesForKey(%x) = %v: expected 3 owners\n", key, got)
+			continue
+		}
+		// The owners must be the nodes of the next 3 virtual nodes.
+		j := state.search(key)
+		for k, node := range got {
+			if want := state.virtualNodes[(j+k)%len(state.virtualNodes)].node; node != want {
+				t.Errorf("NodesForKey(%x)[%d] = %q; expected %q\n", key, k, node, want)
+			}
+		}
+		if got[0] == got[1] || got[1] == got[2] || got[0] == got[2] {
+			sawDuplicate = true
+		}
+	}
+	if !sawDuplicate {
+		t.Errorf("expected some keys with duplicate owners\n")
+	}
+
+	// Rings with fewer virtual nodes than the replication factor.
+	small, err := NewHashRingWithOptions(hashFunc, 3, 2, WithAllowDuplicateOwners(true))
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = small.Insert("node-0"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	if got := small.NodesForKey([]byte("key")); len(got) != 2 || got[0] != "node-0" || got[1] != "node-0" {
+		t.Errorf("NodesForKey() = %v; expected [node-0 node-0]\n", got)
+	}
+
+	// The option survives saving and loading.
+	buf := &bytes.Buffer{}
+	if err = dup.Save(buf); err != nil {
+		t.Errorf("Save(): %v\n", err)
+		t.FailNow()
+	}
+	loaded, err := Load(hashFunc, buf)
+	if err != nil {
+		t.Errorf("Load(): %v\n", err)
+		t.FailNow()
+	}
+	if !loaded.state.Load().(*hashRingState).duplicateOwners {
+		t.Errorf("Load(): duplicate owners not restored\n")
+	}
+
+	if err = dup.SetJoinWeight("node-0", 0.5); err == nil {
+		t.Errorf("SetJoinWeight(): expected an error with duplicate owners\n")
+	}
+	rackOf := func(Node) string { return "rack" }
+	if _, err = NewHashRingWithOptions(hashFunc, 3, 8, WithAllowDuplicateOwners(true), WithRackConstraint(rackOf, 1)); err == nil {
+		t.Errorf("NewHashRingWithOptions(): expected an error with a rack constraint\n")
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	hasWarning := func(warnings []string, substr string) bool {
+		for _, w := range warnings {
+			if strings.Contains(w, substr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	r, err := NewHashRing(hashFunc, 3, 8)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if w := r.Warnings(); len(w) != 1 || !strings.Contains(w[0], "empty") {
+		t.Errorf("Warnings() = %q; expected an empty ring warning\n", w)
+	}
+	if _, err = r.Insert("node-0", "node-1"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	if w := r.Warnings(); !hasWarning(w, "exceeds") {
+		t.Errorf("Warnings() = %q; expected a replication factor warning\n", w)
+	}
+	if _, err = r.Insert("node-2"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	if w := r.Warnings(); !hasWarning(w, "removing any of them") {
+		t.Errorf("Warnings() = %q; expected a warning about removals\n", w)
+	}
+	if _, err = r.Insert("node-3"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	if w := r.Warnings(); w != nil {
+		t.Errorf("Warnings() = %q; expected none\n", w)
+	}
+	if err = r.SetReadExcluded("node-3", true); err != nil {
+		t.Errorf("SetReadExcluded(): %v\n", err)
+	}
+	if err = r.SetReadExcluded("node-2", true); err != nil {
+		t.Errorf("SetReadExcluded(): %v\n", err)
+	}
+	if w := r.Warnings(); len(w) != 1 || !strings.Contains(w[0], "excluded from reads") {
+		t.Errorf("Warnings() = %q; expected a read exclusion warning\n", w)
+	}
+
+	// A rack constraint that the nodes of the ring cannot satisfy.
+	rackOf := func(node Node) string {
+		if node == "node-0" {
+			return "rack-a"
+		}
+		return "rack-b"
+	}
+	r, err = NewHashRingWithOptions(hashFunc, 3, 8, WithRackConstraint(rackOf, 3))
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.Insert("node-0", "node-1", "node-2", "node-3"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	w := r.Warnings()
+	if !hasWarning(w, "spans 2 racks") || !hasWarning(w, "32 of 32 arcs span fewer than 3 racks") {
+		t.Errorf("Warnings() = %q; expected rack constraint warnings\n", w)
+	}
+
+	// Arcs with duplicate owners.
+	r, err = NewHashRingWithOptions(hashFunc, 3, 8, WithAllowDuplicateOwners(true))
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.Insert("node-0", "node-1", "node-2", "node-3"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	if w := r.Warnings(); !hasWarning(w, "duplicate") {
+		t.Errorf("Warnings() = %q; expected a duplicate owners warning\n", w)
+	}
+}
+
+func TestInsertWeighted(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 16, "node-0", "node-1")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	gen := r.Generation()
+	for _, weight := range []int{0, -1, 1 << 12, 1 << 62, math.MaxInt64} {
+		if _, err = r.InsertWeighted(weight, "node-2"); err == nil {
+			t.Errorf("InsertWeighted(%d): expected an error\n", weight)
+		}
+	}
+	if _, err = r.InsertWeighted(4, "node-0"); err == nil {
+		t.Errorf("InsertWeighted(node-0): expected an error for a node already in the ring\n")
+	}
+	if r.Generation() != gen || r.VirtualNodesLen() != 32 || r.Size() != 2 {
+		t.Errorf("failed InsertWeighted() modified the ring\n")
+	}
+
+	vns, err := r.InsertWeighted(4, "node-2", "node-3")
+	if err != nil {
+		t.Errorf("InsertWeighted(): %v\n", err)
+		t.FailNow()
+	}
+	if len(vns) != 128 {
+		t.Errorf("InsertWeighted() returned %d virtual nodes; expected 128\n", len(vns))
+	}
+	counts := r.NodeVNodeCounts()
+	for node, want := range map[Node]int{"node-0": 16, "node-1": 16, "node-2": 64, "node-3": 64} {
+		if counts[node] != want {
+			t.Errorf("node %q has %d virtual nodes; expected %d\n", node, counts[node], want)
+		}
+	}
+	if err = r.Validate(); err != nil {
+		t.Errorf("Validate(): %v\n", err)
+	}
+	if got := strings.Count(r.String(), "\n"); got != 160 {
+		t.Errorf("String() has %d lines; expected 160\n", got)
+	}
+
+	// Weighted nodes survive saving and loading.
+	buf := &bytes.Buffer{}
+	if err = r.Save(buf); err != nil {
+		t.Errorf("Save(): %v\n", err)
+		t.FailNow()
+	}
+	loaded, err := Load(hashFunc, buf)
+	if err != nil {
+		t.Errorf("Load(): %v\n", err)
+		t.FailNow()
+	}
+	if loaded.NodeVNodeCounts()["node-2"] != 64 {
+		t.Errorf("Load(): weight of node-2 not restored\n")
+	}
+
+	removed, err := r.Remove("node-2")
+	if err != nil {
+		t.Errorf("Remove(): %v\n", err)
+	}
+	if len(removed) != 64 || r.VirtualNodesLen() != 96 {
+		t.Errorf("Remove() removed %d virtual nodes, leaving %d; expected 64 and 96\n", len(removed), r.VirtualNodesLen())
+	}
+	if err = r.Validate(); err != nil {
+		t.Errorf("Validate(): %v\n", err)
+	}
+}
+
+func TestSetReplicationFactor(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 3, 16, "node-0", "node-1", "node-2", "node-3", "node-4")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	gen := r.Generation()
+	for _, rf := range []int{0, -1, 6, 1 << 16} {
+		if err = r.SetReplicationFactor(rf); err == nil {
+			t.Errorf("SetReplicationFactor(%d): expected an error\n", rf)
+		}
+	}
+	if r.Generation() != gen {
+		t.Errorf("failed SetReplicationFactor() modified the ring\n")
+	}
+
+	key := hashFunc([]byte("key"))
+	old := r.state.Load().(*hashRingState)
+	if err = r.SetReplicationFactor(5); err != nil {
+		t.Errorf("SetReplicationFactor(5): %v\n", err)
+		t.FailNow()
+	}
+	if got := old.readNodesForKey(key); len(got) != 3 {
+		t.Errorf("old state returned %d owners; expected 3\n", len(got))
+	}
+	got := r.NodesForKey(key)
+	if len(got) != 5 {
+		t.Errorf("NodesForKey() returned %d owners; expected 5\n", len(got))
+	}
+	if err = r.Validate(); err != nil {
+		t.Errorf("Validate(): %v\n", err)
+	}
+
+	// Lowering the replication factor keeps the first owners.
+	if err = r.SetReplicationFactor(2); err != nil {
+		t.Errorf("SetReplicationFactor(2): %v\n", err)
+	}
+	if lower := r.NodesForKey(key); len(lower) != 2 || lower[0] != got[0] || lower[1] != got[1] {
+		t.Errorf("NodesForKey() = %v; expected %v\n", lower, got[:2])
+	}
+
+	rackOf := func(node Node) string { return string(node) }
+	r, err = NewHashRingWithOptions(hashFunc, 3, 8, WithRackConstraint(rackOf, 3))
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.Insert("node-0", "node-1", "node-2"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	if err = r.SetReplicationFactor(2); err == nil {
+		t.Errorf("SetReplicationFactor(2): expected an error with a rack constraint of 3\n")
+	}
+}
+
+func TestInsertRemoveWithMigration(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 3, 8, "node-0", "node-1", "node-2", "node-3")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if _, _, err = r.InsertWithMigration("node-0"); err == nil {
+		t.Errorf("InsertWithMigration(node-0): expected an error for a node already in the ring\n")
+	}
+	if _, _, err = r.RemoveWithMigration("node-9"); err == nil {
+		t.Errorf("RemoveWithMigration(node-9): expected an error for a node not in the ring\n")
+	}
+
+	oldState := r.state.Load().(*hashRingState)
+	vns, migs, err := r.InsertWithMigration("node-4")
+	if err != nil {
+		t.Errorf("InsertWithMigration(): %v\n", err)
+		t.FailNow()
+	}
+	if len(vns) != 8 || len(migs) == 0 {
+		t.Errorf("InsertWithMigration() returned %d virtual nodes and %d migrations\n", len(vns), len(migs))
+	}
+	newState := r.state.Load().(*hashRingState)
+	checkMigrations(t, oldState, newState, migs)
+	for _, mig := range migs {
+		if !(OwnerSet{owners: mig.NewOwners}).Contains("node-4") {
+			t.Errorf("migration %v does not involve the inserted node\n", mig)
+		}
+	}
+
+	vns, migs, err = r.RemoveWithMigration("node-4")
+	if err != nil {
+		t.Errorf("RemoveWithMigration(): %v\n", err)
+		t.FailNow()
+	}
+	if len(vns) != 8 {
+		t.Errorf("RemoveWithMigration() returned %d virtual nodes; expected 8\n", len(vns))
+	}
+	checkMigrations(t, newState, r.state.Load().(*hashRingState), migs)
+	for _, mig := range migs {
+		if !(OwnerSet{owners: mig.OldOwners}).Contains("node-4") {
+			t.Errorf("migration %v does not involve the removed node\n", mig)
+		}
+	}
+}
+
+func TestTopology(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1", "node-2")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	topo := r.Topology()
+	if topo.Generation != r.Generation() || topo.ReplicationFactor != 2 || len(topo.VirtualNodes) != 24 {
+		t.Errorf("Topology() = %+v: unexpected header\n", topo)
+	}
+	state := r.state.Load().(*hashRingState)
+	for i, info := range topo.VirtualNodes {
+		vn := state.virtualNodes[i]
+		if info.Name != hex.EncodeToString(vn.name) || info.Node != vn.node || info.VNID != vn.vnid {
+			t.Errorf("Topology().VirtualNodes[%d] = %+v; expected %s\n", i, info, vn)
+		}
+		if !sameNodes(info.Owners, state.owners(i)) {
+			t.Errorf("Topology().VirtualNodes[%d].Owners = %v; expected %v\n", i, info.Owners, state.owners(i))
+		}
+		if i > 0 && topo.VirtualNodes[i-1].Name >= info.Name {
+			t.Errorf("Topology().VirtualNodes are not sorted by name\n")
+		}
+	}
+	// The topology must not share memory with the ring.
+	topo.VirtualNodes[0].Owners[0] = "garbage"
+	if state.owners(0)[0] == "garbage" {
+		t.Errorf("Topology() shares replica owners with the ring\n")
+	}
+
+	encoded, err := json.Marshal(r)
+	if err != nil {
+		t.Errorf("json.Marshal(): %v\n", err)
+		t.FailNow()
+	}
+	var decoded Topology
+	if err = json.Unmarshal(encoded, &decoded); err != nil {
+		t.Errorf("json.Unmarshal(): %v\n", err)
+		t.FailNow()
+	}
+	if len(decoded.VirtualNodes) != 24 || decoded.VirtualNodes[5].Name != hex.EncodeToString(state.virtualNodes[5].name) {
+		t.Errorf("json.Unmarshal() = %+v: does not match the ring\n", decoded)
+	}
+	again, _ := json.Marshal(r)
+	if !bytes.Equal(encoded, again) {
+		t.Errorf("json.Marshal() is not stable\n")
+	}
+
+	empty, _ := NewHashRing(hashFunc, 2, 8)
+	if encoded, err = json.Marshal(empty); err != nil || !strings.Contains(string(encoded), `"virtualNodes":[]`) {
+		t.Errorf("json.Marshal() = %s, %v; expected an empty list of virtual nodes\n", encoded, err)
+	}
+}
+
+func TestSynchronizedWriters(t *testing.T) {
+	r, err := NewHashRingWithOptions(hashFunc, 2, 8, WithSynchronizedWriters())
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	const writers, nodesPerWriter = 8, 16
+	done := make(chan struct{}, writers)
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			defer func() { done <- struct{}{} }()
+			for i := 0; i < nodesPerWriter; i++ {
+				node := Node(fmt.Sprintf("node-%d-%d", w, i))
+				if _, err := r.Insert(node); err != nil {
+					t.Errorf("Insert(%q): %v\n", node, err)
+				}
+				if i%2 == 1 {
+					if _, err := r.Remove(node); err != nil {
+						t.Errorf("Remove(%q): %v\n", node, err)
+					}
+				}
+			}
+		}(w)
+	}
+	for w := 0; w < writers; w++ {
+		<-done
+	}
+	if size := r.Size(); size != writers*nodesPerWriter/2 {
+		t.Errorf("Size() = %d; expected %d, since no modification should be lost\n", size, writers*nodesPerWriter/2)
+	}
+	if gen := r.Generation(); gen != writers*nodesPerWriter*3/2 {
+		t.Errorf("Generation() = %d; expected %d\n", gen, writers*nodesPerWriter*3/2)
+	}
+	if err = r.Validate(); err != nil {
+		t.Errorf("Validate(): %v\n", err)
+	}
+	if r.Clone().writers == nil {
+		t.Errorf("Clone() does not synchronize its writers\n")
+	}
+
+	// Lookups must not allocate because of the mutex.
+	key := hashFunc([]byte("key"))
+	if allocs := testing.AllocsPerRun(100, func() { r.NodesForKey(key) }); allocs != 0 {
+		t.Errorf("NodesForKey() allocated %v times per run\n", allocs)
+	}
+}
+
+func TestNodesForKeyExcluding(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 3, 8, "node-0", "node-1", "node-2", "node-3", "node-4")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	for i := 0; i < 64; i++ {
+		key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+		owners := r.NodesForKey(key)
+		if got := r.NodesForKeyExcluding(key); !sameNodes(got, owners) {
+			t.Errorf("NodesForKeyExcluding(%x) = %v; expected %v\n", key, got, owners)
+		}
+		got := r.NodesForKeyExcluding(key, owners[1])
+		if len(got) != 3 || got[0] != owners[0] || got[1] != owners[2] {
+			t.Errorf("NodesForKeyExcluding(%x, %q) = %v; owners were %v\n", key, owners[1], got, owners)
+		}
+		for _, node := range got {
+			if node == owners[1] {
+				t.Errorf("NodesForKeyExcluding(%x, %q) = %v: includes the excluded node\n", key, owners[1], got)
+			}
+		}
+	}
+
+	// Fewer nodes remain than the replication factor.
+	key := hashFunc([]byte("key"))
+	if got := r.NodesForKeyExcluding(key, "node-0", "node-1", "node-2"); len(got) != 2 {
+		t.Errorf("NodesForKeyExcluding() = %v; expected 2 nodes\n", got)
+	}
+	if got := r.NodesForKeyExcluding(key, "node-0", "node-1", "node-2", "node-3", "node-4"); len(got) != 0 {
+		t.Errorf("NodesForKeyExcluding() = %v; expected none\n", got)
+	}
+	empty, _ := NewHashRing(hashFunc, 3, 8)
+	if got := empty.NodesForKeyExcluding(key, "node-0"); len(got) != 0 {
+		t.Errorf("NodesForKeyExcluding() = %v; expected none for an empty ring\n", got)
+	}
+}
+
+func TestVirtualNodesIteratorFrom(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1", "node-2")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	state := r.state.Load().(*hashRingState)
+	n := len(state.virtualNodes)
+	for _, key := range [][]byte{
+		hashFunc([]byte("key")),
+		state.virtualNodes[0].name,
+		state.virtualNodes[n-1].name,
+		bytes.Repeat([]byte{0xff}, sha256.Size),
+	} {
+		start := state.search(key)
+		if state.virtualNodes[start] != r.VirtualNodeForKey(key) {
+			t.Errorf("unexpected start for key %x\n", key)
+		}
+
+		i := 0
+		for iter := r.NewVirtualNodesIteratorFrom(key); iter.HasNext(); i++ {
+			if vn, want := iter.Next(), state.virtualNodes[(start+i)%n]; vn != want {
+				t.Errorf("NewVirtualNodesIteratorFrom(%x): #%d is %s; expected %s\n", key, i, vn, want)
+			}
+		}
+		if i != n {
+			t.Errorf("NewVirtualNodesIteratorFrom(%x) iterated over %d virtual nodes; expected %d\n", key, i, n)
+		}
+
+		i = 0
+		for iter := r.NewVirtualNodesReverseIteratorFrom(key); iter.HasNext(); i++ {
+			if vn, want := iter.Next(), state.virtualNodes[(start-i+n)%n]; vn != want {
+				t.Errorf("NewVirtualNodesReverseIteratorFrom(%x): #%d is %s; expected %s\n", key, i, vn, want)
+			}
+		}
+		if i != n {
+			t.Errorf("NewVirtualNodesReverseIteratorFrom(%x) iterated over %d virtual nodes; expected %d\n", key, i, n)
+		}
+	}
+
+	empty, _ := NewHashRing(hashFunc, 2, 8)
+	if empty.NewVirtualNodesIteratorFrom([]byte("key")).HasNext() || empty.NewVirtualNodesReverseIteratorFrom([]byte("key")).HasNext() {
+		t.Errorf("iterators of an empty ring have a next virtual node\n")
+	}
+}
+
+func TestVirtualNodesForNode(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1", "node-2")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.InsertWeighted(2, "node-3"); err != nil {
+		t.Errorf("InsertWeighted(): %v\n", err)
+	}
+	if _, err = r.ReduceWeight("node-0", 3); err != nil {
+		t.Errorf("ReduceWeight(): %v\n", err)
+	}
+	state := r.state.Load().(*hashRingState)
+	for node, count := range map[Node]int{"node-0": 5, "node-1": 8, "node-2": 8, "node-3": 16, "node-4": 0} {
+		want := make([]*VirtualNode, 0)
+		for _, vn := range state.virtualNodes {
+			if vn.node == node {
+				want = append(want, vn)
+			}
+		}
+		got := r.VirtualNodesForNode(node)
+		if got == nil || len(got) != count || len(got) != len(want) {
+			t.Errorf("VirtualNodesForNode(%q) returned %d virtual nodes; expected %d\n", node, len(got), count)
+			continue
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("VirtualNodesForNode(%q)[%d] = %s; expected %s\n", node, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestRemoveVirtualNodesByName(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 4, "node-0", "node-1", "node-2")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	vns := r.VirtualNodesForNode("node-0")
+	vnidOf := func(vnid uint16) []byte {
+		for _, vn := range vns {
+			if vn.vnid == vnid {
+				return vn.name
+			}
+		}
+		t.FailNow()
+		return nil
+	}
+
+	gen := r.Generation()
+	_, err = r.RemoveVirtualNodesByName(vnidOf(1), []byte("missing"), vnidOf(1))
+	if batchErr, ok := err.(*BatchError); !ok || len(batchErr.Errs) != 2 {
+		t.Errorf("RemoveVirtualNodesByName(): returned %v; expected a *BatchError of 2 errors\n", err)
+	}
+	if r.Generation() != gen || r.VirtualNodesLen() != 12 {
+		t.Errorf("failed RemoveVirtualNodesByName() modified the ring\n")
+	}
+
+	// Remove vnids 1 and 2 individually, and then the highest one.
+	removed, err := r.RemoveVirtualNodesByName(vnidOf(1), vnidOf(2))
+	if err != nil {
+		t.Errorf("RemoveVirtualNodesByName(): %v\n", err)
+		t.FailNow()
+	}
+	if len(removed) != 2 || r.VirtualNodesLen() != 10 {
+		t.Errorf("RemoveVirtualNodesByName() removed %d virtual nodes, leaving %d; expected 2 and 10\n", len(removed), r.VirtualNodesLen())
+	}
+	if err = r.Validate(); err != nil {
+		t.Errorf("Validate(): %v\n", err)
+	}
+	state := r.state.Load().(*hashRingState)
+	if state.vnodeCounts["node-0"] != 4 || len(state.removedVNIDs["node-0"]) != 2 {
+		t.Errorf("unexpected vnid range %d with removed vnids %v\n", state.vnodeCounts["node-0"], state.removedVNIDs["node-0"])
+	}
+	if left := r.VirtualNodesForNode("node-0"); len(left) != 2 {
+		t.Errorf("VirtualNodesForNode() returned %d virtual nodes; expected 2\n", len(left))
+	}
+
+	// Saving, loading and diffing preserve the removed virtual nodes.
+	buf := &bytes.Buffer{}
+	if err = r.Save(buf); err != nil {
+		t.Errorf("Save(): %v\n", err)
+		t.FailNow()
+	}
+	loaded, err := Load(hashFunc, buf)
+	if err != nil {
+		t.Errorf("Load(): %v\n", err)
+		t.FailNow()
+	}
+	if loaded.String() != r.String() {
+		t.Errorf("Load() restored a different ring:\n%s\nexpected:\n%s\n", loaded, r)
+	}
+	if p := DiffPatch(r, loaded); p.From != p.To {
+		t.Errorf("DiffPatch(): fingerprints of equal rings differ\n")
+	}
+	if p := DiffPatch(r, r.Clone()); p.From != p.To {
+		t.Errorf("DiffPatch(): fingerprint of a clone differs\n")
+	}
+
+	// Dropping the highest vnid shrinks the range past the removed ones.
+	if _, err = r.RemoveVirtualNodesByName(vnidOf(3)); err != nil {
+		t.Errorf("RemoveVirtualNodesByName(): %v\n", err)
+	}
+	state = r.state.Load().(*hashRingState)
+	if state.vnodeCounts["node-0"] != 1 || state.removedVNIDs["node-0"] != nil {
+		t.Errorf("unexpected vnid range %d with removed vnids %v\n", state.vnodeCounts["node-0"], state.removedVNIDs["node-0"])
+	}
+
+	// Removing the last virtual node removes the distinct node.
+	if err = r.SetDraining("node-0", true); err != nil {
+		t.Errorf("SetDraining(): %v\n", err)
+	}
+	if _, err = r.RemoveVirtualNodesByName(vnidOf(0)); err != nil {
+		t.Errorf("RemoveVirtualNodesByName(): %v\n", err)
+	}
+	state = r.state.Load().(*hashRingState)
+	if r.Size() != 2 || state.hasNode("node-0") || len(state.draining) != 0 {
+		t.Errorf("RemoveVirtualNodesByName() did not remove node-0\n")
+	}
+	if err = r.Validate(); err != nil {
+		t.Errorf("Validate(): %v\n", err)
+	}
+	if _, err = r.Insert("node-0"); err != nil || r.VirtualNodesLen() != 12 {
+		t.Errorf("Insert(): %v\n", err)
+	}
+
+	// Only the affected replica owners are recomputed, but all of them
+	// are as if they had been recomputed from scratch.
+	rng := rand.New(rand.NewSource(42))
+	for _, rf := range []int{1, 3, 5} {
+		r, err = NewHashRing(hashFunc, rf, 16, "node-0", "node-1", "node-2", "node-3")
+		if err != nil {
+			t.Errorf("NewHashRing(): %v\n", err)
+			t.FailNow()
+		}
+		for r.VirtualNodesLen() > 0 {
+			vns := r.state.Load().(*hashRingState).virtualNodes
+			k := 1 + rng.Intn(3)
+			if k > len(vns) {
+				k = len(vns)
+			}
+			names := make([][]byte, 0, k)
+			for _, i := range rng.Perm(len(vns))[:k] {
+				names = append(names, vns[i].Name())
+			}
+			if _, err = r.RemoveVirtualNodesByName(names...); err != nil {
+				t.Errorf("RemoveVirtualNodesByName(): %v\n", err)
+				t.FailNow()
+			}
+			state = r.state.Load().(*hashRingState)
+			for i := range state.virtualNodes {
+				if expected := state.computeOwners(i); !sameNodes(state.replicaOwners[i], expected) {
+					t.Errorf("replica owners of vnode %d (rf=%d) are %v; expected %v\n", i, rf, state.replicaOwners[i], expected)
+					t.FailNow()
+				}
+			}
+		}
+	}
+}
+
+func TestLoadDistribution(t *testing.T) {
+	empty, _ := NewHashRing(hashFunc, 2, 8)
+	if dist := empty.LoadDistribution(); len(dist) != 0 {
+		t.Errorf("LoadDistribution() = %v; expected an empty map\n", dist)
+	}
+	if stats := LoadStatsOf(empty.LoadDistribution()); stats != (LoadStats{}) {
+		t.Errorf("LoadStatsOf() = %+v; expected zero stats\n", stats)
+	}
+
+	r, err := NewHashRing(hashFunc, 2, 256, "node-0", "node-1", "node-2", "node-3")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	dist := r.LoadDistribution()
+	var sum float64
+	for _, share := range dist {
+		sum += share
+	}
+	if len(dist) != 4 || math.Abs(sum-1) > 1e-9 {
+		t.Errorf("LoadDistribution() = %v; expected 4 shares summing up to 1\n", dist)
+	}
+	stats := LoadStatsOf(dist)
+	if math.Abs(stats.Mean-0.25) > 1e-9 || stats.Min > stats.Mean || stats.Max < stats.Mean {
+		t.Errorf("LoadStatsOf() = %+v: inconsistent\n", stats)
+	}
+	// With 256 virtual nodes per node, the distribution should be even.
+	if stats.Max > 0.3 || stats.Min < 0.2 || stats.StdDev > 0.05 {
+		t.Errorf("LoadStatsOf() = %+v: too uneven\n", stats)
+	}
+
+	stats = LoadStatsOf(map[Node]float64{"a": 0.1, "b": 0.3, "c": 0.6})
+	if stats.Min != 0.1 || stats.Max != 0.6 || math.Abs(stats.Mean-1.0/3) > 1e-9 || math.Abs(stats.StdDev-0.2054804667) > 1e-9 {
+		t.Errorf("LoadStatsOf() = %+v: unexpected\n", stats)
+	}
+}
+
+func TestNodesForKeyBounded(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 16, "node-0", "node-1", "node-2", "node-3")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	empty, _ := NewHashRing(hashFunc, 2, 16)
+	if got := empty.NodesForKeyBounded([]byte("key"), nil, 1.25); got != nil {
+		t.Errorf("NodesForKeyBounded() = %v; expected nil for an empty ring\n", got)
+	}
+
+	// Without any load, the lookups are not affected.
+	for i := 0; i < 64; i++ {
+		key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+		if got, want := r.NodesForKeyBounded(key, nil, 1.25), r.NodesForKey(key); !sameNodes(got, want) {
+			t.Errorf("NodesForKeyBounded(%x) = %v; expected %v\n", key, got, want)
+		}
+	}
+
+	// Placing keys one by one keeps all loads within the bound.
+	const numKeys, capacity = 1000, 1.25
+	loads := make(map[Node]int)
+	for i := 0; i < numKeys; i++ {
+		key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+		got := r.NodesForKeyBounded(key, loads, capacity)
+		if len(got) != 2 || got[0] == got[1] {
+			t.Errorf("NodesForKeyBounded(%x) = %v; expected 2 distinct nodes\n", key, got)
+			t.FailNow()
+		}
+		loads[got[0]]++
+	}
+	for node, load := range loads {
+		if bound := math.Ceil(capacity * numKeys / 4); float64(load) > bound {
+			t.Errorf("node %q has a load of %d; expected at most %v\n", node, load, bound)
+		}
+	}
+
+	// A fully saturated ring falls back to the least loaded nodes.
+	key := hashFunc([]byte("key"))
+	loads = map[Node]int{"node-0": 10, "node-1": 10, "node-2": 3, "node-3": 7}
+	if got := r.NodesForKeyBounded(key, loads, 0); len(got) != 2 || got[0] != "node-2" || got[1] != "node-3" {
+		t.Errorf("NodesForKeyBounded() = %v; expected [node-2 node-3]\n", got)
+	}
+	// Only node-2 is below the bound; node-3 is the least loaded saturated.
+	if got := r.NodesForKeyBounded(key, loads, 0.5); len(got) != 2 || got[0] != "node-2" || got[1] != "node-3" {
+		t.Errorf("NodesForKeyBounded() = %v; expected [node-2 node-3]\n", got)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	meta := map[string]string{"dc": "eu-1", "rack": "r7"}
+	if err = r.SetMeta("node-2", meta); err == nil {
+		t.Errorf("SetMeta(node-2): expected an error for a node not in the ring\n")
+	}
+	if err = r.SetMeta("node-0", meta); err != nil {
+		t.Errorf("SetMeta(): %v\n", err)
+	}
+	meta["dc"] = "garbage"
+	if got := r.Meta("node-0"); len(got) != 2 || got["dc"] != "eu-1" || got["rack"] != "r7" {
+		t.Errorf("Meta(node-0) = %v: unexpected\n", got)
+	}
+	r.Meta("node-0")["dc"] = "garbage"
+	if got := r.Meta("node-0")["dc"]; got != "eu-1" {
+		t.Errorf("Meta() shares its metadata with the ring\n")
+	}
+	if got := r.Meta("node-1"); got != nil {
+		t.Errorf("Meta(node-1) = %v; expected nil\n", got)
+	}
+
+	// Metadata survive other modifications and clones.
+	if _, err = r.Insert("node-2"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	if _, err = r.Remove("node-1"); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+	}
+	if got := r.Clone().Meta("node-0")["dc"]; got != "eu-1" {
+		t.Errorf("Clone().Meta(node-0)[dc] = %q; expected %q\n", got, "eu-1")
+	}
+
+	// Removing (or re-inserting) a node clears its metadata.
+	if _, err = r.Remove("node-0"); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+	}
+	if _, err = r.Insert("node-0"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	if got := r.Meta("node-0"); got != nil {
+		t.Errorf("Meta(node-0) = %v; expected nil after its removal\n", got)
+	}
+	if err = r.SetMeta("node-2", map[string]string{"dc": "us-2"}); err != nil {
+		t.Errorf("SetMeta(): %v\n", err)
+	}
+	if err = r.SetMeta("node-2", nil); err != nil || r.Meta("node-2") != nil {
+		t.Errorf("SetMeta(node-2, nil) did not clear the metadata\n")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 4, "node-0", "node-1")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	key := hashFunc([]byte("key"))
+	rs := r.Snapshot()
+	pred, _ := rs.Predecessor(key)
+	succ, _ := rs.Successor(key)
+
+	// Modify the ring while still reading through the snapshot.
+	if _, err = r.Insert("node-2", "node-3", "node-4"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	if rs.Size() != 2 || r.Size() != 5 {
+		t.Errorf("ReadSnapshot.Size() == %d; expected 2\n", rs.Size())
+	}
+	if vn, err := rs.Predecessor(key); err != nil || vn != pred {
+		t.Errorf("ReadSnapshot.Predecessor() changed from %s to %s (%v)\n", pred, vn, err)
+	}
+	if vn, err := rs.Successor(key); err != nil || vn != succ {
+		t.Errorf("ReadSnapshot.Successor() changed from %s to %s (%v)\n", succ, vn, err)
+	}
+	n := 0
+	for iter := rs.NewVirtualNodesIterator(); iter.HasNext(); n++ {
+		iter.Next()
+	}
+	for iter := rs.NewVirtualNodesReverseIterator(); iter.HasNext(); n++ {
+		iter.Next()
+	}
+	for iter := rs.NewReplicaOwnersIterator(); iter.HasNext(); n++ {
+		if _, owners := iter.Next(); len(owners) != 2 {
+			t.Errorf("ReplicaOwnersIterator.Next() returned owners %v\n", owners)
+		}
+	}
+	if n != 3*8 {
+		t.Errorf("ReadSnapshot iterators iterated over %d virtual nodes; expected %d\n", n, 3*8)
+	}
+
+	empty, _ := NewHashRing(hashFunc, 2, 4)
+	if _, err = empty.Snapshot().Predecessor(key); err == nil {
+		t.Errorf("ReadSnapshot.Predecessor(): expected an error for an empty ring\n")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1", "node-2")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if d := r.Diff(r.Clone()); !d.Empty() {
+		t.Errorf("Diff() = %+v; expected no differences from a clone\n", d)
+	}
+
+	other := r.Clone()
+	if _, err = other.Insert("node-3"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	if _, err = other.Remove("node-0"); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+	}
+	d := r.Diff(other)
+	if d.Structural() || d.Empty() {
+		t.Errorf("Diff() = %+v: expected a non-structural difference\n", d)
+	}
+	if len(d.AddedNodes) != 1 || d.AddedNodes[0] != "node-3" || len(d.RemovedNodes) != 1 || d.RemovedNodes[0] != "node-0" {
+		t.Errorf("Diff() added %v and removed %v; expected [node-3] and [node-0]\n", d.AddedNodes, d.RemovedNodes)
+	}
+	if len(d.ChangedVirtualNodes) == 0 {
+		t.Errorf("Diff() reported no changed virtual nodes\n")
+	}
+	oldState, newState := r.state.Load().(*hashRingState), other.state.Load().(*hashRingState)
+	changed := make(map[string]bool)
+	for _, c := range d.ChangedVirtualNodes {
+		changed[string(c.Name)] = true
+		if !sameNodeSet(c.OldOwners, oldState.nodesForKey(c.Name)) || !sameNodeSet(c.NewOwners, newState.nodesForKey(c.Name)) {
+			t.Errorf("Diff() reported wrong owners for virtual node %x\n", c.Name)
+		}
+	}
+	for _, vn := range oldState.virtualNodes {
+		if !newState.hasVirtualNode(vn.name) {
+			continue
+		}
+		if differ := !sameNodeSet(oldState.nodesForKey(vn.name), newState.nodesForKey(vn.name)); differ != changed[string(vn.name)] {
+			t.Errorf("Diff() misreported virtual node %s\n", vn)
+		}
+	}
+
+	// Structural differences.
+	other, _ = NewHashRing(hashFunc, 3, 16, "node-0", "node-1", "node-2")
+	if d = r.Diff(other); !d.Structural() || d.OldReplicationFactor != 2 || d.NewReplicationFactor != 3 ||
+		d.OldVirtualNodeCount != 8 || d.NewVirtualNodeCount != 16 {
+		t.Errorf("Diff() = %+v: expected a structural difference\n", d)
+	}
+
+	// Rings of different hash functions differ structurally, and their
+	// virtual nodes are not compared.
+	a, _ := NewHashRingWithOptions(hashFunc, 2, 8, WithHashName("sha256"))
+	b, _ := NewHashRingWithOptions(hashFunc, 2, 8, WithHashName("fnv"))
+	for _, ring := range []*HashRing{a, b} {
+		if _, err = ring.Insert("node-0", "node-1", "node-2"); err != nil {
+			t.Errorf("Insert(): %v\n", err)
+			t.FailNow()
+		}
+	}
+	if _, err = b.Remove("node-0"); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+	}
+	if d = a.Diff(b); !d.Structural() || d.OldHashName != "sha256" || d.NewHashName != "fnv" || len(d.ChangedVirtualNodes) != 0 {
+		t.Errorf("Diff() = %+v: expected a structural difference of hash functions\n", d)
+	}
+	if d = a.Diff(r); d.Structural() {
+		t.Errorf("Diff() = %+v: expected no structural difference from a ring of unknown hash function\n", d)
+	}
+}
+
+func TestVirtualNodesInRange(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1", "node-2")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	state := r.state.Load().(*hashRingState)
+	// inRange reports whether name falls in [start, end), the naive way.
+	inRange := func(name, start, end []byte) bool {
+		switch bytes.Compare(start, end) {
+		case -1:
+			return bytes.Compare(name, start) >= 0 && bytes.Compare(name, end) < 0
+		case 1:
+			return bytes.Compare(name, start) >= 0 || bytes.Compare(name, end) < 0
+		}
+		return false
+	}
+	check := func(start, end []byte) {
+		expected := make([]*VirtualNode, 0)
+		for _, vn := range state.virtualNodes {
+			if inRange(vn.Name(), start, end) {
+				expected = append(expected, vn)
+			}
+		}
+		if bytes.Compare(start, end) > 0 {
+			// Wrapping ranges start from the first name >= start.
+			sort.SliceStable(expected, func(i, j int) bool {
+				return bytes.Compare(expected[i].Name(), start) >= 0 && bytes.Compare(expected[j].Name(), start) < 0
+			})
+		}
+		got := r.VirtualNodesInRange(start, end)
+		if got == nil || len(got) != len(expected) {
+			t.Errorf("VirtualNodesInRange(%x, %x) returned %d virtual nodes; expected %d\n", start, end, len(got), len(expected))
+			return
+		}
+		for i := range got {
+			if got[i] != expected[i] {
+				t.Errorf("VirtualNodesInRange(%x, %x)[%d] = %s; expected %s\n", start, end, i, got[i], expected[i])
+			}
+		}
+	}
+
+	vn3, vn10 := state.virtualNodes[3].Name(), state.virtualNodes[10].Name()
+	check(vn3, vn10)
+	check(vn10, vn3)
+	check(vn3, vn3)
+	check(vn3, append(append([]byte{}, vn3...), 0))
+	check(hashFunc([]byte("foo")), hashFunc([]byte("bar")))
+	check(hashFunc([]byte("bar")), hashFunc([]byte("foo")))
+	check([]byte{}, []byte{0xff})
+
+	empty, _ := NewHashRing(hashFunc, 1, 1)
+	if got := empty.VirtualNodesInRange(vn3, vn10); got == nil || len(got) != 0 {
+		t.Errorf("VirtualNodesInRange() on an empty ring = %v; expected an empty slice\n", got)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1", "node-2")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if !r.Equal(r) || !r.Equal(r.Clone()) {
+		t.Errorf("Equal() = false for the ring itself or its clone\n")
+	}
+
+	var buf bytes.Buffer
+	if err = r.Save(&buf); err != nil {
+		t.Errorf("Save(): %v\n", err)
+		t.FailNow()
+	}
+	loaded, err := Load(hashFunc, &buf)
+	if err != nil {
+		t.Errorf("Load(): %v\n", err)
+		t.FailNow()
+	}
+	if !r.Equal(loaded) || !loaded.Equal(r) {
+		t.Errorf("Equal() = false for a saved and loaded ring\n")
+	}
+
+	other := r.Clone()
+	if _, err = other.Insert("node-3"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	if r.Equal(other) || other.Equal(r) {
+		t.Errorf("Equal() = true for rings with different nodes\n")
+	}
+	if _, err = other.Remove("node-3"); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+	}
+	if !r.Equal(other) {
+		t.Errorf("Equal() = false after inserting and removing a node\n")
+	}
+
+	state := r.state.Load().(*hashRingState)
+	if _, err = other.RemoveVirtualNodesByName(state.virtualNodes[0].Name()); err != nil {
+		t.Errorf("RemoveVirtualNodesByName(): %v\n", err)
+	}
+	if r.Equal(other) {
+		t.Errorf("Equal() = true for rings with different virtual nodes\n")
+	}
+
+	otherHash := func(in []byte) []byte {
+		out := sha256.Sum256(append([]byte("salt-"), in...))
+		return out[:]
+	}
+	for _, cfg := range []struct {
+		hashFunc                            func([]byte) []byte
+		replicationFactor, virtualNodeCount int
+	}{
+		{hashFunc, 3, 8},
+		{hashFunc, 2, 4},
+		{otherHash, 2, 8},
+	} {
+		other, err := NewHashRing(cfg.hashFunc, cfg.replicationFactor, cfg.virtualNodeCount, "node-0", "node-1", "node-2")
+		if err != nil {
+			t.Errorf("NewHashRing(): %v\n", err)
+			continue
+		}
+		if r.Equal(other) {
+			t.Errorf("Equal() = true for rings with different configurations or hash functions\n")
+		}
+	}
+}
+
+func TestNodesForObjectContext(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1", "node-2")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	object := strings.Repeat("some object ", 1<<12)
+	expected, _ := r.NodesForObject(strings.NewReader(object))
+	owners, err := r.NodesForObjectContext(context.Background(), strings.NewReader(object))
+	if err != nil || !sameNodes(owners, expected) {
+		t.Errorf("NodesForObjectContext() = %v, %v; expected %v\n", owners, err, expected)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = r.NodesForObjectContext(ctx, strings.NewReader(object)); err != context.Canceled {
+		t.Errorf("NodesForObjectContext() with a canceled context returned %v; expected %v\n", err, context.Canceled)
+	}
+
+	// A Read that blocks until the pipe is closed must not block the call.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = r.NodesForObjectContext(ctx, pr); err != context.DeadlineExceeded {
+		t.Errorf("NodesForObjectContext() with a blocked reader returned %v; expected %v\n", err, context.DeadlineExceeded)
+	}
+}
+
+// countingHash is a hash.Hash that counts the calls to its Write method.
+type countingHash struct {
+	hash.Hash
+	writes *int
+}
+
+func (ch *countingHash) Write(p []byte) (int, error) {
+	*ch.writes++
+	return ch.Hash.Write(p)
+}
+
+func TestNodesForObjectStreaming(t *testing.T) {
+	r, err := NewHashRingWithOptions(hashFunc, 2, 8, WithStreamingHash(sha256.New))
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.Insert("node-0", "node-1", "node-2"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	for i := 0; i < 16; i++ {
+		object := strings.Repeat(fmt.Sprintf("object-%d ", i), 1<<i)
+		expected := r.NodesForKey(hashFunc([]byte(object)))
+		owners, err := r.Clone().NodesForObjectStreaming(strings.NewReader(object))
+		if err != nil || !sameNodes(owners, expected) {
+			t.Errorf("NodesForObjectStreaming() = %v, %v; expected %v\n", owners, err, expected)
+		}
+		if owners, err = r.NodesForObject(strings.NewReader(object)); err != nil || !sameNodes(owners, expected) {
+			t.Errorf("NodesForObject() = %v, %v; expected %v\n", owners, err, expected)
+		}
+	}
+
+	// NodesForObject and NodesForObjectContext stream the object as well,
+	// unless it starts with a prefix that a hash function is registered for.
+	writes := 0
+	counting, err := NewHashRingWithOptions(hashFunc, 2, 8, WithStreamingHash(func() hash.Hash {
+		writes = 0
+		return &countingHash{Hash: sha256.New(), writes: &writes}
+	}))
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = counting.Insert("node-0", "node-1", "node-2"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	tenantHash := func(in []byte) []byte {
+		out := sha256.Sum256(append([]byte("tenant-"), in...))
+		return out[:]
+	}
+	if err = counting.RegisterHashForPrefix([]byte("tenant:"), tenantHash); err != nil {
+		t.Errorf("RegisterHashForPrefix(): %v\n", err)
+	}
+	large := strings.Repeat("x", 1<<20)
+	for _, object := range []string{large, "tenant:" + large, "tenant", ""} {
+		expected := counting.NodesForKey(counting.HashKey([]byte(object)))
+		if owners, err := counting.NodesForObject(strings.NewReader(object)); err != nil || !sameNodes(owners, expected) {
+			t.Errorf("NodesForObject() = %v, %v; expected %v\n", owners, err, expected)
+		}
+		if object == large && writes < 2 {
+			t.Errorf("NodesForObject() hashed the object in %d writes; expected it streamed\n", writes)
+		}
+		if owners, err := counting.NodesForObjectContext(context.Background(), strings.NewReader(object)); err != nil || !sameNodes(owners, expected) {
+			t.Errorf("NodesForObjectContext() = %v, %v; expected %v\n", owners, err, expected)
+		}
+	}
+
+	withoutStreaming, _ := NewHashRing(hashFunc, 2, 8, "node-0")
+	if _, err = withoutStreaming.NodesForObjectStreaming(strings.NewReader("object")); err == nil {
+		t.Errorf("NodesForObjectStreaming() succeeded without a streaming hash function\n")
+	}
+	if _, err = NewHashRingWithOptions(hashFunc, 2, 8, WithStreamingHash(sha256.New224)); err == nil {
+		t.Errorf("NewHashRingWithOptions() succeeded with a disagreeing streaming hash function\n")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	events, unsubscribe := r.Subscribe()
+	defer unsubscribe()
+	if _, err = r.Insert("node-2", "node-3"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	if err = r.SetDraining("node-2", true); err != nil {
+		t.Errorf("SetDraining(): %v\n", err)
+	}
+	if _, err = r.Remove("node-0"); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+	}
+	if err = r.SetReplicationFactor(3); err != nil {
+		t.Errorf("SetReplicationFactor(): %v\n", err)
+	}
+	expected := []RingEvent{
+		{Generation: 1, Added: []Node{"node-2", "node-3"}, Removed: []Node{}, OldReplicationFactor: 2, NewReplicationFactor: 2},
+		{Generation: 3, Added: []Node{}, Removed: []Node{"node-0"}, OldReplicationFactor: 2, NewReplicationFactor: 2},
+		{Generation: 4, Added: []Node{}, Removed: []Node{}, OldReplicationFactor: 2, NewReplicationFactor: 3},
+	}
+	for _, exp := range expected {
+		select {
+		case ev := <-events:
+			if fmt.Sprint(ev) != fmt.Sprint(exp) {
+				t.Errorf("received %+v; expected %+v\n", ev, exp)
+			}
+		default:
+			t.Errorf("no event received; expected %+v\n", exp)
+		}
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("received unexpected event %+v\n", ev)
+	default:
+	}
+
+	// A subscriber that falls behind receives the net effect of the
+	// modifications it has missed.
+	for i := 0; i < 2*subscriptionBuffer; i++ {
+		node := Node(fmt.Sprintf("tmp-%d", i))
+		if _, err = r.Insert(node); err != nil {
+			t.Errorf("Insert(): %v\n", err)
+		}
+		if i%2 == 0 {
+			if _, err = r.Remove(node); err != nil {
+				t.Errorf("Remove(): %v\n", err)
+			}
+		}
+	}
+	added := make(map[Node]bool)
+	for len(events) > 0 {
+		ev := <-events
+		for _, node := range ev.Added {
+			added[node] = true
+		}
+		for _, node := range ev.Removed {
+			delete(added, node)
+		}
+	}
+	if len(added) != subscriptionBuffer {
+		t.Errorf("net effect of received events added %d nodes; expected %d\n", len(added), subscriptionBuffer)
+	}
+	for i := 1; i < 2*subscriptionBuffer; i += 2 {
+		if node := Node(fmt.Sprintf("tmp-%d", i)); !added[node] {
+			t.Errorf("net effect of received events did not add %q\n", node)
+		}
+	}
+
+	unsubscribe()
+	unsubscribe()
+	if _, err = r.Insert("node-4"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	if _, ok := <-events; ok {
+		t.Errorf("received an event after unsubscribing\n")
+	}
+}
+
+func TestNodesForKeyOrdering(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 3, 4, "node-0", "node-1", "node-2", "node-3", "node-4")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	check := func() {
+		state := r.state.Load().(*hashRingState)
+		for i := 0; i < 200; i++ {
+			key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+			// Walk the ring clockwise from the first virtual node whose
+			// name is greater than or equal to the key.
+			start := sort.Search(len(state.virtualNodes), func(j int) bool {
+				return bytes.Compare(state.virtualNodes[j].Name(), key) >= 0
+			})
+			expected := make([]Node, 0, state.replicationFactor)
+			for j := 0; j < len(state.virtualNodes) && len(expected) < int(state.replicationFactor); j++ {
+				node := state.virtualNodes[(start+j)%len(state.virtualNodes)].Node()
+				seen := false
+				for _, owner := range expected {
+					seen = seen || owner == node
+				}
+				if !seen {
+					expected = append(expected, node)
+				}
+			}
+			if owners := r.NodesForKey(key); !sameNodes(owners, expected) {
+				t.Errorf("NodesForKey(%x) = %v; expected %v\n", key, owners, expected)
+			}
+		}
+	}
+	check()
+	if _, err = r.Remove("node-2"); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+	}
+	check()
+	if _, err = r.Insert("node-5", "node-6"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	check()
+	if _, err = r.Remove("node-0", "node-1", "node-3", "node-4"); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+	}
+	check()
+}
+
+func TestUpdate(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1", "node-2")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	events, unsubscribe := r.Subscribe()
+	defer unsubscribe()
+	gen := r.Generation()
+	newVnodes, removedVnodes, err := r.Update([]Node{"node-3"}, []Node{"node-1"})
+	if err != nil {
+		t.Errorf("Update(): %v\n", err)
+		t.FailNow()
+	}
+	if len(newVnodes) != 8 || len(removedVnodes) != 8 {
+		t.Errorf("Update() returned %d new and %d removed virtual nodes; expected 8 and 8\n", len(newVnodes), len(removedVnodes))
+	}
+	for _, vn := range newVnodes {
+		if vn.Node() != "node-3" {
+			t.Errorf("Update() returned new virtual node %s\n", vn)
+		}
+	}
+	for _, vn := range removedVnodes {
+		if vn.Node() != "node-1" {
+			t.Errorf("Update() returned removed virtual node %s\n", vn)
+		}
+	}
+	if nodes := r.Nodes(); fmt.Sprint(nodes) != "[node-0 node-2 node-3]" {
+		t.Errorf("Nodes() = %v; expected [node-0 node-2 node-3]\n", nodes)
+	}
+	if r.Generation() != gen+1 {
+		t.Errorf("Generation() = %d; expected a single modification\n", r.Generation())
+	}
+	if len(events) != 1 {
+		t.Errorf("received %d events; expected a single one\n", len(events))
+	}
+	checkVirtualNodes(t, r)
+	if err = r.Validate(); err != nil {
+		t.Errorf("Validate(): %v\n", err)
+	}
+
+	// Failures leave the ring untouched.
+	for _, tc := range []struct{ insert, remove []Node }{
+		{[]Node{"node-4"}, []Node{"node-1"}},
+		{[]Node{"node-0"}, []Node{"node-2"}},
+		{[]Node{"node-4", "node-4"}, nil},
+	} {
+		if _, _, err = r.Update(tc.insert, tc.remove); err == nil {
+			t.Errorf("Update(%v, %v) succeeded\n", tc.insert, tc.remove)
+		}
+	}
+	if nodes := r.Nodes(); fmt.Sprint(nodes) != "[node-0 node-2 node-3]" || r.Generation() != gen+1 {
+		t.Errorf("failed Update() modified the ring: %v\n", nodes)
+	}
+
+	// A node in both batches is inserted again.
+	if _, _, err = r.Update([]Node{"node-0"}, []Node{"node-0"}); err != nil {
+		t.Errorf("Update(): %v\n", err)
+	}
+	if _, _, err = r.Update(nil, nil); err != nil {
+		t.Errorf("Update(): %v\n", err)
+	}
+	if nodes := r.Nodes(); fmt.Sprint(nodes) != "[node-0 node-2 node-3]" {
+		t.Errorf("Nodes() = %v; expected [node-0 node-2 node-3]\n", nodes)
+	}
+}
+
+func TestCountKeysPerNode(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1", "node-2")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	primaries, replicas := make(map[Node]int), make(map[Node]int)
+	for _, key := range keys {
+		owners := r.NodesForKey(key)
+		primaries[owners[0]]++
+		for _, owner := range owners {
+			replicas[owner]++
+		}
+	}
+	if counts := r.CountKeysPerNode(keys); fmt.Sprint(counts) != fmt.Sprint(primaries) {
+		t.Errorf("CountKeysPerNode() = %v; expected %v\n", counts, primaries)
+	}
+	if counts := r.CountKeyReplicasPerNode(keys); fmt.Sprint(counts) != fmt.Sprint(replicas) {
+		t.Errorf("CountKeyReplicasPerNode() = %v; expected %v\n", counts, replicas)
+	}
+
+	empty, _ := NewHashRing(hashFunc, 2, 8)
+	if counts := empty.CountKeysPerNode(keys); counts == nil || len(counts) != 0 {
+		t.Errorf("CountKeysPerNode() on an empty ring = %v; expected an empty map\n", counts)
+	}
+	if counts := empty.CountKeyReplicasPerNode(keys); counts == nil || len(counts) != 0 {
+		t.Errorf("CountKeyReplicasPerNode() on an empty ring = %v; expected an empty map\n", counts)
+	}
+}
+
+func TestSuccessorsPredecessors(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 4, "node-0", "node-1", "node-2")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	state := r.state.Load().(*hashRingState)
+	vnodesLen := len(state.virtualNodes)
+	keys := [][]byte{
+		hashFunc([]byte("key")),
+		state.virtualNodes[0].Name(),
+		state.virtualNodes[vnodesLen-1].Name(),
+		bytes.Repeat([]byte{0xff}, sha256.Size),
+	}
+	for _, key := range keys {
+		i := state.search(key)
+		for _, n := range []int{0, 1, 5, vnodesLen, vnodesLen + 7} {
+			succs, err := r.Successors(key, n)
+			if err != nil {
+				t.Errorf("Successors(): %v\n", err)
+				continue
+			}
+			preds, err := r.Predecessors(key, n)
+			if err != nil {
+				t.Errorf("Predecessors(): %v\n", err)
+				continue
+			}
+			expectedLen := n
+			if expectedLen > vnodesLen {
+				expectedLen = vnodesLen
+			}
+			if len(succs) != expectedLen || len(preds) != expectedLen {
+				t.Errorf("Successors() and Predecessors() returned %d and %d virtual nodes; expected %d\n", len(succs), len(preds), expectedLen)
+				continue
+			}
+			for k := 0; k < expectedLen; k++ {
+				if succs[k] != state.virtualNodes[(i+k+1)%vnodesLen] {
+					t.Errorf("Successors(%x, %d)[%d] = %s\n", key, n, k, succs[k])
+				}
+				if preds[k] != state.virtualNodes[(i-k-1+2*vnodesLen)%vnodesLen] {
+					t.Errorf("Predecessors(%x, %d)[%d] = %s\n", key, n, k, preds[k])
+				}
+			}
+			if n > 0 {
+				if succ, _ := r.Successor(key); succ != succs[0] {
+					t.Errorf("Successors(%x, %d)[0] = %s; Successor() = %s\n", key, n, succs[0], succ)
+				}
+				if pred, _ := r.Predecessor(key); pred != preds[0] {
+					t.Errorf("Predecessors(%x, %d)[0] = %s; Predecessor() = %s\n", key, n, preds[0], pred)
+				}
+			}
+		}
+	}
+	if _, err = r.Successors(keys[0], -1); err == nil {
+		t.Errorf("Successors() succeeded for a negative n\n")
+	}
+	empty, _ := NewHashRing(hashFunc, 2, 4)
+	if _, err = empty.Successors(keys[0], 1); err == nil {
+		t.Errorf("Successors() succeeded on an empty ring\n")
+	}
+	if _, err = empty.Predecessors(keys[0], 1); err == nil {
+		t.Errorf("Predecessors() succeeded on an empty ring\n")
+	}
+}
+
+func TestKeyCache(t *testing.T) {
+	calls := 0
+	counting := func(in []byte) []byte {
+		calls++
+		return hashFunc(in)
+	}
+	r, err := NewHashRingWithOptions(counting, 2, 4, WithKeyCache(64))
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.Insert("node-0", "node-1", "node-2"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	key := []byte("hot-key")
+	calls = 0
+	for i := 0; i < 10; i++ {
+		if hashed := r.HashKey(key); !bytes.Equal(hashed, hashFunc(key)) {
+			t.Errorf("HashKey() = %x; expected %x\n", hashed, hashFunc(key))
+		}
+		expected := r.NodesForKey(hashFunc(key))
+		if owners := r.NodesForKeyFunc(key, nil); !sameNodes(owners, expected) {
+			t.Errorf("NodesForKeyFunc() = %v; expected %v\n", owners, expected)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("hash function called %d times; expected once\n", calls)
+	}
+
+	// Modifying the returned hash does not affect the cache.
+	hashed := r.HashKey(key)
+	hashed[0] ^= 0xff
+	if !bytes.Equal(r.HashKey(key), hashFunc(key)) {
+		t.Errorf("HashKey() returned a modified hash\n")
+	}
+
+	r.ClearKeyCache()
+	calls = 0
+	r.HashKey(key)
+	r.HashKey(key)
+	if calls != 1 {
+		t.Errorf("hash function called %d times after ClearKeyCache(); expected once\n", calls)
+	}
+
+	// The cache is bounded.
+	for i := 0; i < 1000; i++ {
+		r.HashKey([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	kc := r.state.Load().(*hashRingState).keyCache
+	for i := range kc.shards {
+		if n := kc.shards[i].lru.Len(); n > kc.shardCapacity || n != len(kc.shards[i].entries) {
+			t.Errorf("shard %d holds %d entries (%d in map); expected at most %d\n", i, n, len(kc.shards[i].entries), kc.shardCapacity)
+		}
+	}
+
+	// Neither long keys nor objects are cached.
+	r.ClearKeyCache()
+	long := bytes.Repeat([]byte("x"), maxCachedKeyLen+1)
+	r.HashKey(long)
+	r.NodesForKeyFunc(long, nil)
+	if _, err = r.NodesForObject(bytes.NewReader(key)); err != nil {
+		t.Errorf("NodesForObject(): %v\n", err)
+	}
+	for i := range kc.shards {
+		if n := len(kc.shards[i].entries); n != 0 {
+			t.Errorf("shard %d holds %d entries; expected none\n", i, n)
+		}
+	}
+
+	// Registering a hash function for a prefix invalidates the cache.
+	prefixed := []byte("tenant:hot-key")
+	r.HashKey(prefixed)
+	tenantHash := func(in []byte) []byte {
+		out := sha256.Sum256(append([]byte("tenant-"), in...))
+		return out[:]
+	}
+	if err = r.RegisterHashForPrefix([]byte("tenant:"), tenantHash); err != nil {
+		t.Errorf("RegisterHashForPrefix(): %v\n", err)
+	}
+	if !bytes.Equal(r.HashKey(prefixed), tenantHash(prefixed)) {
+		t.Errorf("HashKey() used a stale cached hash after RegisterHashForPrefix()\n")
+	}
+
+	if _, err = NewHashRingWithOptions(hashFunc, 2, 4, WithKeyCache(-1)); err == nil {
+		t.Errorf("NewHashRingWithOptions() succeeded with a negative key cache size\n")
+	}
+}
+
+func TestClear(t *testing.T) {
+	r, err := NewHashRingWithOptions(hashFunc, 2, 4, WithHashName("sha256"))
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.Insert("node-0", "node-1", "node-2"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	if err = r.SetDraining("node-1", true); err != nil {
+		t.Errorf("SetDraining(): %v\n", err)
+	}
+	snap := r.Snapshot()
+	key := hashFunc([]byte("key"))
+	before := r.NodesForKey(key)
+
+	gen := r.Generation()
+	if removed := r.Clear(); len(removed) != 12 {
+		t.Errorf("Clear() returned %d virtual nodes; expected 12\n", len(removed))
+	}
+	if r.Size() != 0 || r.VirtualNodesLen() != 0 || r.Generation() != gen+1 {
+		t.Errorf("after Clear(): Size() = %d, VirtualNodesLen() = %d, Generation() = %d\n", r.Size(), r.VirtualNodesLen(), r.Generation())
+	}
+	if owners := r.NodesForKey(key); len(owners) != 0 {
+		t.Errorf("NodesForKey() = %v after Clear(); expected no owners\n", owners)
+	}
+	if owners, err := r.NodesForObject(strings.NewReader("object")); err != nil || len(owners) != 0 {
+		t.Errorf("NodesForObject() = %v, %v after Clear(); expected no owners\n", owners, err)
+	}
+	if vn := r.VirtualNodeForKey(key); vn != nil {
+		t.Errorf("VirtualNodeForKey() = %s after Clear(); expected nil\n", vn)
+	}
+	if r.OwnerSetForKey(key).Len() != 0 || len(r.NodesForKeyRotated(key)) != 0 {
+		t.Errorf("lookups found owners after Clear()\n")
+	}
+	if _, err = r.OwnerForKey(key); err == nil {
+		t.Errorf("OwnerForKey() succeeded after Clear()\n")
+	}
+	if err = r.Validate(); err != nil {
+		t.Errorf("Validate(): %v\n", err)
+	}
+	// Readers of the previous state are not affected.
+	if owners := snap.NodesForKey(key); !sameNodes(owners, before) {
+		t.Errorf("snapshot's NodesForKey() = %v after Clear(); expected %v\n", owners, before)
+	}
+
+	// The configuration of the ring is preserved.
+	if r.HashName() != "sha256" {
+		t.Errorf("HashName() = %q after Clear()\n", r.HashName())
+	}
+	if _, err = r.Insert("node-1", "node-3"); err != nil {
+		t.Errorf("Insert() after Clear(): %v\n", err)
+	}
+	expected, _ := NewHashRing(hashFunc, 2, 4, "node-1", "node-3")
+	if !r.Equal(expected) {
+		t.Errorf("ring after Clear() and Insert() differs from a new one\n")
+	}
+	if _, draining := r.state.Load().(*hashRingState).draining["node-1"]; draining {
+		t.Errorf("draining status of node-1 survived Clear()\n")
+	}
+}
+
+func TestVirtualNodeNaming(t *testing.T) {
+	javaKey := func(node Node, vnid uint16) []byte {
+		return []byte(fmt.Sprintf("%s#%d", node, vnid))
+	}
+	for _, lazy := range []bool{false, true} {
+		opts := []Option{WithVirtualNodeNaming(javaKey)}
+		if lazy {
+			opts = append(opts, WithLazyNames())
+		}
+		r, err := NewHashRingWithOptions(hashFunc, 2, 4, opts...)
+		if err != nil {
+			t.Errorf("NewHashRingWithOptions(): %v\n", err)
+			continue
+		}
+		if _, err = r.Insert("node-0", "node-1", "node-2"); err != nil {
+			t.Errorf("Insert(): %v\n", err)
+		}
+		state := r.state.Load().(*hashRingState)
+		for _, vn := range state.virtualNodes {
+			if expected := hashFunc(javaKey(vn.node, vn.vnid)); !bytes.Equal(vn.Name(), expected) {
+				t.Errorf("virtual node %s is named %x; expected %x\n", vn, vn.Name(), expected)
+			}
+		}
+		if err = r.Validate(); err != nil {
+			t.Errorf("Validate(): %v\n", err)
+		}
+
+		// Virtual nodes are found by their custom names when removed.
+		if _, err = r.RemoveVirtualNodesByName(hashFunc(javaKey("node-1", 2))); err != nil {
+			t.Errorf("RemoveVirtualNodesByName(): %v\n", err)
+		}
+		if vnodes := r.VirtualNodesForNode("node-1"); len(vnodes) != 3 {
+			t.Errorf("VirtualNodesForNode() returned %d virtual nodes; expected 3\n", len(vnodes))
+		}
+		if _, err = r.Remove("node-1"); err != nil {
+			t.Errorf("Remove(): %v\n", err)
+		}
+		if r.VirtualNodesLen() != 8 || r.Clone().VirtualNodesLen() != 8 {
+			t.Errorf("VirtualNodesLen() = %d; expected 8\n", r.VirtualNodesLen())
+		}
+		if err = r.Validate(); err != nil {
+			t.Errorf("Validate(): %v\n", err)
+		}
+
+		// A saved ring is only loaded along with its naming scheme.
+		buf := &bytes.Buffer{}
+		if err = r.Save(buf); err != nil {
+			t.Errorf("Save(): %v\n", err)
+			t.FailNow()
+		}
+		if _, err = Load(hashFunc, bytes.NewReader(buf.Bytes())); err == nil {
+			t.Errorf("Load() succeeded without the custom naming scheme\n")
+		}
+		loaded, err := LoadWithOptions(hashFunc, bytes.NewReader(buf.Bytes()), opts...)
+		if err != nil {
+			t.Errorf("LoadWithOptions(): %v\n", err)
+			t.FailNow()
+		}
+		if !loaded.Equal(r) {
+			t.Errorf("loaded ring differs from the saved one\n")
+		}
+		plain, _ := NewHashRing(hashFunc, 2, 4, "node-0")
+		buf.Reset()
+		if err = plain.Save(buf); err != nil {
+			t.Errorf("Save(): %v\n", err)
+			t.FailNow()
+		}
+		if _, err = LoadWithOptions(hashFunc, buf, opts...); err == nil {
+			t.Errorf("LoadWithOptions() succeeded with a custom naming scheme for a plain ring\n")
+		}
+	}
+}
+
+func TestPreviewInsertRemove(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1", "node-2")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	gen := r.Generation()
+	preview, err := r.PreviewInsert("node-3")
+	if err != nil {
+		t.Errorf("PreviewInsert(): %v\n", err)
+	}
+	if r.Generation() != gen || r.Size() != 3 {
+		t.Errorf("PreviewInsert() modified the ring\n")
+	}
+	_, actual, err := r.Clone().InsertWithMigration("node-3")
+	if err != nil {
+		t.Errorf("InsertWithMigration(): %v\n", err)
+	}
+	if len(preview) == 0 || fmt.Sprint(preview) != fmt.Sprint(actual) {
+		t.Errorf("PreviewInsert() = %v; expected %v\n", preview, actual)
+	}
+
+	preview, err = r.PreviewRemove("node-0", "node-2")
+	if err != nil {
+		t.Errorf("PreviewRemove(): %v\n", err)
+	}
+	if r.Generation() != gen || r.Size() != 3 {
+		t.Errorf("PreviewRemove() modified the ring\n")
+	}
+	_, actual, err = r.Clone().RemoveWithMigration("node-0", "node-2")
+	if err != nil {
+		t.Errorf("RemoveWithMigration(): %v\n", err)
+	}
+	if len(preview) == 0 || fmt.Sprint(preview) != fmt.Sprint(actual) {
+		t.Errorf("PreviewRemove() = %v; expected %v\n", preview, actual)
+	}
+
+	if _, err = r.PreviewInsert("node-0"); err == nil {
+		t.Errorf("PreviewInsert() of an existing node succeeded\n")
+	}
+	if _, err = r.PreviewRemove("node-3"); err == nil {
+		t.Errorf("PreviewRemove() of a missing node succeeded\n")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1", "node-2")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	other, _ := NewHashRing(hashFunc, 2, 8, "node-2")
+	if _, err = other.Insert("node-1", "node-0"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	if !r.Equal(other) || r.Checksum() != other.Checksum() || r.Checksum() != r.Clone().Checksum() {
+		t.Errorf("Checksum() differs between equal rings\n")
+	}
+
+	sum := r.Checksum()
+	if allocs := testing.AllocsPerRun(100, func() { r.Checksum() }); allocs != 0 {
+		t.Errorf("Checksum() allocated %v times once computed; expected 0\n", allocs)
+	}
+	if _, err = r.Insert("node-3"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	if r.Checksum() == sum {
+		t.Errorf("Checksum() did not change after Insert()\n")
+	}
+	if _, err = r.Remove("node-3"); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+	}
+	if r.Checksum() != sum {
+		t.Errorf("Checksum() differs after inserting and removing a node\n")
+	}
+	if _, err = r.Remove("node-0"); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+	}
+	if r.Checksum() == sum {
+		t.Errorf("Checksum() did not change after Remove()\n")
+	}
+
+	rf3, _ := NewHashRing(hashFunc, 3, 8, "node-0", "node-1", "node-2")
+	if rf3.Checksum() == sum {
+		t.Errorf("Checksum() does not depend on the replication factor\n")
+	}
+}
+
+func TestVirtualNodesForKey(t *testing.T) {
+	for _, allowDuplicates := range []bool{false, true} {
+		r, err := NewHashRingWithOptions(hashFunc, 3, 4, WithAllowDuplicateOwners(allowDuplicates))
+		if err != nil {
+			t.Errorf("NewHashRingWithOptions(): %v\n", err)
+			continue
+		}
+		if vnodes := r.VirtualNodesForKey(hashFunc([]byte("key"))); vnodes != nil {
+			t.Errorf("VirtualNodesForKey() on an empty ring = %v; expected nil\n", vnodes)
+		}
+		if _, err = r.Insert("node-0", "node-1", "node-2", "node-3"); err != nil {
+			t.Errorf("Insert(): %v\n", err)
+		}
+		state := r.state.Load().(*hashRingState)
+		for i := 0; i < 100; i++ {
+			key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+			owners, vnodes := r.NodesForKey(key), r.VirtualNodesForKey(key)
+			if len(vnodes) != len(owners) {
+				t.Errorf("VirtualNodesForKey() returned %d virtual nodes; expected %d\n", len(vnodes), len(owners))
+				continue
+			}
+			if vnodes[0] != r.VirtualNodeForKey(key) {
+				t.Errorf("VirtualNodesForKey()[0] = %s; expected %s\n", vnodes[0], r.VirtualNodeForKey(key))
+			}
+			for k, vn := range vnodes {
+				if vn == nil || vn.Node() != owners[k] {
+					t.Errorf("VirtualNodesForKey()[%d] = %v; expected a virtual node of %q\n", k, vn, owners[k])
+					continue
+				}
+				// No earlier virtual node clockwise may belong to the
+				// same node, unless it has been matched already.
+				for j := state.search(key); state.virtualNodes[j] != vn; j = (j + 1) % len(state.virtualNodes) {
+					if state.virtualNodes[j].node != vn.node {
+						continue
+					}
+					matched := false
+					for _, other := range vnodes[:k] {
+						matched = matched || other == state.virtualNodes[j]
+					}
+					if !matched {
+						t.Errorf("VirtualNodesForKey()[%d] = %s skips %s\n", k, vn, state.virtualNodes[j])
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestOwnerRank(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1", "node-2", "node-3")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	check := func() {
+		for i := 0; i < 100; i++ {
+			key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+			owners := r.NodesForKey(key)
+			for _, node := range r.Nodes() {
+				expectedRank, expectedOwner := -1, false
+				for rank, owner := range owners {
+					if owner == node {
+						expectedRank, expectedOwner = rank, true
+					}
+				}
+				if rank, isOwner := r.OwnerRank(node, key); rank != expectedRank || isOwner != expectedOwner {
+					t.Errorf("OwnerRank(%q, %x) = %d, %t; expected %d, %t\n", node, key, rank, isOwner, expectedRank, expectedOwner)
+				}
+				if isOwner := r.IsOwner(node, key); isOwner != expectedOwner {
+					t.Errorf("IsOwner(%q, %x) = %t; expected %t\n", node, key, isOwner, expectedOwner)
+				}
+			}
+		}
+	}
+	check()
+	key := hashFunc([]byte("key"))
+	if allocs := testing.AllocsPerRun(100, func() { r.OwnerRank("node-1", key) }); allocs != 0 {
+		t.Errorf("OwnerRank() allocated %v times; expected 0\n", allocs)
+	}
+	if err = r.SetReadExcluded("node-1", true); err != nil {
+		t.Errorf("SetReadExcluded(): %v\n", err)
+	}
+	check()
+	if r.IsOwner("node-4", key) {
+		t.Errorf("IsOwner() = true for a node that is not in the ring\n")
+	}
+	empty, _ := NewHashRing(hashFunc, 2, 8)
+	if rank, isOwner := empty.OwnerRank("node-0", key); rank != -1 || isOwner {
+		t.Errorf("OwnerRank() on an empty ring = %d, %t; expected -1, false\n", rank, isOwner)
+	}
+}
+
+func TestNodesForKeyHealthy(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 8, "node-0", "node-1", "node-2", "node-3")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	for _, key := range keys {
+		if owners := r.NodesForKeyHealthy(key); !sameNodes(owners, r.NodesForKey(key)) {
+			t.Errorf("NodesForKeyHealthy() = %v; expected %v\n", owners, r.NodesForKey(key))
+		}
+	}
+
+	before := make([][]Node, len(keys))
+	for i, key := range keys {
+		before[i] = r.NodesForKey(key)
+	}
+	oldState := r.state.Load().(*hashRingState)
+	if err = r.SetNodeStatus("node-1", false); err != nil {
+		t.Errorf("SetNodeStatus(): %v\n", err)
+	}
+	// The replica owners are reused rather than recomputed.
+	newState := r.state.Load().(*hashRingState)
+	for i := range newState.replicaOwners {
+		if &newState.replicaOwners[i][0] != &oldState.replicaOwners[i][0] {
+			t.Errorf("replica owners of vnode %d were recomputed by SetNodeStatus()\n", i)
+			t.FailNow()
+		}
+	}
+	if err = r.Validate(); err != nil {
+		t.Errorf("Validate(): %v\n", err)
+	}
+	for i, key := range keys {
+		if !sameNodes(r.NodesForKey(key), before[i]) {
+			t.Errorf("NodesForKey() changed after SetNodeStatus()\n")
+		}
+		owners := r.NodesForKeyHealthy(key)
+		if !sameNodes(owners, r.NodesForKeyExcluding(key, "node-1")) {
+			t.Errorf("NodesForKeyHealthy() = %v; expected %v\n", owners, r.NodesForKeyExcluding(key, "node-1"))
+		}
+	}
+
+	// Too many nodes down.
+	for _, node := range []Node{"node-0", "node-2"} {
+		if err = r.SetNodeStatus(node, false); err != nil {
+			t.Errorf("SetNodeStatus(): %v\n", err)
+		}
+	}
+	for _, key := range keys {
+		if owners := r.NodesForKeyHealthy(key); len(owners) != 1 || owners[0] != "node-3" {
+			t.Errorf("NodesForKeyHealthy() = %v; expected [node-3]\n", owners)
+		}
+	}
+
+	// Back up, and removal clears the status.
+	for _, node := range []Node{"node-0", "node-1"} {
+		if err = r.SetNodeStatus(node, true); err != nil {
+			t.Errorf("SetNodeStatus(): %v\n", err)
+		}
+	}
+	if _, err = r.Remove("node-2"); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+	}
+	if _, err = r.Insert("node-2"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	for i, key := range keys {
+		if owners := r.NodesForKeyHealthy(key); !sameNodes(owners, before[i]) {
+			t.Errorf("NodesForKeyHealthy() = %v; expected %v\n", owners, before[i])
+		}
+	}
+
+	if err = r.SetNodeStatus("node-4", false); err == nil {
+		t.Errorf("SetNodeStatus() of a node that is not in the ring succeeded\n")
+	}
+}
+
+func TestRehash(t *testing.T) {
+	r, err := NewHashRingWithOptions(hashFunc, 2, 8, WithHashName("sha256"))
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.Insert("node-0", "node-1", "node-2"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	if _, err = r.RemoveVirtualNodesByName(r.state.Load().(*hashRingState).virtualNodes[0].Name()); err != nil {
+		t.Errorf("RemoveVirtualNodesByName(): %v\n", err)
+	}
+	newHash := func(in []byte) []byte {
+		out := sha256.Sum256(append([]byte("v2-"), in...))
+		return out[:]
+	}
+	before := r.Checksum()
+	rehashed, err := r.Rehash(newHash)
+	if err != nil {
+		t.Errorf("Rehash(): %v\n", err)
+		t.FailNow()
+	}
+	if r.Checksum() != before {
+		t.Errorf("Rehash() modified the ring\n")
+	}
+	if err = rehashed.Validate(); err != nil {
+		t.Errorf("Validate(): %v\n", err)
+	}
+	if fmt.Sprint(rehashed.Nodes()) != fmt.Sprint(r.Nodes()) || rehashed.VirtualNodesLen() != r.VirtualNodesLen() {
+		t.Errorf("Rehash() returned a ring with different nodes\n")
+	}
+	if rehashed.HashName() != "" {
+		t.Errorf("HashName() = %q; expected no name\n", rehashed.HashName())
+	}
+	expected, _ := NewHashRing(newHash, 2, 8, "node-0", "node-1", "node-2")
+	state, expectedState := rehashed.state.Load().(*hashRingState), expected.state.Load().(*hashRingState)
+	// All virtual nodes (but the removed one) are placed through the new hash.
+	for _, vn := range state.virtualNodes {
+		if !expectedState.hasVirtualNode(vn.Name()) {
+			t.Errorf("virtual node %s is not placed through the new hash function\n", vn)
+		}
+	}
+	if rehashed.Equal(r) {
+		t.Errorf("Equal() = true for the rehashed ring\n")
+	}
+	if _, err = r.Rehash(nil); err == nil {
+		t.Errorf("Rehash() succeeded with a nil hash function\n")
+	}
+}
+
+func TestIteratorReset(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 4, "node-0", "node-1", "node-2")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	key := hashFunc([]byte("key"))
+	forward := []*VirtualNodesIterator{r.NewVirtualNodesIterator(), r.NewVirtualNodesIteratorFrom(key)}
+	reverse := []*VirtualNodesReverseIterator{r.NewVirtualNodesReverseIterator(), r.NewVirtualNodesReverseIteratorFrom(key)}
+
+	// Modifications after the iterators have been created are not seen,
+	// even after resetting them.
+	if _, err = r.Insert("node-3"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+	}
+	for _, iter := range forward {
+		if iter.Len() != 12 {
+			t.Errorf("Len() = %d; expected 12\n", iter.Len())
+		}
+		first := make([]*VirtualNode, 0, iter.Len())
+		for iter.HasNext() {
+			first = append(first, iter.Next())
+		}
+		iter.Reset()
+		second := make([]*VirtualNode, 0, iter.Len())
+		for iter.HasNext() {
+			second = append(second, iter.Next())
+		}
+		if len(first) != 12 || fmt.Sprint(first) != fmt.Sprint(second) {
+			t.Errorf("iteration after Reset() = %v; expected %v\n", second, first)
+		}
+	}
+	for _, iter := range reverse {
+		if iter.Len() != 12 {
+			t.Errorf("Len() = %d; expected 12\n", iter.Len())
+		}
+		first := make([]*VirtualNode, 0, iter.Len())
+		for iter.HasNext() {
+			first = append(first, iter.Next())
+		}
+		iter.Reset()
+		second := make([]*VirtualNode, 0, iter.Len())
+		for iter.HasNext() {
+			second = append(second, iter.Next())
+		}
+		if len(first) != 12 || fmt.Sprint(first) != fmt.Sprint(second) {
+			t.Errorf("reverse iteration after Reset() = %v; expected %v\n", second, first)
+		}
+	}
+}
+
+func TestRingBuilder(t *testing.T) {
+	b := NewRingBuilder(hashFunc, 3, 8)
+	naive, err := NewHashRing(hashFunc, 3, 8)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	for i := 0; i < 50; i++ {
+		node := Node(fmt.Sprintf("node-%d", i))
+		weight := 1 + i%3
+		b.AddWeighted(weight, node)
+		if _, err = naive.InsertWeighted(weight, node); err != nil {
+			t.Errorf("InsertWeighted(): %v\n", err)
+			t.FailNow()
+		}
+	}
+	if b.Len() != 50 {
+		t.Errorf("Len() == %d; expected 50\n", b.Len())
+	}
+	built, err := b.Build()
+	if err != nil {
+		t.Errorf("Build(): %v\n", err)
+		t.FailNow()
+	}
+	if !built.Equal(naive) {
+		t.Errorf("Build() differs from inserting the nodes one by one: %+v\n", built.Diff(naive))
+	}
+	if built.Checksum() != naive.Checksum() {
+		t.Errorf("Checksum() differs from inserting the nodes one by one\n")
+	}
+
+	// The builder is not affected by modifications of the built ring.
+	if _, err = built.Remove("node-0"); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+		t.FailNow()
+	}
+	again, err := b.Build()
+	if err != nil {
+		t.Errorf("Build(): %v\n", err)
+		t.FailNow()
+	}
+	if !again.Equal(naive) {
+		t.Errorf("Build() differs from inserting the nodes one by one, after modifying a built ring\n")
+	}
+
+	// Errors are reported by Build.
+	_, err = NewRingBuilder(hashFunc, 3, 8).Add("a", "b", "a").Build()
+	if _, ok := err.(*BatchError); !ok {
+		t.Errorf("Build() returned %v for a repeated node; expected a *BatchError\n", err)
+	}
+	if _, err = NewRingBuilder(hashFunc, 3, 8).AddWeighted(0, "a").Build(); err == nil {
+		t.Errorf("Build() succeeded with a non-positive weight\n")
+	}
+	if _, err = NewRingBuilder(hashFunc, 0, 8).Add("a").Build(); err == nil {
+		t.Errorf("Build() succeeded with an invalid replication factor\n")
+	}
+	empty, err := NewRingBuilder(hashFunc, 3, 8).Build()
+	if err != nil {
+		t.Errorf("Build(): %v\n", err)
+		t.FailNow()
+	}
+	if empty.Size() != 0 {
+		t.Errorf("Size() == %d for a ring built without nodes; expected 0\n", empty.Size())
+	}
+}
+
+func TestDistinctNodesForKey(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 3, 8, "node-1", "node-2", "node-3", "node-4", "node-5")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	for i := 0; i < 100; i++ {
+		key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+		owners := r.NodesForKey(key)
+		if nodes := r.DistinctNodesForKey(key, 3); !sameNodes(nodes, owners) {
+			t.Errorf("DistinctNodesForKey(%x, 3) == %v; expected %v\n", key, nodes, owners)
+		}
+		all := r.DistinctNodesForKey(key, 10)
+		if len(all) != 5 {
+			t.Errorf("DistinctNodesForKey(%x, 10) returned %d nodes; expected 5\n", key, len(all))
+			t.FailNow()
+		}
+		if !sameNodes(all[:3], owners) {
+			t.Errorf("DistinctNodesForKey(%x, 10) == %v; expected it to start with %v\n", key, all, owners)
+		}
+		seen := make(map[Node]struct{})
+		for _, node := range all {
+			if _, isSeen := seen[node]; isSeen {
+				t.Errorf("DistinctNodesForKey(%x, 10) == %v; node %q is repeated\n", key, all, node)
+			}
+			seen[node] = struct{}{}
+		}
+		if nodes := r.DistinctNodesForKey(key, 1); len(nodes) != 1 || nodes[0] != owners[0] {
+			t.Errorf("DistinctNodesForKey(%x, 1) == %v; expected [%v]\n", key, nodes, owners[0])
+		}
+	}
+	if nodes := r.DistinctNodesForKey(hashFunc([]byte("key")), 0); nodes != nil {
+		t.Errorf("DistinctNodesForKey() == %v for n == 0; expected nil\n", nodes)
+	}
+
+	empty, err := NewHashRing(hashFunc, 3, 8)
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	if nodes := empty.DistinctNodesForKey(hashFunc([]byte("key")), 3); nodes != nil {
+		t.Errorf("DistinctNodesForKey() == %v for an empty ring; expected nil\n", nodes)
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 2, 4, "node-0", `node"1`, "node-2")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	buf := &bytes.Buffer{}
+	if err = r.WriteDOT(buf); err != nil {
+		t.Errorf("WriteDOT(): %v\n", err)
+		t.FailNow()
+	}
+	dot := buf.String()
+	if !strings.HasPrefix(dot, "digraph ring {\n") || !strings.HasSuffix(dot, "}\n") {
+		t.Errorf("WriteDOT() wrote a malformed graph:\n%s\n", dot)
+	}
+	n := r.VirtualNodesLen()
+	colors := make(map[Node]string)
+	for i := 0; i < n; i++ {
+		vn, _ := r.VirtualNodeAt(i)
+		edge := fmt.Sprintf("\tv%d -> v%d;\n", i, (i+1)%n)
+		if !strings.Contains(dot, edge) {
+			t.Errorf("WriteDOT() did not write edge %q\n", edge)
+		}
+		owners := r.NodesForKey(vn.Name())
+		label := fmt.Sprintf(`%s #%d\n%x\nowners: %s, %s`, vn.Node(), vn.vnid, vn.Name()[:4], owners[0], owners[1])
+		label = strings.ReplaceAll(label, `"`, `\"`)
+		prefix := fmt.Sprintf("\tv%d [label=\"%s\", fillcolor=", i, label)
+		start := strings.Index(dot, prefix)
+		if start < 0 {
+			t.Errorf("WriteDOT() did not write virtual node %d with label %q\n", i, label)
+			continue
+		}
+		line := dot[start+len(prefix):]
+		color := line[:strings.Index(line, "]")]
+		if prev, exists := colors[vn.Node()]; exists && prev != color {
+			t.Errorf("WriteDOT() colored node %q both %s and %s\n", vn.Node(), prev, color)
+		}
+		colors[vn.Node()] = color
+	}
+	distinct := make(map[string]struct{})
+	for _, color := range colors {
+		distinct[color] = struct{}{}
+	}
+	if len(distinct) != 3 {
+		t.Errorf("WriteDOT() colored the nodes %v; expected 3 distinct colors\n", colors)
+	}
+	if edges := strings.Count(dot, "->"); edges != n {
+		t.Errorf("WriteDOT() wrote %d edges; expected %d\n", edges, n)
+	}
+}
+
+func TestNameComparator(t *testing.T) {
+	// shortHash yields variable-length names, by trimming the leading zero
+	// bytes of a 2-byte digest, as an integer would be encoded.
+	shortHash := func(data []byte) []byte {
+		sum := sha256.Sum256(data)
+		return bytes.TrimLeft(sum[:2], "\x00")
+	}
+	numeric := func(a, b []byte) int {
+		return new(big.Int).SetBytes(a).Cmp(new(big.Int).SetBytes(b))
+	}
+	r, err := NewHashRingWithOptions(shortHash, 2, 64, WithNameComparator(numeric))
+	if err != nil {
+		t.Errorf("NewHashRingWithOptions(): %v\n", err)
+		t.FailNow()
+	}
+	if _, err = r.Insert("node-0", "node-1", "node-2", "node-3"); err != nil {
+		t.Errorf("Insert(): %v\n", err)
+		t.FailNow()
+	}
+	checkVirtualNodes(t, r)
+	state := r.state.Load().(*hashRingState)
+	if err = state.validate(); err != nil {
+		t.Errorf("validate(): %v\n", err)
+	}
+	for i := 1; i < len(state.virtualNodes); i++ {
+		if numeric(state.virtualNodes[i-1].Name(), state.virtualNodes[i].Name()) > 0 {
+			t.Errorf("virtual nodes %d and %d are not in numeric order\n", i-1, i)
+			t.FailNow()
+		}
+	}
+
+	// Lookups must respect the comparator, e.g. key 0x00ff is numerically
+	// less than 0x0100, although it is longer than 0x01 (or 0x0100
+	// trimmed).
+	for i := 0; i < 1000; i++ {
+		key := shortHash([]byte(fmt.Sprintf("key-%d", i)))
+		expected := state.virtualNodes[0]
+		for _, vn := range state.virtualNodes {
+			if numeric(vn.Name(), key) >= 0 {
+				expected = vn
+				break
+			}
+		}
+		if vn := r.VirtualNodeForKey(key); vn != expected {
+			t.Errorf("VirtualNodeForKey(%x) == %v; expected %v\n", key, vn, expected)
+		}
+	}
+
+	// Removals must find the virtual nodes through the comparator, too.
+	if _, err = r.Remove("node-1"); err != nil {
+		t.Errorf("Remove(): %v\n", err)
+		t.FailNow()
+	}
+	checkVirtualNodes(t, r)
+	if err = r.state.Load().(*hashRingState).validate(); err != nil {
+		t.Errorf("validate() after Remove(): %v\n", err)
+	}
+
+	// The arcs of the ring order keys through the comparator, too.
+	for i := 0; i < 1000; i++ {
+		key := shortHash([]byte(fmt.Sprintf("key-%d", i)))
+		if _, _, arc := r.NodesForKeyCacheable(key); !arc.Contains(key) {
+			t.Errorf("NodesForKeyCacheable(%x): arc (%x, %x] does not contain the key\n", key, arc.Lo, arc.Hi)
+		}
+	}
+
+	// Snapshots are diffed through the comparator, too.
+	buf := &bytes.Buffer{}
+	if err = r.Save(buf); err != nil {
+		t.Errorf("Save(): %v\n", err)
+		t.FailNow()
+	}
+	if migs, err := r.DiffAgainstSnapshot(buf); err != nil || len(migs) != 0 {
+		t.Errorf("DiffAgainstSnapshot() == (%v, %v); expected no migrations\n", migs, err)
+	}
+
+	// The keyspace cannot be measured without positions.
+	if dist := r.LoadDistribution(); dist != nil {
+		t.Errorf("LoadDistribution() == %v; expected nil\n", dist)
+	}
+	if _, _, _, err = r.LargestArc(); err != ErrUnknownPositions {
+		t.Errorf("LargestArc(): %v; expected %v\n", err, ErrUnknownPositions)
+	}
+	if err = r.WriteCSV(io.Discard); err != ErrUnknownPositions {
+		t.Errorf("WriteCSV(): %v; expected %v\n", err, ErrUnknownPositions)
+	}
+	if impact := r.EstimateScaleImpact(1); !math.IsNaN(impact) {
+		t.Errorf("EstimateScaleImpact(1) == %v; expected NaN\n", impact)
+	}
+
+	// Inconsistent comparators are rejected.
+	for name, compare := range map[string]func(a, b []byte) int{
+		"always greater": func(a, b []byte) int { return 1 },
+		"irreflexive":    func(a, b []byte) int { return bytes.Compare(a, b) | 1 },
+		"non-transitive": func(a, b []byte) int { return [3]int{0, 1, -1}[(int(a[0]%3)-int(b[0]%3)+3)%3] },
+	} {
+		if _, err = NewHashRingWithOptions(hashFunc, 2, 8, WithNameComparator(compare)); err == nil {
+			t.Errorf("NewHashRingWithOptions() succeeded with an inconsistent (%s) comparator\n", name)
+		}
+	}
+}
+
+func TestNameComparatorInconsistentDoesNotPanic(t *testing.T) {
+	r, err := NewHashRing(hashFunc, 3, 16, "node-0", "node-1", "node-2", "node-3")
+	if err != nil {
+		t.Errorf("NewHashRing(): %v\n", err)
+		t.FailNow()
+	}
+	// Swap in a comparator that defines no order at all, bypassing the
+	// checks at initialization; nothing may panic, even if the placement
+	// of the keys is meaningless.
+	state := r.state.Load().(*hashRingState).derive()
+	state.compare = func(a, b []byte) int { return int(a[len(a)-1]&1) - int(b[0]&1) }
+	state.sortVirtualNodes()
+	state.fixReplicaOwners()
+	r.commit(state)
+	for i := 0; i < 100; i++ {
+		key := hashFunc([]byte(fmt.Sprintf("key-%d", i)))
+		_ = r.NodesForKey(key)
+		_ = r.VirtualNodeForKey(key)
+		_, _ = r.Successors(key, 5)
+		_, _ = r.Predecessors(key, 5)
+		_ = r.DistinctNodesForKey(key, 10)
+		_ = r.WrapsAround(key)
+	}
+	_, _ = r.Remove("node-1")
+	_, _ = r.Insert("node-4")
+	_, _ = r.PreviewRemove("node-0")
+}
+
+/*
+ * BENCHMARKS
+ *
+ * To run only the benchmarks:
+ *	$ go test -v -bench=. -benchtime=9s -benchmem -run=matchnothingregex
+ */
+
+func benchmarkNewHashRing(b *testing.B, hash func([]byte) []byte, replicationFactor, numVnodes, numNodes int) {
+	nodes := make([]Node, numNodes)
+	for i := 0; i < numNodes; i++ {
+		nodes[i] = Node(fmt.Sprintf("node-%d", i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, _ = NewHashRing(hash, replicationFactor, numVnodes, nodes...)
+	}
+}
+
+//func BenchmarkNewHashRing_4x256_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 4, 256) }
+//func BenchmarkNewHashRing_4x256_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 4, 256) }
+func BenchmarkNewHashRing_4x256(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 4, 256) }
+
+//func BenchmarkNewHashRing_4x512_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 4, 512) }
+//func BenchmarkNewHashRing_4x512_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 4, 512) }
+func BenchmarkNewHashRing_4x512(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 4, 512) }
+
+//func BenchmarkNewHashRing_4x1024_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 4, 1024) }
+//func BenchmarkNewHashRing_4x1024_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 4, 1024) }
+func BenchmarkNewHashRing_4x1024(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 4, 1024) }
+
+//func BenchmarkNewHashRing_8x128_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 8, 128) }
+//func BenchmarkNewHashRing_8x128_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 8, 128) }
+func BenchmarkNewHashRing_8x128(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 8, 128) }
+
+//func BenchmarkNewHashRing_8x256_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 8, 256) }
+//func BenchmarkNewHashRing_8x256_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 8, 256) }
+func BenchmarkNewHashRing_8x256(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 8, 256) }
+
+//func BenchmarkNewHashRing_8x512_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 8, 512) }
+//func BenchmarkNewHashRing_8x512_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 8, 512) }
+func BenchmarkNewHashRing_8x512(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 8, 512) }
+
+//func BenchmarkNewHashRing_16x64_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 16, 64) }
+//func BenchmarkNewHashRing_16x64_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 16, 64) }
+func BenchmarkNewHashRing_16x64(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 16, 64) }
+
+//func BenchmarkNewHashRing_16x128_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 16, 128) }
+//func BenchmarkNewHashRing_16x128_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 16, 128) }
+func BenchmarkNewHashRing_16x128(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 16, 128) }
+
+//func BenchmarkNewHashRing_16x256_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 16, 256) }
+//func BenchmarkNewHashRing_16x256_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 16, 256) }
+func BenchmarkNewHashRing_16x256(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 16, 256) }
+
+//func BenchmarkNewHashRing_32x32_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 32, 32) }
+//func BenchmarkNewHashRing_32x32_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 32, 32) }
+func BenchmarkNewHashRing_32x32(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 32, 32) }
+
+//func BenchmarkNewHashRing_32x64_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 32, 64) }
+//func BenchmarkNewHashRing_32x64_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 32, 64) }
+func BenchmarkNewHashRing_32x64(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 32, 64) }
+
+//func BenchmarkNewHashRing_32x128_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 32, 128) }
+//func BenchmarkNewHashRing_32x128_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 32, 128) }
+func BenchmarkNewHashRing_32x128(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 32, 128) }
+
+//func BenchmarkNewHashRing_32x256_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 32, 256) }
+//func BenchmarkNewHashRing_32x256_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 32, 256) }
+func BenchmarkNewHashRing_32x256(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 32, 256) }
+
+//func BenchmarkNewHashRing_64x32_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 64, 32) }
+//func BenchmarkNewHashRing_64x32_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 64, 32) }
+func BenchmarkNewHashRing_64x32(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 64, 32) }
+
+//func BenchmarkNewHashRing_64x64_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 64, 64) }
+//func BenchmarkNewHashRing_64x64_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 64, 64) }
+func BenchmarkNewHashRing_64x64(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 64, 64) }
+
+//func BenchmarkNewHashRing_64x128_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 64, 128) }
+//func BenchmarkNewHashRing_64x128_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 64, 128) }
+func BenchmarkNewHashRing_64x128(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 64, 128) }
+
+//func BenchmarkNewHashRing_64x256_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 64, 256) }
+//func BenchmarkNewHashRing_64x256_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 64, 256) }
+func BenchmarkNewHashRing_64x256(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 64, 256) }
+
+//func BenchmarkNewHashRing_128x16_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 128, 16) }
+//func BenchmarkNewHashRing_128x16_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 128, 16) }
+func BenchmarkNewHashRing_128x16(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 128, 16) }
+
+//func BenchmarkNewHashRing_128x32_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 128, 32) }
+//func BenchmarkNewHashRing_128x32_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 128, 32) }
+func BenchmarkNewHashRing_128x32(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 128, 32) }
+
+//func BenchmarkNewHashRing_128x64_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 128, 64) }
+//func BenchmarkNewHashRing_128x64_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 128, 64) }
+func BenchmarkNewHashRing_128x64(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 128, 64) }
+
+//func BenchmarkNewHashRing_128x128_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 128, 128) }
+//func BenchmarkNewHashRing_128x128_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 128, 128) }
+func BenchmarkNewHashRing_128x128(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 128, 128) }
+
+//func BenchmarkNewHashRing_128x256_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 128, 256) }
+//func BenchmarkNewHashRing_128x256_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 128, 256) }
+func BenchmarkNewHashRing_128x256(b *testing.B) { benchmarkNewHashRing(b, hashFunc, 3, 128, 256) }
 
 //func BenchmarkNewHashRing_256x16_blake2b(b *testing.B) { benchmarkNewHashRing(b, blake2bHash, 3, 256, 16) }
 //func BenchmarkNewHashRing_256x16_sha256(b *testing.B)  { benchmarkNewHashRing(b, sha256Hash, 3, 256, 16) }
@@ -1325,3 +6820,106 @@ func benchmarkString(b *testing.B, replicationFactor, numVnodes, numNodes int) {
 func BenchmarkHashRingToString_64x32(b *testing.B)   { benchmarkString(b, 3, 64, 32) }
 func BenchmarkHashRingToString_128x8(b *testing.B)   { benchmarkString(b, 3, 128, 8) }
 func BenchmarkHashRingToString_128x128(b *testing.B) { benchmarkString(b, 3, 128, 128) }
+
+func benchmarkOwnerMap(b *testing.B, withMap bool, replicationFactor, numVnodes, numNodes int) {
+	nodes := make([]Node, numNodes)
+	for i := 0; i < numNodes; i++ {
+		nodes[i] = Node(fmt.Sprintf("node-%d", i))
+	}
+	var opts []Option
+	if !withMap {
+		opts = append(opts, WithoutReplicaOwnerMap())
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, _ = NewHashRingWithOptions(hashFunc, replicationFactor, numVnodes, opts...)
+		_, _ = r.Insert(nodes...)
+	}
+}
+func BenchmarkOwnerMap_256x256(b *testing.B)   { benchmarkOwnerMap(b, true, 3, 256, 256) }
+func BenchmarkNoOwnerMap_256x256(b *testing.B) { benchmarkOwnerMap(b, false, 3, 256, 256) }
+func BenchmarkOwnerMap_512x512(b *testing.B)   { benchmarkOwnerMap(b, true, 3, 512, 512) }
+func BenchmarkNoOwnerMap_512x512(b *testing.B) { benchmarkOwnerMap(b, false, 3, 512, 512) }
+
+func benchmarkNodesForKey(b *testing.B, replicationFactor, numVnodes, numNodes int) {
+	nodes := make([]Node, numNodes)
+	for i := 0; i < numNodes; i++ {
+		nodes[i] = Node(fmt.Sprintf("node-%d", i))
+	}
+	r, err := NewHashRing(hashFunc, replicationFactor, numVnodes, nodes...)
+	if err != nil {
+		panic(err)
+	}
+	keys := make([][]byte, 1024)
+	for i := range keys {
+		keys[i] = hashFunc([]byte(strconv.Itoa(i)))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = r.NodesForKey(keys[i%len(keys)])
+	}
+}
+func BenchmarkNodesForKey_64x32(b *testing.B)   { benchmarkNodesForKey(b, 3, 64, 32) }
+func BenchmarkNodesForKey_128x128(b *testing.B) { benchmarkNodesForKey(b, 3, 128, 128) }
+func BenchmarkNodesForKey_256x512(b *testing.B) { benchmarkNodesForKey(b, 3, 256, 512) }
+
+func benchmarkInternedNodes(b *testing.B, intern bool, numVnodes, numNodes, idLen int) {
+	var opts []Option
+	if intern {
+		opts = append(opts, WithInternedNodes())
+	}
+	var heapBytes uint64
+	var m runtime.MemStats
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		r = nil
+		runtime.GC()
+		runtime.ReadMemStats(&m)
+		before := m.HeapAlloc
+		b.StartTimer()
+
+		// Each identifier is sliced out of a (larger) buffer of its
+		// own, as it would if it had been read from the network.
+		nodes := make([]Node, numNodes)
+		for j := range nodes {
+			buf := fmt.Sprintf("node-%0*d", 4*idLen-5, j)
+			nodes[j] = Node(buf[len(buf)-idLen:])
+		}
+		r, _ = NewHashRingWithOptions(hashFunc, 3, numVnodes, opts...)
+		_, _ = r.Insert(nodes...)
+
+		b.StopTimer()
+		nodes = nil
+		runtime.GC()
+		runtime.ReadMemStats(&m)
+		heapBytes += m.HeapAlloc - before
+		b.StartTimer()
+	}
+	b.ReportMetric(float64(heapBytes)/float64(b.N), "heap-B/op")
+}
+func BenchmarkNotInternedNodes_64x500(b *testing.B) { benchmarkInternedNodes(b, false, 64, 500, 64) }
+func BenchmarkInternedNodes_64x500(b *testing.B)    { benchmarkInternedNodes(b, true, 64, 500, 64) }
+
+func benchmarkRingBuilder(b *testing.B, numVnodes, numNodes int, naive bool) {
+	nodes := make([]Node, numNodes)
+	for i := range nodes {
+		nodes[i] = Node(fmt.Sprintf("node-%d", i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if naive {
+			r, _ = NewHashRing(hashFunc, 3, numVnodes)
+			for _, node := range nodes {
+				_, _ = r.Insert(node)
+			}
+		} else {
+			r, _ = NewRingBuilder(hashFunc, 3, numVnodes).Add(nodes...).Build()
+		}
+	}
+}
+func BenchmarkInsertOneByOne_16x1000(b *testing.B) { benchmarkRingBuilder(b, 16, 1000, true) }
+func BenchmarkRingBuilder_16x1000(b *testing.B)    { benchmarkRingBuilder(b, 16, 1000, false) }
+func BenchmarkInsertOneByOne_64x1000(b *testing.B) { benchmarkRingBuilder(b, 64, 1000, true) }
+func BenchmarkRingBuilder_64x1000(b *testing.B)    { benchmarkRingBuilder(b, 64, 1000, false) }
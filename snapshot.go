@@ -0,0 +1,124 @@
+// Copyright 2018 Christos Katsakioris
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lfchring
+
+// ReadSnapshot is a read-only view of a single state of the ring. All queries
+// made through the same ReadSnapshot observe the same state (and generation)
+// of the ring, regardless of any concurrent modifications of the latter.
+type ReadSnapshot struct {
+	state *hashRingState
+}
+
+// WithReadState loads the current state of the ring once, and passes a
+// read-only view of it to the given function, so that multiple queries may be
+// composed consistently, all observing the same generation of the ring.
+func (r *HashRing) WithReadState(fn func(rs ReadSnapshot)) {
+	fn(r.Snapshot())
+}
+
+// Snapshot loads the current state of the ring once, and returns a read-only
+// view of it, like WithReadState, for callers whose related queries do not fit
+// in the scope of a single function. It is cheap: the state is not copied, but
+// only referred to. The state is kept alive for as long as the ReadSnapshot is
+// reachable, hence it should not be retained for longer than needed.
+func (r *HashRing) Snapshot() ReadSnapshot {
+	return ReadSnapshot{state: r.state.Load().(*hashRingState)}
+}
+
+// Generation returns the generation of the ring's state that the ReadSnapshot
+// refers to.
+func (rs ReadSnapshot) Generation() uint64 {
+	return rs.state.generation
+}
+
+// Size returns the number of *distinct* nodes in the ring's state that the
+// ReadSnapshot refers to.
+func (rs ReadSnapshot) Size() int {
+	return rs.state.size()
+}
+
+// NodesForKey returns a slice of Nodes (of length equal to the configured
+// replication factor) that are responsible for holding the given key, in the
+// ring's state that the ReadSnapshot refers to.
+//
+// Complexity: O( log(V*N) )
+func (rs ReadSnapshot) NodesForKey(key []byte) []Node {
+	return rs.state.readNodesForKey(key)
+}
+
+// OwnerSetForKey returns the set of Nodes that are responsible for holding the
+// given key, in the ring's state that the ReadSnapshot refers to.
+//
+// Complexity: O( log(V*N) )
+func (rs ReadSnapshot) OwnerSetForKey(key []byte) OwnerSet {
+	return OwnerSet{owners: rs.state.readNodesForKey(key)}
+}
+
+// VirtualNodeForKey returns the virtual node that the given key would be
+// assigned to, in the ring's state that the ReadSnapshot refers to.
+//
+// Complexity: O( log(V*N) )
+func (rs ReadSnapshot) VirtualNodeForKey(key []byte) *VirtualNode {
+	return rs.state.virtualNodeForKey(key)
+}
+
+// Predecessor returns the virtual node which is predecessor to the one that the
+// given key would be assigned to, in the ring's state that the ReadSnapshot
+// refers to. It returns a non-nil error if the state is empty.
+//
+// Complexity: O( log(V*N) )
+func (rs ReadSnapshot) Predecessor(key []byte) (*VirtualNode, error) {
+	return rs.state.predecessor(key)
+}
+
+// Successor returns the virtual node which is successor to the one that the
+// given key would be assigned to, in the ring's state that the ReadSnapshot
+// refers to. It returns a non-nil error if the state is empty.
+//
+// Complexity: O( log(V*N) )
+func (rs ReadSnapshot) Successor(key []byte) (*VirtualNode, error) {
+	return rs.state.successor(key)
+}
+
+// NewVirtualNodesIterator returns a new VirtualNodesIterator for efficiently
+// iterating through the virtual nodes of the ring's state that the
+// ReadSnapshot refers to, in (alphanumerical) order.
+func (rs ReadSnapshot) NewVirtualNodesIterator() *VirtualNodesIterator {
+	return &VirtualNodesIterator{
+		ring: rs.state,
+		curr: 0,
+	}
+}
+
+// NewVirtualNodesReverseIterator returns a new VirtualNodesReverseIterator for
+// efficiently iterating through the virtual nodes of the ring's state that the
+// ReadSnapshot refers to, in reverse (alphanumerical) order.
+func (rs ReadSnapshot) NewVirtualNodesReverseIterator() *VirtualNodesReverseIterator {
+	return &VirtualNodesReverseIterator{
+		ring: rs.state,
+		curr: len(rs.state.virtualNodes) - 1,
+	}
+}
+
+// NewReplicaOwnersIterator returns a new ReplicaOwnersIterator for efficiently
+// iterating through the virtual nodes of the ring's state that the
+// ReadSnapshot refers to, in (alphanumerical) order, along with the replica
+// owners of each one of them.
+func (rs ReadSnapshot) NewReplicaOwnersIterator() *ReplicaOwnersIterator {
+	return &ReplicaOwnersIterator{
+		ring: rs.state,
+		curr: 0,
+	}
+}
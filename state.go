@@ -16,8 +16,16 @@ package lfchring
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
 	"sort"
+	"sync"
 )
 
 // hashRingState represents a state of the HashRing, and this is why it is not
@@ -32,6 +40,11 @@ type hashRingState struct {
 	// ring functionality and operations.
 	hash func([]byte) []byte
 
+	// hashName is an optional identifier of the hash function, used to
+	// verify the compatibility of the hash functions of different rings.
+	// An empty hashName means that the hash function is unidentified.
+	hashName string
+
 	// virtualNodeCount is the number of virtual nodes that each of the
 	// distinct nodes in the ring has.
 	//
@@ -42,294 +55,2072 @@ type hashRingState struct {
 	// replicationFactor is the number of distinct nodes in the ring that
 	// own each of the keys.
 	//
+	// It is set during ring's initialization, and it may only be modified
+	// later through setReplicationFactor.
+	replicationFactor uint16
+
+	// virtualNodes is a sorted slice of pointers to VirtualNode structs,
+	// which correspond to each of the virtual nodes of all distinct nodes
+	// that are members of the ring in its current state.
+	virtualNodes []*VirtualNode
+
+	// replicaOwners holds, for each virtual node, a set of distinct nodes
+	// that are members of the ring in its current state, and which should
+	// own replicas of that virtual node's keys in this state. It is aligned
+	// to virtualNodes, i.e. replicaOwners[i] are the replica owners of
+	// virtualNodes[i]; this spares the read path from any map lookups.
+	//
+	// It is nil if withoutReplicaOwners is set.
+	replicaOwners [][]Node
+
+	// withoutReplicaOwners is set if the state should not maintain the
+	// replicaOwners slice at all, but compute the replica owners of each
+	// virtual node on demand instead, trading CPU time on each lookup for
+	// (potentially a lot of) memory.
+	//
+	// It is set during ring's initialization and should not be modified
+	// later.
+	withoutReplicaOwners bool
+
+	// duplicateOwners is set if the replica owners of each virtual node
+	// are the distinct nodes of the next replicationFactor virtual nodes,
+	// including any duplicates, rather than the next replicationFactor
+	// distinct nodes.
+	//
+	// It is set during ring's initialization and should not be modified
+	// later.
+	duplicateOwners bool
+
+	// generation is the number of the state, in the sequence of states
+	// that the ring has gone through; each state derived from another
+	// one is numbered after it.
+	generation uint64
+
+	// draining is the set of distinct nodes that are being drained, i.e.
+	// which should stop being the primary owners of any keys, but still
+	// serve as backup replica owners until their data have been migrated.
+	draining map[Node]struct{}
+
+	// interned maps each distinct node in the state to the canonical copy
+	// of its identifier, which all references to the node share. It is nil
+	// if the state does not intern its nodes.
+	interned map[Node]Node
+
+	// vnodeCounts maps each distinct node in the state to the number of
+	// its virtual nodes, which are always the ones with vnids in
+	// [0, vnodeCounts[node]), except for any that have been removed
+	// individually (see removedVNIDs). It equals virtualNodeCount for all
+	// nodes, unless some of them have been inserted with a weight (see
+	// insertWeighted) or have had their weight reduced.
+	vnodeCounts map[Node]int
+
+	// removedVNIDs maps each distinct node in the state that has had some
+	// of its virtual nodes removed individually (see
+	// removeVirtualNodesByName) to the set of their vnids, all of which are
+	// less than vnodeCounts[node]-1; nodes without any such virtual nodes
+	// are not in the map. The actual number of virtual nodes of a distinct
+	// node is returned by numVirtualNodes.
+	removedVNIDs map[Node]map[uint16]struct{}
+
+	// rackOf returns the rack of each distinct node, if the replica owners
+	// of each virtual node should span at least minRacks distinct racks;
+	// otherwise, it is nil.
+	//
+	// They are set during ring's initialization and should not be
+	// modified later.
+	rackOf   func(Node) string
+	minRacks int
+
+	// lazyNames computes (and caches) the names of the virtual nodes on
+	// demand, if they should not be stored in the virtual nodes; otherwise,
+	// it is nil.
+	lazyNames *lazyNames
+
+	// prefixHashes are the hash functions that keys with specific prefixes
+	// should be hashed with, instead of hash, sorted by decreasing length
+	// of their prefixes, so that the longest matching prefix comes first.
+	prefixHashes []prefixHash
+
+	// tieBreakHash, if not nil, orders virtual nodes with colliding names.
+	//
+	// It is set during ring's initialization and should not be modified
+	// later.
+	tieBreakHash func([]byte) []byte
+
+	// virtualNodeKey derives the bytes that are hashed into the name of
+	// the virtual node with the given vnid of the given distinct node.
+	//
+	// It is set during ring's initialization and should not be modified
+	// later.
+	virtualNodeKey func(Node, uint16) []byte
+
+	// customNaming is set if virtualNodeKey is not defaultVirtualNodeKey
+	// (see WithVirtualNodeNaming), so that saved rings may record it.
+	customNaming bool
+
+	// compare, if not nil, orders the names of the virtual nodes and the
+	// keys that are looked up in the state, instead of bytes.Compare (see
+	// compareNames). Keys have no known positions on the ring then.
+	//
+	// It is set during ring's initialization and should not be modified
+	// later.
+	compare func(a, b []byte) int
+
+	// keyCache, if not nil, caches the hashes of the most recently hashed
+	// keys, as computed by hashKey. It is shared among states, as long as
+	// they hash keys in the same way; otherwise, a new one is created.
+	keyCache *keyCache
+
+	// streamingHash, if not nil, creates hash.Hash instances that compute
+	// the same digests as hash, for hashing objects while reading them.
+	//
 	// It is set during ring's initialization and should not be modified
 	// later.
-	replicationFactor uint8
+	streamingHash func() hash.Hash
+
+	// joinWeights maps each distinct node that is still joining the ring
+	// to its join weight in [0, 1), i.e. the probability that it is
+	// accepted as a replica owner of each virtual node's keys. Nodes with
+	// a join weight of 1 (i.e. full members) are not in the map.
+	joinWeights map[Node]float64
+
+	// readExcluded is the set of distinct nodes that are excluded from the
+	// replica owners of keys when they are looked up for reading, e.g.
+	// while they are restarting, without affecting the placement of keys.
+	readExcluded map[Node]struct{}
+
+	// down is the set of distinct nodes that are currently unreachable, as
+	// marked through setNodeStatus, which NodesForKeyHealthy routes around.
+	down map[Node]struct{}
+
+	// nodeIndex maps each distinct node in the state to its index in the
+	// (sorted) slice of nodes, as returned by nodes. Since it is only
+	// needed by OwnerIndicesForKey, it is built lazily (and only once),
+	// through nodeIndexOnce.
+	nodeIndex     map[Node]int
+	nodeIndexOnce sync.Once
+
+	// checksum is the checksum of the state, as computed (once, on first
+	// use) through checksumOnce.
+	checksum     [sha256.Size]byte
+	checksumOnce sync.Once
+
+	// fallback, if not empty, is the node that keys are routed to while
+	// the state is empty. It is not a member of the ring, and it is
+	// cleared as soon as any nodes are inserted.
+	fallback Node
+
+	// meta maps distinct nodes in the state to their metadata (e.g. their
+	// datacenters), as set through setMeta; nodes without any metadata are
+	// not in the map. The metadata of each node are never modified once
+	// they have been set, hence they are shared among states.
+	meta map[Node]map[string]string
+
+	// values maps distinct nodes in the state to the values that they
+	// have been inserted as through a HashRingG; nodes inserted otherwise
+	// are not in the map.
+	values map[Node]interface{}
+}
+
+// defaultVirtualNodeKey derives the bytes that are hashed into the name of the
+// virtual node with the given vnid of the given distinct node, unless the ring
+// has been configured otherwise through WithVirtualNodeNaming.
+func defaultVirtualNodeKey(node Node, vnid uint16) []byte {
+	return []byte(fmt.Sprintf("%s-%d", node, vnid))
+}
+
+// prefixHash is a hash function that keys with a specific prefix are hashed
+// with.
+type prefixHash struct {
+	prefix []byte
+	hash   func([]byte) []byte
+}
+
+// nextGeneration returns the generation that follows gen. It saturates at
+// math.MaxUint64 rather than wrapping around to 0, so that a state derived from
+// one at the last generation does not advance it, and cannot be committed.
+func nextGeneration(gen uint64) uint64 {
+	if gen == math.MaxUint64 {
+		return gen
+	}
+	return gen + 1
+}
+
+// TODO: Documentation
+func (s *hashRingState) derive() *hashRingState {
+	// Deep copy the slice of virtual nodes.
+	newVNs := make([]*VirtualNode, len(s.virtualNodes))
+	for i := range s.virtualNodes {
+		newVNs[i] = &VirtualNode{
+			name: s.virtualNodes[i].name,
+			node: s.virtualNodes[i].node,
+			vnid: s.virtualNodes[i].vnid,
+			lazy: s.virtualNodes[i].lazy,
+		}
+	}
+	// The slice of replica owners is left **EMPTY, to be filled by the
+	// caller** (through fixReplicaOwners) when needed. XXX
+
+	// Copy the set of draining nodes.
+	newDraining := make(map[Node]struct{}, len(s.draining))
+	for node := range s.draining {
+		newDraining[node] = struct{}{}
+	}
+
+	// Copy the canonical copies of nodes' identifiers, if any.
+	var newInterned map[Node]Node
+	if s.interned != nil {
+		newInterned = make(map[Node]Node, len(s.interned))
+		for node, canonical := range s.interned {
+			newInterned[node] = canonical
+		}
+	}
+
+	// Copy the set of nodes that are excluded from reads.
+	newReadExcluded := make(map[Node]struct{}, len(s.readExcluded))
+	for node := range s.readExcluded {
+		newReadExcluded[node] = struct{}{}
+	}
+
+	// Copy the set of nodes that are down.
+	newDown := make(map[Node]struct{}, len(s.down))
+	for node := range s.down {
+		newDown[node] = struct{}{}
+	}
+
+	// Copy the metadata of the nodes; the metadata themselves are never
+	// modified, so they may be shared.
+	newMeta := make(map[Node]map[string]string, len(s.meta))
+	for node, meta := range s.meta {
+		newMeta[node] = meta
+	}
+
+	// Copy the values of the nodes.
+	newValues := make(map[Node]interface{}, len(s.values))
+	for node, v := range s.values {
+		newValues[node] = v
+	}
+
+	// Copy the join weights of the joining nodes.
+	newJoinWeights := make(map[Node]float64, len(s.joinWeights))
+	for node, w := range s.joinWeights {
+		newJoinWeights[node] = w
+	}
+
+	// Copy the numbers of virtual nodes of the distinct nodes, along with
+	// the vnids of any virtual nodes that have been removed individually.
+	newVnodeCounts := make(map[Node]int, len(s.vnodeCounts))
+	for node, count := range s.vnodeCounts {
+		newVnodeCounts[node] = count
+	}
+	newRemovedVNIDs := make(map[Node]map[uint16]struct{}, len(s.removedVNIDs))
+	for node, vnids := range s.removedVNIDs {
+		newRemovedVNIDs[node] = make(map[uint16]struct{}, len(vnids))
+		for vnid := range vnids {
+			newRemovedVNIDs[node][vnid] = struct{}{}
+		}
+	}
+
+	return &hashRingState{
+		hash:                 s.hash,
+		hashName:             s.hashName,
+		replicationFactor:    s.replicationFactor,
+		virtualNodeCount:     s.virtualNodeCount,
+		virtualNodes:         newVNs,
+		withoutReplicaOwners: s.withoutReplicaOwners,
+		duplicateOwners:      s.duplicateOwners,
+		generation:           nextGeneration(s.generation),
+		draining:             newDraining,
+		interned:             newInterned,
+		vnodeCounts:          newVnodeCounts,
+		removedVNIDs:         newRemovedVNIDs,
+		rackOf:               s.rackOf,
+		minRacks:             s.minRacks,
+		lazyNames:            s.lazyNames,
+		prefixHashes:         s.prefixHashes,
+		tieBreakHash:         s.tieBreakHash,
+		streamingHash:        s.streamingHash,
+		keyCache:             s.keyCache,
+		virtualNodeKey:       s.virtualNodeKey,
+		customNaming:         s.customNaming,
+		compare:              s.compare,
+		joinWeights:          newJoinWeights,
+		readExcluded:         newReadExcluded,
+		down:                 newDown,
+		fallback:             s.fallback,
+		meta:                 newMeta,
+		values:               newValues,
+	}
+}
+
+// numVirtualNodes returns the number of virtual nodes of the given distinct
+// node in the state, or 0 if it is not a member of the state.
+func (s *hashRingState) numVirtualNodes(node Node) int {
+	return s.vnodeCounts[node] - len(s.removedVNIDs[node])
+}
+
+// isRemovedVNID returns true if the virtual node of the given distinct node
+// with the given vnid has been removed individually, or false otherwise.
+func (s *hashRingState) isRemovedVNID(node Node, vnid uint16) bool {
+	_, removed := s.removedVNIDs[node][vnid]
+	return removed
+}
+
+// size returns the number of distinct nodes in the state.
+func (s *hashRingState) size() int {
+	return len(s.vnodeCounts)
+}
+
+// checkHashCompatible returns a non-nil error if both states have identified
+// their hash functions, but by different names.
+func (s *hashRingState) checkHashCompatible(other *hashRingState) error {
+	if s.hashName != "" && other.hashName != "" && s.hashName != other.hashName {
+		return fmt.Errorf("incompatible hash functions %q and %q", s.hashName, other.hashName)
+	}
+	return nil
+}
+
+// hasNode returns true if the given distinct node is a member of the ring in
+// this state, or false otherwise.
+//
+// Complexity: O( 1 )
+func (s *hashRingState) hasNode(node Node) bool {
+	_, exists := s.vnodeCounts[node]
+	return exists
+}
+
+// nodes returns a sorted slice of the distinct nodes in the state.
+//
+// Complexity: O( V*N )
+func (s *hashRingState) nodes() []Node {
+	seen := make(map[Node]struct{}, s.size())
+	ret := make([]Node, 0, s.size())
+	for _, vn := range s.virtualNodes {
+		if _, exists := seen[vn.node]; !exists {
+			seen[vn.node] = struct{}{}
+			ret = append(ret, vn.node)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// indexOfNode returns the index of the given distinct node in the (sorted)
+// slice of nodes of the state, as returned by nodes, building the index of all
+// nodes on first use.
+//
+// Complexity: O( 1 ) (amortized)
+func (s *hashRingState) indexOfNode(node Node) int {
+	s.nodeIndexOnce.Do(func() {
+		nodes := s.nodes()
+		s.nodeIndex = make(map[Node]int, len(nodes))
+		for i, node := range nodes {
+			s.nodeIndex[node] = i
+		}
+	})
+	return s.nodeIndex[node]
+}
+
+// setPrefixHash makes keys with the given prefix be hashed by the given hash
+// function, replacing any hash function previously set for the same prefix.
+// It returns a non-nil error if the width of the hash function's outputs is
+// not the same as the width of state's keyspace.
+func (s *hashRingState) setPrefixHash(prefix []byte, hashFunc func([]byte) []byte) error {
+	if hashFunc == nil {
+		return fmt.Errorf("hashFunc cannot be nil")
+	}
+	if width := len(hashFunc(nil)); width != s.keyWidth() {
+		return fmt.Errorf("hashFunc output of length %d; expected %d", width, s.keyWidth())
+	}
+	// Copy the prefix hashes, since the original slice is shared with the
+	// state that this one was derived from.
+	newPrefixHashes := make([]prefixHash, 0, len(s.prefixHashes)+1)
+	for _, ph := range s.prefixHashes {
+		if !bytes.Equal(ph.prefix, prefix) {
+			newPrefixHashes = append(newPrefixHashes, ph)
+		}
+	}
+	newPrefixHashes = append(newPrefixHashes, prefixHash{
+		prefix: append([]byte(nil), prefix...),
+		hash:   hashFunc,
+	})
+	sort.SliceStable(newPrefixHashes, func(i, j int) bool {
+		return len(newPrefixHashes[i].prefix) > len(newPrefixHashes[j].prefix)
+	})
+	s.prefixHashes = newPrefixHashes
+	if s.keyCache != nil {
+		// Keys with the prefix are hashed differently from now on.
+		s.keyCache = newKeyCache(s.keyCache.size)
+	}
+	return nil
+}
+
+// hashKey hashes the given key with the hash function of the longest prefix
+// of it that has one, or with state's hash function if there is none, through
+// state's key cache, if any.
+func (s *hashRingState) hashKey(key []byte) []byte {
+	if s.keyCache != nil {
+		return s.keyCache.hash(key, s.hashKeyUncached)
+	}
+	return s.hashKeyUncached(key)
+}
+
+// hashKeyUncached is like hashKey, but it bypasses state's key cache.
+func (s *hashRingState) hashKeyUncached(key []byte) []byte {
+	for _, ph := range s.prefixHashes {
+		if bytes.HasPrefix(key, ph.prefix) {
+			return ph.hash(key)
+		}
+	}
+	return s.hash(key)
+}
+
+// hashObject hashes the object that can be read from the given io.Reader, like
+// hashKeyUncached. If state's streaming hash function is set, the object is
+// hashed while it is read, rather than read into memory in its entirety first,
+// unless it starts with a prefix that a hash function has been registered for.
+func (s *hashRingState) hashObject(reader io.Reader) ([]byte, error) {
+	if s.streamingHash == nil {
+		objectBytes, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		return s.hashKeyUncached(objectBytes), nil
+	}
+	// Read as much of the object as needed to match it against all
+	// registered prefixes.
+	headLen := 0
+	for _, ph := range s.prefixHashes {
+		if len(ph.prefix) > headLen {
+			headLen = len(ph.prefix)
+		}
+	}
+	head := make([]byte, headLen)
+	n, err := io.ReadFull(reader, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// The whole object is shorter than the longest prefix.
+		return s.hashKeyUncached(head[:n]), nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, ph := range s.prefixHashes {
+		if bytes.HasPrefix(head, ph.prefix) {
+			rest, err := ioutil.ReadAll(reader)
+			if err != nil {
+				return nil, err
+			}
+			return ph.hash(append(head, rest...)), nil
+		}
+	}
+	h := s.streamingHash()
+	h.Write(head)
+	if _, err = io.Copy(h, reader); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// fingerprint returns a SHA-256 digest of the parameters and the distinct nodes
+// (along with their virtual node counts) of the state, which identifies its
+// membership. States with equal fingerprints place all virtual nodes at the
+// same positions, as long as they use the same hash function; the generation
+// of the state, as well as any draining nodes, are not taken into account.
+// Unlike the checksum of the state (see computeChecksum), it covers the name of
+// the hash function, but not the replica owners.
+//
+// Complexity: O( V*N )
+func (s *hashRingState) fingerprint() [sha256.Size]byte {
+	d := newStateDigest(s)
+	d.putBytes([]byte(s.hashName))
+	nodes := s.nodes()
+	d.putUvarint(uint64(len(nodes)))
+	for _, node := range nodes {
+		d.putBytes([]byte(node))
+		d.putUvarint(uint64(s.vnodeCounts[node]))
+		removedVNIDs := s.sortedRemovedVNIDs(node)
+		d.putUvarint(uint64(len(removedVNIDs)))
+		for _, vnid := range removedVNIDs {
+			d.putUvarint(uint64(vnid))
+		}
+	}
+	var ret [sha256.Size]byte
+	d.h.Sum(ret[:0])
+	return ret
+}
+
+// stateDigest is the SHA-256 digest of an unambiguous encoding of (parts of) a
+// state, shared by fingerprint and computeChecksum: each one of them chooses
+// what to cover after the state's parameters, with which it always starts.
+// Variable-length fields are prefixed by their lengths, and so are lists by
+// their counts, so that the encodings of different states never collide.
+type stateDigest struct {
+	h   hash.Hash
+	buf [binary.MaxVarintLen64]byte
+}
+
+// newStateDigest returns a new stateDigest, having encoded the replication
+// factor and the default number of virtual nodes per distinct node of the
+// given state.
+func newStateDigest(s *hashRingState) *stateDigest {
+	d := &stateDigest{h: sha256.New()}
+	d.putUvarint(uint64(s.replicationFactor))
+	d.putUvarint(uint64(s.virtualNodeCount))
+	return d
+}
+
+// putUvarint encodes the given number.
+func (d *stateDigest) putUvarint(x uint64) {
+	d.h.Write(d.buf[:binary.PutUvarint(d.buf[:], x)])
+}
+
+// putBytes encodes the given bytes, prefixed by their length.
+func (d *stateDigest) putBytes(b []byte) {
+	d.putUvarint(uint64(len(b)))
+	d.h.Write(b)
+}
+
+// equal returns true if the two states are equal; see HashRing.Equal.
+func (s *hashRingState) equal(other *hashRingState) bool {
+	if s.replicationFactor != other.replicationFactor || s.virtualNodeCount != other.virtualNodeCount ||
+		len(s.virtualNodes) != len(other.virtualNodes) || len(s.vnodeCounts) != len(other.vnodeCounts) {
+		return false
+	}
+	for node, vnodeCount := range s.vnodeCounts {
+		if otherCount, ok := other.vnodeCounts[node]; !ok || otherCount != vnodeCount {
+			return false
+		}
+	}
+	for i, vn := range s.virtualNodes {
+		otherVN := other.virtualNodes[i]
+		if vn.node != otherVN.node || vn.vnid != otherVN.vnid || !bytes.Equal(vn.Name(), otherVN.Name()) ||
+			!sameNodes(s.owners(i), other.owners(i)) {
+			return false
+		}
+	}
+	return true
+}
+
+// computeChecksum returns the checksum of the state (see HashRing.Checksum),
+// computing it on first use. The state must not be modified afterwards.
+//
+// Complexity: O( (V*N)*R ), or O( 1 ) once computed
+func (s *hashRingState) computeChecksum() [sha256.Size]byte {
+	s.checksumOnce.Do(func() {
+		d := newStateDigest(s)
+		d.putUvarint(uint64(len(s.virtualNodes)))
+		for i, vn := range s.virtualNodes {
+			d.putBytes(vn.Name())
+			d.putBytes([]byte(vn.node))
+			d.putUvarint(uint64(vn.vnid))
+			owners := s.owners(i)
+			d.putUvarint(uint64(len(owners)))
+			for _, owner := range owners {
+				d.putBytes([]byte(owner))
+			}
+		}
+		d.h.Sum(s.checksum[:0])
+	})
+	return s.checksum
+}
+
+// rehash returns a new state, with the same parameters and distinct nodes as
+// the original, but with all virtual nodes placed on the ring using the given
+// hash function instead.
+func (s *hashRingState) rehash(hashFunc func([]byte) []byte) *hashRingState {
+	newState := s.derive()
+	newState.hash = hashFunc
+	newState.hashName = ""
+	newState.streamingHash = nil
+	if s.lazyNames != nil {
+		newState.lazyNames = newLazyNames(hashFunc, s.virtualNodeKey, s.lazyNames.capacity)
+	}
+	if s.keyCache != nil {
+		newState.keyCache = newKeyCache(s.keyCache.size)
+	}
+	newState.virtualNodes = make([]*VirtualNode, 0, len(s.virtualNodes))
+	newState.vnodeCounts = make(map[Node]int, len(s.vnodeCounts))
+	newState.removedVNIDs = make(map[Node]map[uint16]struct{})
+	for _, node := range s.nodes() {
+		// The nodes are already known to be distinct; no error may
+		// occur here.
+		_, _ = newState.insertNode(node, uint16(s.vnodeCounts[node]))
+	}
+	newState.sortVirtualNodes()
+	for _, node := range s.nodes() {
+		_ = newState.removeVNIDs(node, s.sortedRemovedVNIDs(node))
+	}
+	newState.fixReplicaOwners()
+	return newState
+}
+
+// insert is a variadic method to insert an arbitrary number of nodes in the
+// hashRingState (including all nodes' virtual nodes, of course).
+//
+// In the case that any already existing distinct nodes are attempted to be
+// re-inserted, insert returns a *BatchError listing all of them, and the state
+// is left untouched. Otherwise, the state is modified as expected, and a slice
+// (unsorted) of pointers to the new virtual nodes is returned.
+func (s *hashRingState) insert(nodes ...Node) ([]*VirtualNode, error) {
+	return s.insertWeighted(1, nodes...)
+}
+
+// insertWeighted is like insert, but each one of the given nodes gets
+// weight*virtualNodeCount virtual nodes, rather than virtualNodeCount. It
+// returns a non-nil error (and the state is left untouched) if the weight is
+// not positive, or if the resulting number of virtual nodes per node would not
+// fit in a vnid.
+func (s *hashRingState) insertWeighted(weight int, nodes ...Node) ([]*VirtualNode, error) {
+	weights := make([]int, len(nodes))
+	for i := range weights {
+		weights[i] = weight
+	}
+	return s.insertBatch(nodes, weights)
+}
+
+// insertBatch inserts the given distinct nodes to the state, each one of them
+// with weights[i]*virtualNodeCount virtual nodes, sorting the virtual nodes and
+// fixing their replica owners only once for the whole batch. It returns a
+// non-nil error (and the state is left untouched) if any weight is not
+// positive or yields too many virtual nodes per node, or if the batch cannot be
+// inserted as a whole.
+func (s *hashRingState) insertBatch(nodes []Node, weights []int) ([]*VirtualNode, error) {
+	total := 0
+	for _, weight := range weights {
+		if weight < 1 {
+			return nil, fmt.Errorf("weight value %d is not positive", weight)
+		}
+		// Compare before multiplying, so that huge weights cannot
+		// overflow into a seemingly valid number of virtual nodes.
+		if weight > ((1<<16)-1)/int(s.virtualNodeCount) {
+			return nil, fmt.Errorf("weight value %d yields more than %d virtual nodes per node", weight, (1<<16)-1)
+		}
+		vnodeCount := weight * int(s.virtualNodeCount)
+		if total > math.MaxInt32-vnodeCount {
+			return nil, fmt.Errorf("batch of %d nodes yields more than %d virtual nodes", len(nodes), math.MaxInt32)
+		}
+		total += vnodeCount
+	}
+	if err := s.validateBatch(nodes, true); err != nil {
+		return nil, err
+	}
+	if err := s.checkCapacity(len(s.virtualNodes) + total); err != nil {
+		return nil, err
+	}
+	// Add all virtual nodes (for all distinct nodes) in ring's vnodes
+	// slice, while gathering all new vnodes in a slice.
+	newVnodes := make([]*VirtualNode, 0, total)
+	for i := range nodes {
+		vns, err := s.insertNode(nodes[i], uint16(weights[i]*int(s.virtualNodeCount)))
+		if err != nil {
+			return nil, err
+		}
+		newVnodes = append(newVnodes, vns...)
+	}
+	s.sortVirtualNodes()
+	s.fixReplicaOwners()
+	// The fallback node only covers for an empty ring, until its first
+	// nodes are inserted.
+	if len(newVnodes) > 0 {
+		s.fallback = ""
+	}
+
+	// Return the slice of new vnodes, unsorted.
+	return newVnodes, nil
+}
+
+// validateBatch checks whether the given batch of distinct nodes may be inserted
+// to (if inserting is set) or removed from (otherwise) the state, and returns a
+// *BatchError with one error for each problematic node, sorted by node, or nil
+// if there is none. A node that appears more than once in the batch is also
+// considered problematic, since it cannot be inserted or removed twice.
+func (s *hashRingState) validateBatch(nodes []Node, inserting bool) error {
+	seen := make(map[Node]struct{}, len(nodes))
+	problematic := make(map[Node]string)
+	for _, node := range nodes {
+		if _, duplicate := seen[node]; duplicate {
+			if _, exists := problematic[node]; !exists {
+				problematic[node] = "is repeated in the batch"
+			}
+			continue
+		}
+		seen[node] = struct{}{}
+		if inserting && s.hasNode(node) {
+			problematic[node] = "is already in the ring"
+		} else if !inserting && !s.hasNode(node) {
+			problematic[node] = "is not in the ring"
+		}
+	}
+	if len(problematic) == 0 {
+		return nil
+	}
+	sorted := make([]Node, 0, len(problematic))
+	for node := range problematic {
+		sorted = append(sorted, node)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	errs := make([]error, len(sorted))
+	for i, node := range sorted {
+		errs[i] = fmt.Errorf("node %q %s", node, problematic[node])
+	}
+	return &BatchError{Errs: errs}
+}
+
+// insertNode inserts the first vnodeCount virtual nodes of a distinct ring node
+// `node` in the state's slice of virtual nodes, and returns a slice of them, or
+// an error if the node is already in.
+//
+// Virtual nodes whose names collide with the names of other virtual nodes are
+// inserted as well; their order in the ring is resolved by vnodeLess.
+func (s *hashRingState) insertNode(node Node, vnodeCount uint16) ([]*VirtualNode, error) {
+	if s.hasNode(node) {
+		return nil, fmt.Errorf("node %q is already in the ring", node)
+	}
+	node = s.intern(node)
+	newVnodes := make([]*VirtualNode, vnodeCount)
+	for vnid := uint16(0); vnid < vnodeCount; vnid++ {
+		newVnodes[vnid] = s.insertVirtualNode(node, vnid)
+	}
+
+	// Append the new vnodes to state's slice of vnodes.
+	s.virtualNodes = append(s.virtualNodes, newVnodes...)
+	s.vnodeCounts[node] = int(vnodeCount)
+	return newVnodes, nil
+}
+
+// intern returns the canonical copy of the given node's identifier, creating
+// it if needed, if the state interns its nodes; otherwise, it returns the given
+// node as is.
+func (s *hashRingState) intern(node Node) Node {
+	if s.interned == nil {
+		return node
+	}
+	if canonical, exists := s.interned[node]; exists {
+		return canonical
+	}
+	canonical := Node(string([]byte(node)))
+	s.interned[canonical] = canonical
+	return canonical
+}
+
+// insertVirtualNode returns a ready *VirtualNode for node's virtual node with the
+// given vnid.
+func (s *hashRingState) insertVirtualNode(node Node, vnid uint16) *VirtualNode {
+	// Create a new virtual node for Node `node` and append it to the slice
+	// of new vnodes.
+	if s.lazyNames != nil {
+		return &VirtualNode{node: node, vnid: vnid, lazy: s.lazyNames}
+	}
+	newVnodeDigest := s.hash(s.virtualNodeKey(node, vnid))
+	newVnode := &VirtualNode{
+		name: newVnodeDigest[:],
+		node: node,
+		vnid: vnid,
+	}
+	return newVnode
+}
+
+// remove is a variadic method to remove an arbitrary number of nodes from the
+// hashRingState (including all nodes' virtual nodes, of course).
+//
+// If any of the nodes cannot be found in the ring, a *BatchError listing all of
+// them is returned and the state is left untouched. Otherwise the state is
+// modified as expected, and a slice (unsorted) of pointers to the removed
+// virtual nodes is returned.
+func (s *hashRingState) remove(nodes ...Node) ([]*VirtualNode, error) {
+	if err := s.validateBatch(nodes, false); err != nil {
+		return nil, err
+	}
+	// Remove all virtual nodes (of all distinct nodes) from state's vnodes
+	// slice, isolating them in a new slice.
+	removedVnodes := make([]*VirtualNode, 0, len(nodes)*int(s.virtualNodeCount))
+	for i := range nodes {
+		vns, err := s.removeNode(nodes[i])
+		if err != nil {
+			return nil, err
+		}
+		removedVnodes = append(removedVnodes, vns...)
+		s.forgetNode(nodes[i])
+	}
+	s.sortVirtualNodes()
+	s.fixReplicaOwners()
+
+	// Return the slice of the removed vnodes (unsorted).
+	return removedVnodes, nil
+}
+
+// TODO: Documentation
+//
+// removeNode removes all virtual nodes of the given distinct ring node from
+// the state, and returns a sorted slice of them.
+//
+// First, it figures out what are the indices of the virtual nodes that should
+// be removed (by calling the removeVirtualNode method for each one of them).
+// Then, it builds a new slice of virtual nodes for the state, excluding the
+// aforementioned indices.
+//
+// Complexity: O( (V*N)*log(V*N) )
+func (s *hashRingState) removeNode(node Node) ([]*VirtualNode, error) {
+	if !s.hasNode(node) {
+		return nil, fmt.Errorf("node %q is not in the ring", node)
+	}
+	vnodeCount := s.numVirtualNodes(node)
+	removedIndices := make([]int, 0, vnodeCount)
+	for vnid := uint16(0); vnid < uint16(s.vnodeCounts[node]); vnid++ {
+		if s.isRemovedVNID(node, vnid) {
+			continue
+		}
+		removedIndex, err := s.removeVirtualNode(node, vnid)
+		if err != nil {
+			return nil, err
+		}
+		removedIndices = append(removedIndices, removedIndex)
+	}
+	sort.Ints(removedIndices)
+
+	removedVnodes := make([]*VirtualNode, vnodeCount)
+	newRingVirtualNodes := make([]*VirtualNode, len(s.virtualNodes)-vnodeCount)
+	rii, nvni, ovni := 0, 0, 0
+	for ; nvni < len(newRingVirtualNodes) && rii < len(removedIndices); ovni++ {
+		if ovni == removedIndices[rii] {
+			removedVnodes[rii] = s.virtualNodes[ovni]
+			rii++
+		} else {
+			newRingVirtualNodes[nvni] = s.virtualNodes[ovni]
+			nvni++
+		}
+	}
+	if nvni == len(newRingVirtualNodes) {
+		for ; rii < len(removedIndices); rii++ {
+			removedVnodes[rii] = s.virtualNodes[removedIndices[rii]]
+		}
+	}
+	if rii == len(removedIndices) {
+		for ; nvni < len(newRingVirtualNodes); nvni, ovni = nvni+1, ovni+1 {
+			newRingVirtualNodes[nvni] = s.virtualNodes[ovni]
+		}
+	}
+	s.virtualNodes = newRingVirtualNodes
+	delete(s.vnodeCounts, node)
+	delete(s.removedVNIDs, node)
+	return removedVnodes, nil
+}
+
+// clear removes all distinct nodes (i.e. all their virtual nodes) from the
+// state, preserving its configuration, and returns the removed virtual nodes
+// (sorted).
+func (s *hashRingState) clear() []*VirtualNode {
+	for node := range s.vnodeCounts {
+		s.forgetNode(node)
+	}
+	removedVnodes := s.virtualNodes
+	s.virtualNodes = make([]*VirtualNode, 0)
+	s.vnodeCounts = make(map[Node]int)
+	s.removedVNIDs = make(map[Node]map[uint16]struct{})
+	s.fixReplicaOwners()
+	return removedVnodes
+}
+
+// forgetNode clears everything that the state tracks about the given distinct
+// node, besides its virtual nodes, once it is no longer a member of the state.
+func (s *hashRingState) forgetNode(node Node) {
+	delete(s.draining, node)
+	delete(s.joinWeights, node)
+	delete(s.readExcluded, node)
+	delete(s.down, node)
+	delete(s.interned, node)
+	delete(s.meta, node)
+	delete(s.values, node)
+}
+
+// removeVirtualNodeAt removes the virtual node at the given index from state's
+// slice of virtual nodes, and returns it. The slice of virtual nodes remains
+// sorted, but the caller is responsible for fixing the replica owners.
+//
+// Unless the removed virtual node has the highest vnid of its distinct node,
+// its vnid is recorded in removedVNIDs. If it is the last one of its distinct
+// node, the distinct node is no longer considered a member of the state.
+func (s *hashRingState) removeVirtualNodeAt(i int) *VirtualNode {
+	removed := s.virtualNodes[i]
+	node := removed.node
+	if int(removed.vnid) == s.vnodeCounts[node]-1 {
+		// Shrink the range of vnids past any vnids that have already
+		// been removed individually, so that the highest vnid is never
+		// among them.
+		for s.vnodeCounts[node]--; s.vnodeCounts[node] > 0 && s.isRemovedVNID(node, uint16(s.vnodeCounts[node]-1)); s.vnodeCounts[node]-- {
+			delete(s.removedVNIDs[node], uint16(s.vnodeCounts[node]-1))
+		}
+		if len(s.removedVNIDs[node]) == 0 {
+			delete(s.removedVNIDs, node)
+		}
+	} else {
+		if s.removedVNIDs[node] == nil {
+			s.removedVNIDs[node] = make(map[uint16]struct{})
+		}
+		s.removedVNIDs[node][removed.vnid] = struct{}{}
+	}
+	if s.vnodeCounts[node] == 0 {
+		delete(s.vnodeCounts, node)
+		delete(s.removedVNIDs, node)
+		s.forgetNode(node)
+	}
+	newRingVirtualNodes := make([]*VirtualNode, 0, len(s.virtualNodes)-1)
+	newRingVirtualNodes = append(newRingVirtualNodes, s.virtualNodes[:i]...)
+	s.virtualNodes = append(newRingVirtualNodes, s.virtualNodes[i+1:]...)
+	return removed
+}
+
+// removeVirtualNode returns the index of state's slice of virtual nodes which
+// refers to the virtual node that is specified by the given node and vnid, or
+// an error if the virtual node does not exist.
+func (s *hashRingState) removeVirtualNode(node Node, vnid uint16) (int, error) {
+	digest := s.hash(s.virtualNodeKey(node, vnid))
+	i := sort.Search(len(s.virtualNodes), func(j int) bool {
+		if s.compareNames(s.virtualNodes[j].Name(), digest[:]) == -1 {
+			return false
+		}
+		return true
+	})
+	// Skip any other virtual nodes whose names collide with the digest.
+	for ; i < len(s.virtualNodes) && s.compareNames(s.virtualNodes[i].Name(), digest[:]) == 0; i++ {
+		if s.virtualNodes[i].node == node && s.virtualNodes[i].vnid == vnid {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("virtual node {%x (%s, %d)} is not in the ring", digest, node, vnid)
+}
+
+// removeVNIDs removes the virtual nodes of the given distinct node with the
+// given vnids from the state, e.g. to restore the virtual nodes that had been
+// removed individually from a saved state. The caller is responsible for fixing
+// the replica owners.
+func (s *hashRingState) removeVNIDs(node Node, vnids []uint16) error {
+	for _, vnid := range vnids {
+		i, err := s.removeVirtualNode(node, vnid)
+		if err != nil {
+			return err
+		}
+		s.removeVirtualNodeAt(i)
+	}
+	return nil
+}
+
+// sortedRemovedVNIDs returns the vnids of the virtual nodes of the given
+// distinct node that have been removed individually, sorted, or nil if there
+// are none.
+func (s *hashRingState) sortedRemovedVNIDs(node Node) []uint16 {
+	if len(s.removedVNIDs[node]) == 0 {
+		return nil
+	}
+	ret := make([]uint16, 0, len(s.removedVNIDs[node]))
+	for vnid := range s.removedVNIDs[node] {
+		ret = append(ret, vnid)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// removeVirtualNodesByName removes all virtual nodes with the given names from
+// the state, and returns them (unsorted). Removing the last virtual node of a
+// distinct node removes the distinct node from the state altogether.
+//
+// The replica owners of the state must be up to date beforehand (e.g. through
+// inheritReplicaOwners); only those of the virtual nodes that are affected by
+// the removal are recomputed, unless they are computed by a walk other than the
+// plain one of computeOwners (e.g. due to a rack constraint), in which case all
+// of them are.
+//
+// If any of the names cannot be found in the ring (or a name appears more than
+// once in the batch), a *BatchError listing all of them (sorted) is returned
+// and the state is left untouched.
+func (s *hashRingState) removeVirtualNodesByName(names [][]byte) ([]*VirtualNode, error) {
+	seen := make(map[string]struct{}, len(names))
+	problematic := make(map[string]string)
+	for _, name := range names {
+		if _, duplicate := seen[string(name)]; duplicate {
+			if _, exists := problematic[string(name)]; !exists {
+				problematic[string(name)] = "is repeated in the batch"
+			}
+			continue
+		}
+		seen[string(name)] = struct{}{}
+		if !s.hasVirtualNode(name) {
+			problematic[string(name)] = "is not in the ring"
+		}
+	}
+	if len(problematic) > 0 {
+		sorted := make([]string, 0, len(problematic))
+		for name := range problematic {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+		errs := make([]error, len(sorted))
+		for i, name := range sorted {
+			errs[i] = fmt.Errorf("virtual node %x %s", name, problematic[name])
+		}
+		return nil, &BatchError{Errs: errs}
+	}
+
+	local := len(s.replicaOwners) == len(s.virtualNodes) && !s.duplicateOwners && s.rackOf == nil && len(s.joinWeights) == 0
+	var isRemoved, isAffected []bool
+	if local {
+		isRemoved, isAffected = s.affectedByRemoval(names)
+	}
+
+	removed := make([]*VirtualNode, 0, len(names))
+	for _, name := range names {
+		// Remove any virtual nodes whose names collide as well.
+		for i := s.search(name); len(s.virtualNodes) > 0 && s.compareNames(s.virtualNodes[i].Name(), name) == 0; {
+			removed = append(removed, s.removeVirtualNodeAt(i))
+			if i == len(s.virtualNodes) {
+				break
+			}
+		}
+	}
+	if !local {
+		s.fixReplicaOwners()
+		return removed, nil
+	}
+
+	// The remaining virtual nodes keep their relative order, so the k-th
+	// one of them used to be at index j.
+	oldOwners := s.replicaOwners
+	s.replicaOwners = make([][]Node, 0, len(s.virtualNodes))
+	for j := range isRemoved {
+		if isRemoved[j] {
+			continue
+		}
+		if k := len(s.replicaOwners); isAffected[j] {
+			s.replicaOwners = append(s.replicaOwners, s.computeOwners(k))
+		} else {
+			s.replicaOwners = append(s.replicaOwners, oldOwners[j])
+		}
+	}
+	return removed, nil
+}
+
+// affectedByRemoval marks (by their indices in state's slice of virtual nodes)
+// the virtual nodes with the given names, which are about to be removed, as
+// well as the ones whose replica owners depend on them, i.e. those of the
+// preceding run of virtual nodes whose clockwise walks (see computeOwners)
+// reach any of the removed ones before coming across replicationFactor
+// distinct nodes. The replica owners of the rest are not affected.
+func (s *hashRingState) affectedByRemoval(names [][]byte) ([]bool, []bool) {
+	n := len(s.virtualNodes)
+	isRemoved := make([]bool, n)
+	isAffected := make([]bool, n)
+	for _, name := range names {
+		for i := s.search(name); i < n && !isRemoved[i] && s.compareNames(s.virtualNodes[i].Name(), name) == 0; i++ {
+			isRemoved[i] = true
+		}
+	}
+	for i := range isRemoved {
+		if !isRemoved[i] {
+			continue
+		}
+		// Walk counterclockwise, gathering the distinct nodes that a
+		// walk from j meets before reaching i.
+		seen := make(map[Node]struct{}, s.replicationFactor)
+		for j, steps := (i+n-1)%n, 1; steps < n; j, steps = (j+n-1)%n, steps+1 {
+			seen[s.virtualNodes[j].node] = struct{}{}
+			if len(seen) >= int(s.replicationFactor) {
+				break
+			}
+			isAffected[j] = true
+		}
+	}
+	return isRemoved, isAffected
+}
+
+// virtualNodesOf returns the virtual nodes of the given distinct node, in the
+// order in which they appear in state's slice of virtual nodes, or an empty
+// slice if the node is not a member of the state.
+func (s *hashRingState) virtualNodesOf(node Node) []*VirtualNode {
+	vnodeCount := s.vnodeCounts[node]
+	indices := make([]int, 0, vnodeCount)
+	for vnid := 0; vnid < vnodeCount; vnid++ {
+		// The vnids of the node are always in [0, vnodeCount).
+		if i, err := s.removeVirtualNode(node, uint16(vnid)); err == nil {
+			indices = append(indices, i)
+		}
+	}
+	sort.Ints(indices)
+	ret := make([]*VirtualNode, len(indices))
+	for j, i := range indices {
+		ret[j] = s.virtualNodes[i]
+	}
+	return ret
+}
+
+// sortVirtualNodes sorts state's slice of virtual nodes by their names.
+func (s *hashRingState) sortVirtualNodes() {
+	sort.Slice(s.virtualNodes, func(i, j int) bool {
+		return s.vnodeLess(s.virtualNodes[i], s.virtualNodes[j])
+	})
+}
+
+// vnodeLess returns true if virtual node a precedes virtual node b in the ring,
+// i.e. if its name is less than b's. Virtual nodes with colliding names are
+// ordered by the digests of the state's tie-break hash function (if any) of
+// their distinct nodes and vnids, and, failing that, deterministically by
+// their distinct nodes and vnids themselves.
+func (s *hashRingState) vnodeLess(a, b *VirtualNode) bool {
+	switch s.compareNames(a.Name(), b.Name()) {
+	case -1:
+		return true
+	case 1:
+		return false
+	}
+	if s.tieBreakHash != nil {
+		switch bytes.Compare(
+			s.tieBreakHash(s.virtualNodeKey(a.node, a.vnid)),
+			s.tieBreakHash(s.virtualNodeKey(b.node, b.vnid)),
+		) {
+		case -1:
+			return true
+		case 1:
+			return false
+		}
+	}
+	if a.node != b.node {
+		return a.node < b.node
+	}
+	return a.vnid < b.vnid
+}
+
+// compareNames compares the given names (or keys) through the comparator of
+// the state, returning -1, 0 or +1, just like bytes.Compare, whatever the
+// magnitude of the comparator's result.
+func (s *hashRingState) compareNames(a, b []byte) int {
+	if s.compare == nil {
+		return bytes.Compare(a, b)
+	}
+	switch c := s.compare(a, b); {
+	case c < 0:
+		return -1
+	case c > 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// checkComparator returns a non-nil error if the given comparator of names is
+// found inconsistent (i.e. not reflexive, antisymmetric and transitive) on a
+// few probe names, produced by the given hash function.
+func checkComparator(compare func(a, b []byte) int, hashFunc func([]byte) []byte) error {
+	sign := func(c int) int {
+		switch {
+		case c < 0:
+			return -1
+		case c > 0:
+			return 1
+		default:
+			return 0
+		}
+	}
+	probes := make([][]byte, 8)
+	for i := range probes {
+		probes[i] = hashFunc([]byte(fmt.Sprintf("lfchring-%d", i)))
+	}
+	for _, a := range probes {
+		if compare(a, a) != 0 {
+			return fmt.Errorf("comparator does not find %x equal to itself", a)
+		}
+		for _, b := range probes {
+			ab := sign(compare(a, b))
+			if ab != -sign(compare(b, a)) {
+				return fmt.Errorf("comparator is not antisymmetric on %x and %x", a, b)
+			}
+			for _, c := range probes {
+				if ab <= 0 && compare(b, c) <= 0 && compare(a, c) > 0 {
+					return fmt.Errorf("comparator is not transitive on %x, %x and %x", a, b, c)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkCapacity returns a non-nil error if the keyspace of the state is too
+// small to accommodate the given number of virtual nodes, i.e. if they would
+// occupy more than 1/keyspaceMinSlack of all distinct positions in it; beyond
+// that point, collisions of virtual nodes become pervasive and the ring is
+// hopelessly unbalanced.
+func (s *hashRingState) checkCapacity(vnodes int) error {
+	width := s.keyWidth()
+	if width >= 8 {
+		return nil // the ring could not fit in memory anyway
+	}
+	if capacity := (1 << uint(8*width)) / keyspaceMinSlack; vnodes > capacity {
+		return fmt.Errorf("%d virtual nodes exceed the capacity (%d) of the keyspace of %d-byte hash outputs; "+
+			"use a hash function with longer outputs, or fewer virtual nodes", vnodes, capacity, width)
+	}
+	return nil
+}
+
+// fixReplicaOwners creates state's replicaOwners (the slice of replica-owner
+// distinct ring nodes of each virtual node) anew, to re-adjust it after the
+// addition or the removal of one or more distinct ring nodes.
+//
+// If the state has been configured to do without the replica owners,
+// fixReplicaOwners is a no-op, since they are computed on demand instead.
+func (s *hashRingState) fixReplicaOwners() {
+	if s.withoutReplicaOwners {
+		return
+	}
+	s.replicaOwners = make([][]Node, len(s.virtualNodes))
+	for i := 0; i < len(s.virtualNodes); i++ {
+		s.replicaOwners[i] = s.computeOwners(i)
+	}
+}
+
+// inheritReplicaOwners sets the replica owners of the state, which has just
+// been derived from the given one through changes that do not affect them (e.g.
+// of nodes' metadata), to those of the given state, instead of recomputing them
+// through fixReplicaOwners. The owners of each virtual node are shared, since
+// they are never modified.
+func (s *hashRingState) inheritReplicaOwners(from *hashRingState) {
+	if from.replicaOwners == nil {
+		return
+	}
+	s.replicaOwners = make([][]Node, len(from.replicaOwners))
+	copy(s.replicaOwners, from.replicaOwners)
+}
+
+// computeOwners walks the ring clockwise, starting from the virtual node at
+// index i of state's slice of virtual nodes, and returns the first
+// replicationFactor distinct nodes it comes across (or less, if the ring does
+// not consist of that many distinct nodes).
+func (s *hashRingState) computeOwners(i int) []Node {
+	if s.duplicateOwners {
+		return s.computeDuplicateOwners(i)
+	}
+	if s.rackOf != nil {
+		return s.computeRackAwareOwners(i)
+	}
+	if len(s.joinWeights) > 0 {
+		return s.computeJoinWeightedOwners(i)
+	}
+	owners := make([]Node, s.replicationFactor)
+	owners[0] = s.virtualNodes[i].node
+
+	j := i                       // j: index i --> len(s.virtualNodes) --> 0 --> i-1
+	k := s.replicationFactor - 1 // k: # of subsequent nodes remaining to be found
+	for k > 0 {
+		// Get j, the next index in state's vnodes slice.
+		j = (j + 1) % len(s.virtualNodes)
+		// If cycle, break. even if k > 0; it means that s.replicationFactor > # of nodes.
+		if j == i {
+			break
+		}
+		currNode := s.virtualNodes[j].node // the node we are on for this `i`'s (index `j`-)traversal
+		nodePresent := false               // flag to raise if currNode is already in owners
+		// As we want distinct nodes only in owners, make sure currNode is not already in.
+		for _, l := range owners {
+			if currNode == l {
+				nodePresent = true
+				break
+			}
+		}
+		// If currNode is not already in, get it in, and decrease # of nodes remaining to be found.
+		if !nodePresent {
+			owners[s.replicationFactor-k] = currNode
+			k--
+		}
+	}
+	// If cycled above, set slice's length so as to address the useful values only:
+	if j == i {
+		owners = owners[:s.replicationFactor-k]
+		// NOTE: There is a memory leak: the amount of memory that is allocated for the
+		// slice of every vnode in s.replicaOwners is more than the required amount when
+		// such cycles happen (i.e. when replicationFactor > number of distinct nodes).
+		// To fix this, allocate a temp slice as make([]Node, 1, s.replicationFactor)
+		// and immediately fill it with the distinct Node that the vnode belongs to,
+		// then append any extra Nodes found, and in the end, allocate a new slice of
+		// capacity equal to temp slice's *length*, and copy(newSlice, temp).
+		// This, however, would result in lower performance (more allocations) in my
+		// own average use cases (that replicationFactor <= number of distinct nodes),
+		// so I'm not interested in changing it for now.
+	}
+	return owners
+}
+
+// computeRackAwareOwners is like computeOwners, but for states with a rack
+// constraint: while walking the ring clockwise, it skips any distinct node
+// whose rack is already covered, if accepting it would leave too few replicas
+// for the remaining of the minRacks racks to be covered. If the ring runs out
+// of distinct nodes before all replicas have been placed, the skipped nodes are
+// used (in clockwise order) to fill in the rest of the replicas.
+func (s *hashRingState) computeRackAwareOwners(i int) []Node {
+	rf := int(s.replicationFactor)
+	owners := make([]Node, 1, rf)
+	owners[0] = s.virtualNodes[i].node
+	racks := map[string]struct{}{s.rackOf(owners[0]): {}}
+	seen := map[Node]struct{}{owners[0]: {}}
+	skipped := make([]Node, 0)
+	for j := (i + 1) % len(s.virtualNodes); len(owners) < rf && j != i; j = (j + 1) % len(s.virtualNodes) {
+		currNode := s.virtualNodes[j].node
+		if _, exists := seen[currNode]; exists {
+			continue
+		}
+		seen[currNode] = struct{}{}
+		rack := s.rackOf(currNode)
+		if _, covered := racks[rack]; covered && rf-len(owners)-1 < s.minRacks-len(racks) {
+			skipped = append(skipped, currNode)
+			continue
+		}
+		racks[rack] = struct{}{}
+		owners = append(owners, currNode)
+	}
+	for k := 0; len(owners) < rf && k < len(skipped); k++ {
+		owners = append(owners, skipped[k])
+	}
+	return owners
+}
+
+// computeDuplicateOwners is like computeOwners, but for states that allow
+// duplicate owners: it returns the distinct nodes of the (up to)
+// replicationFactor virtual nodes clockwise of (and including) the virtual
+// node at index i, including any duplicates.
+func (s *hashRingState) computeDuplicateOwners(i int) []Node {
+	n := int(s.replicationFactor)
+	if n > len(s.virtualNodes) {
+		n = len(s.virtualNodes)
+	}
+	owners := make([]Node, n)
+	for k := range owners {
+		owners[k] = s.virtualNodes[(i+k)%len(s.virtualNodes)].node
+	}
+	return owners
+}
+
+// computeJoinWeightedOwners is like computeOwners, but for states with joining
+// nodes: while walking the ring clockwise, starting from (and including) the
+// virtual node at index i, each joining node is only accepted as a replica
+// owner with probability equal to its join weight, as decided deterministically
+// by joinAccepts. If the ring runs out of distinct nodes before all replicas
+// have been placed, the rejected nodes are used (in clockwise order) to fill in
+// the rest of the replicas.
+func (s *hashRingState) computeJoinWeightedOwners(i int) []Node {
+	rf := int(s.replicationFactor)
+	owners := make([]Node, 0, rf)
+	seen := make(map[Node]struct{}, rf)
+	rejected := make([]Node, 0)
+	vn := s.virtualNodes[i]
+	for j := i; len(owners) < rf; {
+		currNode := s.virtualNodes[j].node
+		if _, exists := seen[currNode]; !exists {
+			seen[currNode] = struct{}{}
+			if w, isJoining := s.joinWeights[currNode]; isJoining && !joinAccepts(vn, currNode, w) {
+				rejected = append(rejected, currNode)
+			} else {
+				owners = append(owners, currNode)
+			}
+		}
+		if j = (j + 1) % len(s.virtualNodes); j == i {
+			break
+		}
+	}
+	for k := 0; len(owners) < rf && k < len(rejected); k++ {
+		owners = append(owners, rejected[k])
+	}
+	return owners
+}
+
+// joinAccepts decides whether the given joining node, of the given join weight,
+// is accepted as a replica owner of the keys of the given virtual node. The
+// decision is pseudo-random, yet deterministic, so that raising the join weight
+// of a node only ever adds to the virtual nodes that it is accepted for.
+func joinAccepts(vn *VirtualNode, node Node, w float64) bool {
+	h := fnv.New64a()
+	h.Write(vn.Name())
+	h.Write([]byte(node))
+	return float64(h.Sum64()>>11)/(1<<53) < w
+}
+
+// setJoinWeight sets the join weight of the given distinct node. It returns a
+// non-nil error if the node is not a member of the ring, if the join weight is
+// not in [0, 1], or if the state has a rack constraint or allows duplicate
+// owners.
+func (s *hashRingState) setJoinWeight(node Node, w float64) error {
+	if !s.hasNode(node) {
+		return fmt.Errorf("node %q is not in the ring", node)
+	}
+	if !(w >= 0 && w <= 1) {
+		return fmt.Errorf("join weight value %v not in [0, 1]", w)
+	}
+	if s.rackOf != nil {
+		return fmt.Errorf("join weights cannot be combined with a rack constraint")
+	}
+	if s.duplicateOwners {
+		return fmt.Errorf("join weights cannot be combined with duplicate owners")
+	}
+	if w == 1 {
+		delete(s.joinWeights, node)
+	} else {
+		s.joinWeights[node] = w
+	}
+	return nil
+}
+
+// owners returns the replica owners of the virtual node at index i of state's
+// slice of virtual nodes, either by looking them up in state's replicaOwners,
+// or by computing them on demand if the state lacks them.
+func (s *hashRingState) owners(i int) []Node {
+	if s.withoutReplicaOwners {
+		return s.computeOwners(i)
+	}
+	return s.replicaOwners[i]
+}
+
+// primaryOwner returns the primary owner of the keys of the virtual node at
+// index i of state's slice of virtual nodes, i.e. the first one of its replica
+// owners. It is the virtual node's own distinct node, unless the latter is
+// still joining the ring and has not been accepted for it (see joinAccepts).
+func (s *hashRingState) primaryOwner(i int) Node {
+	if len(s.joinWeights) == 0 {
+		return s.virtualNodes[i].node
+	}
+	return s.owners(i)[0]
+}
+
+// validate checks the consistency of the state, returning a non-nil error that
+// describes the first inconsistency found, if any.
+func (s *hashRingState) validate() error {
+	if err := s.validateVirtualNodes(); err != nil {
+		return err
+	}
+	if !s.withoutReplicaOwners && len(s.replicaOwners) != len(s.virtualNodes) {
+		return fmt.Errorf("found replica owners for %d virtual nodes; expected %d", len(s.replicaOwners), len(s.virtualNodes))
+	}
+
+	expectedOwners := int(s.replicationFactor)
+	if s.size() < expectedOwners && !s.duplicateOwners {
+		expectedOwners = s.size()
+	} else if len(s.virtualNodes) < expectedOwners && s.duplicateOwners {
+		expectedOwners = len(s.virtualNodes)
+	}
+	for i, vn := range s.virtualNodes {
+		owners := s.owners(i)
+		if !sameNodes(owners, s.computeOwners(i)) {
+			return fmt.Errorf("replica owners %q of virtual node %s are stale", owners, vn)
+		}
+		if len(owners) != expectedOwners || (owners[0] != vn.node && len(s.joinWeights) == 0) {
+			return fmt.Errorf("invalid replica owners %q of virtual node %s", owners, vn)
+		}
+		if s.rackOf == nil {
+			continue
+		}
+		racks := make(map[string]struct{}, len(owners))
+		for _, owner := range owners {
+			racks[s.rackOf(owner)] = struct{}{}
+		}
+		if len(racks) < s.minRacks {
+			return fmt.Errorf("replica owners %q of virtual node %s span %d racks; expected at least %d", owners, vn, len(racks), s.minRacks)
+		}
+	}
+	return nil
+}
+
+// warnings returns descriptions of the conditions under which the state
+// cannot satisfy its configuration, or nil if there are none.
+func (s *hashRingState) warnings() []string {
+	var ret []string
+	rf := int(s.replicationFactor)
+	switch size := s.size(); {
+	case size == 0:
+		if s.fallback == "" {
+			return []string{"ring is empty; keys have no replica owners"}
+		}
+		return []string{fmt.Sprintf("ring is empty; all keys are assigned to fallback node %q", s.fallback)}
+	case size < rf:
+		ret = append(ret, fmt.Sprintf("replication factor %d exceeds the %d distinct nodes of the ring", rf, size))
+	case size == rf && rf > 1:
+		ret = append(ret, fmt.Sprintf("ring consists of exactly %d distinct nodes; removing any of them would leave fewer than the replication factor", size))
+	}
+	if n := len(s.readExcluded); n > 0 && s.size()-n < rf {
+		ret = append(ret, fmt.Sprintf("only %d distinct nodes are not excluded from reads; reads cannot reach %d replicas", s.size()-n, rf))
+	}
+
+	if s.rackOf != nil {
+		allRacks := make(map[string]struct{})
+		for node := range s.vnodeCounts {
+			allRacks[s.rackOf(node)] = struct{}{}
+		}
+		if len(allRacks) < s.minRacks {
+			ret = append(ret, fmt.Sprintf("ring spans %d racks; rack constraint requires %d", len(allRacks), s.minRacks))
+		}
+	}
+	var tooFewRacks, duplicates int
+	for i := range s.virtualNodes {
+		owners := s.owners(i)
+		if s.rackOf != nil {
+			racks := make(map[string]struct{}, len(owners))
+			for _, owner := range owners {
+				racks[s.rackOf(owner)] = struct{}{}
+			}
+			if len(racks) < s.minRacks {
+				tooFewRacks++
+			}
+		}
+		if s.duplicateOwners {
+			distinct := make(map[Node]struct{}, len(owners))
+			for _, owner := range owners {
+				distinct[owner] = struct{}{}
+			}
+			if len(distinct) < len(owners) && len(distinct) < s.size() {
+				duplicates++
+			}
+		}
+	}
+	if tooFewRacks > 0 {
+		ret = append(ret, fmt.Sprintf("replica owners of %d of %d arcs span fewer than %d racks", tooFewRacks, len(s.virtualNodes), s.minRacks))
+	}
+	if duplicates > 0 {
+		ret = append(ret, fmt.Sprintf("replica owners of %d of %d arcs include duplicate nodes", duplicates, len(s.virtualNodes)))
+	}
+	return ret
+}
+
+// validateVirtualNodes checks that the virtual nodes of the state are sorted,
+// and that they agree with the numbers of virtual nodes of the distinct nodes,
+// returning a non-nil error that describes the first inconsistency found, if
+// any.
+func (s *hashRingState) validateVirtualNodes() error {
+	vnodeCounts := make(map[Node]int, len(s.vnodeCounts))
+	for i, vn := range s.virtualNodes {
+		if i > 0 && !s.vnodeLess(s.virtualNodes[i-1], vn) {
+			return fmt.Errorf("virtual nodes %s and %s are out of order", s.virtualNodes[i-1], vn)
+		}
+		vnodeCounts[vn.node]++
+	}
+	if len(vnodeCounts) != len(s.vnodeCounts) {
+		return fmt.Errorf("found %d distinct nodes; expected %d", len(vnodeCounts), len(s.vnodeCounts))
+	}
+	for node, count := range vnodeCounts {
+		if s.numVirtualNodes(node) != count {
+			return fmt.Errorf("found %d virtual nodes of node %q; expected %d", count, node, s.numVirtualNodes(node))
+		}
+	}
+	for _, vn := range s.virtualNodes {
+		if int(vn.vnid) >= s.vnodeCounts[vn.node] || s.isRemovedVNID(vn.node, vn.vnid) {
+			return fmt.Errorf("virtual node %s should not be in the ring", vn)
+		}
+	}
+	return nil
+}
 
-	// virtualNodes is a sorted slice of pointers to VirtualNode structs,
-	// which correspond to each of the virtual nodes of all distinct nodes
-	// that are members of the ring in its current state.
-	virtualNodes []*VirtualNode
+// search returns the index of the virtual node (in state's sorted slice of
+// virtual nodes) that the given key would be assigned to, i.e. the first one
+// whose name is greater than or equal to the key, wrapping around to the first
+// virtual node of the ring if there is none.
+//
+// Keys that are greater than the names of all virtual nodes (e.g. the maximum
+// key of the keyspace, unless a virtual node happens to be named after it)
+// wrap around; see also HashRing.WrapsAround.
+func (s *hashRingState) search(key []byte) int {
+	index := sort.Search(len(s.virtualNodes), func(j int) bool {
+		if s.compareNames(s.virtualNodes[j].Name(), key) == -1 {
+			return false
+		}
+		return true
+	})
+	if index == len(s.virtualNodes) {
+		index = 0
+	}
+	return index
+}
 
-	// replicaOwners maps each virtual node to a set of distinct nodes that
-	// are members of the ring in its current state, and which should own
-	// replicas of that virtual node's keys in this state.
-	replicaOwners map[*VirtualNode][]Node
+// lowerBound returns the index of the first virtual node in state's slice of
+// virtual nodes whose name is greater than or equal to the given key, or the
+// length of the slice if there is none (i.e. unlike search, it does not wrap).
+func (s *hashRingState) lowerBound(key []byte) int {
+	return sort.Search(len(s.virtualNodes), func(j int) bool {
+		return s.compareNames(s.virtualNodes[j].Name(), key) >= 0
+	})
 }
 
-// TODO: Documentation
-func (s *hashRingState) derive() *hashRingState {
-	// Deep copy the slice of virtual nodes.
-	newVNs := make([]*VirtualNode, len(s.virtualNodes))
-	for i := range s.virtualNodes {
-		newVNs[i] = &VirtualNode{
-			name: s.virtualNodes[i].name,
-			node: s.virtualNodes[i].node,
-			vnid: s.virtualNodes[i].vnid,
-		}
+// virtualNodesInRange returns the virtual nodes of the state whose names fall
+// in [start, end), wrapping around the end of the keyspace if start is greater
+// than end; see HashRing.VirtualNodesInRange.
+func (s *hashRingState) virtualNodesInRange(start, end []byte) []*VirtualNode {
+	ret := make([]*VirtualNode, 0)
+	lo, hi := s.lowerBound(start), s.lowerBound(end)
+	switch s.compareNames(start, end) {
+	case -1:
+		ret = append(ret, s.virtualNodes[lo:hi]...)
+	case 1:
+		ret = append(ret, s.virtualNodes[lo:]...)
+		ret = append(ret, s.virtualNodes[:hi]...)
 	}
-	// Initialize a new map of replica owners, **EMPTY, to be filled by
-	// the caller** when needed. XXX
-	newROs := make(map[*VirtualNode][]Node)
+	return ret
+}
 
-	return &hashRingState{
-		hash:              s.hash,
-		replicationFactor: s.replicationFactor,
-		virtualNodeCount:  s.virtualNodeCount,
-		virtualNodes:      newVNs,
-		replicaOwners:     newROs,
+// TODO: Documentation
+func (s *hashRingState) virtualNodeForKey(key []byte) *VirtualNode {
+	if len(s.virtualNodes) == 0 {
+		return nil
 	}
+	return s.virtualNodes[s.search(key)]
 }
 
 // TODO: Documentation
-func (s *hashRingState) size() int {
-	return len(s.virtualNodes) / int(s.virtualNodeCount)
+func (s *hashRingState) nodesForKey(key []byte) []Node {
+	if len(s.virtualNodes) == 0 {
+		return nil
+	}
+	return s.owners(s.search(key))
 }
 
-// insert is a variadic method to insert an arbitrary number of nodes in the
-// hashRingState (including all nodes' virtual nodes, of course).
-//
-// In the case that an already existing distinct node is attempted to be
-// re-inserted, insert returns a non-nil error value and the state is left
-// untouched. Otherwise, the state is modified as expected, and a slice
-// (unsorted) of pointers to the new virtual nodes is returned.
-func (s *hashRingState) insert(nodes ...Node) ([]*VirtualNode, error) {
-	// Add all virtual nodes (for all distinct nodes) in ring's vnodes
-	// slice, while gathering all new vnodes in a slice.
-	newVnodes := make([]*VirtualNode, len(nodes)*int(s.virtualNodeCount))
-	for i := range nodes {
-		vns, err := s.insertNode(nodes[i])
-		if err != nil {
-			return nil, err
+// nodesForKeyBounded returns the first (up to replicationFactor) distinct
+// nodes clockwise of the given key whose loads are below capacity times the
+// average load, followed by the saturated ones (least loaded first) if there
+// are too few of them. While the state is empty, it returns the fallback node
+// (if any) alone, regardless of its load.
+func (s *hashRingState) nodesForKeyBounded(key []byte, loads map[Node]int, capacity float64) []Node {
+	if len(s.virtualNodes) == 0 {
+		if s.fallback != "" {
+			return []Node{s.fallback}
 		}
-		copy(newVnodes[i*len(vns):(i+1)*len(vns)], vns)
+		return nil
 	}
-	// Sort state's vnodes slice.
-	sort.Slice(s.virtualNodes, func(i, j int) bool {
-		if bytes.Compare(s.virtualNodes[i].name, s.virtualNodes[j].name) < 0 {
+	total := 0
+	for node := range s.vnodeCounts {
+		total += loads[node]
+	}
+	threshold := capacity * float64(total+1) / float64(s.size())
+	// The saturated nodes are gathered in clockwise order; if the walk
+	// stops short of the replication factor, it has covered the whole ring.
+	var saturated []Node
+	ret := s.nodesForKeyWithCapacity(key, func(node Node) bool {
+		if float64(loads[node]) >= threshold {
+			saturated = append(saturated, node)
 			return true
 		}
 		return false
 	})
-	s.fixReplicaOwners()
+	if len(ret) < int(s.replicationFactor) && len(saturated) > 0 {
+		sort.SliceStable(saturated, func(i, j int) bool { return loads[saturated[i]] < loads[saturated[j]] })
+		for _, node := range saturated {
+			if len(ret) == int(s.replicationFactor) {
+				break
+			}
+			ret = append(ret, node)
+		}
+	}
+	return ret
+}
 
-	// Return the slice of new vnodes, unsorted.
-	return newVnodes, nil
+// nodesForKeyExcluding returns the first (up to replicationFactor) distinct
+// nodes clockwise of the given key that are not among the excluded ones.
+func (s *hashRingState) nodesForKeyExcluding(key []byte, excluded []Node) []Node {
+	return s.nodesForKeyWithCapacity(key, func(node Node) bool {
+		for _, ex := range excluded {
+			if node == ex {
+				return true
+			}
+		}
+		return false
+	})
 }
 
-// insertNode inserts all virtual nodes of a distinct ring node `node` in the
-// state's slice of virtual nodes, and returns a sorted slice of them, or an
-// error if the node seems to be already in.
-//
-// To decide whether the node is already in the ring or not, it is checked
-// whether one of the new virtual nodes (vnid 0, hence random order) is already
-// in or not, before appending all of them to the state's slice of virtual
-// nodes.
-//
-// In the extremely unlikely case of a conflict, insertNode has low chances of
-// uncovering it, especially as virtualNodeCount or the size of the ring get
-// bigger.
-func (s *hashRingState) insertNode(node Node) ([]*VirtualNode, error) {
-	newVnodes := make([]*VirtualNode, s.virtualNodeCount)
-	for vnid := uint16(0); vnid < s.virtualNodeCount; vnid++ {
-		newVnodes[vnid] = s.insertVirtualNode(node, vnid)
+// readNodesForKey is like nodesForKey, but for keys that are looked up for
+// reading: it returns the fallback node (if any) while the state is empty, and
+// it replaces any nodes that are excluded from reads. It returns nil if the
+// state is empty and there is no fallback node.
+func (s *hashRingState) readNodesForKey(key []byte) []Node {
+	if len(s.virtualNodes) == 0 {
+		if s.fallback != "" {
+			return []Node{s.fallback}
+		}
+		return nil
 	}
+	return s.readOwners(s.search(key))
+}
 
-	// Check whether the distinct node is already in the ring, by checking
-	// if the first virtual node in the slice of the new ones (which lie in
-	// random order) is already in state's vnodes slice.
-	i := sort.Search(len(s.virtualNodes), func(j int) bool {
-		if bytes.Compare(s.virtualNodes[j].name, newVnodes[0].name) == -1 {
-			return false
-		}
-		return true
+// readOwners is like owners, but for reading: it replaces any nodes that are
+// excluded from reads by the next distinct nodes clockwise.
+func (s *hashRingState) readOwners(i int) []Node {
+	if len(s.readExcluded) == 0 {
+		return s.owners(i)
+	}
+	return s.ownersSkipping(i, func(node Node) bool {
+		_, isExcluded := s.readExcluded[node]
+		return isExcluded
 	})
-	if i < len(s.virtualNodes) && bytes.Compare(s.virtualNodes[i].name, newVnodes[0].name) == 0 {
-		return nil, fmt.Errorf("virtual node {%s} is already in the ring", newVnodes[0])
+}
+
+// virtualNodesForKey returns the virtual nodes that the replica owners of the
+// given key (as returned by readNodesForKey) have been selected through, i.e.
+// the first virtual node of each one of them clockwise from the key.
+func (s *hashRingState) virtualNodesForKey(key []byte) []*VirtualNode {
+	if len(s.virtualNodes) == 0 {
+		return nil
+	}
+	owners := s.readNodesForKey(key)
+	ret := make([]*VirtualNode, len(owners))
+	i := s.search(key)
+	for j, found := i, 0; found < len(ret); {
+		// Nodes that appear more than once among the owners (see
+		// WithAllowDuplicateOwners) are matched with their consecutive
+		// virtual nodes.
+		for k := range ret {
+			if ret[k] == nil && owners[k] == s.virtualNodes[j].node {
+				ret[k] = s.virtualNodes[j]
+				found++
+				break
+			}
+		}
+		if j = (j + 1) % len(s.virtualNodes); j == i {
+			break
+		}
 	}
+	return ret
+}
 
-	// Append the new vnodes to state's slice of vnodes.
-	s.virtualNodes = append(s.virtualNodes, newVnodes...)
-	return newVnodes, nil
+// distinctNodesForKey returns the first (up to n) distinct nodes clockwise of
+// the given key, starting from the virtual node that it is assigned to.
+func (s *hashRingState) distinctNodesForKey(key []byte, n int) []Node {
+	if len(s.virtualNodes) == 0 || n <= 0 {
+		return nil
+	}
+	if size := s.size(); n > size {
+		n = size
+	}
+	ret := make([]Node, 0, n)
+	seen := make(map[Node]struct{}, n)
+	i := s.search(key)
+	for j := i; len(ret) < n; {
+		node := s.virtualNodes[j].node
+		if _, exists := seen[node]; !exists {
+			seen[node] = struct{}{}
+			ret = append(ret, node)
+		}
+		if j = (j + 1) % len(s.virtualNodes); j == i {
+			break
+		}
+	}
+	return ret
 }
 
-// insertVirtualNode returns a ready *VirtualNode for node's virtual node with the
-// given vnid.
-func (s *hashRingState) insertVirtualNode(node Node, vnid uint16) *VirtualNode {
-	// Create a new virtual node for Node `node` and append it to the slice
-	// of new vnodes.
-	newVnodeDigest := s.hash([]byte(fmt.Sprintf("%s-%d", node, vnid)))
-	newVnode := &VirtualNode{
-		name: newVnodeDigest[:],
-		node: node,
-		vnid: vnid,
+// ownerRank returns the position of the given distinct node among the replica
+// owners of the given key, as returned by readNodesForKey, and whether it is
+// one of them at all. It avoids allocating the replica owners, unless it has
+// to compute them.
+func (s *hashRingState) ownerRank(node Node, key []byte) (int, bool) {
+	var owners []Node
+	if len(s.virtualNodes) > 0 && len(s.readExcluded) == 0 && !s.withoutReplicaOwners {
+		owners = s.replicaOwners[s.search(key)]
+	} else {
+		owners = s.readNodesForKey(key)
 	}
-	return newVnode
+	for rank, owner := range owners {
+		if owner == node {
+			return rank, true
+		}
+	}
+	return -1, false
 }
 
-// remove is a variadic method to remove an arbitrary number of nodes from the
-// hashRingState (including all nodes' virtual nodes, of course).
-//
-// If any of the nodes' virtual nodes cannot be found in the ring, a non-nil
-// error value is returned and the state is left untouched. Otherwise the state
-// is modified as expected, and a slice (unsorted) of pointers to the removed
-// virtual nodes is returned.
-func (s *hashRingState) remove(nodes ...Node) ([]*VirtualNode, error) {
-	// Remove all virtual nodes (of all distinct nodes) from state's vnodes
-	// slice, isolating them in a new slice.
-	removedVnodes := make([]*VirtualNode, len(nodes)*int(s.virtualNodeCount))
-	for i := range nodes {
-		vns, err := s.removeNode(nodes[i])
-		if err != nil {
-			return nil, err
+// ownersSkipping returns the replica owners of the virtual node at index i,
+// minus any nodes for which skip returns true, followed by the first distinct
+// nodes clockwise of it that are neither owners nor skipped, so that the
+// replication factor is met (if there are enough such nodes). The predicate is
+// called at most once per distinct node.
+func (s *hashRingState) ownersSkipping(i int, skip func(Node) bool) []Node {
+	owners := s.owners(i)
+	ret := make([]Node, 0, s.replicationFactor)
+	seen := make(map[Node]struct{}, len(owners))
+	for _, owner := range owners {
+		seen[owner] = struct{}{}
+		if !skip(owner) {
+			ret = append(ret, owner)
 		}
-		copy(removedVnodes[i*len(vns):(i+1)*len(vns)], vns)
 	}
-	// Sort state's vnodes slice.
-	sort.Slice(s.virtualNodes, func(i, j int) bool {
-		if bytes.Compare(s.virtualNodes[i].name, s.virtualNodes[j].name) < 0 {
-			return true
+	for j := i; len(ret) < int(s.replicationFactor); {
+		node := s.virtualNodes[j].node
+		if _, isSeen := seen[node]; !isSeen {
+			seen[node] = struct{}{}
+			if !skip(node) {
+				ret = append(ret, node)
+			}
 		}
-		return false
+		if j = (j + 1) % len(s.virtualNodes); j == i {
+			break
+		}
+	}
+	return ret
+}
+
+// rotateOwners returns a newly allocated slice of the given replica owners of
+// the given key, rotated (to the left) by an offset derived from the key.
+func rotateOwners(owners []Node, key []byte) []Node {
+	ret := make([]Node, len(owners))
+	if len(owners) == 0 {
+		return ret
+	}
+	h := fnv.New64a()
+	h.Write(key)
+	offset := int(h.Sum64() % uint64(len(owners)))
+	copy(ret, owners[offset:])
+	copy(ret[len(owners)-offset:], owners[:offset])
+	return ret
+}
+
+// setReadExcluded excludes (or stops excluding) the given distinct node from
+// reads. It returns a non-nil error if the node is not a member of the ring.
+func (s *hashRingState) setReadExcluded(node Node, excluded bool) error {
+	if !s.hasNode(node) {
+		return fmt.Errorf("node %q is not in the ring", node)
+	}
+	if excluded {
+		s.readExcluded[node] = struct{}{}
+	} else {
+		delete(s.readExcluded, node)
+	}
+	return nil
+}
+
+// setNodeStatus marks the given distinct node as up or down. It returns a
+// non-nil error if the node is not a member of the ring.
+func (s *hashRingState) setNodeStatus(node Node, up bool) error {
+	if !s.hasNode(node) {
+		return fmt.Errorf("node %q is not in the ring", node)
+	}
+	if up {
+		delete(s.down, node)
+	} else {
+		s.down[node] = struct{}{}
+	}
+	return nil
+}
+
+// healthyNodesForKey is like readNodesForKey, but it also skips any nodes that
+// are down.
+func (s *hashRingState) healthyNodesForKey(key []byte) []Node {
+	if len(s.virtualNodes) == 0 || len(s.down) == 0 {
+		return s.readNodesForKey(key)
+	}
+	return s.ownersSkipping(s.search(key), func(node Node) bool {
+		_, isExcluded := s.readExcluded[node]
+		_, isDown := s.down[node]
+		return isExcluded || isDown
 	})
-	s.fixReplicaOwners()
+}
 
-	// Return the slice of the removed vnodes (unsorted).
-	return removedVnodes, nil
+// setMeta sets the metadata of the given distinct node to a copy of the given
+// ones, or clears them if meta is empty. It returns a non-nil error if the node
+// is not a member of the ring.
+func (s *hashRingState) setMeta(node Node, meta map[string]string) error {
+	if !s.hasNode(node) {
+		return fmt.Errorf("node %q is not in the ring", node)
+	}
+	if len(meta) == 0 {
+		delete(s.meta, node)
+		return nil
+	}
+	s.meta[node] = copyMeta(meta)
+	return nil
 }
 
-// TODO: Documentation
-//
-// removeNode removes all virtual nodes of the given distinct ring node from
-// the state, and returns a sorted slice of them.
-//
-// First, it figures out what are the indices of the virtual nodes that should
-// be removed (by calling the removeVirtualNode method for each one of them).
-// Then, it builds a new slice of virtual nodes for the state, excluding the
-// aforementioned indices.
-//
-// Complexity: O( (V*N)*log(V*N) )
-func (s *hashRingState) removeNode(node Node) ([]*VirtualNode, error) {
-	removedIndices := make([]int, s.virtualNodeCount)
-	for vnid := uint16(0); vnid < s.virtualNodeCount; vnid++ {
-		removedIndex, err := s.removeVirtualNode(node, vnid)
-		if err != nil {
-			return nil, err
-		}
-		removedIndices[vnid] = removedIndex
+// copyMeta returns a copy of the given metadata.
+func copyMeta(meta map[string]string) map[string]string {
+	ret := make(map[string]string, len(meta))
+	for k, v := range meta {
+		ret[k] = v
 	}
-	sort.Ints(removedIndices)
+	return ret
+}
 
-	removedVnodes := make([]*VirtualNode, s.virtualNodeCount)
-	newRingVirtualNodes := make([]*VirtualNode, len(s.virtualNodes)-int(s.virtualNodeCount))
-	rii, nvni, ovni := 0, 0, 0
-	for ; nvni < len(newRingVirtualNodes) && rii < len(removedIndices); ovni++ {
-		if ovni == removedIndices[rii] {
-			removedVnodes[rii] = s.virtualNodes[ovni]
-			rii++
-		} else {
-			newRingVirtualNodes[nvni] = s.virtualNodes[ovni]
-			nvni++
+// primaryKeysFor implements PrimaryKeysFor, by sorting (the indices of) the
+// keys and merging them with state's (sorted) slice of virtual nodes.
+func (s *hashRingState) primaryKeysFor(node Node, keys [][]byte) [][]byte {
+	if len(s.virtualNodes) == 0 {
+		return nil
+	}
+	primaries := s.primariesOf(keys, s.sortedKeyOrder(keys))
+	ret := make([][]byte, 0)
+	for i := range keys {
+		if primaries[i] == node {
+			ret = append(ret, keys[i])
 		}
 	}
-	if nvni == len(newRingVirtualNodes) {
-		for ; rii < len(removedIndices); rii++ {
-			removedVnodes[rii] = s.virtualNodes[removedIndices[rii]]
+	return ret
+}
+
+// countKeysPerNode counts the given keys per distinct node that owns them, as
+// their primary owner, or as any of their replica owners if allReplicas is
+// set.
+func (s *hashRingState) countKeysPerNode(keys [][]byte, allReplicas bool) map[Node]int {
+	ret := make(map[Node]int)
+	if len(s.virtualNodes) == 0 && s.fallback == "" {
+		return ret
+	}
+	for _, key := range keys {
+		owners := s.readNodesForKey(key)
+		if !allReplicas && len(owners) > 0 {
+			owners = owners[:1]
+		}
+		for _, owner := range owners {
+			ret[owner]++
 		}
 	}
-	if rii == len(removedIndices) {
-		for ; nvni < len(newRingVirtualNodes); nvni, ovni = nvni+1, ovni+1 {
-			newRingVirtualNodes[nvni] = s.virtualNodes[ovni]
+	return ret
+}
+
+// primariesOf returns the primary owner of each one of the given keys, given
+// the order of the keys (as returned by sortedKeyOrder), by merging them with
+// state's (sorted) slice of virtual nodes. The state must not be empty.
+func (s *hashRingState) primariesOf(keys [][]byte, order []int) []Node {
+	ret := make([]Node, len(keys))
+	j := 0 // j: index of the first virtual node not less than the current key
+	for _, k := range order {
+		for j < len(s.virtualNodes) && s.compareNames(s.virtualNodes[j].Name(), keys[k]) < 0 {
+			j++
 		}
+		ret[k] = s.primaryOwner(j % len(s.virtualNodes))
 	}
-	s.virtualNodes = newRingVirtualNodes
-	return removedVnodes, nil
+	return ret
 }
 
-// removeVirtualNode returns the index of state's slice of virtual nodes which
-// refers to the virtual node that is specified by the given node and vnid, or
-// an error if the virtual node does not exist.
-func (s *hashRingState) removeVirtualNode(node Node, vnid uint16) (int, error) {
-	digest := s.hash([]byte(fmt.Sprintf("%s-%d", node, vnid)))
-	i := sort.Search(len(s.virtualNodes), func(j int) bool {
-		if bytes.Compare(s.virtualNodes[j].name, digest[:]) == -1 {
-			return false
+// sortedKeyOrder returns the indices of the given keys, sorted by the keys
+// (through the comparator of the state).
+func (s *hashRingState) sortedKeyOrder(keys [][]byte) []int {
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return s.compareNames(keys[order[i]], keys[order[j]]) < 0 })
+	return order
+}
+
+// setReplicationFactor sets the replication factor of the state, without
+// fixing the replica owners. It returns a non-nil error if rf is out of the
+// bounds accepted by NewHashRing, if it exceeds the number of distinct nodes
+// in the state, or if it is smaller than the number of racks required by the
+// state's rack constraint.
+func (s *hashRingState) setReplicationFactor(rf int) error {
+	if rf < 1 || rf > (1<<16)-1 {
+		return fmt.Errorf("replicationFactor value %d not in (0, %d)", rf, 1<<16)
+	}
+	if rf > s.size() {
+		return fmt.Errorf("replicationFactor value %d exceeds the %d distinct nodes of the ring", rf, s.size())
+	}
+	if s.rackOf != nil && rf < s.minRacks {
+		return fmt.Errorf("replicationFactor value %d is less than minRacks value %d", rf, s.minRacks)
+	}
+	s.replicationFactor = uint16(rf)
+	return nil
+}
+
+// setDraining marks (or unmarks) the given distinct node as draining. It
+// returns a non-nil error if the node is not a member of the ring.
+func (s *hashRingState) setDraining(node Node, draining bool) error {
+	if !s.hasNode(node) {
+		return fmt.Errorf("node %q is not in the ring", node)
+	}
+	if draining {
+		s.draining[node] = struct{}{}
+	} else {
+		delete(s.draining, node)
+	}
+	return nil
+}
+
+// nodesForKeyRespectingDrain returns the replica owners of the given key, with
+// any draining nodes moved (in their original relative order) after all other
+// owners, so that they do not serve as primary owners.
+func (s *hashRingState) nodesForKeyRespectingDrain(key []byte) []Node {
+	owners := s.readNodesForKey(key)
+	if len(s.draining) == 0 {
+		return owners
+	}
+	ret := make([]Node, 0, len(owners))
+	for _, owner := range owners {
+		if _, isDraining := s.draining[owner]; !isDraining {
+			ret = append(ret, owner)
 		}
-		return true
-	})
-	if bytes.Compare(s.virtualNodes[i].name, digest[:]) != 0 {
-		return -1, fmt.Errorf("virtual node {%x (%s, %d)} is not in the ring", digest, node, vnid)
 	}
-	return i, nil
+	for _, owner := range owners {
+		if _, isDraining := s.draining[owner]; isDraining {
+			ret = append(ret, owner)
+		}
+	}
+	return ret
 }
 
-// fixReplicaOwners creates state's replicaOwners (the map of virtual nodes to
-// replica-owner distinct ring nodes) anew, to re-adjust it after the addition
-// or the removal of one or more distinct ring nodes.
-func (s *hashRingState) fixReplicaOwners() {
-	for i := 0; i < len(s.virtualNodes); i++ {
-		vnode := s.virtualNodes[i] // auxiliary
-		s.replicaOwners[vnode] = make([]Node, s.replicationFactor)
-		s.replicaOwners[vnode][0] = s.virtualNodes[i].node
-
-		j := i                       // j: index i --> len(s.virtualNodes) --> 0 --> i-1
-		k := s.replicationFactor - 1 // k: # of subsequent nodes remaining to be found
-		for k > 0 {
-			// Get j, the next index in state's vnodes slice.
-			j = (j + 1) % len(s.virtualNodes)
-			// If cycle, break. even if k > 0; it means that s.replicationFactor > # of nodes.
-			if j == i {
-				break
-			}
-			currNode := s.virtualNodes[j].node // the node we are on for this `i`'s (index `j`-)traversal
-			nodePresent := false               // flag to raise if currNode is already in s.replicaOwners
-			// As we want distinct nodes only in s.replicaOwners, make sure currNode is not already in.
-			for _, l := range s.replicaOwners[vnode] {
-				if currNode == l {
-					nodePresent = true
-					break
+// nodesForKeyWithCapacity returns the first (up to replicationFactor) distinct
+// nodes clockwise of the given key for which full returns false. Joining nodes
+// are accepted (or deferred to the end) just like by computeJoinWeightedOwners.
+// While the state is empty, it returns the fallback node (if any) alone, unless
+// full returns true for it.
+func (s *hashRingState) nodesForKeyWithCapacity(key []byte, full func(Node) bool) []Node {
+	if len(s.virtualNodes) == 0 {
+		if s.fallback != "" && !full(s.fallback) {
+			return []Node{s.fallback}
+		}
+		return nil
+	}
+	ret := make([]Node, 0, s.replicationFactor)
+	seen := make(map[Node]struct{})
+	rejected := make([]Node, 0)
+	i := s.search(key)
+	for j := i; len(ret) < int(s.replicationFactor); {
+		node := s.virtualNodes[j].node
+		if _, isSeen := seen[node]; !isSeen {
+			seen[node] = struct{}{}
+			if !full(node) {
+				if w, isJoining := s.joinWeights[node]; isJoining && !joinAccepts(s.virtualNodes[i], node, w) {
+					rejected = append(rejected, node)
+				} else {
+					ret = append(ret, node)
 				}
 			}
-			// If currNode is not already in, get it in, and decrease # of nodes remaining to be found.
-			if !nodePresent {
-				s.replicaOwners[vnode][s.replicationFactor-k] = currNode
-				k--
-			}
 		}
-		// If cycled above, set slice's length so as to address the useful values only:
-		if j == i {
-			s.replicaOwners[vnode] = s.replicaOwners[vnode][:s.replicationFactor-k]
-			// NOTE: There is a memory leak: the amount of memory that is allocated for the
-			// slice of every key in s.replicaOwners is more than the required amount when
-			// such cycles happen (i.e. when replicationFactor > number of distinct nodes).
-			// To fix this, allocate a temp slice as make([]Node, 1, s.replicationFactor)
-			// and immediately fill it with the distinct Node that the vnode belongs to,
-			// then append any extra Nodes found, and in the end, allocate a new slice of
-			// capacity equal to temp slice's *length*, and copy(newSlice, temp).
-			// This, however, would result in lower performance (more allocations) in my
-			// own average use cases (that replicationFactor <= number of distinct nodes),
-			// so I'm not interested in changing it for now.
+		if j = (j + 1) % len(s.virtualNodes); j == i {
+			break
 		}
 	}
+	for k := 0; len(ret) < int(s.replicationFactor) && k < len(rejected); k++ {
+		ret = append(ret, rejected[k])
+	}
+	return ret
 }
 
-// TODO: Documentation
-func (s *hashRingState) virtualNodeForKey(key []byte) *VirtualNode {
-	index := sort.Search(len(s.virtualNodes), func(j int) bool {
-		if bytes.Compare(s.virtualNodes[j].name, key) == -1 {
-			return false
-		}
-		return true
-	})
-	if index == len(s.virtualNodes) {
-		index = 0
+// indexOf returns the index of the virtual node with the given name in state's
+// slice of virtual nodes, or a non-nil error if there is no such virtual node.
+//
+// Complexity: O( log(V*N) )
+func (s *hashRingState) indexOf(vnodeName []byte) (int, error) {
+	if !s.hasVirtualNode(vnodeName) {
+		return -1, fmt.Errorf("virtual node %x is not in the ring", vnodeName)
 	}
-	return s.virtualNodes[index]
+	return s.search(vnodeName), nil
 }
 
-// TODO: Documentation
-func (s *hashRingState) nodesForKey(key []byte) []Node {
-	return s.replicaOwners[s.virtualNodeForKey(key)]
+// replicaChain returns the ordered chain of virtual nodes that should receive
+// replicas of the data whose primary owner is the virtual node with the given
+// name: for each of the (non-primary) replica owners of the virtual node, the
+// first one of its virtual nodes that lies clockwise of the given one.
+//
+// Complexity: Worst case O(V*N) but should be O( log(V*N) ) on average.
+func (s *hashRingState) replicaChain(vnodeName []byte) ([]*VirtualNode, error) {
+	i, err := s.indexOf(vnodeName)
+	if err != nil {
+		return nil, err
+	}
+	owners := s.owners(i)
+	chain := make([]*VirtualNode, len(owners)-1)
+	for j, found := (i+1)%len(s.virtualNodes), 0; found < len(chain) && j != i; j = (j + 1) % len(s.virtualNodes) {
+		for k := range chain {
+			if chain[k] == nil && owners[k+1] == s.virtualNodes[j].node {
+				chain[k] = s.virtualNodes[j]
+				found++
+				break
+			}
+		}
+	}
+	return chain, nil
 }
 
 // TODO: Documentation
@@ -338,7 +2129,7 @@ func (s *hashRingState) predecessor(vnodeHash []byte) (*VirtualNode, error) {
 		return nil, fmt.Errorf("empty ring")
 	}
 	index := sort.Search(len(s.virtualNodes), func(j int) bool {
-		if bytes.Compare(s.virtualNodes[j].name, vnodeHash) == -1 {
+		if s.compareNames(s.virtualNodes[j].Name(), vnodeHash) == -1 {
 			return false
 		}
 		return true
@@ -356,7 +2147,7 @@ func (s *hashRingState) successor(vnodeHash []byte) (*VirtualNode, error) {
 		return nil, fmt.Errorf("empty ring")
 	}
 	index := sort.Search(len(s.virtualNodes), func(j int) bool {
-		if bytes.Compare(s.virtualNodes[j].name, vnodeHash) == -1 {
+		if s.compareNames(s.virtualNodes[j].Name(), vnodeHash) == -1 {
 			return false
 		}
 		return true
@@ -366,6 +2157,50 @@ func (s *hashRingState) successor(vnodeHash []byte) (*VirtualNode, error) {
 	return s.virtualNodes[index], nil
 }
 
+// neighbors returns the (up to) n virtual nodes that follow the one that the
+// given key is assigned to, walking the ring clockwise if step is 1, or
+// counter-clockwise if step is -1.
+func (s *hashRingState) neighbors(key []byte, n, step int) ([]*VirtualNode, error) {
+	if len(s.virtualNodes) == 0 {
+		return nil, fmt.Errorf("empty ring")
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("n value %d is negative", n)
+	}
+	if n > len(s.virtualNodes) {
+		n = len(s.virtualNodes)
+	}
+	ret := make([]*VirtualNode, n)
+	index := s.search(key)
+	for k := range ret {
+		index = (index + step + len(s.virtualNodes)) % len(s.virtualNodes)
+		ret[k] = s.virtualNodes[index]
+	}
+	return ret, nil
+}
+
+// ownerBoundaryForKey returns the name of the first virtual node of the run of
+// consecutive virtual nodes of the same distinct node that the given key's
+// virtual node belongs to.
+func (s *hashRingState) ownerBoundaryForKey(key []byte) ([]byte, error) {
+	switch s.size() {
+	case 0:
+		return nil, fmt.Errorf("empty ring")
+	case 1:
+		return nil, fmt.Errorf("single-distinct-node ring")
+	default:
+	}
+	index := s.search(key)
+	owner := s.virtualNodes[index].node
+	for {
+		prev := (index + len(s.virtualNodes) - 1) % len(s.virtualNodes)
+		if s.virtualNodes[prev].node != owner {
+			return s.virtualNodes[index].Name(), nil
+		}
+		index = prev
+	}
+}
+
 // TODO: Documentation
 func (s *hashRingState) predecessorNode(vnodeHash []byte) (*VirtualNode, error) {
 	switch s.size() {
@@ -377,7 +2212,7 @@ func (s *hashRingState) predecessorNode(vnodeHash []byte) (*VirtualNode, error)
 	}
 
 	index := sort.Search(len(s.virtualNodes), func(j int) bool {
-		if bytes.Compare(s.virtualNodes[j].name, vnodeHash) == -1 {
+		if s.compareNames(s.virtualNodes[j].Name(), vnodeHash) == -1 {
 			return false
 		}
 		return true
@@ -421,7 +2256,7 @@ func (s *hashRingState) successorNode(vnodeHash []byte) (*VirtualNode, error) {
 	}
 
 	index := sort.Search(len(s.virtualNodes), func(j int) bool {
-		if bytes.Compare(s.virtualNodes[j].name, vnodeHash) == -1 {
+		if s.compareNames(s.virtualNodes[j].Name(), vnodeHash) == -1 {
 			return false
 		}
 		return true
@@ -442,15 +2277,31 @@ func (s *hashRingState) successorNode(vnodeHash []byte) (*VirtualNode, error) {
 	}
 }
 
+// nextVNodeOfNode returns the first virtual node of the target distinct node,
+// walking the ring clockwise from the virtual node that the key is assigned to.
+func (s *hashRingState) nextVNodeOfNode(key []byte, target Node) (*VirtualNode, error) {
+	if !s.hasNode(target) {
+		return nil, fmt.Errorf("node %q is not in the ring", target)
+	}
+	index := s.search(key)
+	for k := 0; k < len(s.virtualNodes); k++ {
+		if s.virtualNodes[index].node == target {
+			return s.virtualNodes[index], nil
+		}
+		index = (index + 1) % len(s.virtualNodes)
+	}
+	return nil, fmt.Errorf("node %q has no virtual nodes in the ring", target)
+}
+
 // TODO: Documentation
 func (s *hashRingState) hasVirtualNode(vnodeHash []byte) bool {
 	index := sort.Search(len(s.virtualNodes), func(j int) bool {
-		if bytes.Compare(s.virtualNodes[j].name, vnodeHash) == -1 {
+		if s.compareNames(s.virtualNodes[j].Name(), vnodeHash) == -1 {
 			return false
 		}
 		return true
 	})
-	return index != len(s.virtualNodes) && bytes.Compare(s.virtualNodes[index].name, vnodeHash) == 0
+	return index != len(s.virtualNodes) && s.compareNames(s.virtualNodes[index].Name(), vnodeHash) == 0
 }
 
 // TODO: Documentation
@@ -0,0 +1,71 @@
+// Copyright 2018 Christos Katsakioris
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lfchring
+
+import (
+	"encoding/hex"
+	"encoding/json"
+)
+
+// Topology is an exported, serializable representation of a state of the
+// ring, e.g. for an admin dashboard to display the layout of the ring.
+type Topology struct {
+	Generation        uint64            `json:"generation"`
+	ReplicationFactor int               `json:"replicationFactor"`
+	VirtualNodes      []VirtualNodeInfo `json:"virtualNodes"`
+}
+
+// VirtualNodeInfo is an exported, serializable representation of a virtual
+// node of the ring, as part of a Topology.
+type VirtualNodeInfo struct {
+	// Name is the name of the virtual node, in hex.
+	Name   string `json:"name"`
+	Node   Node   `json:"node"`
+	VNID   uint16 `json:"vnid"`
+	Owners []Node `json:"owners"`
+}
+
+// Topology returns a representation of the current state of the ring, listing
+// each one of its virtual nodes, in the order in which they appear on the ring
+// (i.e. sorted by name), along with its replica owners. The returned Topology
+// shares no memory with the ring.
+//
+// Complexity: O( (V*N)*R )
+func (r *HashRing) Topology() Topology {
+	state := r.state.Load().(*hashRingState)
+	ret := Topology{
+		Generation:        state.generation,
+		ReplicationFactor: int(state.replicationFactor),
+		VirtualNodes:      make([]VirtualNodeInfo, len(state.virtualNodes)),
+	}
+	for i, vn := range state.virtualNodes {
+		owners := state.owners(i)
+		ret.VirtualNodes[i] = VirtualNodeInfo{
+			Name:   hex.EncodeToString(vn.Name()),
+			Node:   vn.node,
+			VNID:   vn.vnid,
+			Owners: append(make([]Node, 0, len(owners)), owners...),
+		}
+	}
+	return ret
+}
+
+// MarshalJSON implements the json.Marshaler interface, encoding the Topology
+// of the current state of the ring. Since the virtual nodes are always encoded
+// in the order in which they appear on the ring, the encodings of successive
+// states of the ring may be meaningfully diffed.
+func (r *HashRing) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.Topology())
+}
@@ -0,0 +1,156 @@
+// Copyright 2018 Christos Katsakioris
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lfchring
+
+// WalkOption configures which distinct nodes are skipped when the replica
+// owners of the arcs of the ring are walked, on top of the placement of the
+// keys, e.g. by MinReplicationAcrossRing and Materialize.
+type WalkOption func(*walkOptions)
+
+// walkOptions gathers the skip rules of a walk, as set by the WalkOptions
+// passed to it.
+type walkOptions struct {
+	skipDraining     bool
+	skipReadExcluded bool
+	full             func(Node) bool
+}
+
+// SkipDraining configures the walk to skip any draining nodes (see
+// SetDraining).
+func SkipDraining() WalkOption {
+	return func(wo *walkOptions) {
+		wo.skipDraining = true
+	}
+}
+
+// SkipReadExcluded configures the walk to skip any nodes that are excluded from
+// reads (see SetReadExcluded).
+func SkipReadExcluded() WalkOption {
+	return func(wo *walkOptions) {
+		wo.skipReadExcluded = true
+	}
+}
+
+// SkipFull configures the walk to skip any nodes for which the given predicate
+// returns true, i.e. nodes that are full (see NodesForKeyWithCapacity).
+func SkipFull(full func(Node) bool) WalkOption {
+	return func(wo *walkOptions) {
+		wo.full = full
+	}
+}
+
+// newWalkOptions applies the given WalkOptions.
+func newWalkOptions(opts []WalkOption) *walkOptions {
+	wo := &walkOptions{}
+	for _, opt := range opts {
+		opt(wo)
+	}
+	return wo
+}
+
+// skips returns true if the walk should skip the given distinct node of the
+// given state.
+func (wo *walkOptions) skips(s *hashRingState, node Node) bool {
+	if _, isDraining := s.draining[node]; isDraining && wo.skipDraining {
+		return true
+	}
+	if _, isExcluded := s.readExcluded[node]; isExcluded && wo.skipReadExcluded {
+		return true
+	}
+	return wo.full != nil && wo.full(node)
+}
+
+// MinReplicationAcrossRing walks all arcs of the ring and returns the smallest
+// number of replica owners of any of them that are not skipped according to the
+// given WalkOptions, i.e. the replication that is effectively achieved
+// throughout the keyspace, e.g. to alert on any part of it being
+// under-replicated. Skipped owners are not replaced by other nodes, since these
+// do not hold replicas of the arcs' data. Without any WalkOptions, it reflects
+// arcs with fewer replica owners than the replication factor, which is the
+// case if the ring consists of fewer distinct nodes. It returns 0 if the ring
+// is empty.
+//
+// Complexity: O( (V*N)*R )
+func (r *HashRing) MinReplicationAcrossRing(opts ...WalkOption) int {
+	state := r.state.Load().(*hashRingState)
+	wo := newWalkOptions(opts)
+	if len(state.virtualNodes) == 0 {
+		return 0
+	}
+	min := int(state.replicationFactor)
+	for i := range state.virtualNodes {
+		n := 0
+		for _, owner := range state.owners(i) {
+			if !wo.skips(state, owner) {
+				n++
+			}
+		}
+		if n < min {
+			min = n
+		}
+	}
+	return min
+}
+
+// Router routes keys to their replica owners according to the skip rules of
+// a set of WalkOptions, as they were at the time that it was materialized
+// through Materialize. It is immutable, and therefore safe for concurrent use.
+type Router struct {
+	state  *hashRingState
+	owners [][]Node
+}
+
+// Materialize evaluates the given WalkOptions against the current state of the
+// ring once, and returns a Router that routes each key to its replica owners
+// minus the skipped nodes, followed by the first distinct nodes clockwise that
+// are neither owners nor skipped, so that the replication factor is met (if
+// there are enough such nodes). Since the owners of all arcs are computed in
+// advance, routing through the Router is as fast as NodesForKey, regardless of
+// the skip rules (e.g. SkipFull predicates are evaluated once per distinct
+// node). It should be materialized anew whenever the ring or the rules change.
+//
+// Complexity: O( (V*N)*R )
+func (r *HashRing) Materialize(opts ...WalkOption) *Router {
+	state := r.state.Load().(*hashRingState)
+	wo := newWalkOptions(opts)
+	skipped := make(map[Node]bool, state.size())
+	for node := range state.vnodeCounts {
+		skipped[node] = wo.skips(state, node)
+	}
+	skip := func(node Node) bool { return skipped[node] }
+	router := &Router{state: state, owners: make([][]Node, len(state.virtualNodes))}
+	for i := range state.virtualNodes {
+		router.owners[i] = state.ownersSkipping(i, skip)
+	}
+	return router
+}
+
+// Route returns the replica owners of the given key, according to the skip
+// rules that the Router was materialized with. It returns nil if the ring was
+// empty.
+//
+// Complexity: O( log(V*N) )
+func (rt *Router) Route(key []byte) []Node {
+	if len(rt.owners) == 0 {
+		return nil
+	}
+	return rt.owners[rt.state.search(key)]
+}
+
+// Generation returns the generation of the ring's state that the Router was
+// materialized from.
+func (rt *Router) Generation() uint64 {
+	return rt.state.generation
+}